@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogTime is the time format of the Apache access log
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes one line per request in the Apache common or combined
+// format to a file, separate from the diagnostic log. The duration (in
+// microseconds) and the script are appended to each line.
+type accessLog struct {
+	path     string
+	combined bool
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAccessLog(path string, format string) (*accessLog, error) {
+	l := &accessLog{path: path, combined: format == "combined"}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen opens the file again, e.g. after it was rotated
+func (l *accessLog) reopen() error {
+	if l == nil {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// accessLogField returns s or "-" if it is empty
+func accessLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// log records the request r which was answered with status and size bytes
+func (l *accessLog) log(r *http.Request, env map[string]string, script string, status int, size int64, start time.Time, took time.Duration) {
+	if l == nil {
+		return
+	}
+	host := env["REMOTE_ADDR"]
+	if host == "" {
+		var err error
+		if host, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+			host = r.RemoteAddr
+		}
+	}
+	// not set for FastCGI requests
+	uri := cmp.Or(env["REQUEST_URI"], r.RequestURI, r.URL.RequestURI())
+	var b strings.Builder
+	b.WriteString(accessLogField(host))
+	b.WriteString(" - ")
+	b.WriteString(accessLogField(env["REMOTE_USER"]))
+	b.WriteString(" [" + start.Format(accessLogTime) + "] ")
+	b.WriteString(strconv.Quote(r.Method + " " + uri + " " + r.Proto))
+	b.WriteString(" " + strconv.Itoa(status) + " ")
+	if size > 0 {
+		b.WriteString(strconv.FormatInt(size, 10))
+	} else {
+		b.WriteString("-")
+	}
+	if l.combined {
+		b.WriteString(" " + strconv.Quote(accessLogField(r.Referer())))
+		b.WriteString(" " + strconv.Quote(accessLogField(r.UserAgent())))
+	}
+	b.WriteString(" " + strconv.FormatInt(took.Microseconds(), 10))
+	b.WriteString(" " + strconv.Quote(script) + "\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// errors are not logged, that would flood the diagnostic log
+	_, _ = l.f.WriteString(b.String())
+}
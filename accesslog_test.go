@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "ok.sh", "printf 'Status: 201 Created\\r\\nContent-Type: text/plain\\r\\n\\r\\nhello'\n")
+	path := filepath.Join(tmpDir, "access.log")
+	l, err := openAccessLog(path, "combined")
+	require.NoError(t, err)
+	addr := serveFCGI(t, cgiResponder(arguments{accessLog: l}, nil))
+
+	doFCGI(t, addr, map[string]string{
+		"SCRIPT_FILENAME": script,
+		"REQUEST_URI":     "/ok.sh?a=1",
+		"REMOTE_ADDR":     "192.0.2.1",
+		"REMOTE_USER":     "alice",
+		"HTTP_USER_AGENT": `curl "8"`,
+	}, "")
+
+	// rotated files are replaced by a new one
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, l.reopen())
+	l.combined = false
+	doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "REQUEST_URI": "/ok.sh"}, "")
+
+	data, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Regexp(t, `^192\.0\.2\.1 - alice \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET /ok\.sh\?a=1 HTTP/1\.1" 201 5 "-" "curl \\"8\\"" \d+ "`+regexp.QuoteMeta(script)+`"\n$`, string(data))
+
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+	assert.Regexp(t, `\] "GET /ok\.sh HTTP/1\.1" 201 5 \d+ "`, string(data))
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminServer serves the (optional) admin HTTP API
+type adminServer struct {
+	logs       *logHub
+	errors     *logHub
+	activeJobs *atomic.Int32
+	started    time.Time
+	// virtual clock advanced via the API (nil if the real clock is used)
+	clock *virtualClock
+	// metrics served in the Prometheus format (nil if sent elsewhere)
+	metrics *promMetrics
+	// --workers (0: unlimited)
+	workers int
+	// summary of the current configuration (see setConfig)
+	config atomic.Pointer[map[string]string]
+}
+
+// setConfig updates the configuration reported in the status
+func (a *adminServer) setConfig(args arguments) {
+	summary := configSummary(args)
+	a.config.Store(&summary)
+}
+
+// handler returns the http handler with all admin endpoints
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /logs", a.serveLogs)
+	mux.HandleFunc("GET /status", a.serveStatus)
+	mux.HandleFunc("GET /buildinfo", a.serveBuildInfo)
+	if a.clock != nil {
+		mux.HandleFunc("POST /clock", a.serveClock)
+	}
+	if a.metrics != nil {
+		mux.Handle("GET /metrics", a.metrics)
+	}
+	return mux
+}
+
+// serveLogs streams recent and live log entries as NDJSON. Supports the query
+// parameters level (minimum level), request_id, script (substring) and
+// follow=false (only send the recent entries).
+func (a *adminServer) serveLogs(w http.ResponseWriter, r *http.Request) {
+	var f logFilter
+	q := r.URL.Query()
+	if l := q.Get("level"); l != "" {
+		if err := f.level.UnmarshalText([]byte(l)); err != nil {
+			http.Error(w, "invalid level: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		f.level = slog.LevelDebug
+	}
+	f.requestID = q.Get("request_id")
+	f.script = q.Get("script")
+	follow := !strings.EqualFold(q.Get("follow"), "false")
+
+	backlog, live, cancel := a.logs.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	rc := http.NewResponseController(w)
+
+	for _, e := range backlog {
+		if f.match(e) {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+	}
+	_ = rc.Flush()
+
+	if !follow {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-live:
+			if !f.match(e) {
+				continue
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// status is the response of the status endpoint
+type status struct {
+	Version      string     `json:"version"`
+	Uptime       string     `json:"uptime"`
+	ActiveJobs   int32      `json:"active_jobs"`
+	Self         selfStats  `json:"self"`
+	RecentErrors []logEntry `json:"recent_errors"`
+	// handled requests (lifetime with --stats-file)
+	Requests *requestStats `json:"requests"`
+	// requests rejected before being handled by reason
+	Rejected map[string]uint64 `json:"rejected"`
+	// --workers and the share of them busy (not reported if unlimited)
+	Workers           int     `json:"workers,omitempty"`
+	WorkerUtilization float64 `json:"worker_utilization,omitempty"`
+	// settings differing from the defaults
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// status returns the current state of the wrapper
+func (a *adminServer) status() status {
+	st := status{
+		Version:      version(),
+		Uptime:       time.Since(a.started).Round(time.Second).String(),
+		ActiveJobs:   a.activeJobs.Load(),
+		Self:         collectSelfStats(),
+		RecentErrors: a.errors.snapshot(),
+		Requests:     lifetimeStats.snapshot(),
+		Rejected:     rejectedRequests.snapshot(),
+		Workers:      a.workers,
+	}
+	if a.workers > 0 {
+		// active jobs include the ones waiting for a slot
+		st.WorkerUtilization = float64(min(int(st.ActiveJobs), a.workers)) / float64(a.workers)
+	}
+	if config := a.config.Load(); config != nil {
+		st.Config = *config
+	}
+	return st
+}
+
+// serveStatus reports the current state of the wrapper as JSON
+func (a *adminServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a.status()); err != nil {
+		slog.Warn("writing status failed", "error", err)
+	}
+}
+
+// dumpStatus writes the current state as one line of JSON to w (on SIGUSR1)
+func (a *adminServer) dumpStatus(w io.Writer) {
+	if err := json.NewEncoder(w).Encode(a.status()); err != nil {
+		slog.Warn("writing status failed", "error", err)
+	}
+}
+
+// serveClock advances the virtual clock by the duration given in the query
+// parameter advance and reports the new time
+func (a *adminServer) serveClock(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("advance"))
+	if err != nil || d < 0 {
+		http.Error(w, "invalid advance: expected a positive duration", http.StatusBadRequest)
+		return
+	}
+	a.clock.advance(d)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, a.clock.Now().Format(time.RFC3339Nano))
+}
+
+// version returns the version of the main module (from the build information)
+func version() string {
+	info, err := readBuildInfo()
+	if err != nil {
+		return "unknown"
+	}
+	if rev, ok := info.Settings["vcs.revision"]; ok && info.Main.Version == "(devel)" {
+		return info.Main.Version + " " + rev
+	}
+	return info.Main.Version
+}
+
+// serveBuildInfo reports the build information (go version, modules and build
+// settings) as JSON. ?format=cyclonedx returns it as CycloneDX SBOM.
+func (a *adminServer) serveBuildInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := readBuildInfo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var v any = info
+	if r.URL.Query().Get("format") == "cyclonedx" {
+		v = info.cycloneDX(time.Now())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Warn("writing build info failed", "error", err)
+	}
+}
@@ -0,0 +1,192 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogHubRing(t *testing.T) {
+	hub := newLogHub(3, slog.LevelDebug)
+	for i := range 5 {
+		hub.publish(logEntry{Msg: string(rune('a' + i))})
+	}
+	var msgs []string
+	for _, e := range hub.snapshot() {
+		msgs = append(msgs, e.Msg)
+	}
+	assert.Equal(t, []string{"c", "d", "e"}, msgs)
+}
+
+func TestTailHandlerLevel(t *testing.T) {
+	// the hubs get records below the level of the log output
+	hub := newLogHub(10, slog.LevelDebug)
+	var out bytes.Buffer
+	logger := slog.New(newTailHandler(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}), hub))
+	assert.True(t, logger.Enabled(context.Background(), slog.LevelDebug))
+	logger.Debug("hidden")
+	logger.Info("shown")
+	require.Len(t, hub.snapshot(), 2)
+	assert.Equal(t, "hidden", hub.snapshot()[0].Msg)
+	assert.NotContains(t, out.String(), "hidden")
+	assert.Contains(t, out.String(), "shown")
+
+	logger = slog.New(newTailHandler(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	assert.False(t, logger.Enabled(context.Background(), slog.LevelDebug))
+}
+
+func TestAdminLogs(t *testing.T) {
+	hub := newLogHub(10, slog.LevelDebug)
+	logger := slog.New(newTailHandler(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}), hub))
+	logger.Debug("validated", "script", "/srv/a.cgi")
+	logger.With("request_id", "42").Warn("failed", "script", "/srv/b.cgi")
+	logger.WithGroup("g").Error("grouped", "k", "v")
+
+	srv := httptest.NewServer((&adminServer{logs: hub}).handler())
+	defer srv.Close()
+
+	get := func(query string) []logEntry {
+		resp, err := http.Get(srv.URL + "/logs?follow=false&" + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var entries []logEntry
+		dec := json.NewDecoder(resp.Body)
+		for dec.More() {
+			var e logEntry
+			require.NoError(t, dec.Decode(&e))
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	assert.Len(t, get(""), 3)
+	assert.Len(t, get("level=warn"), 2)
+	assert.Len(t, get("script=b.cgi"), 1)
+	assert.Len(t, get("request_id=42"), 1)
+	assert.Equal(t, "v", get("level=error")[0].Attrs["g.k"])
+
+	resp, err := http.Get(srv.URL + "/logs?level=nope")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	t.Run("Follow live entries", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/logs?level=info", nil)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		br := bufio.NewReader(resp.Body)
+		// skip backlog
+		for range 2 {
+			_, err := br.ReadString('\n')
+			require.NoError(t, err)
+		}
+		logger.Info("live entry")
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.True(t, strings.Contains(line, "live entry"))
+	})
+}
+
+func TestAdminStatus(t *testing.T) {
+	logs := newLogHub(10, slog.LevelDebug)
+	errs := newLogHub(2, slog.LevelWarn)
+	logger := slog.New(newTailHandler(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}), logs, errs))
+	logger.Info("fine")
+	logger.Warn("first", "script", "/srv/a.cgi")
+	logger.Error("second")
+	logger.Error("third")
+
+	var active atomic.Int32
+	active.Store(3)
+	admin := &adminServer{logs: logs, errors: errs, activeJobs: &active, started: time.Now(), workers: 4}
+	args := defaultArguments()
+	args.Workers = 4
+	args.Env = envList{{Key: "DB_PASSWORD", Value: "secret"}}
+	admin.setConfig(args)
+	srv := httptest.NewServer(admin.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var st status
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&st))
+	assert.Equal(t, int32(3), st.ActiveJobs)
+	assert.Positive(t, st.Self.RSSBytes)
+	assert.Positive(t, st.Self.OpenFDs)
+	assert.Positive(t, st.Self.Goroutines)
+	require.Len(t, st.RecentErrors, 2)
+	assert.Equal(t, "second", st.RecentErrors[0].Msg)
+	assert.Equal(t, "third", st.RecentErrors[1].Msg)
+	assert.Equal(t, 4, st.Workers)
+	assert.Equal(t, 0.75, st.WorkerUtilization)
+	assert.Equal(t, map[string]string{"workers": "4", "env": "(redacted)"}, st.Config)
+
+	// the same on SIGUSR1, in one line
+	var buf bytes.Buffer
+	admin.dumpStatus(&buf)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &st))
+	assert.Equal(t, int32(3), st.ActiveJobs)
+}
+
+func TestAdminBuildInfo(t *testing.T) {
+	h := (&adminServer{}).handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/buildinfo", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var info buildInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.NotEmpty(t, info.GoVersion)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/buildinfo?format=cyclonedx", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var bom cdxBOM
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &bom))
+	assert.Equal(t, "CycloneDX", bom.BOMFormat)
+	assert.Regexp(t, `^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, bom.SerialNumber)
+}
+
+func TestCycloneDX(t *testing.T) {
+	info := buildInfo{
+		Main: buildModule{Path: "fcgiwrap_go", Version: "v1.2.0"},
+		Deps: []buildModule{{Path: "github.com/alexflint/go-arg", Version: "v1.5.1"}},
+	}
+	bom := info.cycloneDX(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "2025-01-01T00:00:00Z", bom.Metadata.Timestamp)
+	assert.Equal(t, "pkg:golang/fcgiwrap_go@v1.2.0", bom.Metadata.Component.PURL)
+	require.Len(t, bom.Components, 1)
+	assert.Equal(t, "library", bom.Components[0].Type)
+	assert.Equal(t, []cdxDependency{{Ref: "pkg:golang/fcgiwrap_go@v1.2.0", DependsOn: []string{"pkg:golang/github.com/alexflint/go-arg@v1.5.1"}}}, bom.Dependencies)
+
+	assert.Equal(t, "pkg:golang/fcgiwrap_go", buildModule{Path: "fcgiwrap_go", Version: "(devel)"}.purl())
+	assert.Equal(t, "pkg:golang/example.com/a%40b/c%20d@v1.0.0%2Bincompatible",
+		buildModule{Path: "example.com/a@b/c d", Version: "v1.0.0+incompatible"}.purl())
+	assert.Equal(t, buildModule{Path: "example.com/x"},
+		toBuildModule(&debug.Module{Path: "example.com/x", Version: "v1.0.0", Replace: &debug.Module{Path: "../x"}}))
+}
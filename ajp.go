@@ -0,0 +1,550 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// AJP 1.3 packet types
+const (
+	ajpForwardRequest = 2
+	ajpSendBodyChunk  = 3
+	ajpSendHeaders    = 4
+	ajpEndResponse    = 5
+	ajpGetBodyChunk   = 6
+	ajpShutdown       = 7
+	ajpCPong          = 9
+	ajpCPing          = 10
+)
+
+const (
+	// max size of a packet (the default of mod_proxy_ajp and mod_jk)
+	ajpMaxPacket = 8192
+	// max data of a body packet sent by the web server (length prefix)
+	ajpMaxBodyData = ajpMaxPacket - 6
+	// max data of a SEND_BODY_CHUNK (type, length and trailing zero byte)
+	ajpMaxChunk = ajpMaxPacket - 8
+)
+
+// attributes of a forward request
+const (
+	ajpAttrRemoteUser   = 0x03
+	ajpAttrAuthType     = 0x04
+	ajpAttrQueryString  = 0x05
+	ajpAttrSSLKeySize   = 0x0B
+	ajpAttrReqAttribute = 0x0A
+	ajpAttrSecret       = 0x0C
+	ajpAttrStoredMethod = 0x0D
+	ajpAttrDone         = 0xFF
+)
+
+// ajpMethods are the methods by their code
+var ajpMethods = []string{
+	1: "OPTIONS", "GET", "HEAD", "POST", "PUT", "DELETE", "TRACE", "PROPFIND",
+	"PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "ACL", "REPORT",
+	"VERSION-CONTROL", "CHECKIN", "CHECKOUT", "UNCHECKOUT", "SEARCH",
+	"MKWORKSPACE", "UPDATE", "LABEL", "MERGE", "BASELINE-CONTROL", "MKACTIVITY",
+}
+
+// ajpRequestHeaders are the request headers by their code - 0xA001
+var ajpRequestHeaders = []string{
+	"Accept", "Accept-Charset", "Accept-Encoding", "Accept-Language",
+	"Authorization", "Connection", "Content-Type", "Content-Length", "Cookie",
+	"Cookie2", "Host", "Pragma", "Referer", "User-Agent",
+}
+
+// ajpResponseHeaders are the codes of response headers
+var ajpResponseHeaders = map[string]uint16{
+	"Content-Type":     0xA001,
+	"Content-Language": 0xA002,
+	"Content-Length":   0xA003,
+	"Date":             0xA004,
+	"Last-Modified":    0xA005,
+	"Location":         0xA006,
+	"Set-Cookie":       0xA007,
+	"Set-Cookie2":      0xA008,
+	"Servlet-Engine":   0xA009,
+	"Status":           0xA00A,
+	"Www-Authenticate": 0xA00B,
+}
+
+// ajpParamsKey is the context key of the CGI variables passed via AJP
+// attributes
+type ajpParamsKey struct{}
+
+// ajpParamsFrom returns the CGI variables passed via AJP attributes (nil if r
+// wasn't received via AJP)
+func ajpParamsFrom(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(ajpParamsKey{}).(map[string]string)
+	return params
+}
+
+// errAJPSecret is returned for requests without the configured secret
+var errAJPSecret = errors.New("ajp: request without the secret")
+
+// serveAJP accepts AJP 1.3 connections on l and serves their requests with h.
+// Unless secret is empty, requests have to carry it (the secret attribute of
+// mod_proxy_ajp, the shared secret of mod_jk).
+func serveAJP(l net.Listener, h http.Handler, secret string) error {
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &ajpConn{rwc: rw, br: bufio.NewReaderSize(rw, ajpMaxPacket), handler: h, secret: secret}
+		go c.serve()
+	}
+}
+
+// ajpConn is a connection to the web server, it carries one request after the
+// other
+type ajpConn struct {
+	rwc     net.Conn
+	br      *bufio.Reader
+	handler http.Handler
+	secret  string
+}
+
+// readPacket reads the payload of the next packet of the web server
+func (c *ajpConn) readPacket() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x12 || hdr[1] != 0x34 {
+		return nil, fmt.Errorf("ajp: invalid packet magic %#x%x", hdr[0], hdr[1])
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err := io.ReadFull(c.br, buf)
+	return buf, err
+}
+
+// writePacket writes a packet to the web server
+func (c *ajpConn) writePacket(payload []byte) error {
+	if len(payload) > ajpMaxPacket-4 {
+		return errors.New("ajp: packet too large")
+	}
+	buf := make([]byte, 4, 4+len(payload))
+	buf[0], buf[1] = 'A', 'B'
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	_, err := c.rwc.Write(append(buf, payload...))
+	return err
+}
+
+// serve reads the packets of the connection until it is closed
+func (c *ajpConn) serve() {
+	defer c.rwc.Close()
+	for {
+		pkt, err := c.readPacket()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("reading AJP packet failed", "error", err)
+			}
+			return
+		}
+		if len(pkt) == 0 {
+			continue
+		}
+		switch pkt[0] {
+		case ajpCPing:
+			err = c.writePacket([]byte{ajpCPong})
+		case ajpForwardRequest:
+			err = c.serveRequest(pkt[1:])
+		case ajpShutdown:
+			slog.Debug("ignoring AJP shutdown request")
+		default:
+			err = fmt.Errorf("unexpected packet type %d", pkt[0])
+		}
+		if err != nil {
+			slog.Warn("AJP request failed, closing the connection", "error", err)
+			return
+		}
+	}
+}
+
+// serveRequest serves the forward request pkt
+func (c *ajpConn) serveRequest(pkt []byte) error {
+	r, params, secret, err := parseAJPRequest(pkt)
+	if err != nil {
+		return err
+	}
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, c.rwc.LocalAddr())
+	r = r.WithContext(context.WithValue(ctx, ajpParamsKey{}, params))
+	if c.secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(c.secret)) != 1 {
+		// like Tomcat: 403 and the connection isn't reused
+		rejectedRequests.add("ajp_secret")
+		w := &ajpResponseWriter{c: c, header: make(http.Header)}
+		w.bw = bufio.NewWriterSize(ajpChunkWriter{c}, ajpMaxChunk)
+		writeError(w, r.Context(), http.StatusForbidden)
+		if err := w.finish(); err != nil {
+			return err
+		}
+		if err := c.writePacket([]byte{ajpEndResponse, 0}); err != nil {
+			return err
+		}
+		return errAJPSecret
+	}
+
+	body := &ajpBody{c: c, remaining: r.ContentLength}
+	if r.ContentLength < 0 || r.ContentLength > 0 {
+		// the first chunk is sent without being asked for
+		body.inFlight = true
+	}
+	r.Body = body
+	w := &ajpResponseWriter{c: c, header: make(http.Header)}
+	w.bw = bufio.NewWriterSize(ajpChunkWriter{c}, ajpMaxChunk)
+	c.handler.ServeHTTP(w, r)
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if err := body.discard(); err != nil {
+		return err
+	}
+	return c.writePacket([]byte{ajpEndResponse, 1})
+}
+
+// ajpReader decodes the fields of a packet
+type ajpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *ajpReader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *ajpReader) int() int {
+	if len(r.b) < 2 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := int(binary.BigEndian.Uint16(r.b))
+	r.b = r.b[2:]
+	return v
+}
+
+// string reads a length-prefixed, zero terminated string ("" if null)
+func (r *ajpReader) string() string {
+	n := r.int()
+	if n == 0xFFFF || r.err != nil {
+		return ""
+	}
+	if len(r.b) < n+1 {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(r.b[:n])
+	r.b = r.b[n+1:]
+	return v
+}
+
+// parseAJPRequest decodes a forward request (without its type). CGI variables
+// without an equivalent in http.Request are returned as params, the secret
+// attribute separately.
+func parseAJPRequest(pkt []byte) (*http.Request, map[string]string, string, error) {
+	p := &ajpReader{b: pkt}
+	methodCode := int(p.byte())
+	proto := p.string()
+	uri := p.string()
+	remoteAddr := p.string()
+	remoteHost := p.string()
+	serverName := p.string()
+	serverPort := p.int()
+	ssl := p.byte() != 0
+
+	r := &http.Request{Header: make(http.Header), ContentLength: -1}
+	if methodCode < len(ajpMethods) {
+		r.Method = ajpMethods[methodCode]
+	}
+	for n := p.int(); n > 0 && p.err == nil; n-- {
+		var name string
+		if len(p.b) > 0 && p.b[0] == 0xA0 {
+			// coded header name
+			code := p.int() - 0xA001
+			if code < 0 || code >= len(ajpRequestHeaders) {
+				return nil, nil, "", fmt.Errorf("ajp: unknown header code %#x", code+0xA001)
+			}
+			name = ajpRequestHeaders[code]
+		} else {
+			name = p.string()
+		}
+		r.Header.Add(name, p.string())
+	}
+
+	params := map[string]string{"SERVER_NAME": serverName, "SERVER_PORT": strconv.Itoa(serverPort)}
+	if remoteHost != "" && remoteHost != remoteAddr {
+		params["REMOTE_HOST"] = remoteHost
+	}
+	var query, remotePort, secret string
+	for p.err == nil {
+		attr := p.byte()
+		if attr == ajpAttrDone {
+			break
+		}
+		switch attr {
+		case ajpAttrRemoteUser:
+			params["REMOTE_USER"] = p.string()
+		case ajpAttrAuthType:
+			params["AUTH_TYPE"] = p.string()
+		case ajpAttrQueryString:
+			query = p.string()
+		case ajpAttrReqAttribute:
+			name, value := p.string(), p.string()
+			if name == "AJP_REMOTE_PORT" {
+				remotePort = value
+			}
+		case ajpAttrSecret:
+			secret = p.string()
+		case ajpAttrSSLKeySize:
+			p.int()
+		case ajpAttrStoredMethod:
+			r.Method = p.string()
+		default:
+			// all other attributes are strings
+			p.string()
+		}
+	}
+	if p.err != nil {
+		return nil, nil, "", fmt.Errorf("ajp: malformed forward request: %w", p.err)
+	}
+	if r.Method == "" {
+		return nil, nil, "", fmt.Errorf("ajp: unknown method code %d", methodCode)
+	}
+
+	var err error
+	if r.URL, err = url.ParseRequestURI(uri); err != nil {
+		return nil, nil, "", err
+	}
+	r.URL.RawQuery = query
+	r.RequestURI = r.URL.RequestURI()
+	r.Proto = proto
+	var ok bool
+	if r.ProtoMajor, r.ProtoMinor, ok = http.ParseHTTPVersion(proto); !ok {
+		return nil, nil, "", fmt.Errorf("ajp: invalid protocol %q", proto)
+	}
+	r.Host = r.Header.Get("Host")
+	if r.Host == "" {
+		r.Host = serverName
+	}
+	if remotePort == "" {
+		remotePort = "0"
+	}
+	r.RemoteAddr = net.JoinHostPort(remoteAddr, remotePort)
+	if ssl {
+		r.TLS = &tls.ConnectionState{}
+	}
+	if cl := r.Header.Get("Content-Length"); cl != "" {
+		if r.ContentLength, err = strconv.ParseInt(cl, 10, 64); err != nil || r.ContentLength < 0 {
+			return nil, nil, "", fmt.Errorf("ajp: invalid Content-Length %q", cl)
+		}
+	} else if !strings.EqualFold(r.Header.Get("Transfer-Encoding"), "chunked") {
+		r.ContentLength = 0
+	}
+	return r, params, secret, nil
+}
+
+// ajpBody is the body of a request. Chunks are requested from the web server
+// as they are read.
+type ajpBody struct {
+	c *ajpConn
+	// not yet received (-1: unknown)
+	remaining int64
+	// a chunk is on its way
+	inFlight bool
+	buf      []byte
+	eof      bool
+}
+
+func (b *ajpBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.eof || b.remaining == 0 {
+			b.eof = true
+			return 0, io.EOF
+		}
+		if err := b.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// next receives the next chunk
+func (b *ajpBody) next() error {
+	if !b.inFlight {
+		size := int64(ajpMaxBodyData)
+		if b.remaining >= 0 {
+			size = min(size, b.remaining)
+		}
+		if err := b.c.writePacket([]byte{ajpGetBodyChunk, byte(size >> 8), byte(size)}); err != nil {
+			return err
+		}
+	}
+	b.inFlight = false
+	pkt, err := b.c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(pkt) < 2 || binary.BigEndian.Uint16(pkt) == 0 {
+		b.eof = true
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(pkt))
+	if n > len(pkt)-2 {
+		return errors.New("ajp: short body chunk")
+	}
+	b.buf = pkt[2 : 2+n]
+	if b.remaining > 0 {
+		b.remaining -= int64(min(int64(n), b.remaining))
+	}
+	return nil
+}
+
+// discard receives a chunk sent but not read by the handler, so the
+// connection can carry the next request. Further chunks aren't requested.
+func (b *ajpBody) discard() error {
+	if !b.inFlight {
+		return nil
+	}
+	b.inFlight = false
+	_, err := b.c.readPacket()
+	return err
+}
+
+func (b *ajpBody) Close() error {
+	return nil
+}
+
+// ajpChunkWriter sends SEND_BODY_CHUNK packets
+type ajpChunkWriter struct {
+	c *ajpConn
+}
+
+func (cw ajpChunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), ajpMaxChunk)]
+		pkt := make([]byte, 0, len(chunk)+4)
+		pkt = append(pkt, ajpSendBodyChunk, byte(len(chunk)>>8), byte(len(chunk)))
+		pkt = append(append(pkt, chunk...), 0)
+		if err := cw.c.writePacket(pkt); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// ajpResponseWriter is the http.ResponseWriter of a request
+type ajpResponseWriter struct {
+	c           *ajpConn
+	header      http.Header
+	code        int
+	wroteHeader bool
+	sentHeader  bool
+	bw          *bufio.Writer
+	err         error
+}
+
+func (w *ajpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *ajpResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader || code < http.StatusOK {
+		// AJP can't carry interim responses
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+}
+
+func (w *ajpResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if !w.sentHeader {
+		w.sendHeaders(p)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.bw.Write(p)
+}
+
+func (w *ajpResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	if !w.sentHeader {
+		w.sendHeaders(nil)
+	}
+	if w.err == nil {
+		w.err = w.bw.Flush()
+	}
+}
+
+// sendHeaders sends SEND_HEADERS, p is the start of the body to sniff the
+// content type from
+func (w *ajpResponseWriter) sendHeaders(p []byte) {
+	w.sentHeader = true
+	if w.code == http.StatusNotModified {
+		w.header.Del("Content-Type")
+		w.header.Del("Content-Length")
+	} else if _, ok := w.header["Content-Type"]; !ok {
+		w.header.Set("Content-Type", http.DetectContentType(p))
+	}
+	w.header.Del("Transfer-Encoding")
+
+	pkt := []byte{ajpSendHeaders}
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(w.code))
+	pkt = appendAJPString(pkt, http.StatusText(w.code))
+	n := 0
+	for _, vals := range w.header {
+		n += len(vals)
+	}
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(n))
+	for name, vals := range w.header {
+		for _, v := range vals {
+			if code, ok := ajpResponseHeaders[name]; ok {
+				pkt = binary.BigEndian.AppendUint16(pkt, code)
+			} else {
+				pkt = appendAJPString(pkt, name)
+			}
+			pkt = appendAJPString(pkt, v)
+		}
+	}
+	w.err = w.c.writePacket(pkt)
+}
+
+// finish sends the rest of the response
+func (w *ajpResponseWriter) finish() error {
+	w.Flush()
+	return w.err
+}
+
+// appendAJPString appends a length-prefixed, zero terminated string
+func appendAJPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(append(b, s...), 0)
+}
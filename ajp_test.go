@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAJPPacket writes a packet of the web server
+func writeAJPPacket(t *testing.T, w io.Writer, payload []byte) {
+	t.Helper()
+	_, err := w.Write(append([]byte{0x12, 0x34, byte(len(payload) >> 8), byte(len(payload))}, payload...))
+	require.NoError(t, err)
+}
+
+// readAJPPacket reads a packet of the container
+func readAJPPacket(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	require.NoError(t, err)
+	require.Equal(t, "AB", string(hdr[:2]))
+	pkt := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err = io.ReadFull(r, pkt)
+	require.NoError(t, err)
+	return pkt
+}
+
+func TestAJP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveAJP(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Remote", r.RemoteAddr)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+r.Host+" "+ajpParamsFrom(r)["REMOTE_USER"]+" "+string(body))
+	}), "")
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	writeAJPPacket(t, conn, []byte{ajpCPing})
+	assert.Equal(t, []byte{ajpCPong}, readAJPPacket(t, conn))
+
+	body := strings.Repeat("x", ajpMaxBodyData+10)
+	req := []byte{ajpForwardRequest, 4} // POST
+	for _, s := range []string{"HTTP/1.1", "/test.sh", "10.0.0.1", "10.0.0.1", "example.org"} {
+		req = appendAJPString(req, s)
+	}
+	req = binary.BigEndian.AppendUint16(req, 443)
+	req = append(req, 1)
+	req = binary.BigEndian.AppendUint16(req, 2)
+	req = binary.BigEndian.AppendUint16(req, 0xA008) // Content-Length
+	req = appendAJPString(req, "8196")
+	req = appendAJPString(req, "Host")
+	req = appendAJPString(req, "example.org")
+	req = appendAJPString(append(req, ajpAttrQueryString), "a=b")
+	req = appendAJPString(append(req, ajpAttrRemoteUser), "alice")
+	req = appendAJPString(appendAJPString(append(req, ajpAttrReqAttribute), "AJP_REMOTE_PORT"), "1234")
+	req = append(req, ajpAttrDone)
+	writeAJPPacket(t, conn, req)
+
+	// the first chunk is sent right away, the rest on request
+	chunk := func(data string) []byte {
+		return append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)
+	}
+	writeAJPPacket(t, conn, chunk(body[:ajpMaxBodyData]))
+	assert.Equal(t, []byte{ajpGetBodyChunk, 0, 10}, readAJPPacket(t, conn))
+	writeAJPPacket(t, conn, chunk(body[ajpMaxBodyData:]))
+
+	hdrs := readAJPPacket(t, conn)
+	require.Equal(t, byte(ajpSendHeaders), hdrs[0])
+	assert.Equal(t, uint16(http.StatusCreated), binary.BigEndian.Uint16(hdrs[1:]))
+	assert.Contains(t, string(hdrs), "X-Remote\x00\x00\x0d10.0.0.1:1234")
+
+	var out []byte
+	for {
+		pkt := readAJPPacket(t, conn)
+		if pkt[0] == ajpEndResponse {
+			assert.Equal(t, []byte{ajpEndResponse, 1}, pkt)
+			break
+		}
+		require.Equal(t, byte(ajpSendBodyChunk), pkt[0])
+		n := binary.BigEndian.Uint16(pkt[1:])
+		out = append(out, pkt[3:3+n]...)
+	}
+	assert.Equal(t, "POST /test.sh?a=b example.org alice "+body, string(out))
+}
+
+func TestAJPSecret(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveAJP(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, ajpParamsFrom(r)["REMOTE_USER"])
+	}), "s3cret")
+
+	// forward sends a GET request as alice with secret (none if empty)
+	forward := func(secret string) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+		req := []byte{ajpForwardRequest, 2} // GET
+		for _, s := range []string{"HTTP/1.1", "/", "10.0.0.1", "10.0.0.1", "example.org"} {
+			req = appendAJPString(req, s)
+		}
+		req = append(binary.BigEndian.AppendUint16(req, 80), 0)
+		req = binary.BigEndian.AppendUint16(req, 0)
+		req = appendAJPString(append(req, ajpAttrRemoteUser), "alice")
+		if secret != "" {
+			req = appendAJPString(append(req, ajpAttrSecret), secret)
+		}
+		writeAJPPacket(t, conn, append(req, ajpAttrDone))
+		return conn
+	}
+
+	before := rejectedRequests.snapshot()["ajp_secret"]
+	for _, secret := range []string{"", "wrong"} {
+		conn := forward(secret)
+		hdrs := readAJPPacket(t, conn)
+		require.Equal(t, byte(ajpSendHeaders), hdrs[0])
+		assert.Equal(t, uint16(http.StatusForbidden), binary.BigEndian.Uint16(hdrs[1:]))
+		for pkt := readAJPPacket(t, conn); pkt[0] != ajpEndResponse; pkt = readAJPPacket(t, conn) {
+			assert.NotContains(t, string(pkt), "alice")
+		}
+		// the connection is closed
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	}
+	assert.Equal(t, before+2, rejectedRequests.snapshot()["ajp_secret"])
+
+	conn := forward("s3cret")
+	hdrs := readAJPPacket(t, conn)
+	assert.Equal(t, uint16(http.StatusOK), binary.BigEndian.Uint16(hdrs[1:]))
+	pkt := readAJPPacket(t, conn)
+	require.Equal(t, byte(ajpSendBodyChunk), pkt[0])
+	assert.Equal(t, "alice", string(pkt[3:3+binary.BigEndian.Uint16(pkt[1:])]))
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// scriptAlias maps a URL prefix of SCRIPT_NAME to a script or a directory of
+// scripts outside of the DOCUMENT_ROOT (--alias), like Apache's ScriptAlias
+type scriptAlias struct {
+	prefix string
+	target string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (a *scriptAlias) UnmarshalText(text []byte) error {
+	prefix, target, ok := strings.Cut(string(text), "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || !filepath.IsAbs(target) {
+		return fmt.Errorf("invalid alias %q (expected /URL/PREFIX=/ABSOLUTE/PATH)", string(text))
+	}
+	*a = scriptAlias{prefix: path.Clean(prefix), target: filepath.Clean(target)}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (a scriptAlias) MarshalText() ([]byte, error) {
+	return []byte(a.prefix + "=" + a.target), nil
+}
+
+// applyAlias maps the SCRIPT_NAME of env with the first matching alias. If
+// the target is a file, it is the script and the rest of SCRIPT_NAME becomes
+// PATH_INFO, a directory target replaces the prefix.
+func applyAlias(env map[string]string, aliases []scriptAlias, fs *fsGuard) {
+	name := env["SCRIPT_NAME"]
+	if name == "" {
+		return
+	}
+	for _, a := range aliases {
+		rest, ok := stripURLPrefix(name, a.prefix)
+		if !ok {
+			continue
+		}
+		if fi, err := fs.stat(a.target); err == nil && fi.IsDir() {
+			env["SCRIPT_FILENAME"] = filepath.Join(a.target, filepath.FromSlash(rest))
+		} else {
+			env["SCRIPT_FILENAME"] = a.target
+			env["SCRIPT_NAME"] = a.prefix
+			if rest != "/" {
+				env["PATH_INFO"] = rest
+			}
+		}
+		slog.Debug("script aliased", "script_name", name, "alias", a.prefix, "script", env["SCRIPT_FILENAME"])
+		return
+	}
+}
+
+// aliasTarget returns the alias target script is (or is below), which
+// replaces the DOCUMENT_ROOT for the containment checks
+func aliasTarget(script string, aliases []scriptAlias) (string, bool) {
+	for _, a := range aliases {
+		if withinDir(a.target, script) {
+			return a.target, true
+		}
+	}
+	return "", false
+}
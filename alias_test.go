@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponderAlias(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	body := "printf 'Content-Type: text/plain\\r\\n\\r\\n%s %s %s' \"$0\" \"$SCRIPT_NAME\" \"$PATH_INFO\"\n"
+	backend := cgiScript(t, outside, "backend.sh", body)
+	other := cgiScript(t, outside, "other.sh", body)
+
+	var file, dir scriptAlias
+	require.NoError(t, file.UnmarshalText([]byte("/git="+backend)))
+	require.NoError(t, dir.UnmarshalText([]byte("/tools/="+outside)))
+	addr := serveFCGI(t, cgiResponder(arguments{Alias: []scriptAlias{file, dir}}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_NAME": "/git/info/refs", "DOCUMENT_ROOT": root}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, backend+" /git /info/refs", res.body)
+
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_NAME": "/tools/other.sh/x", "DOCUMENT_ROOT": root}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, other+" /tools/other.sh /x", res.body)
+
+	// without a matching alias the containment in the DOCUMENT_ROOT holds
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_NAME": "/gitweb", "SCRIPT_FILENAME": filepath.Join(root, "../x.sh"), "DOCUMENT_ROOT": root}, "")
+	assert.Equal(t, http.StatusForbidden, res.status)
+
+	var a scriptAlias
+	assert.Error(t, a.UnmarshalText([]byte("/git=relative/path")))
+}
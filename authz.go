@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// authzRequest is the metadata of a request sent to the authorization callout
+type authzRequest struct {
+	Script string      `json:"script"`
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Client string      `json:"client"`
+	Header http.Header `json:"header"`
+}
+
+// maxAuthzCacheEntries bounds the decision cache, the least recently used
+// decisions are dropped first
+const maxAuthzCacheEntries = 4096
+
+// authzDecision is a cached decision, status 0 means allowed
+type authzDecision struct {
+	key     [sha256.Size]byte
+	status  int
+	expires time.Time
+}
+
+// authzCache is an LRU cache of decisions. Expired ones are removed once they
+// are looked up, or like any other once the cache is full.
+type authzCache struct {
+	max     int
+	order   *list.List // of *authzDecision, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+func newAuthzCache(max int) *authzCache {
+	return &authzCache{max: max, order: list.New(), entries: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+// get returns the decision for key unless there is none or it expired
+func (c *authzCache) get(key [sha256.Size]byte, now time.Time) (authzDecision, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return authzDecision{}, false
+	}
+	d := e.Value.(*authzDecision)
+	if !now.Before(d.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return authzDecision{}, false
+	}
+	c.order.MoveToFront(e)
+	return *d, true
+}
+
+// put adds or replaces a decision, dropping the least recently used one if
+// the cache is full
+func (c *authzCache) put(d authzDecision) {
+	if e, ok := c.entries[d.key]; ok {
+		*e.Value.(*authzDecision) = d
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authzDecision).key)
+	}
+	c.entries[d.key] = c.order.PushFront(&d)
+}
+
+// authorizer asks an external HTTP endpoint or command whether a request may
+// be executed
+type authorizer struct {
+	url      string
+	command  string
+	timeout  time.Duration
+	ttl      time.Duration
+	failOpen bool
+	clock    clock
+	procs    *procPool
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache *authzCache
+}
+
+// newAuthorizer returns nil if no callout is configured
+func newAuthorizer(args arguments) *authorizer {
+	if args.AuthzURL == "" && args.AuthzCommand == "" {
+		return nil
+	}
+	return &authorizer{
+		url:      args.AuthzURL,
+		command:  args.AuthzCommand,
+		timeout:  args.AuthzTimeout,
+		ttl:      args.AuthzCacheTTL,
+		failOpen: args.AuthzFailOpen,
+		clock:    args.clk(),
+		procs:    args.procs,
+		client:   &http.Client{},
+		cache:    newAuthzCache(maxAuthzCacheEntries),
+	}
+}
+
+// authorize returns 0 if the request may execute script, the status to answer
+// with otherwise
+func (a *authorizer) authorize(ctx context.Context, r *http.Request, script string) int {
+	if a == nil {
+		return 0
+	}
+	data, err := json.Marshal(authzRequest{
+		Script: script,
+		Method: r.Method,
+		URI:    r.URL.RequestURI(),
+		Client: clientIP(r),
+		Header: r.Header,
+	})
+	if err != nil {
+		return a.failed(ctx, script, err)
+	}
+	key := sha256.Sum256(data)
+
+	now := a.clock.Now()
+	a.mu.Lock()
+	d, ok := a.cache.get(key, now)
+	a.mu.Unlock()
+	if ok {
+		return d.status
+	}
+
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(a.clock, ctx, a.timeout)
+		defer cancel()
+	}
+	var status int
+	if a.url != "" {
+		status, err = a.askURL(ctx, data)
+	} else {
+		status, err = a.askCommand(ctx, data)
+	}
+	if err != nil {
+		return a.failed(ctx, script, err)
+	}
+	if status != 0 {
+		slog.InfoContext(ctx, "request denied by authorization callout", "script", script, "status", status)
+	}
+
+	if a.ttl > 0 {
+		a.mu.Lock()
+		a.cache.put(authzDecision{key: key, status: status, expires: now.Add(a.ttl)})
+		a.mu.Unlock()
+	}
+	return status
+}
+
+// failed applies the fail-open/fail-closed policy
+func (a *authorizer) failed(ctx context.Context, script string, err error) int {
+	if a.failOpen {
+		slog.WarnContext(ctx, "authorization callout failed, allowing request", "script", script, "error", err)
+		return 0
+	}
+	slog.ErrorContext(ctx, "authorization callout failed, denying request", "script", script, "error", err)
+	return http.StatusServiceUnavailable
+}
+
+// askURL POSTs the metadata to the endpoint. 2xx allows, 401 and 403 deny with
+// that status, everything else is a failure.
+func (a *authorizer) askURL(ctx context.Context, data []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return resp.StatusCode, nil
+	default:
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// askCommand runs the command (via /bin/sh) with the metadata on stdin. Exit
+// code 0 allows, 1 denies, everything else is a failure.
+func (a *authorizer) askCommand(ctx context.Context, data []byte) (int, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", a.command)
+	cmd.Stdin = bytes.NewReader(data)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	// started like CGI children so the reaper leaves it alone
+	err := a.procs.start(cmd)
+	if err == nil {
+		err = a.procs.wait(cmd)
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return http.StatusForbidden, nil
+	default:
+		return 0, fmt.Errorf("%w (output: %q)", err, out.String())
+	}
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizerURL(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req authzRequest
+		// not require, this isn't the test goroutine
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Header.Get("Authorization") {
+		case "good":
+			w.WriteHeader(http.StatusNoContent)
+		case "":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	c := newVirtualClock(time.Now())
+	a := newAuthorizer(arguments{AuthzURL: srv.URL, AuthzCacheTTL: time.Minute, clock: c})
+	req := func(auth string) *http.Request {
+		r := httptest.NewRequest("GET", "/x", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	assert.Equal(t, 0, a.authorize(context.Background(), req("good"), "/srv/a.cgi"))
+	assert.Equal(t, http.StatusUnauthorized, a.authorize(context.Background(), req(""), "/srv/a.cgi"))
+	assert.Equal(t, http.StatusServiceUnavailable, a.authorize(context.Background(), req("broken"), "/srv/a.cgi"))
+	assert.EqualValues(t, 3, calls.Load())
+
+	// decisions are cached, failures are not
+	assert.Equal(t, 0, a.authorize(context.Background(), req("good"), "/srv/a.cgi"))
+	assert.Equal(t, http.StatusServiceUnavailable, a.authorize(context.Background(), req("broken"), "/srv/a.cgi"))
+	assert.EqualValues(t, 4, calls.Load())
+	c.advance(time.Minute)
+	assert.Equal(t, 0, a.authorize(context.Background(), req("good"), "/srv/a.cgi"))
+	assert.EqualValues(t, 5, calls.Load())
+
+	a.failOpen = true
+	assert.Equal(t, 0, a.authorize(context.Background(), req("broken"), "/srv/a.cgi"))
+
+	assert.Nil(t, newAuthorizer(arguments{}))
+}
+
+func TestAuthzCache(t *testing.T) {
+	now := time.Now()
+	c := newAuthzCache(2)
+	key := func(b byte) [sha256.Size]byte { return [sha256.Size]byte{b} }
+	c.put(authzDecision{key: key(1), status: 0, expires: now.Add(time.Minute)})
+	c.put(authzDecision{key: key(2), status: 403, expires: now.Add(time.Second)})
+
+	// expired decisions are dropped on lookup
+	_, ok := c.get(key(2), now.Add(time.Second))
+	assert.False(t, ok)
+	assert.Len(t, c.entries, 1)
+
+	// the least recently used decision is dropped once full
+	c.put(authzDecision{key: key(2), status: 403, expires: now.Add(time.Minute)})
+	_, ok = c.get(key(1), now)
+	assert.True(t, ok)
+	c.put(authzDecision{key: key(3), status: 401, expires: now.Add(time.Minute)})
+	assert.Len(t, c.entries, 2)
+	_, ok = c.get(key(2), now)
+	assert.False(t, ok)
+	d, ok := c.get(key(3), now)
+	assert.True(t, ok)
+	assert.Equal(t, 401, d.status)
+}
+
+func TestAuthorizerCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	// allows a.cgi only
+	check := cgiScript(t, tmpDir, "check.sh", "grep -q '\"script\":\"/srv/a.cgi\"' || exit 1\n")
+	a := newAuthorizer(arguments{AuthzCommand: check})
+	assert.Equal(t, 0, a.authorize(context.Background(), httptest.NewRequest("GET", "/", nil), "/srv/a.cgi"))
+	assert.Equal(t, http.StatusForbidden, a.authorize(context.Background(), httptest.NewRequest("GET", "/", nil), "/srv/b.cgi"))
+
+	a = newAuthorizer(arguments{AuthzCommand: "exit 2"})
+	assert.Equal(t, http.StatusServiceUnavailable, a.authorize(context.Background(), httptest.NewRequest("GET", "/", nil), "/srv/a.cgi"))
+
+	// denied requests are never executed
+	script := cgiScript(t, tmpDir, "b.cgi", "touch "+filepath.Join(tmpDir, "executed")+"\n")
+	addr := serveFCGI(t, cgiResponder(arguments{authz: newAuthorizer(arguments{AuthzCommand: check})}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, http.StatusForbidden, res.status)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "executed"))
+}
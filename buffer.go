@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// responseBuffer collects a response up to max bytes before it is passed on,
+// so a script failing late can still be answered with a clean error. Larger
+// responses and flushes (streaming) pass the response on right away.
+type responseBuffer struct {
+	w      http.ResponseWriter
+	max    int64
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+	// the response was passed on, writes go to w directly
+	committed bool
+}
+
+func newResponseBuffer(w http.ResponseWriter, max int64) *responseBuffer {
+	return &responseBuffer{w: w, max: max, header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	if b.committed {
+		return b.w.Header()
+	}
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(code int) {
+	if b.committed {
+		b.w.WriteHeader(code)
+		return
+	}
+	if code < http.StatusOK {
+		// interim responses are sent right away
+		h := b.w.Header()
+		for key, vals := range b.header {
+			h[key] = vals
+		}
+		b.w.WriteHeader(code)
+		for key := range b.header {
+			delete(h, key)
+		}
+		return
+	}
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if !b.committed && int64(b.buf.Len()+len(p)) > b.max {
+		if err := b.commit(); err != nil {
+			return 0, err
+		}
+	}
+	if b.committed {
+		return b.w.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Flush passes the response on, streaming output must not be held back
+func (b *responseBuffer) Flush() {
+	if err := b.commit(); err == nil {
+		_ = http.NewResponseController(b.w).Flush()
+	}
+}
+
+// commit passes the response collected so far on
+func (b *responseBuffer) commit() error {
+	if b.committed {
+		return nil
+	}
+	b.committed = true
+	for key, vals := range b.header {
+		b.w.Header()[key] = vals
+	}
+	if b.code != 0 {
+		b.w.WriteHeader(b.code)
+	}
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
+
+// finish passes the collected response on. If the script failed, a response
+// of the script is replaced by 500 (504 on timeouts), errors of the wrapper
+// itself are passed on.
+func (b *responseBuffer) finish(ctx context.Context, failed bool) {
+	if !failed || b.code >= 400 {
+		if err := b.commit(); err != nil {
+			slog.WarnContext(ctx, "error writing buffered CGI response", "error", err)
+		}
+		return
+	}
+	if b.committed {
+		slog.WarnContext(ctx, "CGI failed after its response exceeded the buffer, can't replace it")
+		return
+	}
+	status := http.StatusInternalServerError
+	if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	slog.WarnContext(ctx, "discarding buffered response of failed CGI", "size", b.buf.Len(), "status", status)
+	b.committed = true
+	writeError(b.w, ctx, status)
+}
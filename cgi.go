@@ -6,34 +6,257 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
+
+// cgiEnv returns the CGI meta-variables of the FastCGI request r. Variables
+// the web server didn't pass are reconstructed from r, SCRIPT_NAME and
+// PATH_INFO are derived from SCRIPT_FILENAME and DOCUMENT_ROOT.
+func cgiEnv(r *http.Request, params map[string]string) map[string]string {
+	env := make(map[string]string, len(params)+len(r.Header)+16)
+	set := func(k, v string) {
+		if _, ok := env[k]; !ok && v != "" {
+			env[k] = v
+		}
+	}
+	for k, v := range params {
+		env[k] = v
+	}
+	// the Proxy header of the client would be taken for the proxy to use
+	// (httpoxy), web servers pass it as HTTP_PROXY
+	delete(env, "HTTP_PROXY")
+
+	set("GATEWAY_INTERFACE", "CGI/1.1")
+	set("REQUEST_METHOD", r.Method)
+	set("SERVER_PROTOCOL", r.Proto)
+	if r.URL != nil {
+		set("QUERY_STRING", r.URL.RawQuery)
+		set("REQUEST_URI", r.URL.RequestURI())
+	}
+	if r.ContentLength > 0 {
+		set("CONTENT_LENGTH", strconv.FormatInt(r.ContentLength, 10))
+	}
+	set("CONTENT_TYPE", r.Header.Get("Content-Type"))
+	if r.TLS != nil {
+		set("HTTPS", "on")
+	}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		set("REMOTE_ADDR", host)
+		if port != "0" {
+			set("REMOTE_PORT", port)
+		}
+	}
+	set("HTTP_HOST", r.Host)
+	for k, vals := range r.Header {
+		if k == "Proxy" {
+			continue
+		}
+		set("HTTP_"+strings.ToUpper(strings.ReplaceAll(k, "-", "_")), strings.Join(vals, ", "))
+	}
+
+	if script, root := env["SCRIPT_FILENAME"], env["DOCUMENT_ROOT"]; script != "" && root != "" {
+		if name, ok := strings.CutPrefix(script, strings.TrimSuffix(root, "/")); ok && strings.HasPrefix(name, "/") {
+			set("SCRIPT_NAME", name)
+			if r.URL != nil {
+				if info, ok := strings.CutPrefix(r.URL.Path, name); ok && strings.HasPrefix(info, "/") {
+					set("PATH_INFO", info)
+				}
+			}
+		}
+	}
+	return env
+}
+
+// stripURLPrefix removes prefix (e.g. /cgi-bin, --strip-prefix) from the URL
+// path p if it starts with it as a whole path segment
+func stripURLPrefix(p, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return p, false
+	}
+	rest, ok := strings.CutPrefix(p, prefix)
+	if !ok || rest != "" && !strings.HasPrefix(rest, "/") {
+		return p, false
+	}
+	return "/" + strings.TrimPrefix(rest, "/"), true
+}
+
+// mapScriptName sets the SCRIPT_FILENAME of requests only passing SCRIPT_NAME
+// to DOCUMENT_ROOT/SCRIPT_NAME with the URL prefix (--strip-prefix) removed
+func mapScriptName(env map[string]string, prefix string) {
+	if env["SCRIPT_FILENAME"] != "" || env["DOCUMENT_ROOT"] == "" {
+		return
+	}
+	if name, ok := stripURLPrefix(env["SCRIPT_NAME"], prefix); ok {
+		env["SCRIPT_FILENAME"] = filepath.Join(env["DOCUMENT_ROOT"], name)
+	}
+}
+
+// scriptPath is the path of the requested script, SCRIPT_FILENAME or
+// DOCUMENT_ROOT/SCRIPT_NAME ("" if neither is set)
+func scriptPath(env map[string]string) string {
+	if script := env["SCRIPT_FILENAME"]; script != "" {
+		return script
+	}
+	if env["DOCUMENT_ROOT"] == "" || env["SCRIPT_NAME"] == "" {
+		return ""
+	}
+	return filepath.Join(env["DOCUMENT_ROOT"], env["SCRIPT_NAME"])
+}
+
+// defaultDirIndex are the index scripts used if --dir-index isn't given
+var defaultDirIndex = []string{"index.cgi", "index.pl"}
+
+// dirIndexScript replaces a script path which is a directory by the first of
+// the index scripts (names, nil: defaultDirIndex) existing in it. SCRIPT_NAME
+// is adjusted accordingly.
+func dirIndexScript(env map[string]string, names []string, fs *fsGuard) {
+	dir := scriptPath(env)
+	if dir == "" {
+		return
+	}
+	if names == nil {
+		names = defaultDirIndex
+	}
+	if fi, err := fs.stat(dir); err != nil || !fi.IsDir() {
+		return
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		index := filepath.Join(dir, name)
+		if _, err := fs.lstat(index); err != nil {
+			continue
+		}
+		slog.Debug("script is a directory, using its index script", "dir", dir, "script", index)
+		env["SCRIPT_FILENAME"] = index
+		if scriptName := env["SCRIPT_NAME"]; scriptName != "" {
+			env["SCRIPT_NAME"] = path.Join(scriptName, name)
+		}
+		return
+	}
+}
+
+// splitPathInfo handles a script path with trailing path information such as
+// /docroot/app.cgi/extra/path like Apache does: the longest existing prefix
+// which is a file becomes SCRIPT_FILENAME, the rest PATH_INFO (unless passed by
+// the web server) and PATH_TRANSLATED (PATH_INFO below DOCUMENT_ROOT).
+// SCRIPT_NAME is cut accordingly.
+func splitPathInfo(env map[string]string, fs *fsGuard) {
+	script, root := scriptPath(env), env["DOCUMENT_ROOT"]
+	if !filepath.IsAbs(script) {
+		return
+	}
+
+	prefix, info := filepath.Clean(script), ""
+	inRoot := root != "" && withinDir(filepath.Clean(root), prefix)
+	for {
+		fi, err := fs.lstat(prefix)
+		if err == nil {
+			if info == "" || fi.IsDir() {
+				return
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return
+		}
+		parent := filepath.Dir(prefix)
+		// don't leave the DOCUMENT_ROOT (if the script is in it)
+		if parent == prefix || inRoot && !withinDir(filepath.Clean(root), parent) {
+			return
+		}
+		info = "/" + filepath.Base(prefix) + info
+		prefix = parent
+	}
+
+	slog.Debug("split path info off the script", "script", prefix, "path_info", info)
+	env["SCRIPT_FILENAME"] = prefix
+	if name, ok := strings.CutSuffix(env["SCRIPT_NAME"], info); ok {
+		env["SCRIPT_NAME"] = name
+	}
+	if env["PATH_INFO"] == "" {
+		env["PATH_INFO"] = info
+	}
+	if root != "" && env["PATH_TRANSLATED"] == "" {
+		env["PATH_TRANSLATED"] = filepath.Join(root, env["PATH_INFO"])
+	}
+}
+
+// isindexArgs returns the command line arguments of an ISINDEX query (RFC 3875
+// section 4.4): a QUERY_STRING without "=" is split into words at "+". Returns
+// nil if the query isn't one or can't be decoded.
+func isindexArgs(query string) []string {
+	if query == "" || strings.Contains(query, "=") {
+		return nil
+	}
+	var words []string
+	for w := range strings.SplitSeq(query, "+") {
+		word, err := url.PathUnescape(w)
+		if err != nil {
+			return nil
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
 // validateScript ensures the requested script path is under docRoot and is executable
-func validateScript(script string, docRoot string) error {
+// Filesystem access is done via fs (might be nil).
+func validateScript(script string, docRoot string, fs *fsGuard) error {
 	if !filepath.IsAbs(script) {
 		return fmt.Errorf("script path must be absolute: %s", script)
 	}
+	if docRoot == "" {
+		return fmt.Errorf("no DOCUMENT_ROOT to contain the script %s", script)
+	}
 
 	// Clean up the path (removes "."/".." components)
 	script = filepath.Clean(script)
 
-	if docRoot != "" {
-		// Ensure path is under docRoot
-		rel, err := filepath.Rel(docRoot, script)
-		if err != nil || strings.HasPrefix(rel, "..") {
-			return fmt.Errorf("script path (%s) outside DOCUMENT_ROOT (%s)", script, docRoot)
-		}
+	// Ensure path is under docRoot
+	if !withinDir(docRoot, script) {
+		return fmt.Errorf("script path (%s) outside DOCUMENT_ROOT (%s)", script, docRoot)
 	}
+	return checkExecutable(script, fs)
+}
+
+// withinDir reports whether the (clean) path p is dir itself or below it.
+// Only the path is compared, symlinks are not resolved.
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkExecutable ensures script (absolute) is an executable regular file
+func checkExecutable(script string, fs *fsGuard) error {
+	if !filepath.IsAbs(script) {
+		return fmt.Errorf("script path must be absolute: %s", script)
+	}
+	script = filepath.Clean(script)
 
 	// Lstat file (does not follow symlink) to ensure target is a regular executable and no symlink
 	// symlink are the root of many vulnerabilities!
-	info, err := os.Lstat(script)
+	info, err := fs.lstat(script)
 	if err != nil {
+		if errors.Is(err, errFSUnavailable) {
+			return err
+		}
 		if os.IsNotExist(err) {
 			return fmt.Errorf("script not found: %w", err)
 		}
@@ -49,12 +272,67 @@ func validateScript(script string, docRoot string) error {
 		return fmt.Errorf("script not executable: %s", script)
 	}
 
-	slog.Debug("script validated", "script", script)
 	return nil
 }
 
+// resolveScript resolves the symlinks of script and docRoot (--follow-symlinks).
+// The resolved script must be below the resolved docRoot or one of roots
+// (unchecked if neither is given).
+func resolveScript(script string, docRoot string, roots []string, fs *fsGuard) (string, string, error) {
+	if !filepath.IsAbs(script) {
+		return "", "", fmt.Errorf("script path must be absolute: %s", script)
+	}
+	resolved, err := fs.evalSymlinks(filepath.Clean(script))
+	if err != nil {
+		if errors.Is(err, errFSUnavailable) {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("resolving script failed: %w", err)
+	}
+	if docRoot != "" {
+		if docRoot, err = fs.evalSymlinks(docRoot); err != nil {
+			return "", "", fmt.Errorf("resolving DOCUMENT_ROOT failed: %w", err)
+		}
+		roots = append([]string{docRoot}, roots...)
+	}
+	if len(roots) == 0 {
+		return resolved, docRoot, nil
+	}
+	for _, root := range roots {
+		if withinDir(root, resolved) {
+			return resolved, docRoot, nil
+		}
+	}
+	return "", "", fmt.Errorf("resolved script path (%s) outside of the allowed roots %v", resolved, roots)
+}
+
+// resolveDirs resolves the symlinks of docRoot and of the directory of script
+// (--resolve-docroot), a symlink as script itself is kept and rejected later
+func resolveDirs(script string, docRoot string, fs *fsGuard) (string, string, error) {
+	if !filepath.IsAbs(script) {
+		return "", "", fmt.Errorf("script path must be absolute: %s", script)
+	}
+	script = filepath.Clean(script)
+	dir, err := fs.evalSymlinks(filepath.Dir(script))
+	if err != nil {
+		if errors.Is(err, errFSUnavailable) {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("resolving script directory failed: %w", err)
+	}
+	if docRoot != "" {
+		if docRoot, err = fs.evalSymlinks(docRoot); err != nil {
+			if errors.Is(err, errFSUnavailable) {
+				return "", "", err
+			}
+			return "", "", fmt.Errorf("resolving DOCUMENT_ROOT failed: %w", err)
+		}
+	}
+	return filepath.Join(dir, filepath.Base(script)), docRoot, nil
+}
+
 // prepareCGICommand constructs an *exec.Cmd from the cgi request
-func prepareCGICommand(env map[string]string, inherited_env []string, ctx context.Context) (*exec.Cmd, error) {
+func prepareCGICommand(args arguments, env map[string]string, inherited_env []string, ctx context.Context) (*exec.Cmd, error) {
 	script := env["SCRIPT_FILENAME"]
 
 	docRoot, ok := env["DOCUMENT_ROOT"]
@@ -70,12 +348,66 @@ func prepareCGICommand(env map[string]string, inherited_env []string, ctx contex
 		script = filepath.Join(docRoot, scriptName)
 	}
 
-	if err := validateScript(script, docRoot); err != nil {
+	// aliased scripts (--alias) are contained in the alias target instead
+	if target, ok := aliasTarget(filepath.Clean(script), args.Alias); ok {
+		docRoot = target
+	}
+
+	// the script is executed via its resolved path, Args[0] stays the requested
+	// one
+	path, root := script, docRoot
+	if args.FollowSymlinks {
+		var err error
+		if path, root, err = resolveScript(script, docRoot, args.SymlinkRoots, args.fs); err != nil {
+			return nil, err
+		}
+		// containment was checked on the resolved paths
+		if err := checkExecutable(path, args.fs); err != nil {
+			return nil, err
+		}
+	} else if args.ResolveDocRoot {
+		var err error
+		if path, root, err = resolveDirs(script, docRoot, args.fs); err != nil {
+			return nil, err
+		}
+		if err := validateScript(path, root, args.fs); err != nil {
+			return nil, err
+		}
+	} else if docRoot == "" {
+		// the web server passed SCRIPT_FILENAME without DOCUMENT_ROOT, it is
+		// trusted like fcgiwrap does (never the case with --http/--ajp)
+		if err := checkExecutable(script, args.fs); err != nil {
+			return nil, err
+		}
+	} else if err := validateScript(script, docRoot, args.fs); err != nil {
+		return nil, err
+	}
+	if args.Suexec {
+		if err := checkOwnership(filepath.Clean(path), args.SuexecDir, args.ScriptOwner, args.fs); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkHidden(filepath.Clean(script), docRoot, args.Hidden); err != nil {
+		return nil, err
+	}
+	if args.FollowSymlinks {
+		if err := checkHidden(path, root, args.Hidden); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPathRules(filepath.Clean(path), args.Allow, args.Deny); err != nil {
 		return nil, err
 	}
 
-	cmd := exec.CommandContext(ctx, script)
-	cmd.Env = inherit_environment(env, inherited_env)
+	var scriptArgs []string
+	if args.IsindexArgs {
+		scriptArgs = isindexArgs(env["QUERY_STRING"])
+	}
+	cmd := exec.CommandContext(ctx, path, scriptArgs...)
+	cmd.Args[0] = script
+	// own process group, so descendants can be signalled along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = inherit_environment(env, childEnv(args, env, inherited_env))
 
 	if dir, ok := env["FCGI_CHDIR"]; ok {
 		switch dir {
@@ -87,7 +419,7 @@ func prepareCGICommand(env map[string]string, inherited_env []string, ctx contex
 				return nil, fmt.Errorf("FCGI_CHDIR must be absolute: %q", dir)
 			}
 			// stat it
-			info, err := os.Stat(dir)
+			info, err := args.fs.stat(dir)
 			if err != nil {
 				return nil, fmt.Errorf("FCGI_CHDIR stat failed: %w", err)
 			}
@@ -102,14 +434,162 @@ func prepareCGICommand(env map[string]string, inherited_env []string, ctx contex
 		cmd.Dir = filepath.Dir(script)
 	}
 
+	var spec childSpec
+	mounts, err := dnsOverrides(args, env)
+	if err != nil {
+		return nil, err
+	}
+	spec.Mounts = append(spec.Mounts, mounts...)
+	spec.Rlimits = rlimitsFromArgs(args)
+	spec.Seccomp = args.seccomp
+	spec.Nice = args.Nice
+	spec.IOPrio = args.IONice
+	spec.ExecPrefix = args.execPrefix
+	interp := env["FCGI_INTERPRETER"]
+	if interp == "" {
+		interp = interpreterFor(path, args.Interpreters)
+	}
+	if interp != "" {
+		argv, err := parseExecPrefix(interp)
+		if err != nil {
+			return nil, fmt.Errorf("FCGI_INTERPRETER: %w", err)
+		}
+		spec.ExecPrefix = append(slices.Clip(spec.ExecPrefix), argv...)
+	}
+	if args.Sandbox {
+		if root == "" {
+			root = filepath.Dir(path)
+		}
+		spec.Sandbox = newSandboxSpec(args, root, cmd.Dir)
+	}
+
+	if err := wrapChildCommand(cmd, spec); err != nil {
+		return nil, err
+	}
+
 	return cmd, nil
 }
 
+// dnsOverrides determines which files should be bind-mounted over
+// /etc/resolv.conf and /etc/hosts for the child. The FCGI_RESOLV_CONF and
+// FCGI_HOSTS params override the global settings per script ("-" disables the
+// override for this script).
+func dnsOverrides(args arguments, env map[string]string) ([]bindMount, error) {
+	var mounts []bindMount
+	for _, o := range []struct{ param, global, target string }{
+		{"FCGI_RESOLV_CONF", args.ResolvConf, "/etc/resolv.conf"},
+		{"FCGI_HOSTS", args.HostsFile, "/etc/hosts"},
+	} {
+		src := o.global
+		if v, ok := env[o.param]; ok {
+			src = v
+		}
+		if src == "" || src == "-" {
+			continue
+		}
+
+		if !filepath.IsAbs(src) {
+			return nil, fmt.Errorf("%s override must be absolute: %q", o.target, src)
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s override stat failed: %w", o.target, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s override is not a regular file: %q", o.target, src)
+		}
+		mounts = append(mounts, bindMount{Source: src, Target: o.target, ReadOnly: true})
+	}
+	return mounts, nil
+}
+
+// envVar is a KEY=VALUE pair injected into the environment of CGI children
+type envVar struct {
+	Key   string
+	Value string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (e *envVar) UnmarshalText(text []byte) error {
+	k, v, ok := strings.Cut(string(text), "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid environment variable %q (expected KEY=VALUE)", string(text))
+	}
+	*e = envVar{Key: k, Value: v}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (e envVar) MarshalText() ([]byte, error) {
+	return []byte(e.Key + "=" + e.Value), nil
+}
+
+// envList is the list of --env variables. In the configuration file a mapping
+// of KEY: VALUE is accepted as well.
+type envList []envVar
+
+// jsonSchemaType implements jsonSchemaTyper
+func (envList) jsonSchemaType() any {
+	return []string{"array", "object"}
+}
+
+// childEnv returns the environment of CGI children apart from the request
+// params (the first occurrence of a variable wins)
+func childEnv(args arguments, env map[string]string, inherited_env []string) []string {
+	ret := localeEnv(args, env)
+	for _, e := range args.Env {
+		ret = append(ret, e.Key+"="+e.Value)
+	}
+	return append(ret, inherited_env...)
+}
+
+// localeEnv returns the LANG/LC_ALL/TZ variables which should be forced for the
+// child. These take precedence over the inherited host environment but not
+// over variables set by the web server. The FCGI_LOCALE and FCGI_TIMEZONE params
+// override the global settings per script.
+func localeEnv(args arguments, env map[string]string) []string {
+	locale := args.Locale
+	if v, ok := env["FCGI_LOCALE"]; ok {
+		locale = v
+	}
+	tz := args.Timezone
+	if v, ok := env["FCGI_TIMEZONE"]; ok {
+		tz = v
+	}
+
+	var ret []string
+	if locale != "" {
+		ret = append(ret, "LANG="+locale, "LC_ALL="+locale)
+	}
+	if tz != "" {
+		ret = append(ret, "TZ="+tz)
+	}
+	return ret
+}
+
+// execTimeout returns the execution timeout for the request. The FCGI_TIMEOUT
+// param (duration or plain seconds, 0 to disable) overrides --exec-timeout.
+func execTimeout(args arguments, env map[string]string) time.Duration {
+	v, ok := env["FCGI_TIMEOUT"]
+	if !ok {
+		return args.ExecTimeout
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Warn("ignoring invalid FCGI_TIMEOUT", "value", v, "error", err)
+		return args.ExecTimeout
+	}
+	return d
+}
+
 func inherit_environment(env map[string]string, inherited_env []string) []string {
 	ret_env := make([]string, 0, len(env)+len(inherited_env))
 	seen := make(map[string]bool)
 
-	for k,v := range env {
+	for k, v := range env {
 		if _, ok := seen[k]; ok {
 			continue
 		}
@@ -119,7 +599,7 @@ func inherit_environment(env map[string]string, inherited_env []string) []string
 
 	for _, i := range inherited_env {
 		tmp := strings.SplitN(i, "=", 2)
-		k,_ := tmp[0], tmp[1]
+		k, _ := tmp[0], tmp[1]
 		if _, ok := seen[k]; ok {
 			continue
 		}
@@ -129,3 +609,152 @@ func inherit_environment(env map[string]string, inherited_env []string) []string
 
 	return ret_env
 }
+
+// timeoutWarning arranges for the warning signal to be sent to the started cmd
+// TimeoutGrace before the execution timeout (nil if there is nothing to do).
+// The FCGI_TIMEOUT_SIGNAL param overrides --timeout-signal ("-" disables it).
+func timeoutWarning(args arguments, env map[string]string, timeout time.Duration, cmd *exec.Cmd) clockTimer {
+	sig := args.TimeoutSignal
+	if v, ok := env["FCGI_TIMEOUT_SIGNAL"]; ok {
+		if v == "-" {
+			sig = 0
+		} else if err := sig.UnmarshalText([]byte(v)); err != nil {
+			slog.Warn("ignoring invalid FCGI_TIMEOUT_SIGNAL", "value", v, "error", err)
+			sig = args.TimeoutSignal
+		}
+	}
+	if sig == 0 || timeout <= 0 {
+		return nil
+	}
+
+	// with a timeout shorter than the grace period the signal is sent immediately
+	pid := cmd.Process.Pid
+	return args.clk().AfterFunc(max(timeout-args.TimeoutGrace, 0), func() {
+		slog.Debug("sending timeout warning signal to CGI", "pid", pid, "signal", syscall.Signal(sig))
+		_ = signalGroup(cmd, syscall.Signal(sig))
+	})
+}
+
+// signalGroup sends sig to the process group of the started cmd, so
+// descendants (e.g. still holding stdout open) don't outlive the script
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return nil
+}
+
+// interpreterRule runs scripts matching a glob through an interpreter
+// (--interpreter GLOB=COMMAND), e.g. *.py=/usr/bin/python3. Globs without "/"
+// match the file name, others the whole path.
+type interpreterRule struct {
+	Pattern string
+	Command string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (r *interpreterRule) UnmarshalText(text []byte) error {
+	pattern, command, ok := strings.Cut(string(text), "=")
+	if !ok || pattern == "" || command == "" {
+		return fmt.Errorf("expected GLOB=COMMAND, got %q", text)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if _, err := splitCommandLine(command); err != nil {
+		return fmt.Errorf("invalid interpreter %q: %w", command, err)
+	}
+	r.Pattern, r.Command = pattern, command
+	return nil
+}
+
+func (r interpreterRule) MarshalText() ([]byte, error) {
+	return []byte(r.Pattern + "=" + r.Command), nil
+}
+
+// interpreterFor returns the command of the first rule matching script ("" if
+// none does)
+func interpreterFor(script string, rules []interpreterRule) string {
+	for _, rule := range rules {
+		name := script
+		if !strings.Contains(rule.Pattern, "/") {
+			name = filepath.Base(script)
+		}
+		if ok, _ := filepath.Match(rule.Pattern, name); ok {
+			return rule.Command
+		}
+	}
+	return ""
+}
+
+// parseExecPrefix splits the --exec-prefix command line and resolves the
+// command via PATH
+func parseExecPrefix(prefix string) ([]string, error) {
+	argv, err := splitCommandLine(prefix)
+	if err != nil || len(argv) == 0 {
+		return nil, err
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return nil, fmt.Errorf("exec prefix: %w", err)
+	}
+	argv[0] = path
+	return argv, nil
+}
+
+// splitCommandLine splits s into words like a POSIX shell would (quotes and
+// backslash escapes, no expansions)
+func splitCommandLine(s string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			cur.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// inside double quotes backslash only escapes these
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				cur.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated double quote in %q", s)
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			cur.WriteByte(s[i])
+			inWord = true
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
@@ -5,16 +5,29 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
-	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	// the test binary needs to act as child setup helper as well
+	if len(os.Args) > 1 && os.Args[1] == childInitArg {
+		childInit(os.Args[2:])
+	}
+	os.Exit(m.Run())
+}
+
 func dummyScript(t *testing.T, root string, name string, exec bool) string {
 	t.Helper()
 	script := filepath.Join(root, name)
@@ -74,7 +87,7 @@ func TestPrepareCGICommand(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			cmd, err := prepareCGICommand(tt.env, make([]string, 0), context.Background())
+			cmd, err := prepareCGICommand(arguments{}, tt.env, make([]string, 0), context.Background())
 			if tt.wantErr {
 				require.Error(t, err)
 				if tt.errContains != "" {
@@ -97,47 +110,69 @@ func TestValidateScript_BasicCases(t *testing.T) {
 	assert.NoError(t, os.WriteFile(scriptPath, []byte("echo ok"), 0o755))
 
 	t.Run("Valid absolute executable script", func(t *testing.T) {
-		assert.NoError(t, validateScript(scriptPath, tmpDir))
+		assert.NoError(t, validateScript(scriptPath, tmpDir, nil))
+	})
+
+	t.Run("Missing DOCUMENT_ROOT", func(t *testing.T) {
+		assert.ErrorContains(t, validateScript(scriptPath, "", nil), "no DOCUMENT_ROOT")
 	})
 
 	t.Run("Relative path should fail", func(t *testing.T) {
-		err := validateScript("rel/test.sh", tmpDir)
+		err := validateScript("rel/test.sh", tmpDir, nil)
 		assert.ErrorContains(t, err, "absolute")
 	})
 
 	t.Run("Script outside DOCUMENT_ROOT", func(t *testing.T) {
 		outside := filepath.Join(os.TempDir(), "evil.sh")
 		_ = os.WriteFile(outside, []byte("echo bad"), 0o755)
-		err := validateScript(outside, tmpDir)
+		err := validateScript(outside, tmpDir, nil)
 		assert.ErrorContains(t, err, "outside")
 	})
 
 	t.Run("Non-existent file", func(t *testing.T) {
 		missing := filepath.Join(tmpDir, "nofile")
-		err := validateScript(missing, tmpDir)
+		err := validateScript(missing, tmpDir, nil)
 		assert.ErrorContains(t, err, "script not found")
 	})
 
 	t.Run("Non-executable script", func(t *testing.T) {
 		nonExec := filepath.Join(tmpDir, "noexec.sh")
 		_ = os.WriteFile(nonExec, []byte("echo x"), 0o644)
-		err := validateScript(nonExec, tmpDir)
+		err := validateScript(nonExec, tmpDir, nil)
 		assert.ErrorContains(t, err, "not executable")
 	})
 
 	t.Run("Path is directory", func(t *testing.T) {
 		dir := filepath.Join(tmpDir, "dir")
 		_ = os.Mkdir(dir, 0o755)
-		err := validateScript(dir, tmpDir)
+		err := validateScript(dir, tmpDir, nil)
 		assert.ErrorContains(t, err, "not a regular file")
 	})
 
 	t.Run("Path with .. normalized correctly", func(t *testing.T) {
 		norm := filepath.Join(tmpDir, "subdir", "..", "ok.sh")
-		assert.NoError(t, validateScript(norm, tmpDir))
+		assert.NoError(t, validateScript(norm, tmpDir, nil))
+	})
+
+	t.Run("Name starting with ..", func(t *testing.T) {
+		dots := filepath.Join(tmpDir, "..ok.sh")
+		require.NoError(t, os.WriteFile(dots, []byte("echo ok"), 0o755))
+		assert.NoError(t, validateScript(dots, tmpDir, nil))
+		resolved, _, err := resolveScript(dots, tmpDir, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, dots, resolved)
 	})
 }
 
+func TestWithinDir(t *testing.T) {
+	assert.True(t, withinDir("/srv/www", "/srv/www"))
+	assert.True(t, withinDir("/srv/www", "/srv/www/a/b.cgi"))
+	assert.True(t, withinDir("/srv/www", "/srv/www/..a.cgi"))
+	assert.False(t, withinDir("/srv/www", "/srv"))
+	assert.False(t, withinDir("/srv/www", "/srv/www2/a.cgi"))
+	assert.False(t, withinDir("/srv/www", "/srv/other/a.cgi"))
+}
+
 func TestValidateScript_Symlinks(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -147,6 +182,563 @@ func TestValidateScript_Symlinks(t *testing.T) {
 	t.Run("Reject symlink to valid file", func(t *testing.T) {
 		link := filepath.Join(tmpDir, "link.sh")
 		assert.NoError(t, os.Symlink(realScript, link))
-		assert.ErrorContains(t, validateScript(link, tmpDir), "Symlinks are unsupported")
+		assert.ErrorContains(t, validateScript(link, tmpDir, nil), "Symlinks are unsupported")
+	})
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	tmpDir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	release := filepath.Join(tmpDir, "releases", "1")
+	require.NoError(t, os.MkdirAll(release, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(release, "app.sh"), []byte("echo ok"), 0o755))
+	current := filepath.Join(tmpDir, "current")
+	require.NoError(t, os.Symlink(release, current))
+	outside := filepath.Join(tmpDir, "outside.sh")
+	require.NoError(t, os.WriteFile(outside, []byte("echo bad"), 0o755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(release, "escape.sh")))
+	require.NoError(t, os.Symlink("app.sh", filepath.Join(release, "link.sh")))
+
+	env := map[string]string{"DOCUMENT_ROOT": current, "SCRIPT_FILENAME": filepath.Join(current, "link.sh")}
+	_, err = prepareCGICommand(arguments{}, env, nil, context.Background())
+	assert.ErrorContains(t, err, "Symlinks are unsupported")
+
+	args := arguments{FollowSymlinks: true}
+	cmd, err := prepareCGICommand(args, env, nil, context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(release, "app.sh"), cmd.Path)
+	assert.Equal(t, filepath.Join(current, "link.sh"), cmd.Args[0])
+
+	env["SCRIPT_FILENAME"] = filepath.Join(current, "escape.sh")
+	_, err = prepareCGICommand(args, env, nil, context.Background())
+	assert.ErrorContains(t, err, "outside of the allowed roots")
+	args.SymlinkRoots = []string{tmpDir}
+	_, err = prepareCGICommand(args, env, nil, context.Background())
+	assert.NoError(t, err)
+}
+
+func TestResolveDocRoot(t *testing.T) {
+	tmpDir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	release := filepath.Join(tmpDir, "releases", "1")
+	require.NoError(t, os.MkdirAll(release, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(release, "app.sh"), []byte("echo ok"), 0o755))
+	require.NoError(t, os.Symlink("app.sh", filepath.Join(release, "link.sh")))
+	current := filepath.Join(tmpDir, "current")
+	require.NoError(t, os.Symlink(release, current))
+
+	// the web server passes the symlinked root but the resolved script path
+	env := map[string]string{"DOCUMENT_ROOT": current, "SCRIPT_FILENAME": filepath.Join(release, "app.sh")}
+	_, err = prepareCGICommand(arguments{}, env, nil, context.Background())
+	assert.ErrorContains(t, err, "outside DOCUMENT_ROOT")
+
+	args := arguments{ResolveDocRoot: true}
+	cmd, err := prepareCGICommand(args, env, nil, context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(release, "app.sh"), cmd.Path)
+
+	env["SCRIPT_FILENAME"] = filepath.Join(current, "link.sh")
+	_, err = prepareCGICommand(args, env, nil, context.Background())
+	assert.ErrorContains(t, err, "Symlinks are unsupported")
+}
+
+func TestDNSOverrides(t *testing.T) {
+	tmpDir := t.TempDir()
+	resolv := filepath.Join(tmpDir, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0o644))
+
+	t.Run("No override", func(t *testing.T) {
+		mounts, err := dnsOverrides(arguments{}, map[string]string{})
+		assert.NoError(t, err)
+		assert.Empty(t, mounts)
+	})
+
+	t.Run("Global override", func(t *testing.T) {
+		mounts, err := dnsOverrides(arguments{ResolvConf: resolv}, map[string]string{})
+		assert.NoError(t, err)
+		assert.Equal(t, []bindMount{{Source: resolv, Target: "/etc/resolv.conf", ReadOnly: true}}, mounts)
+	})
+
+	t.Run("Per script disables global", func(t *testing.T) {
+		mounts, err := dnsOverrides(arguments{ResolvConf: resolv}, map[string]string{"FCGI_RESOLV_CONF": "-"})
+		assert.NoError(t, err)
+		assert.Empty(t, mounts)
+	})
+
+	t.Run("Per script hosts", func(t *testing.T) {
+		mounts, err := dnsOverrides(arguments{}, map[string]string{"FCGI_HOSTS": resolv})
+		assert.NoError(t, err)
+		assert.Equal(t, "/etc/hosts", mounts[0].Target)
+	})
+
+	t.Run("Relative path", func(t *testing.T) {
+		_, err := dnsOverrides(arguments{HostsFile: "hosts"}, map[string]string{})
+		assert.ErrorContains(t, err, "absolute")
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		_, err := dnsOverrides(arguments{HostsFile: tmpDir}, map[string]string{})
+		assert.ErrorContains(t, err, "not a regular file")
+	})
+
+	t.Run("Mounted in child", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mount namespaces require root")
+		}
+		script := filepath.Join(tmpDir, "cat.sh")
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\ncat /etc/resolv.conf"), 0o755))
+
+		cmd, err := prepareCGICommand(arguments{ResolvConf: resolv}, map[string]string{"SCRIPT_FILENAME": script}, nil, context.Background())
+		require.NoError(t, err)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		assert.Equal(t, "nameserver 10.0.0.1\n", string(out))
+	})
+}
+
+func TestRlimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "limit.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nulimit -n"), 0o755))
+
+	assert.Empty(t, rlimitsFromArgs(arguments{}))
+	// 0 means unlimited, not a limit of zero processes
+	limits := rlimitsFromArgs(arguments{LimitNofile: 42, LimitNproc: 0})
+	require.Len(t, limits, 1)
+	assert.Equal(t, uint64(42), limits[0].Limit)
+
+	cmd, err := prepareCGICommand(arguments{LimitNofile: 42}, map[string]string{"SCRIPT_FILENAME": script}, nil, context.Background())
+	require.NoError(t, err)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "42\n", string(out))
+}
+
+func TestLocaleEnv(t *testing.T) {
+	t.Run("Nothing forced", func(t *testing.T) {
+		assert.Empty(t, localeEnv(arguments{}, map[string]string{}))
+	})
+
+	t.Run("Global settings", func(t *testing.T) {
+		assert.Equal(t, []string{"LANG=C.UTF-8", "LC_ALL=C.UTF-8", "TZ=UTC"},
+			localeEnv(arguments{Locale: "C.UTF-8", Timezone: "UTC"}, map[string]string{}))
+	})
+
+	t.Run("Per script override", func(t *testing.T) {
+		assert.Equal(t, []string{"LANG=de_DE.UTF-8", "LC_ALL=de_DE.UTF-8", "TZ=UTC"},
+			localeEnv(arguments{Locale: "C.UTF-8", Timezone: "UTC"}, map[string]string{"FCGI_LOCALE": "de_DE.UTF-8"}))
+	})
+
+	t.Run("Precedence over host but not web server", func(t *testing.T) {
+		env := map[string]string{"TZ": "Europe/Berlin"}
+		res := inherit_environment(env, append(localeEnv(arguments{Locale: "C", Timezone: "UTC"}, env), "LANG=en_US.UTF-8", "TZ=America/New_York"))
+		assert.ElementsMatch(t, []string{"TZ=Europe/Berlin", "LANG=C", "LC_ALL=C"}, res)
+	})
+}
+
+func TestSetupEnv(t *testing.T) {
+	t.Setenv("FCGITEST_A", "1")
+	t.Setenv("FCGITEST_B", "2")
+	t.Setenv("OTHER_FCGITEST", "3")
+	t.Setenv("LD_PRELOAD", "/evil.so")
+
+	filter := func(env []string) []string {
+		var ret []string
+		for _, e := range env {
+			if strings.Contains(e, "FCGITEST") || strings.HasPrefix(e, "LD_PRELOAD=") {
+				ret = append(ret, e)
+			}
+		}
+		return ret
+	}
+	assert.ElementsMatch(t, []string{"FCGITEST_A=1", "FCGITEST_B=2", "OTHER_FCGITEST=3"}, filter(setupEnv(nil, nil)))
+	assert.ElementsMatch(t, []string{"FCGITEST_A=1", "FCGITEST_B=2"}, filter(setupEnv([]string{"FCGITEST_*"}, nil)))
+	assert.ElementsMatch(t, []string{"OTHER_FCGITEST=3"}, filter(setupEnv([]string{"OTHER_FCGITEST", "LD_PRELOAD"}, nil)))
+	assert.ElementsMatch(t, []string{"FCGITEST_B=2"}, filter(setupEnv(nil, []string{"FCGITEST_A", "OTHER_*"})))
+	// blocking wins over the allowlist
+	assert.ElementsMatch(t, []string{"FCGITEST_A=1"}, filter(setupEnv([]string{"FCGITEST_*"}, []string{"FCGITEST_B"})))
+}
+
+func TestChildEnv(t *testing.T) {
+	var e envVar
+	assert.Error(t, e.UnmarshalText([]byte("NOVALUE")))
+	assert.Error(t, e.UnmarshalText([]byte("=x")))
+	require.NoError(t, e.UnmarshalText([]byte("PERL5LIB=/opt/lib=x")))
+	assert.Equal(t, envVar{Key: "PERL5LIB", Value: "/opt/lib=x"}, e)
+
+	args := arguments{Env: envList{{"PATH", "/opt/bin"}, {"PERL5LIB", "/opt/lib"}}}
+	env := map[string]string{"PERL5LIB": "/srv/lib"}
+	res := inherit_environment(env, childEnv(args, env, []string{"PATH=/usr/bin", "HOME=/"}))
+	assert.ElementsMatch(t, []string{"PERL5LIB=/srv/lib", "PATH=/opt/bin", "HOME=/"}, res)
+}
+
+func TestCGIEnv(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://example.org/cgi/app.sh/some/path?a=b", strings.NewReader("x"))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("X-Forwarded-For", "192.0.2.2")
+
+	env := cgiEnv(r, map[string]string{"SCRIPT_FILENAME": "/srv/cgi/app.sh", "DOCUMENT_ROOT": "/srv/", "REQUEST_METHOD": "PUT"})
+	assert.Equal(t, "PUT", env["REQUEST_METHOD"]) // params take precedence
+	assert.Equal(t, "a=b", env["QUERY_STRING"])
+	assert.Equal(t, "/cgi/app.sh/some/path?a=b", env["REQUEST_URI"])
+	assert.Equal(t, "1", env["CONTENT_LENGTH"])
+	assert.Equal(t, "text/plain", env["CONTENT_TYPE"])
+	assert.Equal(t, "192.0.2.1", env["REMOTE_ADDR"])
+	assert.Equal(t, "1234", env["REMOTE_PORT"])
+	assert.Equal(t, "example.org", env["HTTP_HOST"])
+	assert.Equal(t, "192.0.2.2", env["HTTP_X_FORWARDED_FOR"])
+	assert.Equal(t, "/cgi/app.sh", env["SCRIPT_NAME"])
+	assert.Equal(t, "/some/path", env["PATH_INFO"])
+	assert.NotContains(t, env, "HTTPS")
+
+	// httpoxy
+	r.Header.Set("Proxy", "http://evil.example")
+	env = cgiEnv(r, map[string]string{"HTTP_PROXY": "http://evil.example"})
+	assert.NotContains(t, env, "HTTP_PROXY")
+}
+
+func TestSplitPathInfo(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "cgi"), 0o755))
+	script := cgiScript(t, filepath.Join(root, "cgi"), "app.sh", "exit 0\n")
+
+	env := map[string]string{"SCRIPT_FILENAME": script + "/some/path", "SCRIPT_NAME": "/cgi/app.sh/some/path", "DOCUMENT_ROOT": root}
+	splitPathInfo(env, nil)
+	assert.Equal(t, script, env["SCRIPT_FILENAME"])
+	assert.Equal(t, "/cgi/app.sh", env["SCRIPT_NAME"])
+	assert.Equal(t, "/some/path", env["PATH_INFO"])
+	assert.Equal(t, filepath.Join(root, "some/path"), env["PATH_TRANSLATED"])
+
+	// existing scripts and paths below directories are left alone
+	for _, name := range []string{script, filepath.Join(root, "cgi/missing.sh/x")} {
+		env := map[string]string{"SCRIPT_FILENAME": name, "DOCUMENT_ROOT": root}
+		splitPathInfo(env, nil)
+		assert.Equal(t, name, env["SCRIPT_FILENAME"])
+		assert.NotContains(t, env, "PATH_INFO")
+	}
+
+	// without SCRIPT_FILENAME the script is looked up via SCRIPT_NAME
+	env = map[string]string{"SCRIPT_NAME": "/cgi/app.sh/x", "DOCUMENT_ROOT": root, "PATH_INFO": "/given"}
+	splitPathInfo(env, nil)
+	assert.Equal(t, script, env["SCRIPT_FILENAME"])
+	assert.Equal(t, "/given", env["PATH_INFO"])
+
+	// a sibling sharing the prefix isn't inside the DOCUMENT_ROOT
+	env = map[string]string{"SCRIPT_FILENAME": script + "/x", "DOCUMENT_ROOT": filepath.Join(root, "cg")}
+	splitPathInfo(env, nil)
+	assert.Equal(t, script, env["SCRIPT_FILENAME"])
+	assert.Equal(t, "/x", env["PATH_INFO"])
+}
+
+func TestMapScriptName(t *testing.T) {
+	env := map[string]string{"SCRIPT_NAME": "/cgi-bin/app.sh", "DOCUMENT_ROOT": "/srv/cgi"}
+	mapScriptName(env, "/cgi-bin")
+	assert.Equal(t, "/srv/cgi/app.sh", env["SCRIPT_FILENAME"])
+	assert.Equal(t, "/cgi-bin/app.sh", env["SCRIPT_NAME"])
+
+	// only whole path segments are stripped, SCRIPT_FILENAME takes precedence
+	env = map[string]string{"SCRIPT_NAME": "/cgi-binary/app.sh", "DOCUMENT_ROOT": "/srv/cgi"}
+	mapScriptName(env, "/cgi-bin")
+	assert.NotContains(t, env, "SCRIPT_FILENAME")
+	env = map[string]string{"SCRIPT_NAME": "/cgi-bin/app.sh", "SCRIPT_FILENAME": "/other.sh", "DOCUMENT_ROOT": "/srv/cgi"}
+	mapScriptName(env, "/cgi-bin")
+	assert.Equal(t, "/other.sh", env["SCRIPT_FILENAME"])
+}
+
+func TestDirIndexScript(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "app"), 0o755))
+	index := cgiScript(t, filepath.Join(root, "app"), "index.pl", "exit 0\n")
+
+	env := map[string]string{"SCRIPT_NAME": "/app", "DOCUMENT_ROOT": root}
+	dirIndexScript(env, nil, nil)
+	assert.Equal(t, index, env["SCRIPT_FILENAME"])
+	assert.Equal(t, "/app/index.pl", env["SCRIPT_NAME"])
+
+	// disabled or no index script present
+	for _, names := range [][]string{{""}, {"index.cgi"}} {
+		env := map[string]string{"SCRIPT_FILENAME": filepath.Join(root, "app")}
+		dirIndexScript(env, names, nil)
+		assert.Equal(t, filepath.Join(root, "app"), env["SCRIPT_FILENAME"])
+	}
+}
+
+func TestIsindexArgs(t *testing.T) {
+	assert.Equal(t, []string{"foo", "bar baz!"}, isindexArgs("foo+bar%20baz%21"))
+	assert.Nil(t, isindexArgs("a=b"))
+	assert.Nil(t, isindexArgs(""))
+	assert.Nil(t, isindexArgs("bad%zz"))
+}
+
+func TestSeccomp(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Run("Invalid profiles", func(t *testing.T) {
+		_, err := compileSeccompProfile([]byte(`{"defaultAction": "SCMP_ACT_NOPE"}`))
+		assert.ErrorContains(t, err, "unsupported seccomp action")
+		_, err = compileSeccompProfile([]byte(`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["nope"], "action": "SCMP_ACT_ERRNO"}]}`))
+		assert.ErrorContains(t, err, "unknown syscall")
+		_, err = decodeBPF([]byte{1, 2, 3})
+		assert.ErrorContains(t, err, "invalid BPF program size")
+	})
+
+	t.Run("BPF roundtrip", func(t *testing.T) {
+		prog, err := compileSeccompProfile([]byte(`{"defaultAction": "SCMP_ACT_ALLOW"}`))
+		require.NoError(t, err)
+		dec, err := decodeBPF(encodeBPF(prog))
+		require.NoError(t, err)
+		assert.Equal(t, prog, dec)
+	})
+
+	t.Run("x32 syscalls killed before the rules", func(t *testing.T) {
+		prog, err := compileSeccompProfile([]byte(`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdir"], "action": "SCMP_ACT_ERRNO"}]}`))
+		require.NoError(t, err)
+		require.Greater(t, len(prog), 6)
+		assert.Equal(t, sockFilter{Code: bpfLdWAbs, K: seccompDataNr}, prog[3])
+		assert.Equal(t, sockFilter{Code: bpfJgeK, Jt: 0, Jf: 1, K: x32SyscallBit}, prog[4])
+		assert.Equal(t, sockFilter{Code: bpfRetK, K: seccompRetKillProcess}, prog[5])
+	})
+
+	t.Run("Blocked syscall in child", func(t *testing.T) {
+		profile := filepath.Join(tmpDir, "profile.json")
+		require.NoError(t, os.WriteFile(profile, []byte(`{
+			"defaultAction": "SCMP_ACT_ALLOW",
+			"syscalls": [{"names": ["mkdir", "mkdirat"], "action": "SCMP_ACT_ERRNO"}]
+		}`), 0o644))
+		prog, err := loadSeccompProfile(profile)
+		require.NoError(t, err)
+
+		script := filepath.Join(tmpDir, "mkdir.sh")
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nmkdir "+filepath.Join(tmpDir, "new")+" 2>/dev/null || echo blocked"), 0o755))
+
+		cmd, err := prepareCGICommand(arguments{seccomp: encodeBPF(prog)}, map[string]string{"SCRIPT_FILENAME": script}, nil, context.Background())
+		require.NoError(t, err)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		assert.Equal(t, "blocked\n", string(out))
+		assert.NoDirExists(t, filepath.Join(tmpDir, "new"))
+	})
+}
+
+func TestSandbox(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("sandboxing requires root")
+	}
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "sandbox.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho $PPID\npwd\ntouch x 2>/dev/null || echo ro\nls /tmp | wc -l\ntest -e /root || echo hidden\n"), 0o755))
+
+	cmd, err := prepareCGICommand(arguments{Sandbox: true}, map[string]string{"DOCUMENT_ROOT": tmpDir, "SCRIPT_FILENAME": script}, nil, context.Background())
+	require.NoError(t, err)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	// child of the init (the helper) of the new namespace, docroot is
+	// read-only, /tmp only contains the (nested) docroot and the host is
+	// invisible
+	assert.Equal(t, "1\n"+tmpDir+"\nro\n1\nhidden\n", string(out))
+
+	t.Run("Signals", func(t *testing.T) {
+		// sleep doesn't handle SIGTERM, as pid 1 of the namespace it would be
+		// ignored
+		script := filepath.Join(tmpDir, "sleep.sh")
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho started\nexec sleep 10\n"), 0o755))
+		cmd, err := prepareCGICommand(arguments{Sandbox: true}, map[string]string{"DOCUMENT_ROOT": tmpDir, "SCRIPT_FILENAME": script}, nil, context.Background())
+		require.NoError(t, err)
+		stdout, err := cmd.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, cmd.Start())
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "started\n", line)
+
+		start := time.Now()
+		require.NoError(t, signalGroup(cmd, syscall.SIGTERM))
+		err = cmd.Wait()
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Equal(t, 128+int(syscall.SIGTERM), cmd.ProcessState.ExitCode(), err)
+	})
+
+	t.Run("Seccomp", func(t *testing.T) {
+		// applied by a second helper started by the one staying init
+		prog, err := compileSeccompProfile([]byte(`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdir", "mkdirat"], "action": "SCMP_ACT_ERRNO"}]}`))
+		require.NoError(t, err)
+		script := filepath.Join(tmpDir, "mkdir.sh")
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nmkdir /tmp/x 2>/dev/null || echo blocked\n"), 0o755))
+		cmd, err := prepareCGICommand(arguments{Sandbox: true, seccomp: encodeBPF(prog)}, map[string]string{"DOCUMENT_ROOT": tmpDir, "SCRIPT_FILENAME": script}, nil, context.Background())
+		require.NoError(t, err)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		assert.Equal(t, "blocked\n", string(out))
 	})
 }
+
+func TestPriority(t *testing.T) {
+	var p ioPriority
+	assert.NoError(t, p.UnmarshalText([]byte("best-effort:7")))
+	assert.Equal(t, ioPriority(2<<13|7), p)
+	assert.NoError(t, p.UnmarshalText([]byte("idle")))
+	assert.Equal(t, ioPriority(3<<13), p)
+	assert.Error(t, p.UnmarshalText([]byte("best-effort:9")))
+	assert.Error(t, p.UnmarshalText([]byte("fast")))
+
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "nice.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\ncut -d' ' -f19 /proc/self/stat"), 0o755))
+
+	cmd, err := prepareCGICommand(arguments{Nice: 5}, map[string]string{"SCRIPT_FILENAME": script}, nil, context.Background())
+	require.NoError(t, err)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "5\n", string(out))
+}
+
+func TestExecPrefix(t *testing.T) {
+	for in, want := range map[string][]string{
+		`bwrap --ro-bind / / --dev /dev`: {"bwrap", "--ro-bind", "/", "/", "--dev", "/dev"},
+		`a 'b c' "d \"e\" \x" f\ g`:      {"a", "b c", `d "e" \x`, "f g"},
+		`  x''y  ""  `:                   {"xy", ""},
+	} {
+		got, err := splitCommandLine(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{`a 'b`, `a "b`, `a\`} {
+		_, err := splitCommandLine(in)
+		assert.Error(t, err, in)
+	}
+
+	prefix, err := parseExecPrefix("env 'GREETING=hello world'")
+	require.NoError(t, err)
+	assert.True(t, filepath.IsAbs(prefix[0]))
+	_, err = parseExecPrefix("does-not-exist-anywhere --flag")
+	assert.Error(t, err)
+
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "greet.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$GREETING $0\""), 0o755))
+	cmd, err := prepareCGICommand(arguments{execPrefix: prefix}, map[string]string{"SCRIPT_FILENAME": script}, nil, context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, script, cmd.Args[0])
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world "+script+"\n", string(out))
+}
+
+func TestInterpreters(t *testing.T) {
+	var py, sh interpreterRule
+	require.NoError(t, py.UnmarshalText([]byte("*.py=/usr/bin/python3 -u")))
+	require.NoError(t, sh.UnmarshalText([]byte("/srv/legacy/*=/bin/sh")))
+	rules := []interpreterRule{py, sh}
+	assert.Equal(t, "/usr/bin/python3 -u", interpreterFor("/srv/www/app.py", rules))
+	assert.Equal(t, "/bin/sh", interpreterFor("/srv/legacy/app", rules))
+	assert.Equal(t, "", interpreterFor("/srv/www/app", rules))
+	assert.Error(t, py.UnmarshalText([]byte("*.py")))
+
+	// the rule applies unless the FCGI_INTERPRETER param is given
+	script := cgiScript(t, t.TempDir(), "greet.txt", "echo \"hello $0\"\n")
+	require.NoError(t, sh.UnmarshalText([]byte("*.txt=env GREETING=x /bin/sh")))
+	cmd, err := prepareCGICommand(arguments{Interpreters: []interpreterRule{sh}}, map[string]string{"SCRIPT_FILENAME": script}, nil, context.Background())
+	require.NoError(t, err)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "hello "+script+"\n", string(out))
+}
+
+func TestFSGuard(t *testing.T) {
+	g := newFSGuard(20*time.Millisecond, 2, time.Hour)
+	block := make(chan struct{})
+	defer close(block)
+	hang := func() (int, error) { <-block; return 0, nil }
+	fine := func() (int, error) { return 1, nil }
+
+	v, err := guarded(g, fine)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	_, err = guarded(g, hang)
+	assert.ErrorIs(t, err, errFSUnavailable)
+	assert.ErrorContains(t, err, "timed out")
+
+	// a success in between resets the counter
+	_, err = guarded(g, fine)
+	assert.NoError(t, err)
+	_, err = guarded(g, hang)
+	assert.ErrorContains(t, err, "timed out")
+	_, err = guarded(g, hang)
+	assert.ErrorContains(t, err, "timed out")
+
+	// breaker is open now, fails without running op
+	start := time.Now()
+	_, err = guarded(g, hang)
+	assert.ErrorContains(t, err, "circuit breaker open")
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+
+	// after the cooldown a single probe closes the breaker again
+	g.openUntil = time.Now()
+	_, err = guarded(g, fine)
+	assert.NoError(t, err)
+	_, err = guarded(g, fine)
+	assert.NoError(t, err)
+
+	assert.Nil(t, newFSGuard(0, 3, time.Second))
+	var nilGuard *fsGuard
+	_, err = nilGuard.lstat(t.TempDir())
+	assert.NoError(t, err)
+}
+
+func TestStatCache(t *testing.T) {
+	now := time.Now()
+	g := (*fsGuard)(nil).withStatCache(time.Hour, func() time.Time { return now })
+	require.NotNil(t, g)
+	script := cgiScript(t, t.TempDir(), "app.sh", "exit 0\n")
+	require.NoError(t, checkExecutable(script, g))
+
+	// the script itself is checked again right away
+	require.NoError(t, os.Chmod(script, 0o644))
+	assert.ErrorContains(t, checkExecutable(script, g), "not executable")
+	require.NoError(t, os.Chmod(script, 0o755))
+	assert.NoError(t, checkExecutable(script, g))
+
+	// misses are served from the cache until they expire
+	missing := filepath.Join(filepath.Dir(script), "missing.sh")
+	_, err := g.lstat(missing)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, os.WriteFile(missing, nil, 0o755))
+	_, err = g.lstat(missing)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	now = now.Add(2 * time.Hour)
+	_, err = g.lstat(missing)
+	assert.NoError(t, err)
+
+	assert.Nil(t, (*fsGuard)(nil).withStatCache(0, time.Now))
+}
+
+func TestStatCacheBounds(t *testing.T) {
+	now := time.Now()
+	c := newStatCache(time.Minute, func() time.Time { return now })
+	info, err := os.Lstat(t.TempDir())
+	require.NoError(t, err)
+	c.put("/dir", info, nil)
+
+	// misses don't push out the other entries
+	for i := range 2 * maxNegativeStatEntries {
+		c.put("/missing/"+strconv.Itoa(i), nil, os.ErrNotExist)
+	}
+	assert.Equal(t, maxNegativeStatEntries, c.negative)
+	_, _, ok := c.get("/dir")
+	assert.True(t, ok)
+
+	// a full cache makes room for new entries without dropping all of them
+	for i := range maxStatCacheEntries {
+		c.put("/file/"+strconv.Itoa(i), info, nil)
+	}
+	assert.Len(t, c.entries, maxStatCacheEntries)
+
+	// expired misses make room for new ones
+	now = now.Add(2 * time.Minute)
+	c.put("/missing/new", nil, os.ErrNotExist)
+	_, _, ok = c.get("/missing/new")
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.negative)
+}
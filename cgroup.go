@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// counter to generate unique names for per-request cgroups
+var cgroupSeq atomic.Uint64
+
+// childCgroup is a cgroup v2 (below --cgroup-parent) a CGI child is placed in
+type childCgroup struct {
+	path      string
+	dir       *os.File
+	transient bool
+}
+
+// enableCgroupControllers enables the cpu and io controllers for the children
+// of the parent cgroup. Note that the parent itself must not contain any
+// processes for this to work (cgroup v2 "no internal processes" rule).
+func enableCgroupControllers(parent string) error {
+	ctrl := filepath.Join(parent, "cgroup.subtree_control")
+	if err := os.WriteFile(ctrl, []byte("+cpu +io"), 0); err != nil {
+		return fmt.Errorf("enabling controllers in %s failed: %w", parent, err)
+	}
+	return nil
+}
+
+// newChildCgroup creates (or reuses in per-script mode) the cgroup for script
+// and applies the configured limits. Returns nil if cgroups are disabled.
+func newChildCgroup(args arguments, script string) (*childCgroup, error) {
+	if args.CgroupParent == "" {
+		return nil, nil
+	}
+
+	cg := &childCgroup{}
+	switch args.CgroupMode {
+	case "", "request":
+		cg.transient = true
+		cg.path = filepath.Join(args.CgroupParent, fmt.Sprintf("req-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	case "script":
+		cg.path = filepath.Join(args.CgroupParent, url.PathEscape(strings.TrimPrefix(script, "/")))
+	default:
+		return nil, fmt.Errorf("invalid cgroup mode %q", args.CgroupMode)
+	}
+
+	if err := os.Mkdir(cg.path, 0o755); err != nil && !(os.IsExist(err) && !cg.transient) {
+		return nil, fmt.Errorf("creating cgroup %s failed: %w", cg.path, err)
+	}
+
+	if args.CgroupCPUMax != "" {
+		if err := os.WriteFile(filepath.Join(cg.path, "cpu.max"), []byte(args.CgroupCPUMax), 0); err != nil {
+			cg.close()
+			return nil, fmt.Errorf("setting cpu.max failed: %w", err)
+		}
+	}
+	for _, io := range args.CgroupIOMax {
+		if err := os.WriteFile(filepath.Join(cg.path, "io.max"), []byte(io), 0); err != nil {
+			cg.close()
+			return nil, fmt.Errorf("setting io.max failed: %w", err)
+		}
+	}
+
+	dir, err := os.Open(cg.path)
+	if err != nil {
+		cg.close()
+		return nil, fmt.Errorf("opening cgroup %s failed: %w", cg.path, err)
+	}
+	cg.dir = dir
+
+	slog.Debug("cgroup prepared", "path", cg.path)
+	return cg, nil
+}
+
+// attach makes cmd start directly inside the cgroup (CLONE_INTO_CGROUP)
+func (c *childCgroup) attach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+}
+
+// close releases the cgroup. Transient cgroups get all remaining processes
+// killed and are removed.
+func (c *childCgroup) close() {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	if !c.transient {
+		return
+	}
+	// might fail on kernels < 5.14, then rmdir fails as well if processes are left
+	_ = os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0)
+	if err := os.Remove(c.path); err != nil {
+		slog.Warn("removing cgroup failed", "path", c.path, "error", err)
+	}
+}
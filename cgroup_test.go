@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the cgroup files are plain files in a temp directory here, so only the paths
+// and what is written to them are checked
+func TestChildCgroup(t *testing.T) {
+	cg, err := newChildCgroup(arguments{}, "/srv/www/a.cgi")
+	require.NoError(t, err)
+	assert.Nil(t, cg)
+
+	// the files are created with mode 0 (cgroupfs ignores it)
+	read := func(name string) string {
+		require.NoError(t, os.Chmod(name, 0o600))
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	parent := t.TempDir()
+	require.NoError(t, enableCgroupControllers(parent))
+	assert.Equal(t, "+cpu +io", read(filepath.Join(parent, "cgroup.subtree_control")))
+
+	t.Run("Per script", func(t *testing.T) {
+		args := arguments{CgroupParent: parent, CgroupMode: "script", CgroupCPUMax: "50000 100000", CgroupIOMax: []string{"8:0 rbps=1048576"}}
+		cg, err := newChildCgroup(args, "/srv/www/a b.cgi")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(parent, "srv%2Fwww%2Fa%20b.cgi"), cg.path)
+		assert.Equal(t, "50000 100000", read(filepath.Join(cg.path, "cpu.max")))
+		assert.Equal(t, "8:0 rbps=1048576", read(filepath.Join(cg.path, "io.max")))
+
+		// kept and reused
+		cg.close()
+		assert.DirExists(t, cg.path)
+		again, err := newChildCgroup(args, "/srv/www/a b.cgi")
+		require.NoError(t, err)
+		assert.Equal(t, cg.path, again.path)
+		again.close()
+	})
+
+	t.Run("Per request", func(t *testing.T) {
+		args := arguments{CgroupParent: parent}
+		first, err := newChildCgroup(args, "/srv/www/a.cgi")
+		require.NoError(t, err)
+		defer first.dir.Close()
+		second, err := newChildCgroup(args, "/srv/www/a.cgi")
+		require.NoError(t, err)
+		defer second.dir.Close()
+		assert.NotEqual(t, first.path, second.path)
+		assert.True(t, strings.HasPrefix(filepath.Base(first.path), "req-"+strconv.Itoa(os.Getpid())+"-"), first.path)
+		assert.DirExists(t, first.path)
+		assert.True(t, first.transient)
+	})
+
+	_, err = newChildCgroup(arguments{CgroupParent: parent, CgroupMode: "bogus"}, "/srv/www/a.cgi")
+	assert.ErrorContains(t, err, "invalid cgroup mode")
+}
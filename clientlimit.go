@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// rejectCounter counts requests rejected before being handled, by reason
+type rejectCounter struct {
+	counts sync.Map // reason -> *atomic.Uint64
+}
+
+// rejectedRequests is reported on the admin status endpoint
+var rejectedRequests rejectCounter
+
+func (c *rejectCounter) add(reason string) {
+	c.addN(reason, 1)
+}
+
+func (c *rejectCounter) addN(reason string, n uint64) {
+	v, _ := c.counts.LoadOrStore(reason, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(n)
+}
+
+func (c *rejectCounter) snapshot() map[string]uint64 {
+	ret := make(map[string]uint64)
+	c.counts.Range(func(k, v any) bool {
+		ret[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	return ret
+}
+
+// clientIP returns the address of the client. The FastCGI server builds
+// RemoteAddr from the REMOTE_ADDR and REMOTE_PORT params of the web server.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientLimiter caps the number of concurrent requests per client, so a single
+// client can't occupy all workers
+type clientLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active map[string]int
+}
+
+// newClientLimiter returns nil (no limit) if max <= 0
+func newClientLimiter(max int) *clientLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &clientLimiter{max: max, active: make(map[string]int)}
+}
+
+func (l *clientLimiter) acquire(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[client] >= l.max {
+		return false
+	}
+	l.active[client]++
+	return true
+}
+
+func (l *clientLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[client]--; l.active[client] <= 0 {
+		delete(l.active, client)
+	}
+}
+
+// limitClients rejects requests with 429 if the client already has the
+// maximum number of requests in flight (waiting for a worker counts as well)
+func limitClients(l *clientLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r)
+		if !l.acquire(client) {
+			slog.Warn("too many concurrent requests of client", "client", client, "max", l.max)
+			rejectedRequests.add("client_concurrency")
+			writeError(w, r.Context(), http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(client)
+		next.ServeHTTP(w, r)
+	})
+}
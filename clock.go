@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// virtualClockArg is a hidden flag (not known to go-arg) which replaces the
+// real clock by a virtual one, advanced via the admin API. Only meant for
+// integration tests.
+const virtualClockArg = "--x-virtual-clock"
+
+// clock abstracts time for the idle timer, the drain timeout and the request
+// timeouts, so timing dependent behavior can be tested without sleeping
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is the subset of time.Timer used by the wrapper
+type clockTimer interface {
+	// C is nil for timers created by AfterFunc
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// withTimeout is context.WithTimeout driven by c. Expiry is reported by
+// context.Cause as context.DeadlineExceeded.
+func withTimeout(c clock, ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := c.(realClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	t := c.AfterFunc(d, func() { cancel(context.DeadlineExceeded) })
+	return ctx, func() {
+		t.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// clk returns the clock to use (the real one unless replaced)
+func (args arguments) clk() clock {
+	if args.clock == nil {
+		return realClock{}
+	}
+	return args.clock
+}
+
+// realClock is the clock of the system
+type realClock struct{}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+// virtualClock only advances when told so. Timers fire synchronously during
+// advance.
+type virtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	clock  *virtualClock
+	when   time.Time
+	ch     chan time.Time
+	f      func()
+	active bool
+}
+
+func newVirtualClock(now time.Time) *virtualClock {
+	return &virtualClock{now: now}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) NewTimer(d time.Duration) clockTimer {
+	return c.add(d, make(chan time.Time, 1), nil)
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return c.add(d, nil, f)
+}
+
+func (c *virtualClock) add(d time.Duration, ch chan time.Time, f func()) *virtualTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &virtualTimer{clock: c, when: c.now.Add(d), ch: ch, f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// pending returns the number of active timers
+func (c *virtualClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+// advance moves the clock forward by d and fires all timers which are due (in
+// order)
+func (c *virtualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*virtualTimer
+	c.timers = slices.DeleteFunc(c.timers, func(t *virtualTimer) bool {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+		return !t.active
+	})
+	now := c.now
+	c.mu.Unlock()
+
+	slices.SortStableFunc(due, func(a, b *virtualTimer) int { return a.when.Compare(b.when) })
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+		} else {
+			select {
+			case t.ch <- now:
+			default:
+			}
+		}
+	}
+}
+
+func (t *virtualTimer) C() <-chan time.Time { return t.ch }
+
+func (t *virtualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := t.active
+	t.when = c.now.Add(d)
+	t.active = true
+	if !slices.Contains(c.timers, t) {
+		c.timers = append(c.timers, t)
+	}
+	return was
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newVirtualClock(start)
+
+	timer := c.NewTimer(time.Minute)
+	var fired []string
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	c.AfterFunc(time.Second, func() { fired = append(fired, "a") })
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	assert.True(t, stopped.Stop())
+	assert.Equal(t, 3, c.pending())
+
+	c.advance(5 * time.Second)
+	assert.Equal(t, []string{"a", "b"}, fired)
+	assert.Equal(t, start.Add(5*time.Second), c.Now())
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	// reset restarts from the current time
+	assert.True(t, timer.Reset(time.Minute))
+	c.advance(59 * time.Second)
+	assert.Len(t, timer.C(), 0)
+	c.advance(time.Second)
+	assert.Equal(t, start.Add(65*time.Second), <-timer.C())
+	assert.False(t, timer.Stop())
+
+	// stopped timers can be reused
+	assert.False(t, stopped.Reset(time.Second))
+	c.advance(time.Second)
+	assert.Equal(t, []string{"a", "b", "stopped"}, fired)
+	assert.Equal(t, 0, c.pending())
+}
+
+func TestWithTimeout(t *testing.T) {
+	c := newVirtualClock(time.Now())
+	ctx, cancel := withTimeout(c, context.Background(), time.Hour)
+	defer cancel()
+	assert.NoError(t, ctx.Err())
+	c.advance(time.Hour)
+	assert.ErrorIs(t, context.Cause(ctx), context.DeadlineExceeded)
+
+	ctx, cancel = withTimeout(realClock{}, context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	assert.ErrorIs(t, context.Cause(ctx), context.DeadlineExceeded)
+}
+
+func TestResponderVirtualClock(t *testing.T) {
+	tmpDir := t.TempDir()
+	slow := cgiScript(t, tmpDir, "slow.sh", "exec sleep 5\n")
+	c := newVirtualClock(time.Now())
+	addr := serveFCGI(t, cgiResponder(arguments{ExecTimeout: time.Hour, clock: c}, nil))
+
+	done := make(chan fcgiResponse)
+	go func() { done <- doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": slow}, "") }()
+	// advance only once the child runs, the request would fail differently otherwise
+	require.Eventually(t, func() bool { return runningChildren.Load() > 0 }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, c.pending())
+	c.advance(time.Hour)
+	assert.Equal(t, http.StatusGatewayTimeout, (<-done).status)
+}
+
+func TestAdminClock(t *testing.T) {
+	c := newVirtualClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := (&adminServer{clock: c}).handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clock?advance=90s", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2025-01-01T00:01:30Z", strings.TrimSpace(rec.Body.String()))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clock?advance=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// not available with the real clock
+	rec = httptest.NewRecorder()
+	(&adminServer{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clock?advance=1s", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// checkConfig runs the checks done at startup without serving (the `check`
+// subcommand): the files referenced by the configuration are loaded and the
+// directories have to exist
+func checkConfig(args arguments) error {
+	var errs []error
+	if _, err := newRedactor(args.RedactHeader, args.RedactEnv, args.RedactValue); err != nil {
+		errs = append(errs, fmt.Errorf("redaction: %w", err))
+	}
+	if args.ErrorPages != "" && args.ErrorPages != errorPagesText {
+		if _, err := newErrorPages(args.ErrorPages, args.ErrorTemplate); err != nil {
+			errs = append(errs, fmt.Errorf("error pages: %w", err))
+		}
+	}
+	if args.SeccompProfile != "" {
+		if _, err := loadSeccompProfile(args.SeccompProfile); err != nil {
+			errs = append(errs, fmt.Errorf("seccomp profile: %w", err))
+		}
+	}
+	if args.ExecPrefix != "" {
+		if _, err := parseExecPrefix(args.ExecPrefix); err != nil {
+			errs = append(errs, fmt.Errorf("exec prefix: %w", err))
+		}
+	}
+	if _, err := loadVhosts(args); err != nil {
+		errs = append(errs, fmt.Errorf("virtual hosts: %w", err))
+	}
+	for flag, dir := range map[string]string{"document-root": args.DocumentRoot, "http-root": args.HTTPRoot, "spool-dir": args.SpoolDir, "cgroup-parent": args.CgroupParent} {
+		if dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", flag, err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("%s: %s is not a directory", flag, dir))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeVersion prints the version and build information of the binary (the
+// `version` subcommand)
+func writeVersion(w io.Writer) error {
+	info, err := readBuildInfo()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "fcgiwrap_go %s\n", info.Main.Version)
+	fmt.Fprintf(w, "go: %s\n", info.GoVersion)
+	if rev := info.Settings["vcs.revision"]; rev != "" {
+		if info.Settings["vcs.modified"] == "true" {
+			rev += " (modified)"
+		}
+		fmt.Fprintf(w, "revision: %s\n", rev)
+	}
+	if t := info.Settings["vcs.time"]; t != "" {
+		fmt.Fprintf(w, "commit time: %s\n", t)
+	}
+	_, err = fmt.Fprintf(w, "platform: %s/%s\n", info.Settings["GOOS"], info.Settings["GOARCH"])
+	return err
+}
@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, checkConfig(arguments{DocumentRoot: dir}))
+
+	script := cgiScript(t, dir, "app.sh", "exit 0\n")
+	var vc vhostConfig
+	require.NoError(t, vc.UnmarshalText([]byte("example.org="+filepath.Join(dir, "missing.yaml"))))
+	err := checkConfig(arguments{DocumentRoot: script, SeccompProfile: filepath.Join(dir, "missing.json"), ExecPrefix: "does-not-exist-anywhere", Vhosts: []vhostConfig{vc}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "document-root: "+script+" is not a directory")
+	assert.Contains(t, err.Error(), "seccomp profile:")
+	assert.Contains(t, err.Error(), "exec prefix:")
+	assert.Contains(t, err.Error(), "virtual hosts:")
+}
+
+func TestWriteVersion(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeVersion(&buf))
+	assert.Regexp(t, `(?m)^fcgiwrap_go .*\ngo: go1\.`, buf.String())
+}
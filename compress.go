@@ -0,0 +1,308 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressTypes are the glob patterns of media types compressed by default
+var compressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+// dczHeader starts bodies compressed with a dictionary (dcz, RFC 9842), it is
+// followed by the SHA-256 of the dictionary
+var dczHeader = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+// maxZstdWindow is the largest window clients have to support for zstd
+// (RFC 9659)
+const maxZstdWindow = 8 << 20
+
+// negotiateEncoding returns the encoding to compress with according to the
+// Accept-Encoding of the request ("" if none), encodings in order of
+// preference at equal quality
+func negotiateEncoding(accept string, encodings []string) string {
+	best, bestQ := "", 0.0
+	quality := acceptedEncodings(accept)
+	for _, enc := range encodings {
+		q, ok := quality[enc]
+		if !ok {
+			q, ok = quality["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// acceptedEncodings parses Accept-Encoding into the quality of each encoding
+func acceptedEncodings(accept string) map[string]float64 {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				q = 0
+			}
+		}
+		quality[name] = q
+	}
+	return quality
+}
+
+// availableDictionary returns the SHA-256 of the dictionary the client has
+// (Available-Dictionary, a structured field byte sequence) if it accepts dcz
+// ("" otherwise)
+func availableDictionary(accept, available string) string {
+	if acceptedEncodings(accept)["dcz"] <= 0 {
+		return ""
+	}
+	b64, ok := strings.CutPrefix(strings.TrimSpace(available), ":")
+	if b64, ok = strings.CutSuffix(b64, ":"); !ok {
+		return ""
+	}
+	hash, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(hash) != sha256.Size {
+		return ""
+	}
+	return string(hash)
+}
+
+// compressibleType reports whether the media type of contentType matches one
+// of the glob patterns
+func compressibleType(contentType string, patterns []string) bool {
+	typ, _, _ := strings.Cut(contentType, ";")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if typ == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// responseEncoding returns the encoding the body in br (declared: its
+// Content-Length or -1) is compressed with according to opts and the headers
+// of the script ("" if it isn't) and the dictionary used for dcz
+func responseEncoding(opts responseOptions, h http.Header, br *bufio.Reader, declared int64) (string, *compressDict) {
+	if opts.compress == "" && opts.availableDict == "" || opts.head || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return "", nil
+	}
+	contentType := h.Get("Content-Type")
+	if !compressibleType(contentType, opts.compressTypes) {
+		return "", nil
+	}
+	if declared >= 0 && declared < opts.compressMin {
+		return "", nil
+	}
+	if declared < 0 {
+		// the body is at least as large if that much can be read
+		if _, err := br.Peek(int(min(opts.compressMin, int64(br.Size())))); err != nil {
+			return "", nil
+		}
+	}
+	if d := compressDictFor(contentType, opts.compressDicts); d != nil && d.hash == opts.availableDict {
+		return "dcz", d
+	}
+	return opts.compress, nil
+}
+
+// compressLevel is the compression level of the media types matching a glob
+// (--compress-level GLOB=LEVEL), e.g. application/json=1. With zstd the level
+// maps to the zstd level of the same number.
+type compressLevel struct {
+	Pattern string
+	Level   int
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (l *compressLevel) UnmarshalText(text []byte) error {
+	pattern, level, ok := strings.Cut(string(text), "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("expected GLOB=LEVEL, got %q", text)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < gzip.HuffmanOnly || n > gzip.BestCompression {
+		return fmt.Errorf("invalid compression level %q, expected %d to %d", level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	l.Pattern, l.Level = strings.ToLower(pattern), n
+	return nil
+}
+
+func (l compressLevel) MarshalText() ([]byte, error) {
+	return []byte(l.Pattern + "=" + strconv.Itoa(l.Level)), nil
+}
+
+// compressLevelFor returns the level of the first rule matching the media type
+// of contentType (gzip.DefaultCompression if none does)
+func compressLevelFor(contentType string, levels []compressLevel) int {
+	typ, _, _ := strings.Cut(contentType, ";")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	for _, l := range levels {
+		if ok, _ := path.Match(l.Pattern, typ); ok {
+			return l.Level
+		}
+	}
+	return gzip.DefaultCompression
+}
+
+// compressWindow is the zstd window of the media types matching a glob
+// (--compress-window GLOB=SIZE), e.g. application/json=256K. Smaller windows
+// need less memory to compress and decompress but find fewer matches. gzip
+// and deflate always use 32K.
+type compressWindow struct {
+	Pattern string
+	Size    byteSize
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (cw *compressWindow) UnmarshalText(text []byte) error {
+	pattern, size, ok := strings.Cut(string(text), "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("expected GLOB=SIZE, got %q", text)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	var n byteSize
+	if err := n.UnmarshalText([]byte(size)); err != nil {
+		return err
+	}
+	if n < zstd.MinWindowSize || n > maxZstdWindow || n&(n-1) != 0 {
+		return fmt.Errorf("invalid window %q, expected a power of two from 1K to 8M", size)
+	}
+	cw.Pattern, cw.Size = strings.ToLower(pattern), n
+	return nil
+}
+
+func (cw compressWindow) MarshalText() ([]byte, error) {
+	size, _ := cw.Size.MarshalText()
+	return []byte(cw.Pattern + "=" + string(size)), nil
+}
+
+// compressWindowFor returns the window of the first rule matching the media
+// type of contentType (0: the default of the level)
+func compressWindowFor(contentType string, windows []compressWindow) int {
+	typ, _, _ := strings.Cut(contentType, ";")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	for _, cw := range windows {
+		if ok, _ := path.Match(cw.Pattern, typ); ok {
+			return int(cw.Size)
+		}
+	}
+	return 0
+}
+
+// compressDict is a zstd dictionary for the media types matching a glob
+// (--compress-dict GLOB=PATH). It is used if the client announces to have it
+// via Available-Dictionary and accepts dcz (Compression Dictionary Transport,
+// RFC 9842), the scripts serve it with Use-As-Dictionary themselves. Any file
+// works (raw content dictionary), e.g. a previous version of the response.
+type compressDict struct {
+	Pattern string
+	Path    string
+
+	content []byte
+	// SHA-256 of content
+	hash string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg), it reads
+// the dictionary
+func (d *compressDict) UnmarshalText(text []byte) error {
+	pattern, file, ok := strings.Cut(string(text), "=")
+	if !ok || pattern == "" || file == "" {
+		return fmt.Errorf("expected GLOB=PATH, got %q", text)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(content) == 0 {
+		return fmt.Errorf("dictionary %s is empty", file)
+	}
+	hash := sha256.Sum256(content)
+	*d = compressDict{Pattern: strings.ToLower(pattern), Path: file, content: content, hash: string(hash[:])}
+	return nil
+}
+
+func (d compressDict) MarshalText() ([]byte, error) {
+	return []byte(d.Pattern + "=" + d.Path), nil
+}
+
+// compressDictFor returns the dictionary of the first rule matching the media
+// type of contentType (nil if none does)
+func compressDictFor(contentType string, dicts []compressDict) *compressDict {
+	typ, _, _ := strings.Cut(contentType, ";")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	for i, d := range dicts {
+		if ok, _ := path.Match(d.Pattern, typ); ok {
+			return &dicts[i]
+		}
+	}
+	return nil
+}
+
+// newCompressor returns a writer compressing to w with encoding (gzip, deflate,
+// zstd or dcz with dict) at level, zstd with the window (0: default)
+func newCompressor(w io.Writer, encoding string, level int, window int, dict *compressDict) (io.WriteCloser, error) {
+	switch encoding {
+	case "zstd", "dcz":
+		zl := zstd.SpeedDefault
+		if level > 0 {
+			zl = zstd.EncoderLevelFromZstd(level)
+		} else if level != gzip.DefaultCompression {
+			zl = zstd.SpeedFastest
+		}
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zl), zstd.WithEncoderConcurrency(1)}
+		if window > 0 {
+			opts = append(opts, zstd.WithWindowSize(window))
+		}
+		if encoding == "dcz" {
+			if _, err := w.Write(append(dczHeader[:len(dczHeader):len(dczHeader)], dict.hash...)); err != nil {
+				return nil, err
+			}
+			opts = append(opts, zstd.WithEncoderDictRaw(0, dict.content))
+		}
+		return zstd.NewWriter(w, opts...)
+	case "deflate":
+		// the HTTP "deflate" coding is the zlib format (RFC 9110 section 8.4.1.2)
+		return zlib.NewWriterLevel(w, level)
+	}
+	return gzip.NewWriterLevel(w, level)
+}
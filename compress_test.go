@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                           "",
+		"br":                         "",
+		"gzip":                       "gzip",
+		"deflate, gzip":              "gzip",
+		"gzip;q=0.5, deflate":        "deflate",
+		"gzip;q=0, deflate;q=0":      "",
+		"*":                          "gzip",
+		"*;q=0.1, gzip;q=0":          "deflate",
+		"GZIP;q=1.0, identity;q=0.5": "gzip",
+	} {
+		assert.Equal(t, want, negotiateEncoding(accept, []string{"gzip", "deflate"}), accept)
+	}
+	assert.Equal(t, "zstd", negotiateEncoding("gzip, deflate, br, zstd", []string{"zstd", "gzip", "deflate"}))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate, br, zstd", []string{"gzip", "deflate"}))
+
+	hash := sha256.Sum256([]byte("dict"))
+	available := ":" + base64.StdEncoding.EncodeToString(hash[:]) + ":"
+	assert.Equal(t, string(hash[:]), availableDictionary("gzip, dcz", available))
+	assert.Equal(t, "", availableDictionary("gzip", available))
+	assert.Equal(t, "", availableDictionary("*", available))
+	assert.Equal(t, "", availableDictionary("dcz", base64.StdEncoding.EncodeToString(hash[:])))
+	assert.Equal(t, "", availableDictionary("dcz", ":c2hvcnQ=:"))
+}
+
+func TestCompressibleType(t *testing.T) {
+	assert.True(t, compressibleType("text/html; charset=utf-8", compressTypes))
+	assert.True(t, compressibleType("application/ld+json", compressTypes))
+	assert.False(t, compressibleType("image/png", compressTypes))
+	assert.False(t, compressibleType("", compressTypes))
+}
+
+func TestCompressLevel(t *testing.T) {
+	var l compressLevel
+	require.NoError(t, l.UnmarshalText([]byte("application/JSON=1")))
+	assert.Equal(t, compressLevel{Pattern: "application/json", Level: 1}, l)
+	for _, invalid := range []string{"text/html", "=1", "text/*=10", "text/*=-3", "text/*=fast", "[=1"} {
+		assert.Error(t, l.UnmarshalText([]byte(invalid)), invalid)
+	}
+
+	levels := []compressLevel{{"application/json", 1}, {"text/*", 9}, {"*/*", 0}}
+	assert.Equal(t, 1, compressLevelFor("application/json; charset=utf-8", levels))
+	assert.Equal(t, 9, compressLevelFor("text/html", levels))
+	assert.Equal(t, 0, compressLevelFor("image/svg+xml", levels))
+	assert.Equal(t, gzip.DefaultCompression, compressLevelFor("text/html", nil))
+}
+
+func TestCompressWindowDict(t *testing.T) {
+	var cw compressWindow
+	require.NoError(t, cw.UnmarshalText([]byte("application/JSON=256K")))
+	assert.Equal(t, compressWindow{Pattern: "application/json", Size: 256 << 10}, cw)
+	for _, invalid := range []string{"text/html", "=1K", "text/*=512", "text/*=16M", "text/*=3K", "[=1K"} {
+		assert.Error(t, cw.UnmarshalText([]byte(invalid)), invalid)
+	}
+	windows := []compressWindow{{"application/json", 1 << 10}, {"text/*", 1 << 20}}
+	assert.Equal(t, 1<<10, compressWindowFor("application/json; charset=utf-8", windows))
+	assert.Equal(t, 0, compressWindowFor("image/svg+xml", windows))
+
+	file := filepath.Join(t.TempDir(), "json.dict")
+	require.NoError(t, os.WriteFile(file, []byte(`{"name": "value"}`), 0o644))
+	var d compressDict
+	require.NoError(t, d.UnmarshalText([]byte("application/*json="+file)))
+	hash := sha256.Sum256([]byte(`{"name": "value"}`))
+	assert.Equal(t, string(hash[:]), d.hash)
+	text, err := d.MarshalText()
+	require.NoError(t, err)
+	assert.Equal(t, "application/*json="+file, string(text))
+	assert.Equal(t, &d, compressDictFor("application/ld+json", []compressDict{d}))
+	assert.Nil(t, compressDictFor("text/html", []compressDict{d}))
+	for _, invalid := range []string{"text/html", "text/*=", "text/*=" + file + ".missing"} {
+		assert.Error(t, d.UnmarshalText([]byte(invalid)), invalid)
+	}
+}
+
+func TestResponderCompressZstd(t *testing.T) {
+	tmpDir := t.TempDir()
+	body := strings.Repeat(`{"name": "value", "id": 1}`, 100)
+	script := cgiScript(t, tmpDir, "json.sh", "printf 'Content-Type: application/json\\r\\n\\r\\n'\nprintf '"+body+"'\n")
+	dictFile := filepath.Join(tmpDir, "json.dict")
+	require.NoError(t, os.WriteFile(dictFile, []byte(strings.Repeat(`{"name": "value", "id": 1}`, 4)), 0o644))
+	var dict compressDict
+	require.NoError(t, dict.UnmarshalText([]byte("application/json="+dictFile)))
+
+	addr := serveFCGI(t, cgiResponder(arguments{
+		Compress: true, CompressZstd: true, CompressMinSize: 100,
+		CompressWindows: []compressWindow{{"application/json", 1 << 10}},
+		CompressDicts:   []compressDict{dict},
+	}, nil))
+	params := map[string]string{"SCRIPT_FILENAME": script, "HTTP_ACCEPT_ENCODING": "gzip, zstd"}
+
+	res := doFCGI(t, addr, params, "")
+	assert.Equal(t, "zstd", res.header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"Accept-Encoding", "Available-Dictionary"}, res.header.Values("Vary"))
+	zr, err := zstd.NewReader(nil)
+	require.NoError(t, err)
+	defer zr.Close()
+	plain, err := zr.DecodeAll([]byte(res.body), nil)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+	var header zstd.Header
+	require.NoError(t, header.Decode([]byte(res.body)))
+	assert.LessOrEqual(t, header.WindowSize, uint64(1<<10))
+
+	// the client has the dictionary
+	params["HTTP_ACCEPT_ENCODING"] = "gzip, zstd, dcz"
+	params["HTTP_AVAILABLE_DICTIONARY"] = ":" + base64.StdEncoding.EncodeToString([]byte(dict.hash)) + ":"
+	res = doFCGI(t, addr, params, "")
+	assert.Equal(t, "dcz", res.header.Get("Content-Encoding"))
+	require.Greater(t, len(res.body), 40)
+	assert.Equal(t, dczHeader, []byte(res.body[:8]))
+	assert.Equal(t, dict.hash, res.body[8:40])
+	dr, err := zstd.NewReader(nil, zstd.WithDecoderDictRaw(0, dict.content))
+	require.NoError(t, err)
+	defer dr.Close()
+	plain, err = dr.DecodeAll([]byte(res.body[40:]), nil)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+
+	// another dictionary
+	params["HTTP_AVAILABLE_DICTIONARY"] = ":" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":"
+	res = doFCGI(t, addr, params, "")
+	assert.Equal(t, "zstd", res.header.Get("Content-Encoding"))
+}
+
+func TestResponderCompress(t *testing.T) {
+	tmpDir := t.TempDir()
+	body := strings.Repeat("hello world ", 200)
+	text := cgiScript(t, tmpDir, "text.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nprintf '"+body+"'\n")
+	short := cgiScript(t, tmpDir, "short.sh", "printf 'Content-Type: text/plain\\r\\nContent-Length: 2\\r\\n\\r\\nhi'\n")
+	image := cgiScript(t, tmpDir, "image.sh", "printf 'Content-Type: image/png\\r\\n\\r\\n'\nprintf '"+body+"'\n")
+	encoded := cgiScript(t, tmpDir, "encoded.sh", "printf 'Content-Type: text/plain\\r\\nContent-Encoding: br\\r\\n\\r\\n'\nprintf '"+body+"'\n")
+
+	addr := serveFCGI(t, cgiResponder(arguments{Compress: true, CompressMinSize: 100}, nil))
+	params := func(script string, accept string) map[string]string {
+		return map[string]string{"SCRIPT_FILENAME": script, "HTTP_ACCEPT_ENCODING": accept}
+	}
+
+	res := doFCGI(t, addr, params(text, "gzip, deflate"), "")
+	assert.Equal(t, "gzip", res.header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.header.Get("Vary"))
+	zr, err := gzip.NewReader(strings.NewReader(res.body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+
+	res = doFCGI(t, addr, params(text, "deflate"), "")
+	assert.Equal(t, "deflate", res.header.Get("Content-Encoding"))
+	zr2, err := zlib.NewReader(strings.NewReader(res.body))
+	require.NoError(t, err)
+	plain, err = io.ReadAll(zr2)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+
+	// stored without compression
+	stored := serveFCGI(t, cgiResponder(arguments{Compress: true, CompressMinSize: 100, CompressLevels: []compressLevel{{"text/plain", 0}}}, nil))
+	res = doFCGI(t, stored, params(text, "gzip"), "")
+	assert.Equal(t, "gzip", res.header.Get("Content-Encoding"))
+	assert.Greater(t, len(res.body), len(body))
+
+	for _, tc := range []struct{ script, accept string }{{text, ""}, {short, "gzip"}, {image, "gzip"}, {encoded, "gzip"}} {
+		res = doFCGI(t, addr, params(tc.script, tc.accept), "")
+		assert.Equal(t, http.StatusOK, res.status)
+		assert.NotEqual(t, "gzip", res.header.Get("Content-Encoding"), tc.script)
+	}
+}
@@ -0,0 +1,446 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configCmd is the `config` subcommand
+type configCmd struct {
+	Schema *struct{} `arg:"subcommand:schema" help:"Print the JSON schema of the configuration file"`
+}
+
+// configField is a field of the arguments struct which can be set via the
+// configuration file. The key is the long name of the commandline flag.
+type configField struct {
+	key   string
+	help  string
+	enum  []string
+	index int
+}
+
+// jsonSchemaTyper can be implemented by flag types to override their JSON
+// schema type (defaults to string for encoding.TextUnmarshaler)
+type jsonSchemaTyper interface {
+	jsonSchemaType() any
+}
+
+var (
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+	jsonSchemaTyperType = reflect.TypeFor[jsonSchemaTyper]()
+)
+
+// configFields lists all fields of the arguments struct which can be set in
+// the configuration file (everything with a flag except --config itself and
+// the fields without one, `arg:"-"`, named like the field)
+func configFields() []configField {
+	t := reflect.TypeFor[arguments]()
+	var fields []configField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("arg")
+		if !f.IsExported() || !ok || strings.Contains(tag, "subcommand:") {
+			continue
+		}
+
+		key := strings.ToLower(f.Name)
+		for _, part := range strings.Split(tag, ",") {
+			if strings.HasPrefix(part, "--") {
+				key = part[2:]
+			}
+		}
+		if key == "config" {
+			continue
+		}
+
+		cf := configField{key: key, help: f.Tag.Get("help"), index: i}
+		if e := f.Tag.Get("enum"); e != "" {
+			cf.enum = strings.Split(e, ",")
+		}
+		fields = append(fields, cf)
+	}
+	return fields
+}
+
+// configLocations maps config keys to the position they were set at
+type configLocations map[string]string
+
+// loadConfigFile applies the YAML (or TOML if the name ends with .toml)
+// configuration file at path onto args. All errors are collected and reported
+// with file:line:column.
+func loadConfigFile(path string, args *arguments) (configLocations, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file failed: %w", err)
+	}
+
+	var doc yaml.Node
+	if strings.HasSuffix(path, ".toml") {
+		err = tomlConfigNode(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	locs := make(configLocations)
+	if len(doc.Content) == 0 {
+		// empty file
+		return locs, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d:%d: expected a mapping of settings", path, root.Line, root.Column)
+	}
+
+	fields := make(map[string]configField)
+	var keys []string
+	for _, f := range configFields() {
+		fields[f.key] = f
+		keys = append(keys, f.key)
+	}
+
+	v := reflect.ValueOf(args).Elem()
+	var errs []error
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, val := root.Content[i], root.Content[i+1]
+		loc := fmt.Sprintf("%s:%d:%d", path, k.Line, k.Column)
+
+		f, ok := fields[k.Value]
+		if !ok {
+			msg := fmt.Sprintf("%s: unknown key %q", loc, k.Value)
+			if s := suggest(k.Value, keys); s != "" {
+				msg += fmt.Sprintf(", did you mean %q?", s)
+			}
+			errs = append(errs, errors.New(msg))
+			continue
+		}
+		if _, dup := locs[f.key]; dup {
+			errs = append(errs, fmt.Errorf("%s: key %q already set at %s", loc, f.key, locs[f.key]))
+			continue
+		}
+		locs[f.key] = loc
+
+		if err := setConfigValue(v.Field(f.index), val); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d:%d: invalid value for %q: %w", path, val.Line, val.Column, f.key, err))
+		}
+	}
+	return locs, errors.Join(errs...)
+}
+
+// tomlConfigNode decodes the TOML configuration data into doc, so it is
+// applied like a YAML file. The TOML decoder doesn't report positions, they are
+// looked up for the top-level keys in data.
+func tomlConfigNode(data []byte, doc *yaml.Node) error {
+	var values map[string]any
+	md, err := toml.Decode(string(data), &values)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	order := make(map[string]int)
+	for i, key := range md.Keys() {
+		order[key.String()] = i
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Line: 1, Column: 1}
+	seen := make(map[string]bool)
+	for _, key := range md.Keys() {
+		// tables only defined implicitly (`[scripts."x"]`) aren't listed
+		// themselves, take the top-level keys from the first key below them
+		if seen[key[0]] {
+			continue
+		}
+		seen[key[0]] = true
+		key = key[:1]
+		k := &yaml.Node{Kind: yaml.ScalarNode, Value: key[0]}
+		k.Line, k.Column = tomlKeyPosition(lines, key[0])
+		v := &yaml.Node{}
+		if err := v.Encode(values[key[0]]); err != nil {
+			return fmt.Errorf("%d:%d: %s: %w", k.Line, k.Column, key[0], err)
+		}
+		orderTOMLTable(v, key, order)
+		v.Line, v.Column = k.Line, k.Column
+		root.Content = append(root.Content, k, v)
+	}
+	doc.Kind = yaml.DocumentNode
+	doc.Content = []*yaml.Node{root}
+	return nil
+}
+
+// orderTOMLTable sorts the keys of the tables in n (the value of key) in the
+// order of the file (order maps keys to their index), the YAML encoder sorts
+// them alphabetically
+func orderTOMLTable(n *yaml.Node, key toml.Key, order map[string]int) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	pairs := make([][2]*yaml.Node, 0, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		orderTOMLTable(n.Content[i+1], append(slices.Clip(key), n.Content[i].Value), order)
+		pairs = append(pairs, [2]*yaml.Node{n.Content[i], n.Content[i+1]})
+	}
+	index := func(k *yaml.Node) int {
+		return order[append(slices.Clip(key), k.Value).String()]
+	}
+	slices.SortStableFunc(pairs, func(a, b [2]*yaml.Node) int { return index(a[0]) - index(b[0]) })
+	n.Content = n.Content[:0]
+	for _, p := range pairs {
+		n.Content = append(n.Content, p[0], p[1])
+	}
+}
+
+// tomlKeyPosition returns the line and column of the top-level key (as
+// assignment or table header) in the lines of a TOML file, 0 if not found
+func tomlKeyPosition(lines []string, key string) (int, int) {
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		col := len(line) - len(trimmed) + 1
+		rest, ok := strings.CutPrefix(trimmed, key)
+		if !ok {
+			if rest, ok = strings.CutPrefix(trimmed, `"`+key+`"`); !ok {
+				if header, found := strings.CutPrefix(trimmed, "["); found && (strings.HasPrefix(strings.TrimSpace(header), key+"]") || strings.HasPrefix(strings.TrimSpace(header), key+".")) {
+					return i + 1, col
+				}
+				continue
+			}
+		}
+		if strings.HasPrefix(strings.TrimLeft(rest, " \t"), "=") {
+			return i + 1, col
+		}
+	}
+	return 0, 0
+}
+
+// dropOverridden removes the locations of all keys whose values from the file
+// (fileArgs) were overridden on the commandline (args)
+func (locs configLocations) dropOverridden(args arguments, fileArgs arguments) {
+	a, f := reflect.ValueOf(args), reflect.ValueOf(fileArgs)
+	for _, field := range configFields() {
+		if !reflect.DeepEqual(a.Field(field.index).Interface(), f.Field(field.index).Interface()) {
+			delete(locs, field.key)
+		}
+	}
+}
+
+// replaceLists sets the lists and maps given on the commandline or via the
+// environment (cli, parsed on top of the defaults) in args. Parsing the
+// commandline again on top of the configuration file appends them to the
+// values of the file instead, but they are meant to override them as well.
+func replaceLists(args *arguments, cli arguments) {
+	a, c, d := reflect.ValueOf(args).Elem(), reflect.ValueOf(cli), reflect.ValueOf(defaultArguments())
+	for _, f := range configFields() {
+		if k := c.Field(f.index).Kind(); k != reflect.Slice && k != reflect.Map {
+			continue
+		}
+		if !reflect.DeepEqual(c.Field(f.index).Interface(), d.Field(f.index).Interface()) {
+			a.Field(f.index).Set(c.Field(f.index))
+		}
+	}
+}
+
+// setConfigValue decodes node into v
+func setConfigValue(v reflect.Value, node *yaml.Node) error {
+	if u, ok := v.Addr().Interface().(yaml.Unmarshaler); ok {
+		return node.Decode(u)
+	}
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		if node.Kind != yaml.ScalarNode {
+			return fmt.Errorf("expected scalar")
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(node.Value))
+	}
+
+	if v.Kind() == reflect.Slice {
+		items := node.Content
+		if node.Kind == yaml.ScalarNode {
+			// allow a single value instead of a list
+			items = []*yaml.Node{node}
+		} else if node.Kind == yaml.MappingNode && v.Type() == reflect.TypeFor[envList]() {
+			items = nil
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				k, val := node.Content[i], node.Content[i+1]
+				if val.Kind != yaml.ScalarNode {
+					return fmt.Errorf("%s: expected scalar", k.Value)
+				}
+				items = append(items, &yaml.Node{Kind: yaml.ScalarNode, Value: k.Value + "=" + val.Value})
+			}
+		} else if node.Kind != yaml.SequenceNode {
+			return fmt.Errorf("expected list")
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setConfigValue(s.Index(i), item); err != nil {
+				return fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("expected %s", schemaType(v.Type()))
+	}
+	if err := node.Decode(v.Addr().Interface()); err != nil {
+		return fmt.Errorf("expected %s, got %q", schemaType(v.Type()), node.Value)
+	}
+	return nil
+}
+
+// secretKeys are the settings whose values might be secrets, they aren't
+// logged or reported
+var secretKeys = []string{"env", "scripts", "ajp-secret"}
+
+// configSummary returns the settings differing from the defaults (as text),
+// secretKeys only as "(redacted)"
+func configSummary(args arguments) map[string]string {
+	v, d := reflect.ValueOf(args), reflect.ValueOf(defaultArguments())
+	summary := make(map[string]string)
+	for _, f := range configFields() {
+		val := v.Field(f.index)
+		if reflect.DeepEqual(val.Interface(), d.Field(f.index).Interface()) {
+			continue
+		}
+		if slices.Contains(secretKeys, f.key) {
+			summary[f.key] = "(redacted)"
+		} else {
+			summary[f.key] = fmt.Sprint(val)
+		}
+	}
+	return summary
+}
+
+// validate checks constraints which can't be expressed by the types alone.
+// Enum values are accepted in any case and normalized to lower case, as they
+// are compared with. locs is used to point to the position in the configuration
+// file.
+func (args *arguments) validate(locs configLocations) error {
+	v := reflect.ValueOf(args).Elem()
+	var errs []error
+	for _, f := range configFields() {
+		if f.enum == nil {
+			continue
+		}
+		val := strings.ToLower(v.Field(f.index).String())
+		if val == "" || slices.Contains(f.enum, val) {
+			v.Field(f.index).SetString(val)
+			continue
+		}
+		where := "commandline"
+		if l, ok := locs[f.key]; ok {
+			where = l
+		}
+		errs = append(errs, fmt.Errorf("%s: invalid value %q for %q (one of %s)", where, val, f.key, strings.Join(f.enum, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// schemaType returns the JSON schema type for t
+func schemaType(t reflect.Type) string {
+	if t == reflect.TypeFor[time.Duration]() {
+		// given as e.g. "30s"
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "array"
+	default:
+		return "string"
+	}
+}
+
+// schemaFor returns the JSON schema of a single value of type t
+func schemaFor(t reflect.Type) map[string]any {
+	if t.Implements(jsonSchemaTyperType) {
+		return map[string]any{"type": reflect.Zero(t).Interface().(jsonSchemaTyper).jsonSchemaType()}
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return map[string]any{"type": "string"}
+	}
+	if t.Kind() == reflect.Slice {
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	}
+	return map[string]any{"type": schemaType(t)}
+}
+
+// configSchema generates the JSON schema of the configuration file
+func configSchema() map[string]any {
+	t := reflect.TypeFor[arguments]()
+	props := make(map[string]any)
+	for _, f := range configFields() {
+		s := schemaFor(t.Field(f.index).Type)
+		if f.help != "" {
+			s["description"] = f.help
+		}
+		if f.enum != nil {
+			s["enum"] = f.enum
+		}
+		props[f.key] = s
+	}
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "fcgiwrap-go configuration",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           props,
+	}
+}
+
+// writeConfigSchema prints the JSON schema of the configuration file
+func writeConfigSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(configSchema())
+}
+
+// suggest returns the candidate closest to s (if reasonably close)
+func suggest(s string, candidates []string) string {
+	best, bestDist := "", 4
+	for _, c := range candidates {
+		if d := levenshtein(s, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fcgiwrap.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	t.Run("Valid file", func(t *testing.T) {
+		path := writeConfig(t, "workers: 4\nlimit-mem: 512M\nsandbox: true\nsandbox-bind: [/srv, /opt]\ncgroup-io-max: '8:0 rbps=1'\n")
+		args := defaultArguments()
+		locs, err := loadConfigFile(path, &args)
+		require.NoError(t, err)
+		assert.Equal(t, 4, args.Workers)
+		assert.Equal(t, byteSize(512<<20), args.LimitMem)
+		assert.True(t, args.Sandbox)
+		assert.Equal(t, []string{"/srv", "/opt"}, args.SandboxBind)
+		assert.Equal(t, []string{"8:0 rbps=1"}, args.CgroupIOMax)
+		assert.Equal(t, "json", args.LogFormat, "defaults are kept")
+		assert.Equal(t, path+":1:1", locs["workers"])
+	})
+
+	t.Run("Environment as list or mapping", func(t *testing.T) {
+		path := writeConfig(t, "env: [A=1, B=2]\n")
+		args := defaultArguments()
+		_, err := loadConfigFile(path, &args)
+		require.NoError(t, err)
+		assert.Equal(t, envList{{"A", "1"}, {"B", "2"}}, args.Env)
+
+		path = writeConfig(t, "env:\n  PATH: /opt/bin:/usr/bin\n  EMPTY: ''\n")
+		args = defaultArguments()
+		_, err = loadConfigFile(path, &args)
+		require.NoError(t, err)
+		assert.Equal(t, envList{{"PATH", "/opt/bin:/usr/bin"}, {"EMPTY", ""}}, args.Env)
+
+		path = writeConfig(t, "env:\n  PATH: [a]\n")
+		_, err = loadConfigFile(path, &args)
+		assert.ErrorContains(t, err, `invalid value for "env": PATH: expected scalar`)
+	})
+
+	t.Run("Errors with locations", func(t *testing.T) {
+		path := writeConfig(t, "wokers: 4\nlimit-mem: 12X\nsocket: [a]\nworkers: many\n")
+		args := defaultArguments()
+		_, err := loadConfigFile(path, &args)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), path+`:1:1: unknown key "wokers", did you mean "workers"?`)
+		assert.Contains(t, err.Error(), path+`:2:12: invalid value for "limit-mem"`)
+		assert.Contains(t, err.Error(), path+`:3:9: invalid value for "socket": expected string`)
+		assert.Contains(t, err.Error(), path+`:4:10: invalid value for "workers": expected integer`)
+	})
+
+	t.Run("No suggestion for unrelated keys", func(t *testing.T) {
+		path := writeConfig(t, "completely-unrelated: 1\n")
+		args := defaultArguments()
+		_, err := loadConfigFile(path, &args)
+		assert.EqualError(t, err, path+`:1:1: unknown key "completely-unrelated"`)
+	})
+
+	t.Run("Duplicate key", func(t *testing.T) {
+		path := writeConfig(t, "workers: 1\nworkers: 2\n")
+		args := defaultArguments()
+		_, err := loadConfigFile(path, &args)
+		assert.ErrorContains(t, err, "already set at "+path+":1:1")
+	})
+
+	t.Run("TOML", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "fcgiwrap.toml")
+		require.NoError(t, os.WriteFile(path, []byte("workers = 4\nlimit-mem = \"512M\"\nsandbox-bind = [\"/srv\"]\n\n[env]\nPATH = \"/usr/bin\"\n"), 0o644))
+		args := defaultArguments()
+		locs, err := loadConfigFile(path, &args)
+		require.NoError(t, err)
+		assert.Equal(t, 4, args.Workers)
+		assert.Equal(t, byteSize(512<<20), args.LimitMem)
+		assert.Equal(t, []string{"/srv"}, args.SandboxBind)
+		assert.Equal(t, envList{{"PATH", "/usr/bin"}}, args.Env)
+		assert.Equal(t, path+":5:1", locs["env"])
+
+		require.NoError(t, os.WriteFile(path, []byte("\nworkers = \"many\"\nwokers = 1\n"), 0o644))
+		_, err = loadConfigFile(path, &args)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), path+`:2:1: invalid value for "workers": expected integer`)
+		assert.Contains(t, err.Error(), path+`:3:1: unknown key "wokers", did you mean "workers"?`)
+
+		require.NoError(t, os.WriteFile(path, []byte("workers = \n"), 0o644))
+		_, err = loadConfigFile(path, &args)
+		assert.ErrorContains(t, err, path+": toml:")
+	})
+
+	t.Run("Not a mapping", func(t *testing.T) {
+		path := writeConfig(t, "- workers\n")
+		args := defaultArguments()
+		_, err := loadConfigFile(path, &args)
+		assert.ErrorContains(t, err, "expected a mapping")
+	})
+}
+
+func TestEnvironmentConfig(t *testing.T) {
+	path := writeConfig(t, "workers: 4\nlog-level: warn\nsocket: unix:/file.sock\n")
+	t.Setenv("FCGIWRAP_CONFIG", path)
+	t.Setenv("FCGIWRAP_WORKERS", "8")
+	t.Setenv("FCGIWRAP_SOCKET", "unix:/env.sock")
+	t.Setenv("FCGIWRAP_PASS_ENV", "PATH,LANG")
+	defer func(orig []string) { os.Args = orig }(os.Args)
+	os.Args = []string{"fcgiwrap_go", "--socket", "tcp:127.0.0.1:9000"}
+
+	// commandline > environment > file > defaults
+	args := parseArgs()
+	assert.Equal(t, "tcp:127.0.0.1:9000", args.Socket)
+	assert.Equal(t, 8, args.Workers)
+	assert.Equal(t, "warn", args.LogLevel)
+	assert.Equal(t, []string{"PATH", "LANG"}, args.PassEnv)
+
+	assert.False(t, allowed_env_inherit("FCGIWRAP_WORKERS=8"), "configuration isn't inherited by scripts")
+}
+
+func TestValidateArguments(t *testing.T) {
+	args := defaultArguments()
+	assert.NoError(t, args.validate(nil))
+
+	args.LogLevel = "verbose"
+	args.CgroupMode = "script"
+	assert.EqualError(t, args.validate(nil), `commandline: invalid value "verbose" for "log-level" (one of debug, info, warn, error)`)
+	assert.ErrorContains(t, args.validate(configLocations{"log-level": "c.yaml:3:1"}), "c.yaml:3:1: invalid value")
+
+	// uppercase is fine, but normalized for the comparisons later on
+	args.LogLevel = "DEBUG"
+	args.HeadMode = "GET"
+	args.CgroupMode = "Script"
+	assert.NoError(t, args.validate(nil))
+	assert.Equal(t, "debug", args.LogLevel)
+	assert.Equal(t, "get", args.HeadMode)
+	assert.Equal(t, "script", args.CgroupMode)
+}
+
+func TestConfigSchema(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeConfigSchema(&buf))
+
+	var schema struct {
+		Properties map[string]struct {
+			Type  any      `json:"type"`
+			Enum  []string `json:"enum"`
+			Items *struct {
+				Type string `json:"type"`
+			} `json:"items"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &schema))
+
+	assert.NotContains(t, schema.Properties, "config")
+	assert.Equal(t, "integer", schema.Properties["workers"].Type)
+	assert.Equal(t, "boolean", schema.Properties["sandbox"].Type)
+	assert.Equal(t, []any{"integer", "string"}, schema.Properties["limit-mem"].Type)
+	assert.Equal(t, "string", schema.Properties["ionice"].Type)
+	assert.Equal(t, "string", schema.Properties["sandbox-bind"].Items.Type)
+	assert.Equal(t, []string{"request", "script"}, schema.Properties["cgroup-mode"].Enum)
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// dirConfigName is the name of per-directory configuration files
+const dirConfigName = ".fcgiwrap.toml"
+
+// dirConfig is a per-directory configuration file (--dir-config). It applies
+// to the scripts in its directory and below, the nearest one wins.
+type dirConfig struct {
+	// command the scripts are run with, e.g. "/usr/bin/python3" (FCGI_INTERPRETER)
+	Interpreter string `toml:"interpreter"`
+	// execution timeout, e.g. "30s" (FCGI_TIMEOUT)
+	Timeout string `toml:"timeout"`
+	// environment variables for the scripts
+	Env   map[string]string `toml:"env"`
+	Allow []pathPattern     `toml:"allow"`
+	Deny  []pathPattern     `toml:"deny"`
+
+	// the file it was loaded from
+	path string
+}
+
+// findDirConfig loads the configuration file nearest to the script of env,
+// searching from its directory up to the DOCUMENT_ROOT (only the directory of
+// the script without one). Returns nil if there is none.
+func findDirConfig(env map[string]string, args arguments) (*dirConfig, error) {
+	script, root := env["SCRIPT_FILENAME"], env["DOCUMENT_ROOT"]
+	if script == "" && root != "" {
+		script = filepath.Join(root, env["SCRIPT_NAME"])
+	}
+	if !filepath.IsAbs(script) {
+		return nil, nil
+	}
+	dir := filepath.Dir(filepath.Clean(script))
+	root = filepath.Clean(root)
+	for {
+		cfg, err := loadDirConfig(filepath.Join(dir, dirConfigName), args)
+		if cfg != nil || err != nil {
+			return cfg, err
+		}
+		if env["DOCUMENT_ROOT"] == "" || dir == root {
+			return nil, nil
+		}
+		if !withinDir(root, dir) {
+			return nil, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// loadDirConfig loads the configuration file at path, nil if it doesn't exist.
+// With --suexec the file (and its directory with --suexec-dir) has to pass the
+// same checks as the scripts, it configures them after all.
+func loadDirConfig(path string, args arguments) (*dirConfig, error) {
+	if args.Suexec {
+		err := checkOwnership(path, args.SuexecDir, args.ScriptOwner, args.fs)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := guarded(args.fs, func() ([]byte, error) { return os.ReadFile(path) })
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg := &dirConfig{path: path}
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %q", path, undecoded[0].String())
+	}
+	if cfg.Timeout != "" {
+		if _, err := strconv.Atoi(cfg.Timeout); err != nil {
+			if _, err := time.ParseDuration(cfg.Timeout); err != nil {
+				return nil, fmt.Errorf("%s: invalid timeout %q", path, cfg.Timeout)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// apply adds the settings to the CGI variables env. Variables already set (by
+// the web server or the scripts section, applied first) take precedence,
+// variables describing the request can't be overridden.
+func (cfg *dirConfig) apply(env map[string]string) {
+	for param, v := range map[string]string{"FCGI_INTERPRETER": cfg.Interpreter, "FCGI_TIMEOUT": cfg.Timeout} {
+		if _, ok := env[param]; !ok && v != "" {
+			env[param] = v
+		}
+	}
+	for k, v := range cfg.Env {
+		if _, ok := env[k]; !ok && allowed_env_inherit(k+"=") && !strings.HasPrefix(k, "FCGI_") {
+			env[k] = v
+		}
+	}
+}
+
+// check applies the access rules to script
+func (cfg *dirConfig) check(script string) error {
+	if cfg == nil {
+		return nil
+	}
+	if err := checkPathRules(script, cfg.Allow, cfg.Deny); err != nil {
+		return fmt.Errorf("%s: %w", cfg.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindDirConfig(t *testing.T) {
+	root := t.TempDir()
+	deeper := filepath.Join(root, "sub", "deeper")
+	require.NoError(t, os.MkdirAll(deeper, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sub", dirConfigName), []byte(`
+timeout = "30s"
+deny = ["**/secret*"]
+
+[env]
+GREETING = "hi"
+REQUEST_METHOD = "DELETE"
+`), 0o644))
+
+	env := map[string]string{"DOCUMENT_ROOT": root, "SCRIPT_FILENAME": filepath.Join(deeper, "x.sh")}
+	cfg, err := findDirConfig(env, arguments{})
+	require.NoError(t, err)
+	require.NotNil(t, cfg)
+	env["REQUEST_METHOD"] = "GET"
+	admin := map[string]string{"GREETING": "hello"}
+	maps.Copy(admin, env)
+	cfg.apply(env)
+	assert.Equal(t, "30s", env["FCGI_TIMEOUT"])
+	assert.Equal(t, "hi", env["GREETING"])
+	// e.g. set by the scripts section
+	cfg.apply(admin)
+	assert.Equal(t, "hello", admin["GREETING"])
+	assert.Equal(t, "GET", env["REQUEST_METHOD"], "request variables can't be overridden")
+	assert.NoError(t, cfg.check(filepath.Join(deeper, "x.sh")))
+	assert.ErrorContains(t, cfg.check(filepath.Join(deeper, "secret.sh")), "denied")
+
+	// not above the document root
+	cfg, err = findDirConfig(map[string]string{"DOCUMENT_ROOT": filepath.Join(root, "other"), "SCRIPT_FILENAME": filepath.Join(root, "other", "x.sh")}, arguments{})
+	require.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	require.NoError(t, os.WriteFile(filepath.Join(deeper, dirConfigName), []byte("timout = \"1s\"\n"), 0o644))
+	_, err = findDirConfig(env, arguments{})
+	assert.ErrorContains(t, err, `unknown key "timout"`)
+	require.NoError(t, os.Remove(filepath.Join(deeper, dirConfigName)))
+
+	t.Run("Suexec", func(t *testing.T) {
+		sub := filepath.Join(root, "sub")
+		file := filepath.Join(sub, dirConfigName)
+		require.NoError(t, os.Chmod(sub, 0o755))
+		require.NoError(t, os.Chmod(file, 0o664))
+		_, err := findDirConfig(env, arguments{Suexec: true})
+		assert.ErrorContains(t, err, dirConfigName+" is writable by group or others")
+
+		require.NoError(t, os.Chmod(file, 0o644))
+		cfg, err := findDirConfig(env, arguments{Suexec: true})
+		require.NoError(t, err)
+		assert.NotNil(t, cfg)
+
+		var owner scriptOwner
+		require.NoError(t, owner.UnmarshalText([]byte(strconv.Itoa(os.Getuid()+1))))
+		_, err = findDirConfig(env, arguments{Suexec: true, ScriptOwner: owner})
+		assert.ErrorContains(t, err, "owned by")
+
+		require.NoError(t, os.Chmod(sub, 0o777))
+		_, err = findDirConfig(env, arguments{Suexec: true})
+		assert.NoError(t, err)
+		_, err = findDirConfig(env, arguments{Suexec: true, SuexecDir: true})
+		assert.ErrorContains(t, err, "sub is writable by group or others")
+	})
+}
+
+func TestResponderDirConfigInterpreter(t *testing.T) {
+	root := t.TempDir()
+	script := filepath.Join(root, "hello")
+	// no shebang, only runs via the interpreter
+	require.NoError(t, os.WriteFile(script, []byte("printf 'Content-Type: text/plain\\r\\n\\r\\n%s' \"$GREETING\"\n"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, dirConfigName), []byte("interpreter = \"/bin/sh\"\nenv = { GREETING = \"hi\" }\n"), 0o644))
+
+	w := httptest.NewRecorder()
+	serveCGI(w, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"DOCUMENT_ROOT": root, "SCRIPT_FILENAME": script}, arguments{DirConfig: true}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hi", w.Body.String())
+}
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Content-Disposition policies
+const (
+	// pass the header of the script on unchanged
+	dispositionKeep = "keep"
+	// pass the header of the script on with a safe filename, drop invalid ones
+	dispositionSanitize = "sanitize"
+	// always display inline
+	dispositionInline = "inline"
+	// always download, with a safe filename derived from PATH_INFO
+	dispositionAttachment = "attachment"
+)
+
+var dispositionPolicies = []string{dispositionKeep, dispositionSanitize, dispositionInline, dispositionAttachment}
+
+// dispositionRule applies a Content-Disposition policy to scripts matching a
+// glob, given as GLOB=POLICY
+type dispositionRule struct {
+	Pattern string
+	Policy  string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (d *dispositionRule) UnmarshalText(text []byte) error {
+	pattern, policy, ok := strings.Cut(string(text), "=")
+	if !ok || pattern == "" {
+		return fmt.Errorf("expected GLOB=POLICY, got %q", text)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if !slices.Contains(dispositionPolicies, policy) {
+		return fmt.Errorf("invalid policy %q (one of %s)", policy, strings.Join(dispositionPolicies, ", "))
+	}
+	d.Pattern, d.Policy = pattern, policy
+	return nil
+}
+
+func (d dispositionRule) MarshalText() ([]byte, error) {
+	return []byte(d.Pattern + "=" + d.Policy), nil
+}
+
+// dispositionPolicy returns the policy for script ("" if there is none). The
+// FCGI_CONTENT_DISPOSITION param overrides the --content-disposition rules.
+func dispositionPolicy(args arguments, script string, env map[string]string) string {
+	if v, ok := env["FCGI_CONTENT_DISPOSITION"]; ok {
+		if slices.Contains(dispositionPolicies, v) {
+			return v
+		}
+		slog.Warn("ignoring invalid FCGI_CONTENT_DISPOSITION", "value", v)
+	}
+	for _, rule := range args.ContentDisposition {
+		if ok, _ := filepath.Match(rule.Pattern, script); ok {
+			return rule.Policy
+		}
+	}
+	return ""
+}
+
+// executableExtensions are extensions of files which are executed when opened
+// on common systems (reflected file download)
+var executableExtensions = []string{
+	".bat", ".cmd", ".com", ".cpl", ".exe", ".hta", ".js", ".jse", ".lnk", ".msi",
+	".ps1", ".scr", ".sh", ".vbe", ".vbs", ".wsf",
+}
+
+// safeFilename reduces name to a filename which can't escape the download
+// directory and isn't executed when opened
+func safeFilename(name string) string {
+	name = filepath.Base(name)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if slices.Contains(executableExtensions, strings.ToLower(filepath.Ext(name))) {
+		name = strings.ReplaceAll(name, ".", "_")
+	}
+	if name == "" {
+		return "download"
+	}
+	return name
+}
+
+// applyDisposition sets the Content-Disposition header of the response of
+// script according to policy
+func applyDisposition(h http.Header, policy string, script string, env map[string]string) {
+	switch policy {
+	case dispositionInline:
+		h.Set("Content-Disposition", "inline")
+	case dispositionAttachment:
+		name := env["PATH_INFO"]
+		if name == "" || strings.HasSuffix(name, "/") {
+			name = script
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": safeFilename(name)}))
+	case dispositionSanitize:
+		cd := h.Get("Content-Disposition")
+		if cd == "" {
+			return
+		}
+		typ, params, err := mime.ParseMediaType(cd)
+		if err != nil || (typ != "inline" && typ != "attachment") {
+			slog.Warn("dropping invalid Content-Disposition of CGI", "script", script, "value", cd)
+			h.Del("Content-Disposition")
+			return
+		}
+		safe := make(map[string]string)
+		if name, ok := params["filename"]; ok {
+			safe["filename"] = safeFilename(name)
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(typ, safe))
+	}
+}
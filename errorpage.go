@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// formats of the error pages
+const (
+	errorPagesText = "text"
+	errorPagesHTML = "html"
+	errorPagesJSON = "json"
+)
+
+// defaultErrorTemplate is the HTML error page if no template is configured
+const defaultErrorTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>{{end}}
+</body>
+</html>
+`
+
+// errorPages renders the responses to errors of the wrapper itself. They only
+// contain the status and the request ID, the details are logged.
+type errorPages struct {
+	format string
+	html   *template.Template
+}
+
+// wrapperErrors are the configured error pages (nil: plain text)
+var wrapperErrors *errorPages
+
+// newErrorPages returns the error pages in format, templatePath replaces the
+// default HTML template
+func newErrorPages(format string, templatePath string) (*errorPages, error) {
+	p := &errorPages{format: format}
+	var err error
+	if templatePath != "" {
+		p.html, err = template.ParseFiles(templatePath)
+	} else {
+		p.html, err = template.New("error").Parse(defaultErrorTemplate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// errorPage is the data of an error page (the template data and the JSON
+// variant)
+type errorPage struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// writeError answers with an error of the wrapper, replaces http.Error
+func writeError(w http.ResponseWriter, ctx context.Context, status int) {
+	wrapperErrors.write(w, ctx, status)
+}
+
+func (p *errorPages) write(w http.ResponseWriter, ctx context.Context, status int) {
+	page := errorPage{Status: status, StatusText: http.StatusText(status), RequestID: requestIDFrom(ctx)}
+	format := errorPagesText
+	if p != nil {
+		format = p.format
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+	var err error
+	switch format {
+	case errorPagesHTML:
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		err = p.html.Execute(w, page)
+	case errorPagesJSON:
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err = json.NewEncoder(w).Encode(page)
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, err = fmt.Fprintln(w, page.StatusText)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "writing error page failed", "error", err)
+	}
+}
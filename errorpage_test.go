@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorPages(t *testing.T) {
+	ctx := withRequestID(context.Background(), "abc123")
+
+	w := httptest.NewRecorder()
+	var text *errorPages
+	text.write(w, ctx, http.StatusBadGateway)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Bad Gateway\n", w.Body.String())
+
+	html, err := newErrorPages(errorPagesHTML, "")
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	html.write(w, ctx, http.StatusGatewayTimeout)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<h1>504 Gateway Timeout</h1>")
+	assert.Contains(t, w.Body.String(), "abc123")
+
+	tmpl := filepath.Join(t.TempDir(), "error.html")
+	require.NoError(t, os.WriteFile(tmpl, []byte("<p>{{.Status}} {{.RequestID}}</p>"), 0o644))
+	html, err = newErrorPages(errorPagesHTML, tmpl)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	html.write(w, ctx, http.StatusForbidden)
+	assert.Equal(t, "<p>403 abc123</p>", w.Body.String())
+
+	_, err = newErrorPages(errorPagesHTML, filepath.Join(t.TempDir(), "missing.html"))
+	assert.Error(t, err)
+
+	json, err := newErrorPages(errorPagesJSON, "")
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Length", "10")
+	json.write(w, ctx, http.StatusForbidden)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Content-Length"))
+	assert.JSONEq(t, `{"status": 403, "error": "Forbidden", "request_id": "abc123"}`, w.Body.String())
+}
@@ -5,32 +5,112 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/semaphore"
 )
 
-// fcgiHandler wraps handler to enforce limits and track active handlers
-func fcgiHandler(activeJobs *atomic.Int32, wg *sync.WaitGroup, sem *semaphore.Weighted, refreshTimer func(), next http.Handler) http.Handler {
+type queueWaitKey struct{}
+
+// queueWaitFrom returns how long the request waited for a worker slot
+func queueWaitFrom(ctx context.Context) (time.Duration, bool) {
+	wait, ok := ctx.Value(queueWaitKey{}).(time.Duration)
+	return wait, ok
+}
+
+var (
+	errQueueFull    = errors.New("queue for worker slots is full")
+	errQueueTimeout = errors.New("waiting for a worker slot timed out")
+)
+
+// workerQueue limits the requests handled at once to the number of workers.
+// At most max further requests wait for a slot (0: unlimited), each at most
+// timeout (0: as long as the client does).
+type workerQueue struct {
+	sem     *semaphore.Weighted
+	max     int64
+	timeout time.Duration
+	waiting atomic.Int64
+}
+
+func newWorkerQueue(workers int, max int, timeout time.Duration) *workerQueue {
+	return &workerQueue{sem: semaphore.NewWeighted(int64(workers)), max: int64(max), timeout: timeout}
+}
+
+// acquire waits for a worker slot, errQueueFull or errQueueTimeout if the
+// request has to be rejected
+func (q *workerQueue) acquire(ctx context.Context) error {
+	if q.sem.TryAcquire(1) {
+		return nil
+	}
+	if waiting := q.waiting.Add(1); q.max > 0 && waiting > q.max {
+		q.waiting.Add(-1)
+		return errQueueFull
+	}
+	defer q.waiting.Add(-1)
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, q.timeout, errQueueTimeout)
+		defer cancel()
+	}
+	if err := q.sem.Acquire(ctx, 1); err != nil {
+		if errors.Is(context.Cause(ctx), errQueueTimeout) {
+			return errQueueTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+func (q *workerQueue) release() {
+	q.sem.Release(1)
+}
+
+// retryAfter is the Retry-After sent with rejections, the queue timeout
+func (q *workerQueue) retryAfter() string {
+	return retryAfterSeconds(q.timeout)
+}
+
+// fcgiHandler wraps handler to enforce limits and track active handlers.
+// Requests the queue rejects are answered with 503.
+func fcgiHandler(activeJobs *atomic.Int32, wg *sync.WaitGroup, queue *workerQueue, refreshTimer func(), metrics Metrics, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// track active
 		wg.Add(1)
 		defer wg.Done()
-		activeJobs.Add(1)
-		defer activeJobs.Add(-1)
+		metrics.Set(metricActiveJobs, float64(activeJobs.Add(1)), nil)
+		defer func() { metrics.Set(metricActiveJobs, float64(activeJobs.Add(-1)), nil) }()
 
-		slog.Debug("waiting for worker slot")
-		if sem != nil {
-			if err := sem.Acquire(r.Context(), 1); err != nil {
+		if queue != nil {
+			queued := time.Now()
+			_, s := startSpan(r.Context(), "queue wait")
+			err := queue.acquire(r.Context())
+			s.finish()
+			if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+				reason := "queue_full"
+				if errors.Is(err, errQueueTimeout) {
+					reason = "queue_timeout"
+				}
+				slog.WarnContext(r.Context(), "rejecting request, no worker slot", "reason", err)
+				rejectedRequests.add(reason)
+				w.Header().Set("Retry-After", queue.retryAfter())
+				writeError(w, r.Context(), http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
 				slog.Error("Failed waiting for worker slot", "err", err)
 				return
 			}
-			defer func() {
-				sem.Release(1)
-			}()
+			defer queue.release()
+			wait := time.Since(queued)
+			metrics.Observe(metricQueueWait, wait.Seconds(), nil)
+			r = r.WithContext(context.WithValue(r.Context(), queueWaitKey{}, wait))
 		}
 
 		// refresh the timer AFTER accepting a new job
@@ -5,24 +5,29 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/sync/semaphore"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFCGIHandlerConcurrencyLimit(t *testing.T) {
 	var active atomic.Int32
 	var current, max int32
-	sem := semaphore.NewWeighted(2)
+	queue := newWorkerQueue(2, 0, 0)
 	wg := &sync.WaitGroup{}
 
-	handler := fcgiHandler(&active, wg, sem, func() {}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := fcgiHandler(&active, wg, queue, func() {}, noopMetrics{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cur := atomic.AddInt32(&current, 1)
 		defer atomic.AddInt32(&current, -1)
 
@@ -52,3 +57,165 @@ func TestFCGIHandlerConcurrencyLimit(t *testing.T) {
 	testWg.Wait()
 	assert.LessOrEqual(t, max, int32(2), "Exceeded worker limit")
 }
+
+func TestFCGIHandlerQueue(t *testing.T) {
+	var active atomic.Int32
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	queue := newWorkerQueue(1, 1, 100*time.Millisecond)
+	handler := fcgiHandler(&active, &sync.WaitGroup{}, queue, func() {}, noopMetrics{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-block
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+
+	// the queued request times out
+	before := rejectedRequests.snapshot()
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		queued <- w
+	}()
+
+	// the queue is full meanwhile
+	require.Eventually(t, func() bool { return queue.waiting.Load() == 1 }, time.Second, time.Millisecond)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, before["queue_full"]+1, rejectedRequests.snapshot()["queue_full"])
+
+	w = <-queued
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, before["queue_timeout"]+1, rejectedRequests.snapshot()["queue_timeout"])
+
+	close(block)
+	<-done
+}
+
+func TestLimitClients(t *testing.T) {
+	assert.Nil(t, newClientLimiter(0))
+
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := limitClients(newClientLimiter(1), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-block
+	}))
+
+	req := func(addr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req("192.0.2.1:1234"))
+		close(done)
+	}()
+	<-started
+
+	before := rejectedRequests.snapshot()["client_concurrency"]
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req("192.0.2.1:5678"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, before+1, rejectedRequests.snapshot()["client_concurrency"])
+
+	// other clients are not affected
+	other := httptest.NewRecorder()
+	go handler.ServeHTTP(other, req("192.0.2.2:1234"))
+	<-started
+	close(block)
+	<-done
+
+	// the slot is free again
+	go func() { <-started }()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestSpoolBodies(t *testing.T) {
+	dir := t.TempDir()
+	var got string
+	handler := spoolBodies(newSpooler(4, dir, 0, 0), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got = string(data)
+		// spooled bodies don't leave files behind
+		entries, _ := os.ReadDir(dir)
+		assert.Empty(t, entries)
+	}))
+
+	for _, body := range []string{"abc", "larger than the threshold"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, body, got)
+	}
+
+	for _, declared := range []int64{10, 0} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("short"))
+		r.ContentLength = declared
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, declared)
+	}
+
+	// failing to read the body is the fault of the client, failing to write
+	// the spool file is not
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", iotest.ErrReader(io.ErrUnexpectedEOF)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	missing := spoolBodies(newSpooler(4, filepath.Join(dir, "missing"), 0, 0), handler)
+	w = httptest.NewRecorder()
+	missing.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("larger than the threshold")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestSpoolLimits(t *testing.T) {
+	assert.Nil(t, newSpooler(0, "", 0, 0))
+
+	dir := t.TempDir()
+	s := newSpooler(4, dir, 20, 10)
+	release := make(chan struct{})
+	handler := spoolBodies(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(strings.Repeat("x", 21)))
+
+	// the first body occupies the quota until it is handled (only the part
+	// exceeding the threshold is written to disk)
+	done := make(chan int)
+	go func() { done <- post(strings.Repeat("x", 14)) }()
+	require.Eventually(t, func() bool { return s.used.Load() == 9 }, time.Second, time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, post(strings.Repeat("y", 7)))
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, int64(0), s.used.Load())
+	assert.Equal(t, http.StatusOK, post(strings.Repeat("y", 7)))
+
+	// orphans of crashed instances are removed
+	orphan := filepath.Join(dir, spoolFilePrefix+"1")
+	recent := filepath.Join(dir, spoolFilePrefix+"2")
+	require.NoError(t, os.WriteFile(orphan, nil, 0o600))
+	require.NoError(t, os.WriteFile(recent, nil, 0o600))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(orphan, old, old))
+	s.removeOrphans()
+	assert.NoFileExists(t, orphan)
+	assert.FileExists(t, recent)
+}
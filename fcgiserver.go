@@ -0,0 +1,704 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FastCGI record types (FastCGI specification section 8)
+const (
+	fcgiBeginRequest    uint8 = 1
+	fcgiAbortRequest    uint8 = 2
+	fcgiEndRequest      uint8 = 3
+	fcgiParams          uint8 = 4
+	fcgiStdin           uint8 = 5
+	fcgiStdout          uint8 = 6
+	fcgiStderr          uint8 = 7
+	fcgiData            uint8 = 8
+	fcgiGetValues       uint8 = 9
+	fcgiGetValuesResult uint8 = 10
+	fcgiUnknownType     uint8 = 11
+)
+
+// FastCGI roles
+const (
+	fcgiRoleResponder uint16 = 1
+	fcgiRoleFilter    uint16 = 3
+)
+
+// FastCGI protocol status of FCGI_END_REQUEST
+const (
+	fcgiRequestComplete uint8 = 0
+	fcgiUnknownRole     uint8 = 3
+)
+
+const (
+	// flag of FCGI_BEGIN_REQUEST, the connection is kept open after the request
+	fcgiKeepConn = 1
+	// maximum content length of a record
+	fcgiMaxWrite = 65535
+	// stdin (or data) queued in memory per request at most. Once a request
+	// has that much unread, further records are queued in a temp file.
+	fcgiBodyBuffer = 1 << 20
+	// max size of the FCGI_PARAMS stream of a request
+	fcgiMaxParams = 1 << 20
+)
+
+var (
+	// error reading the body of a request whose connection was closed
+	errFCGIConnClosed = errors.New("fcgi: connection to web server closed")
+	// error reading the body of a request aborted by the web server
+	errFCGIRequestAborted = errors.New("fcgi: request aborted by web server")
+)
+
+// requestAborted reports whether the web server aborted the request of ctx
+// (FCGI_ABORT_REQUEST or closing the connection)
+func requestAborted(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return errors.Is(cause, errFCGIRequestAborted) || errors.Is(cause, errFCGIConnClosed)
+}
+
+// fcgiRequestKey is the context key of the FastCGI request being served
+type fcgiRequestKey struct{}
+
+// fcgiRequestFrom returns the FastCGI request of r (nil if r wasn't received
+// via FastCGI)
+func fcgiRequestFrom(r *http.Request) *fcgiRequest {
+	req, _ := r.Context().Value(fcgiRequestKey{}).(*fcgiRequest)
+	return req
+}
+
+// fcgiParamsFrom returns all FastCGI parameters of the request r
+func fcgiParamsFrom(r *http.Request) map[string]string {
+	if req := fcgiRequestFrom(r); req != nil {
+		return req.env
+	}
+	return nil
+}
+
+// fcgiDataFrom returns the FCGI_DATA stream of the request r, nil unless it is
+// a filter request
+func fcgiDataFrom(r *http.Request) io.Reader {
+	if req := fcgiRequestFrom(r); req != nil && req.data != nil {
+		return req.data
+	}
+	return nil
+}
+
+// fcgiStderrFrom returns the FCGI_STDERR stream of the request r, nil if r
+// wasn't received via FastCGI
+func fcgiStderrFrom(r *http.Request) io.Writer {
+	if req := fcgiRequestFrom(r); req != nil {
+		return fcgiStreamWriter{req: req, typ: fcgiStderr}
+	}
+	return nil
+}
+
+// setFCGIAppStatus sets the application status reported to the web server at
+// the end of the request r (the exit status of the script)
+func setFCGIAppStatus(r *http.Request, status int) {
+	if req := fcgiRequestFrom(r); req != nil {
+		req.appStatus.Store(uint32(status))
+	}
+}
+
+// serveFastCGI accepts FastCGI connections on l and serves their requests with
+// h. Unlike net/http/fcgi the requests multiplexed on a connection don't block
+// each other: their stdin is queued per request (beyond fcgiBodyBuffer in a
+// temp file in spoolDir), so a handler not (yet) reading its body doesn't
+// stall the others. maxReqs (0: unlimited) is announced as FCGI_MAX_CONNS and
+// FCGI_MAX_REQS. A nil l serves the socket passed as stdin.
+func serveFastCGI(l net.Listener, h http.Handler, maxReqs int, spoolDir string) error {
+	if l == nil {
+		var err error
+		if l, err = net.FileListener(os.Stdin); err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &fcgiConn{rwc: rw, handler: h, maxReqs: maxReqs, spoolDir: spoolDir, requests: make(map[uint16]*fcgiRequest)}
+		go c.serve()
+	}
+}
+
+// fcgiConn is a connection to the web server
+type fcgiConn struct {
+	rwc     io.ReadWriteCloser
+	handler http.Handler
+	maxReqs int
+	// directory of the temp files of queued stdin ("": $TMPDIR)
+	spoolDir string
+
+	// serializes the records written by the requests
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	requests map[uint16]*fcgiRequest
+}
+
+// fcgiRequest is a request in progress on a connection
+type fcgiRequest struct {
+	conn     *fcgiConn
+	id       uint16
+	role     uint16
+	keepConn bool
+	params   bytes.Buffer
+	// the decoded parameters
+	env map[string]string
+	// set once the parameters are complete (the request is being served)
+	body *fcgiBody
+	// the FCGI_DATA stream (filter requests only)
+	data *fcgiBody
+	// cancels the context of the handler
+	cancel context.CancelCauseFunc
+	// the response is discarded
+	aborted atomic.Bool
+	// reported in FCGI_END_REQUEST
+	appStatus atomic.Uint32
+}
+
+// abort ends the streams of the request and cancels its handler with err
+func (req *fcgiRequest) abort(err error) {
+	if req.body == nil {
+		return
+	}
+	req.aborted.Store(true)
+	req.body.closeWithError(err)
+	if req.data != nil {
+		req.data.closeWithError(err)
+	}
+	req.cancel(err)
+}
+
+// fcgiRecord is a record read from the web server
+type fcgiRecord struct {
+	typ     uint8
+	id      uint16
+	content []byte
+}
+
+// readFCGIRecord reads the next record from r
+func readFCGIRecord(r io.Reader) (fcgiRecord, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return fcgiRecord{}, err
+	}
+	if hdr[0] != 1 {
+		return fcgiRecord{}, fmt.Errorf("fcgi: unsupported protocol version %d", hdr[0])
+	}
+	n := int(binary.BigEndian.Uint16(hdr[4:])) + int(hdr[6])
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fcgiRecord{}, err
+	}
+	return fcgiRecord{typ: hdr[1], id: binary.BigEndian.Uint16(hdr[2:]), content: buf[:binary.BigEndian.Uint16(hdr[4:])]}, nil
+}
+
+// writeRecord writes a record, content is padded to a multiple of 8 bytes
+func (c *fcgiConn) writeRecord(typ uint8, id uint16, content []byte) error {
+	pad := -len(content) & 7
+	var hdr [8]byte
+	hdr[0] = 1
+	hdr[1] = typ
+	binary.BigEndian.PutUint16(hdr[2:], id)
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(content)))
+	hdr[6] = byte(pad)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.rwc.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := c.rwc.Write(content); err != nil {
+		return err
+	}
+	_, err := c.rwc.Write(make([]byte, pad))
+	return err
+}
+
+func (c *fcgiConn) writeEndRequest(id uint16, appStatus uint32, protocolStatus uint8) error {
+	content := make([]byte, 8)
+	binary.BigEndian.PutUint32(content, appStatus)
+	content[4] = protocolStatus
+	return c.writeRecord(fcgiEndRequest, id, content)
+}
+
+// serve reads the records of the connection until it is closed
+func (c *fcgiConn) serve() {
+	defer c.close()
+	br := bufio.NewReader(c.rwc)
+	for {
+		rec, err := readFCGIRecord(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("reading FastCGI record failed", "error", err)
+			}
+			return
+		}
+		if err := c.handleRecord(rec); err != nil {
+			slog.Warn("invalid FastCGI record, closing the connection", "type", rec.typ, "id", rec.id, "error", err)
+			return
+		}
+	}
+}
+
+// close closes the connection, the bodies of requests in progress fail
+func (c *fcgiConn) close() {
+	c.mu.Lock()
+	for _, req := range c.requests {
+		req.abort(errFCGIConnClosed)
+	}
+	c.mu.Unlock()
+	c.rwc.Close()
+}
+
+func (c *fcgiConn) handleRecord(rec fcgiRecord) error {
+	if rec.id == 0 {
+		return c.handleManagementRecord(rec)
+	}
+
+	c.mu.Lock()
+	req, ok := c.requests[rec.id]
+	c.mu.Unlock()
+	if !ok && rec.typ != fcgiBeginRequest {
+		// a record of an already completed request
+		return nil
+	}
+
+	switch rec.typ {
+	case fcgiBeginRequest:
+		if ok {
+			return fmt.Errorf("request %d already in progress", rec.id)
+		}
+		if len(rec.content) < 8 {
+			return errors.New("short FCGI_BEGIN_REQUEST")
+		}
+		role := binary.BigEndian.Uint16(rec.content)
+		if role != fcgiRoleResponder && role != fcgiRoleFilter {
+			return c.writeEndRequest(rec.id, 0, fcgiUnknownRole)
+		}
+		c.mu.Lock()
+		c.requests[rec.id] = &fcgiRequest{conn: c, id: rec.id, role: role, keepConn: rec.content[2]&fcgiKeepConn != 0}
+		c.mu.Unlock()
+	case fcgiParams:
+		if req.body != nil {
+			return nil
+		}
+		if req.params.Len()+len(rec.content) > fcgiMaxParams {
+			return c.rejectParams(req)
+		}
+		if len(rec.content) > 0 {
+			req.params.Write(rec.content)
+			return nil
+		}
+		params, err := decodeFCGIParams(req.params.Bytes())
+		if err != nil {
+			return err
+		}
+		req.params.Reset()
+		// like libfcgi, the role is passed on to the application
+		params["FCGI_ROLE"] = "RESPONDER"
+		if req.role == fcgiRoleFilter {
+			params["FCGI_ROLE"] = "FILTER"
+		}
+		ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), fcgiRequestKey{}, req))
+		c.mu.Lock()
+		req.env = params
+		req.body = &fcgiBody{dir: c.spoolDir}
+		if req.role == fcgiRoleFilter {
+			req.data = &fcgiBody{dir: c.spoolDir}
+		}
+		req.cancel = cancel
+		c.mu.Unlock()
+		go c.serveRequest(ctx, req)
+	case fcgiStdin:
+		if req.body == nil {
+			return errors.New("FCGI_STDIN before the end of FCGI_PARAMS")
+		}
+		if len(rec.content) == 0 {
+			req.body.closeWithError(io.EOF)
+		} else {
+			req.body.write(rec.content)
+		}
+	case fcgiData:
+		if req.data == nil {
+			return nil
+		}
+		if len(rec.content) == 0 {
+			req.data.closeWithError(io.EOF)
+		} else {
+			req.data.write(rec.content)
+		}
+	case fcgiAbortRequest:
+		slog.Debug("request aborted by web server", "id", rec.id)
+		if req.body == nil {
+			// aborted before its handler was started
+			c.mu.Lock()
+			delete(c.requests, req.id)
+			c.mu.Unlock()
+			if err := c.writeEndRequest(req.id, 0, fcgiRequestComplete); err != nil || !req.keepConn {
+				c.close()
+			}
+			return nil
+		}
+		req.abort(errFCGIRequestAborted)
+	}
+	return nil
+}
+
+// rejectParams answers the request req whose FCGI_PARAMS exceed fcgiMaxParams
+// with 431 without starting its handler. Its further records are ignored.
+func (c *fcgiConn) rejectParams(req *fcgiRequest) error {
+	slog.Warn("FastCGI params too large, rejecting the request", "id", req.id, "max", fcgiMaxParams)
+	rejectedRequests.add("params_size")
+	c.mu.Lock()
+	delete(c.requests, req.id)
+	c.mu.Unlock()
+	err := c.writeRecord(fcgiStdout, req.id, []byte("Status: 431 Request Header Fields Too Large\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"))
+	if err == nil {
+		err = c.writeEndRequest(req.id, 0, fcgiRequestComplete)
+	}
+	if err != nil || !req.keepConn {
+		c.close()
+	}
+	return nil
+}
+
+// handleManagementRecord answers a record not belonging to a request
+func (c *fcgiConn) handleManagementRecord(rec fcgiRecord) error {
+	if rec.typ != fcgiGetValues {
+		content := make([]byte, 8)
+		content[0] = rec.typ
+		return c.writeRecord(fcgiUnknownType, 0, content)
+	}
+	asked, err := decodeFCGIParams(rec.content)
+	if err != nil {
+		return err
+	}
+	values := map[string]string{"FCGI_MPXS_CONNS": "1"}
+	if c.maxReqs > 0 {
+		values["FCGI_MAX_CONNS"] = strconv.Itoa(c.maxReqs)
+		values["FCGI_MAX_REQS"] = strconv.Itoa(c.maxReqs)
+	}
+	var result bytes.Buffer
+	for name := range asked {
+		if v, ok := values[name]; ok {
+			encodeFCGIPair(&result, name, v)
+		}
+	}
+	return c.writeRecord(fcgiGetValuesResult, 0, result.Bytes())
+}
+
+// serveRequest runs the handler for the request req and completes it
+func (c *fcgiConn) serveRequest(ctx context.Context, req *fcgiRequest) {
+	defer req.cancel(nil)
+	w := newFCGIResponseWriter(c, req)
+	r, err := cgi.RequestFromMap(req.env)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = c.writeRecord(fcgiStderr, req.id, []byte(err.Error()))
+	} else {
+		if req.env["CONTENT_LENGTH"] == "" {
+			// unknown (e.g. a chunked upload), not empty
+			r.ContentLength = -1
+		}
+		r.Body = req.body
+		c.handler.ServeHTTP(w, r.WithContext(ctx))
+	}
+	// further input of the request is discarded
+	req.body.Close()
+	if req.data != nil {
+		req.data.Close()
+	}
+	w.Write(nil)
+	w.Close()
+
+	c.mu.Lock()
+	delete(c.requests, req.id)
+	c.mu.Unlock()
+	_ = c.writeEndRequest(req.id, req.appStatus.Load(), fcgiRequestComplete)
+	if !req.keepConn {
+		c.close()
+	}
+}
+
+// decodeFCGIParams decodes the name-value pairs of FCGI_PARAMS or
+// FCGI_GET_VALUES
+func decodeFCGIParams(b []byte) (map[string]string, error) {
+	params := make(map[string]string)
+	readLen := func() (int, bool) {
+		if len(b) == 0 {
+			return 0, false
+		}
+		if b[0]&0x80 == 0 {
+			n := int(b[0])
+			b = b[1:]
+			return n, true
+		}
+		if len(b) < 4 {
+			return 0, false
+		}
+		n := int(binary.BigEndian.Uint32(b) &^ (1 << 31))
+		b = b[4:]
+		return n, true
+	}
+	for len(b) > 0 {
+		nameLen, ok1 := readLen()
+		valueLen, ok2 := readLen()
+		if !ok1 || !ok2 || nameLen+valueLen > len(b) {
+			return nil, errors.New("malformed name-value pair")
+		}
+		params[string(b[:nameLen])] = string(b[nameLen : nameLen+valueLen])
+		b = b[nameLen+valueLen:]
+	}
+	return params, nil
+}
+
+// encodeFCGIPair appends a name-value pair to buf
+func encodeFCGIPair(buf *bytes.Buffer, name, value string) {
+	for _, n := range []int{len(name), len(value)} {
+		if n < 128 {
+			buf.WriteByte(byte(n))
+		} else {
+			_ = binary.Write(buf, binary.BigEndian, uint32(n)|1<<31)
+		}
+	}
+	buf.WriteString(name)
+	buf.WriteString(value)
+}
+
+// fcgiBody is the stdin of a request. The records are queued as they arrive
+// without ever blocking the connection: in memory up to fcgiBodyBuffer bytes,
+// the rest in an (already unlinked) temp file in dir until the handler reads
+// or closes the body.
+type fcgiBody struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// queued behind buf, written up to spillW and read up to spillR
+	dir            string
+	spill          *os.File
+	spillW, spillR int64
+	// io.EOF once stdin is complete
+	err error
+	// further stdin is discarded
+	closed bool
+}
+
+func (b *fcgiBody) init() {
+	if b.cond == nil {
+		b.cond = sync.NewCond(&b.mu)
+	}
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	for b.buf.Len() == 0 && b.spillR == b.spillW && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	if b.spillR < b.spillW {
+		n, err := b.spill.ReadAt(p[:min(int64(len(p)), b.spillW-b.spillR)], b.spillR)
+		b.spillR += int64(n)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, fmt.Errorf("%w: %w", errSpoolDisk, err)
+		}
+		if b.spillR == b.spillW {
+			// drained, queue in memory again
+			_ = b.spill.Truncate(0)
+			b.spillR, b.spillW = 0, 0
+		}
+		return n, nil
+	}
+	return 0, b.err
+}
+
+// write queues stdin read from the connection. If the temp file can't be
+// written, the body fails with errSpoolDisk.
+func (b *fcgiBody) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.closed || b.err != nil {
+		return
+	}
+	defer b.cond.Broadcast()
+	if b.spillW == 0 && b.buf.Len()+len(p) <= fcgiBodyBuffer {
+		b.buf.Write(p)
+		return
+	}
+	if b.spill == nil {
+		f, err := os.CreateTemp(b.dir, spoolFilePrefix)
+		if err != nil {
+			b.err = fmt.Errorf("%w: %w", errSpoolDisk, err)
+			return
+		}
+		// nobody else needs to see the file, it is gone once closed
+		_ = os.Remove(f.Name())
+		b.spill = f
+	}
+	if _, err := b.spill.WriteAt(p, b.spillW); err != nil {
+		b.err = fmt.Errorf("%w: %w", errSpoolDisk, err)
+		return
+	}
+	b.spillW += int64(len(p))
+}
+
+// closeWithError ends the body, reads return err once the queue is drained
+func (b *fcgiBody) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// Close discards the queued and further stdin
+func (b *fcgiBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	b.closed = true
+	b.buf = bytes.Buffer{}
+	if b.spill != nil {
+		b.spill.Close()
+		b.spill, b.spillR, b.spillW = nil, 0, 0
+	}
+	if b.err == nil {
+		b.err = http.ErrBodyReadAfterClose
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// fcgiStreamWriter writes FCGI_STDOUT or FCGI_STDERR records
+type fcgiStreamWriter struct {
+	req *fcgiRequest
+	typ uint8
+}
+
+func (s fcgiStreamWriter) Write(p []byte) (int, error) {
+	if s.req.aborted.Load() {
+		return 0, errFCGIRequestAborted
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), fcgiMaxWrite)]
+		if err := s.req.conn.writeRecord(s.typ, s.req.id, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// fcgiResponseWriter is the http.ResponseWriter of a request, it writes the response
+// as CGI response (the "Status" header carries the status code)
+type fcgiResponseWriter struct {
+	c           *fcgiConn
+	id          uint16
+	header      http.Header
+	code        int
+	wroteHeader bool
+	wroteCGI    bool
+	w           *bufio.Writer
+}
+
+func newFCGIResponseWriter(c *fcgiConn, req *fcgiRequest) *fcgiResponseWriter {
+	return &fcgiResponseWriter{
+		c:      c,
+		id:     req.id,
+		header: make(http.Header),
+		w:      bufio.NewWriterSize(fcgiStreamWriter{req: req, typ: fcgiStdout}, fcgiMaxWrite),
+	}
+}
+
+func (r *fcgiResponseWriter) Header() http.Header {
+	return r.header
+}
+
+func (r *fcgiResponseWriter) WriteHeader(code int) {
+	if r.wroteHeader || code < http.StatusOK {
+		// FastCGI can't carry interim responses
+		return
+	}
+	r.wroteHeader = true
+	r.code = code
+	if code == http.StatusNotModified {
+		// must not have a body
+		r.header.Del("Content-Type")
+		r.header.Del("Content-Length")
+		r.header.Del("Transfer-Encoding")
+	}
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+}
+
+func (r *fcgiResponseWriter) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.wroteCGI {
+		r.writeCGIHeader(p)
+	}
+	return r.w.Write(p)
+}
+
+// writeCGIHeader writes the status and the headers, p is the start of the body
+// to sniff the content type from
+func (r *fcgiResponseWriter) writeCGIHeader(p []byte) {
+	r.wroteCGI = true
+	fmt.Fprintf(r.w, "Status: %d %s\r\n", r.code, http.StatusText(r.code))
+	if _, ok := r.header["Content-Type"]; r.code != http.StatusNotModified && !ok {
+		r.header.Set("Content-Type", http.DetectContentType(p))
+	}
+	_ = r.header.Write(r.w)
+	_, _ = r.w.WriteString("\r\n")
+}
+
+func (r *fcgiResponseWriter) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.wroteCGI {
+		r.writeCGIHeader(nil)
+	}
+	_ = r.w.Flush()
+}
+
+// Close flushes the response and ends FCGI_STDOUT
+func (r *fcgiResponseWriter) Close() error {
+	r.Flush()
+	return r.c.writeRecord(fcgiStdout, r.id, nil)
+}
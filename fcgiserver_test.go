@@ -0,0 +1,288 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialFCGI connects to a FastCGI server serving h
+func dialFCGI(t *testing.T, h http.Handler) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", serveFCGI(t, h))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	return conn
+}
+
+// beginFCGI starts the request id on conn (keeping the connection)
+func beginFCGI(t *testing.T, conn net.Conn, id uint16, params map[string]string) {
+	t.Helper()
+	params["SERVER_PROTOCOL"] = "HTTP/1.1"
+	require.NoError(t, writeFCGIRecord(conn, fcgiBeginRequest, id, []byte{0, 1, fcgiKeepConn, 0, 0, 0, 0, 0}))
+	require.NoError(t, writeFCGIRecord(conn, fcgiParams, id, encodeFCGIParams(params)))
+	require.NoError(t, writeFCGIRecord(conn, fcgiParams, id, nil))
+}
+
+func TestFastCGIMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	conn := dialFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte(r.URL.Path+":"), body...))
+	}))
+
+	// the slow request doesn't read its body (more than fits in memory) until
+	// the fast one completed
+	body := bytes.Repeat([]byte("abc"), fcgiBodyBuffer)
+	beginFCGI(t, conn, 1, map[string]string{"REQUEST_METHOD": "POST", "REQUEST_URI": "/slow", "CONTENT_LENGTH": strconv.Itoa(len(body))})
+	for chunk := range slices.Chunk(body, fcgiMaxWrite) {
+		require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, chunk))
+	}
+	beginFCGI(t, conn, 2, map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/fast"})
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 2, nil))
+
+	stdout := map[uint16]*bytes.Buffer{1: {}, 2: {}}
+	var order []uint16
+	for len(order) < 2 {
+		rec, err := readFCGIRecord(conn)
+		require.NoError(t, err)
+		switch rec.typ {
+		case fcgiStdout:
+			stdout[rec.id].Write(rec.content)
+		case fcgiEndRequest:
+			order = append(order, rec.id)
+			if rec.id == 2 {
+				close(release)
+				require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+			}
+		}
+	}
+	assert.Equal(t, []uint16{2, 1}, order)
+	assert.Equal(t, "/fast:", parseFCGIResponse(t, stdout[2].Bytes(), "").body)
+	assert.Equal(t, "/slow:"+string(body), parseFCGIResponse(t, stdout[1].Bytes(), "").body)
+}
+
+func TestFastCGIGetValues(t *testing.T) {
+	conn := dialFCGI(t, http.NotFoundHandler())
+	require.NoError(t, writeFCGIRecord(conn, fcgiGetValues, 0, encodeFCGIParams(map[string]string{"FCGI_MPXS_CONNS": "", "UNKNOWN": ""})))
+	rec, err := readFCGIRecord(conn)
+	require.NoError(t, err)
+	assert.Equal(t, fcgiGetValuesResult, rec.typ)
+	values, err := decodeFCGIParams(rec.content)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"FCGI_MPXS_CONNS": "1"}, values)
+
+	require.NoError(t, writeFCGIRecord(conn, 42, 0, nil))
+	rec, err = readFCGIRecord(conn)
+	require.NoError(t, err)
+	assert.Equal(t, fcgiUnknownType, rec.typ)
+	assert.Equal(t, uint8(42), rec.content[0])
+}
+
+func TestFastCGIFilter(t *testing.T) {
+	script := cgiScript(t, t.TempDir(), "upper.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\necho \"$FCGI_ROLE\"\neval \"tr a-z A-Z <&$FCGI_DATA_FD\"\n")
+	conn := dialFCGI(t, cgiResponder(arguments{}, nil))
+
+	params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": script, "FCGI_DATA_LENGTH": "3"}
+	require.NoError(t, writeFCGIRecord(conn, fcgiBeginRequest, 1, []byte{0, byte(fcgiRoleFilter), 0, 0, 0, 0, 0, 0}))
+	require.NoError(t, writeFCGIRecord(conn, fcgiParams, 1, encodeFCGIParams(params)))
+	require.NoError(t, writeFCGIRecord(conn, fcgiParams, 1, nil))
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+	require.NoError(t, writeFCGIRecord(conn, fcgiData, 1, []byte("abc")))
+	require.NoError(t, writeFCGIRecord(conn, fcgiData, 1, nil))
+
+	var stdout bytes.Buffer
+	for {
+		rec, err := readFCGIRecord(conn)
+		require.NoError(t, err)
+		if rec.typ == fcgiStdout {
+			stdout.Write(rec.content)
+		}
+		if rec.typ == fcgiEndRequest {
+			assert.Equal(t, fcgiRequestComplete, rec.content[4])
+			break
+		}
+	}
+	assert.Equal(t, "FILTER\nABC", parseFCGIResponse(t, stdout.Bytes(), "").body)
+}
+
+func TestFastCGIAbortRequest(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "loop.sh", "trap 'touch \"$0.term\"; exit 1' TERM\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\nwhile :; do sleep 0.1; done\n")
+	conn := dialFCGI(t, cgiResponder(arguments{NoBuffering: true}, nil))
+
+	beginFCGI(t, conn, 1, map[string]string{"REQUEST_METHOD": "GET", "SCRIPT_FILENAME": script})
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+	// the script is running once its headers arrived
+	rec, err := readFCGIRecord(conn)
+	require.NoError(t, err)
+	require.Equal(t, fcgiStdout, rec.typ)
+
+	start := time.Now()
+	require.NoError(t, writeFCGIRecord(conn, fcgiAbortRequest, 1, nil))
+	for rec.typ != fcgiEndRequest {
+		rec, err = readFCGIRecord(conn)
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), abortKillDelay)
+	assert.FileExists(t, script+".term", "the script got SIGTERM")
+}
+
+func TestFastCGIAbortRequestWriting(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "cleanup.sh", "trap 'head -c 200000 /dev/zero; sleep 0.2; touch \"$0.term\"; exit 1' TERM\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\nwhile :; do sleep 0.1; done\n")
+	conn := dialFCGI(t, cgiResponder(arguments{NoBuffering: true}, nil))
+
+	beginFCGI(t, conn, 1, map[string]string{"REQUEST_METHOD": "GET", "SCRIPT_FILENAME": script})
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+	rec, err := readFCGIRecord(conn)
+	require.NoError(t, err)
+	require.Equal(t, fcgiStdout, rec.typ)
+
+	// the script writes while cleaning up, failing writes to the aborted
+	// stream don't cut its grace period short
+	require.NoError(t, writeFCGIRecord(conn, fcgiAbortRequest, 1, nil))
+	for rec.typ != fcgiEndRequest {
+		rec, err = readFCGIRecord(conn)
+		require.NoError(t, err)
+	}
+	assert.FileExists(t, script+".term", "the script got SIGTERM")
+}
+
+func TestFastCGIStderrAndAppStatus(t *testing.T) {
+	script := cgiScript(t, t.TempDir(), "fail.sh", "echo oops >&2\nprintf 'Content-Type: text/plain\\r\\n\\r\\nfailed'\nexit 3\n")
+	conn := dialFCGI(t, cgiResponder(arguments{ForwardErr: true}, nil))
+
+	beginFCGI(t, conn, 1, map[string]string{"REQUEST_METHOD": "GET", "SCRIPT_FILENAME": script})
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+	var stderr bytes.Buffer
+	for {
+		rec, err := readFCGIRecord(conn)
+		require.NoError(t, err)
+		if rec.typ == fcgiStderr {
+			stderr.Write(rec.content)
+		}
+		if rec.typ == fcgiEndRequest {
+			assert.Equal(t, []byte{0, 0, 0, 3, fcgiRequestComplete}, rec.content[:5])
+			break
+		}
+	}
+	assert.Equal(t, "oops\n", stderr.String())
+}
+
+func TestFastCGIBodyBuffer(t *testing.T) {
+	b := fcgiBody{dir: t.TempDir()}
+	var want bytes.Buffer
+	// nobody reads: the writes don't block, what exceeds the buffer is queued
+	// in a temp file
+	for i := range 2 * fcgiBodyBuffer / fcgiMaxWrite {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, fcgiMaxWrite)
+		want.Write(chunk)
+		b.write(chunk)
+	}
+	b.mu.Lock()
+	assert.LessOrEqual(t, b.buf.Len(), fcgiBodyBuffer)
+	assert.Equal(t, int64(want.Len()-b.buf.Len()), b.spillW)
+	b.mu.Unlock()
+
+	// in order, with memory used again once the file is drained
+	got := make([]byte, want.Len())
+	_, err := io.ReadFull(&b, got)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(want.Bytes(), got))
+	b.write([]byte("tail"))
+	b.closeWithError(io.EOF)
+	b.mu.Lock()
+	assert.Equal(t, int64(0), b.spillW)
+	b.mu.Unlock()
+	rest, err := io.ReadAll(&b)
+	require.NoError(t, err)
+	assert.Equal(t, "tail", string(rest))
+	require.NoError(t, b.Close())
+	assert.Nil(t, b.spill)
+}
+
+func TestFastCGIParamsTooLarge(t *testing.T) {
+	conn := dialFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	require.NoError(t, writeFCGIRecord(conn, fcgiBeginRequest, 1, []byte{0, 1, fcgiKeepConn, 0, 0, 0, 0, 0}))
+	value := bytes.Repeat([]byte("x"), fcgiMaxWrite-16)
+	for range fcgiMaxParams/len(value) + 1 {
+		require.NoError(t, writeFCGIRecord(conn, fcgiParams, 1, encodeFCGIParams(map[string]string{"HTTP_X": string(value)})))
+	}
+	var stdout bytes.Buffer
+	for {
+		rec, err := readFCGIRecord(conn)
+		require.NoError(t, err)
+		if rec.typ == fcgiStdout {
+			stdout.Write(rec.content)
+		}
+		if rec.typ == fcgiEndRequest {
+			break
+		}
+	}
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, parseFCGIResponse(t, stdout.Bytes(), "").status)
+
+	// the rest of the request is ignored, the connection is still usable
+	require.NoError(t, writeFCGIRecord(conn, fcgiParams, 1, nil))
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+	beginFCGI(t, conn, 2, map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/"})
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 2, nil))
+	stdout.Reset()
+	for {
+		rec, err := readFCGIRecord(conn)
+		require.NoError(t, err)
+		if rec.typ == fcgiStdout {
+			stdout.Write(rec.content)
+		}
+		if rec.typ == fcgiEndRequest {
+			assert.Equal(t, uint16(2), rec.id)
+			break
+		}
+	}
+	assert.Equal(t, "ok", parseFCGIResponse(t, stdout.Bytes(), "").body)
+}
+
+func TestFastCGIAbortBeforeParams(t *testing.T) {
+	conn := dialFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	require.NoError(t, writeFCGIRecord(conn, fcgiBeginRequest, 1, []byte{0, 1, fcgiKeepConn, 0, 0, 0, 0, 0}))
+	require.NoError(t, writeFCGIRecord(conn, fcgiAbortRequest, 1, nil))
+	rec, err := readFCGIRecord(conn)
+	require.NoError(t, err)
+	assert.Equal(t, fcgiEndRequest, rec.typ)
+	assert.Equal(t, uint16(1), rec.id)
+
+	// the id can be used again
+	beginFCGI(t, conn, 1, map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/"})
+	require.NoError(t, writeFCGIRecord(conn, fcgiStdin, 1, nil))
+	var stdout bytes.Buffer
+	for rec.typ = 0; rec.typ != fcgiEndRequest; {
+		rec, err = readFCGIRecord(conn)
+		require.NoError(t, err)
+		if rec.typ == fcgiStdout {
+			stdout.Write(rec.content)
+		}
+	}
+	assert.Equal(t, "ok", parseFCGIResponse(t, stdout.Bytes(), "").body)
+}
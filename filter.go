@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// filterData passes the FCGI_DATA stream of a filter request to the child on
+// an extra file descriptor, its number is passed in FCGI_DATA_FD
+type filterData struct {
+	src     io.Reader
+	r, w    *os.File
+	started bool
+}
+
+// newFilterData wires src to cmd, which must not have been started yet
+func newFilterData(cmd *exec.Cmd, src io.Reader) (*filterData, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	cmd.Env = append(cmd.Env, "FCGI_DATA_FD="+strconv.Itoa(2+len(cmd.ExtraFiles)))
+	return &filterData{src: src, r: r, w: w}, nil
+}
+
+// start copies the stream to the child once it was started
+func (d *filterData) start(ctx context.Context) {
+	d.started = true
+	d.r.Close()
+	go func() {
+		defer d.w.Close()
+		// a child not reading all of the data is fine
+		if _, err := io.Copy(d.w, d.src); err != nil && !errors.Is(err, syscall.EPIPE) {
+			slog.DebugContext(ctx, "passing FCGI_DATA to CGI failed", "error", err)
+		}
+	}()
+}
+
+// close releases the pipe if the child wasn't started
+func (d *filterData) close() {
+	if !d.started {
+		d.r.Close()
+		d.w.Close()
+	}
+}
@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// returned (wrapped) if a filesystem operation timed out or the circuit breaker
+// is open
+var errFSUnavailable = errors.New("filesystem unavailable")
+
+// fsGuard runs filesystem operations with a timeout and opens a circuit
+// breaker after too many consecutive timeouts, so a hung (network) filesystem
+// results in fast failures instead of blocking every worker. A nil guard runs
+// the operations directly.
+type fsGuard struct {
+	timeout   time.Duration
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+
+	// lstat results of scripts (nil: not cached)
+	cache *statCache
+}
+
+func newFSGuard(timeout time.Duration, threshold int, cooldown time.Duration) *fsGuard {
+	if timeout <= 0 {
+		return nil
+	}
+	return &fsGuard{timeout: timeout, threshold: max(threshold, 1), cooldown: cooldown}
+}
+
+// withStatCache returns g caching lstat results for ttl according to now (0: g
+// unchanged)
+func (g *fsGuard) withStatCache(ttl time.Duration, now func() time.Time) *fsGuard {
+	if ttl <= 0 {
+		return g
+	}
+	if g == nil {
+		g = &fsGuard{}
+	}
+	g.cache = newStatCache(ttl, now)
+	return g
+}
+
+// allow checks whether an operation may be run. Once the cooldown is over, a
+// single probe is let through (half-open) to check if the filesystem recovered.
+func (g *fsGuard) allow() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.failures < g.threshold {
+		return nil
+	}
+	if time.Now().Before(g.openUntil) || g.probing {
+		return fmt.Errorf("%w: circuit breaker open", errFSUnavailable)
+	}
+	g.probing = true
+	return nil
+}
+
+// record the outcome of an operation
+func (g *fsGuard) record(timedOut bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.probing = false
+	if !timedOut {
+		if g.failures >= g.threshold {
+			slog.Info("filesystem recovered, closing circuit breaker")
+		}
+		g.failures = 0
+		return
+	}
+
+	g.failures++
+	if g.failures >= g.threshold {
+		g.openUntil = time.Now().Add(g.cooldown)
+		slog.Warn("filesystem operations keep timing out, opening circuit breaker", "failures", g.failures, "cooldown", g.cooldown)
+	}
+}
+
+// guarded runs op under the guard. On timeout op keeps running in the
+// background, its result is discarded.
+func guarded[T any](g *fsGuard, op func() (T, error)) (T, error) {
+	if g == nil || g.timeout <= 0 {
+		return op()
+	}
+	if err := g.allow(); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := op()
+		done <- result{v, err}
+	}()
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		g.record(false)
+		return res.v, res.err
+	case <-timer.C:
+		g.record(true)
+		var zero T
+		return zero, fmt.Errorf("%w: timed out after %v", errFSUnavailable, g.timeout)
+	}
+}
+
+func (g *fsGuard) lstat(name string) (os.FileInfo, error) {
+	if g == nil || g.cache == nil {
+		return guarded(g, func() (os.FileInfo, error) { return os.Lstat(name) })
+	}
+	cached, cachedErr, ok := g.cache.get(name)
+	if ok && (cachedErr != nil || !cached.Mode().IsRegular()) {
+		return cached, cachedErr
+	}
+	info, err := guarded(g, func() (os.FileInfo, error) { return os.Lstat(name) })
+	if errors.Is(err, errFSUnavailable) {
+		return info, err
+	}
+	if ok && err == nil && !fileChanged(cached, info) {
+		return cached, nil
+	}
+	if ok {
+		slog.Debug("script changed, replacing its cached stat", "script", name)
+	}
+	g.cache.put(name, info, err)
+	return info, err
+}
+
+func (g *fsGuard) stat(name string) (os.FileInfo, error) {
+	return guarded(g, func() (os.FileInfo, error) { return os.Stat(name) })
+}
+
+func (g *fsGuard) evalSymlinks(name string) (string, error) {
+	return guarded(g, func() (string, error) { return filepath.EvalSymlinks(name) })
+}
@@ -7,15 +7,18 @@ module fcgiwrap_go
 go 1.24.3
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/alexflint/go-arg v1.5.1
+	github.com/klauspost/compress v1.18.0
 	github.com/lmittmann/tint v1.1.0
 	github.com/stretchr/testify v1.10.0
 	golang.org/x/sync v0.14.0
+	golang.org/x/sys v0.41.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/alexflint/go-scalar v1.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
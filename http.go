@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+)
+
+// httpParams returns the FastCGI parameters a web server would pass for the
+// plain HTTP or AJP request r (--http, --ajp). The script is the file at the
+// URL path (without the prefix, --strip-prefix) below root.
+func httpParams(r *http.Request, root, prefix string) (map[string]string, error) {
+	if root == "" {
+		// the URL path would be used as SCRIPT_FILENAME as is
+		return nil, errors.New("no document root to look up scripts in")
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	params := map[string]string{
+		"DOCUMENT_ROOT":   root,
+		"SCRIPT_FILENAME": filepath.Join(root, filepath.FromSlash(urlPath)),
+		"SERVER_SOFTWARE": "fcgiwrap_go",
+		"SERVER_NAME":     r.Host,
+	}
+	if stripped, ok := stripURLPrefix(urlPath, prefix); ok {
+		params["SCRIPT_FILENAME"] = filepath.Join(root, filepath.FromSlash(stripped))
+		params["SCRIPT_NAME"] = urlPath
+	}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		params["SERVER_NAME"] = host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			params["SERVER_ADDR"] = host
+			params["SERVER_PORT"] = port
+		}
+	}
+	for k, v := range ajpParamsFrom(r) {
+		params[k] = v
+	}
+	return params, nil
+}
+
+// cgiStatusWriter sends the Status header of CGI responses as the status of
+// plain HTTP and AJP responses (FastCGI passes the header on as is)
+type cgiStatusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *cgiStatusWriter) WriteHeader(code int) {
+	if code >= http.StatusOK {
+		if w.wroteHeader {
+			return
+		}
+		w.wroteHeader = true
+		if _, ok := w.Header()["Status"]; ok {
+			code = headerStatus(w.Header())
+			w.Header().Del("Status")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cgiStatusWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cgiStatusWriter) FlushError() error {
+	w.WriteHeader(http.StatusOK)
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *cgiStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// setHTTPRoot makes the directory --http and --ajp look up scripts in
+// absolute. Without --http-root it is the --document-root (if given, see
+// cgiResponder) or the working directory.
+func (args *arguments) setHTTPRoot() error {
+	if args.HTTP == "" && args.AJP == "" || args.HTTPRoot == "" && args.DocumentRoot != "" {
+		return nil
+	}
+	root, err := filepath.Abs(args.HTTPRoot)
+	if err != nil {
+		return err
+	}
+	args.HTTPRoot = root
+	return nil
+}
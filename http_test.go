@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPMode(t *testing.T) {
+	root := t.TempDir()
+	cgiScript(t, root, "hello.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s %s %s' \"$SCRIPT_NAME\" \"$QUERY_STRING\" \"$SERVER_NAME\"\n")
+	srv := httptest.NewServer(cgiResponder(arguments{HTTPRoot: root}, nil))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/hello.sh?x=1")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "/hello.sh x=1 127.0.0.1", string(body))
+
+	res, err = http.Get(srv.URL + "/../../etc/passwd")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestHTTPModeStripPrefix(t *testing.T) {
+	root := t.TempDir()
+	cgiScript(t, root, "hello.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s %s' \"$SCRIPT_NAME\" \"$PATH_INFO\"\n")
+	srv := httptest.NewServer(cgiResponder(arguments{HTTPRoot: root, StripPrefix: "/cgi-bin/"}, nil))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/cgi-bin/hello.sh/x")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "/cgi-bin/hello.sh /x", string(body))
+}
+
+// bodyReader records whether the client sent the body
+type bodyReader struct {
+	r    io.Reader
+	read atomic.Bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.r.Read(p)
+}
+
+func TestHTTPModeExpectContinue(t *testing.T) {
+	root := t.TempDir()
+	cgiScript(t, root, "reject.sh", "printf 'Status: 413 Too Large\\r\\nContent-Type: text/plain\\r\\n\\r\\ntoo large'\n")
+	cgiScript(t, root, "accept.sh", "printf 'Status: 100 Continue\\r\\n\\r\\nStatus: 103 Early Hints\\r\\nLink: </a.css>\\r\\n\\r\\n'\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\ncat\n")
+	cgiScript(t, root, "read.sh", "body=$(cat)\nprintf 'Content-Type: text/plain\\r\\n\\r\\n%s' \"$body\"\n")
+	srv := httptest.NewServer(cgiResponder(arguments{HTTPRoot: root}, nil))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+
+	post := func(script string) (*http.Response, string, *bodyReader, []int) {
+		t.Helper()
+		body := &bodyReader{r: strings.NewReader("upload")}
+		var interim []int
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+				interim = append(interim, code)
+				if code == http.StatusEarlyHints {
+					assert.Equal(t, "</a.css>", h.Get("Link"))
+				}
+				return nil
+			},
+		})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/"+script, body)
+		require.NoError(t, err)
+		req.ContentLength = int64(len("upload"))
+		req.Header.Set("Expect", "100-continue")
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(data), body, interim
+	}
+
+	// rejected before the client sent the body
+	res, data, body, interim := post("reject.sh")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	assert.Equal(t, "too large", data)
+	assert.False(t, body.read.Load())
+	assert.Empty(t, interim)
+
+	// interim responses are forwarded, the final one doesn't carry their headers
+	start := time.Now()
+	res, data, _, interim = post("accept.sh")
+	assert.Equal(t, "upload", data)
+	assert.Equal(t, []int{http.StatusContinue, http.StatusEarlyHints}, interim)
+	assert.Empty(t, res.Header.Get("Link"))
+	assert.Less(t, time.Since(start), expectContinueDelay)
+
+	// scripts reading their input first get it after a while
+	_, data, _, _ = post("read.sh")
+	assert.Equal(t, "upload", data)
+}
@@ -5,11 +5,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 // generic function to setup a listener. Supports
@@ -17,7 +20,10 @@ import (
 // - TCP Socket
 // - TODO tcp6 (supported by original tool)
 // - nil/stdin
-func setupListener(sockArg string) (net.Listener, string, error) {
+//
+// An existing UNIX socket is only replaced if nobody is listening on it anymore
+// (or force is set).
+func setupListener(sockArg string, force bool) (net.Listener, string, error) {
 	var l net.Listener
 	var socketPath string
 
@@ -28,7 +34,9 @@ func setupListener(sockArg string) (net.Listener, string, error) {
 	} else if strings.HasPrefix(sockArg, "unix:") {
 		path := sockArg[len("unix:"):]
 		socketPath = path
-		_ = os.Remove(path)
+		if err := removeStaleSocket(path, force); err != nil {
+			return nil, "", err
+		}
 		l, err = net.Listen("unix", path)
 		if err != nil {
 			return nil, "", fmt.Errorf("listen unix on %v failed with %w", path, err)
@@ -47,3 +55,24 @@ func setupListener(sockArg string) (net.Listener, string, error) {
 
 	return l, socketPath, nil
 }
+
+// removeStaleSocket removes the socket at path if no other process serves on it
+func removeStaleSocket(path string, force bool) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+	if !force {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("socket %v is in use by another process (use --force-socket to take it over)", path)
+		}
+	}
+	slog.Info("removing existing unix socket", "path", path)
+	return os.Remove(path)
+}
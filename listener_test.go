@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupListenerExistingSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fcgi.sock")
+
+	// a live instance is not replaced
+	l, sock, err := setupListener("unix:"+path, false)
+	require.NoError(t, err)
+	assert.Equal(t, path, sock)
+	_, _, err = setupListener("unix:"+path, false)
+	assert.ErrorContains(t, err, "in use")
+
+	// unless forced
+	l2, _, err := setupListener("unix:"+path, true)
+	require.NoError(t, err)
+	l2.Close()
+	l.Close()
+
+	// stale sockets are replaced
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	l, _, err = setupListener("unix:"+path, false)
+	require.NoError(t, err)
+	l.Close()
+
+	// other files are never removed
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	_, _, err = setupListener("unix:"+file, true)
+	assert.ErrorContains(t, err, "not a socket")
+	assert.FileExists(t, file)
+}
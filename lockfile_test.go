@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fcgiwrap.lock")
+
+	lock, err := acquireLockFile(path)
+	require.NoError(t, err)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), string(content))
+
+	_, err = acquireLockFile(path)
+	assert.ErrorContains(t, err, "another instance")
+
+	// released on close
+	require.NoError(t, lock.Close())
+	lock, err = acquireLockFile(path)
+	require.NoError(t, err)
+	lock.Close()
+}
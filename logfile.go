@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedLogTime is appended to the name of rotated log files
+const rotatedLogTime = "20060102T150405.000"
+
+// logFile is a log file which is rotated once it exceeds maxSize bytes or is
+// older than maxAge (0: never). Rotated files get a timestamp suffix, only the
+// newest keep are kept (0: all). After it was rotated externally (logrotate)
+// it has to be reopened.
+type logFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen opens the file again, e.g. after it was rotated by logrotate
+func (l *logFile) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open()
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && (l.maxSize > 0 && l.size+int64(len(p)) > l.maxSize || l.maxAge > 0 && time.Since(l.opened) > l.maxAge) {
+		if err := l.rotate(); err != nil {
+			// keep logging to the current file, stderr is the only place
+			// left to report it
+			fmt.Fprintf(os.Stderr, "rotating log file %s failed: %v\n", l.path, err)
+			l.opened = time.Now()
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one
+func (l *logFile) rotate() error {
+	if err := os.Rename(l.path, l.path+"."+time.Now().Format(rotatedLogTime)); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	return l.prune()
+}
+
+// prune removes the oldest rotated files exceeding keep. Only the files
+// rotated by us count, not e.g. fcgiwrap.log.1.gz of logrotate.
+func (l *logFile) prune() error {
+	if l.keep <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, name := range matches {
+		suffix := strings.TrimPrefix(name, l.path+".")
+		if _, err := time.Parse(rotatedLogTime, suffix); err == nil && len(suffix) == len(rotatedLogTime) {
+			rotated = append(rotated, name)
+		}
+	}
+	// the timestamps sort chronologically
+	slices.Sort(rotated)
+	for len(rotated) > l.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
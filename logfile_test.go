@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fcgiwrap.log")
+	l, err := openLogFile(path, 20, 0, 2)
+	require.NoError(t, err)
+	// not rotated by us
+	others := []string{path + ".1.gz", path + ".access"}
+	for _, name := range others {
+		require.NoError(t, os.WriteFile(name, nil, 0o644))
+	}
+
+	for i := range 4 {
+		_, err := l.Write([]byte(strings.Repeat(string(rune('a'+i)), 15) + "\n"))
+		require.NoError(t, err)
+		// distinct timestamps of the rotated files
+		time.Sleep(2 * time.Millisecond)
+	}
+	for _, name := range others {
+		assert.FileExists(t, name)
+		require.NoError(t, os.Remove(name))
+	}
+	rotated, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 2, "only the newest are kept")
+	data, err := os.ReadFile(rotated[1])
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("c", 15)+"\n", string(data))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("d", 15)+"\n", string(data))
+
+	// rotated by age
+	l, err = openLogFile(path, 0, 10*time.Millisecond, 0)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = l.Write([]byte("new\n"))
+	require.NoError(t, err)
+	rotated, err = filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Len(t, rotated, 3)
+}
+
+func TestLogFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fcgiwrap.log")
+	l, err := openLogFile(path, 0, 0, 0)
+	require.NoError(t, err)
+	_, err = l.Write([]byte("before\n"))
+	require.NoError(t, err)
+
+	// like logrotate
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, l.reopen())
+	_, err = l.Write([]byte("after\n"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "before\n", string(data))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "after\n", string(data))
+}
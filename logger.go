@@ -5,6 +5,7 @@
 package main
 
 import (
+	"io"
 	"log/slog"
 	"os"
 	"strings"
@@ -13,10 +14,11 @@ import (
 	"github.com/lmittmann/tint"
 )
 
-// setup the logging options
-func setupLogger(format string, level string) *slog.Logger {
-	var handler slog.Handler
+// logLevel is the level of the logger, it can be changed at runtime (SIGHUP)
+var logLevel slog.LevelVar
 
+// setLogLevel sets logLevel from its name
+func setLogLevel(level string) {
 	var slevel = slog.LevelInfo
 	switch strings.ToLower(level) {
 	case "debug": slevel = slog.LevelDebug
@@ -24,21 +26,42 @@ func setupLogger(format string, level string) *slog.Logger {
 	case "warn": slevel = slog.LevelWarn
 	case "error": slevel = slog.LevelError
 	}
+	logLevel.Set(slevel)
+}
+
+// setup the logging options, logging to w (unless the format is a system
+// logger)
+func setupLogger(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var handler slog.Handler
+
+	setLogLevel(level)
+	slevel := &logLevel
 
 	switch strings.ToLower(format) {
+	case "syslog":
+		var err error
+		if handler, err = newSyslogHandler("", "", slevel); err != nil {
+			return nil, err
+		}
+	case "journald":
+		var err error
+		if handler, err = newJournaldHandler(journaldSocket, slevel); err != nil {
+			return nil, err
+		}
 	case "json":
-		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		handler = slog.NewJSONHandler(w, &slog.HandlerOptions{
 			Level: slevel,
 		})
 	case "text":
 		fallthrough
 	default:
-		handler = tint.NewHandler(os.Stderr, &tint.Options{
+		handler = tint.NewHandler(w, &tint.Options{
 			Level:      slevel,
 			TimeFormat: time.RFC3339,
-			NoColor:    false,
+			// no escape sequences in files
+			NoColor: w != os.Stderr,
 		})
 	}
 
-	return slog.New(handler)
+	return slog.New(handler), nil
 }
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// sampleKey identifies identical records. Records with the same message
+// differing in their "line" (e.g. CGI stderr) or "error" aren't repeats.
+type sampleKey struct {
+	level  slog.Level
+	msg    string
+	script string
+	// name and value of the "line" or "error" attribute
+	detailKey string
+	detail    string
+}
+
+type sampleEntry struct {
+	start      time.Time
+	count      int
+	suppressed int
+	// handler the suppressed records were sent to, used for the summary
+	handler slog.Handler
+}
+
+// logSampler limits identical warnings and errors (same level, message,
+// script and line or error) to burst per window. The suppressed ones are summarized in one record
+// once the window is over, so a script failing thousands of times doesn't
+// flood the log.
+type logSampler struct {
+	burst  int
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[sampleKey]*sampleEntry
+}
+
+func newLogSampler(burst int, window time.Duration) *logSampler {
+	return &logSampler{burst: burst, window: window, entries: make(map[sampleKey]*sampleEntry)}
+}
+
+// run summarizes the finished windows periodically
+func (s *logSampler) run() {
+	for now := range time.Tick(s.window) {
+		s.flush(now)
+	}
+}
+
+// allow reports whether the record r for handler h is logged
+func (s *logSampler) allow(h slog.Handler, r slog.Record) bool {
+	key := sampleKey{level: r.Level, msg: r.Message}
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "script":
+			key.script = a.Value.String()
+		case "line", "error":
+			key.detailKey, key.detail = a.Key, a.Value.String()
+		}
+		return true
+	})
+
+	s.mu.Lock()
+	e := s.entries[key]
+	var finished *sampleEntry
+	if e == nil || r.Time.Sub(e.start) >= s.window {
+		finished = e
+		e = &sampleEntry{start: r.Time}
+		s.entries[key] = e
+	}
+	e.count++
+	allowed := e.count <= s.burst
+	if !allowed {
+		e.suppressed++
+		e.handler = h
+	}
+	s.mu.Unlock()
+
+	if finished != nil {
+		summarizeSamples(key, finished, r.Time)
+	}
+	return allowed
+}
+
+// flush summarizes and forgets the entries whose window is over at now
+func (s *logSampler) flush(now time.Time) {
+	s.mu.Lock()
+	finished := make(map[sampleKey]*sampleEntry)
+	for key, e := range s.entries {
+		if now.Sub(e.start) >= s.window {
+			finished[key] = e
+			delete(s.entries, key)
+		}
+	}
+	s.mu.Unlock()
+	for key, e := range finished {
+		summarizeSamples(key, e, now)
+	}
+}
+
+// summarizeSamples logs how often the record of key was suppressed (if at
+// all)
+func summarizeSamples(key sampleKey, e *sampleEntry, now time.Time) {
+	if e.suppressed == 0 {
+		return
+	}
+	r := slog.NewRecord(now, key.level, fmt.Sprintf("%s (repeated %d times)", key.msg, e.suppressed), 0)
+	if key.script != "" {
+		r.AddAttrs(slog.String("script", key.script))
+	}
+	if key.detailKey != "" {
+		r.AddAttrs(slog.String(key.detailKey, key.detail))
+	}
+	r.AddAttrs(slog.Int("repeated", e.suppressed))
+	_ = e.handler.Handle(context.Background(), r)
+}
+
+// sampleHandler is a slog.Handler passing warnings and errors on only if the
+// sampler allows it
+type sampleHandler struct {
+	slog.Handler
+	s *logSampler
+}
+
+func (h sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn && !h.s.allow(h.Handler, r) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return sampleHandler{h.Handler.WithAttrs(attrs), h.s}
+}
+
+func (h sampleHandler) WithGroup(name string) slog.Handler {
+	return sampleHandler{h.Handler.WithGroup(name), h.s}
+}
@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSampler(t *testing.T) {
+	var buf bytes.Buffer
+	s := newLogSampler(2, time.Hour)
+	logger := slog.New(sampleHandler{slog.NewJSONHandler(&buf, nil), s})
+
+	for range 5 {
+		logger.Error("CGI exited with error", "script", "/srv/a.cgi")
+		logger.Info("request finished", "script", "/srv/a.cgi")
+	}
+	logger.Error("CGI exited with error", "script", "/srv/b.cgi")
+	s.flush(time.Now().Add(time.Hour))
+
+	var errors []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		if rec["level"] == "ERROR" {
+			errors = append(errors, rec)
+		}
+	}
+	assert.Equal(t, 5, strings.Count(buf.String(), "request finished"), "info records aren't sampled")
+	require.Len(t, errors, 4)
+	assert.Equal(t, "/srv/a.cgi", errors[0]["script"])
+	assert.Equal(t, "/srv/a.cgi", errors[1]["script"])
+	assert.Equal(t, "/srv/b.cgi", errors[2]["script"])
+	assert.Equal(t, "CGI exited with error (repeated 3 times)", errors[3]["msg"])
+	assert.Equal(t, "/srv/a.cgi", errors[3]["script"])
+	assert.Equal(t, float64(3), errors[3]["repeated"])
+
+	// a new window starts after the summary
+	buf.Reset()
+	logger.Error("CGI exited with error", "script", "/srv/a.cgi")
+	assert.Contains(t, buf.String(), `"msg":"CGI exited with error"`)
+
+	// distinct stderr lines (e.g. a traceback) aren't repeats
+	buf.Reset()
+	for i := range 5 {
+		logger.Warn("CGI stderr", "script", "/srv/a.cgi", "line", "frame "+strconv.Itoa(i))
+	}
+	logger.Warn("CGI stderr", "script", "/srv/a.cgi", "line", "frame 0")
+	logger.Warn("CGI stderr", "script", "/srv/a.cgi", "line", "frame 0")
+	s.flush(time.Now().Add(2 * time.Hour))
+	for i := range 5 {
+		assert.Contains(t, buf.String(), `"line":"frame `+strconv.Itoa(i)+`"`)
+	}
+	assert.Contains(t, buf.String(), `"msg":"CGI stderr (repeated 1 times)","script":"/srv/a.cgi","line":"frame 0"`)
+}
@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logEntry is a single log record as exposed via the admin API
+type logEntry struct {
+	Time  time.Time      `json:"time"`
+	Level slog.Level     `json:"level"`
+	Msg   string         `json:"msg"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// logHub keeps the most recent log entries (at least minLevel) and distributes
+// new ones to subscribers (live tail)
+type logHub struct {
+	mu       sync.Mutex
+	minLevel slog.Level
+	recent   []logEntry
+	next     int
+	full     bool
+	subs     map[chan logEntry]struct{}
+}
+
+func newLogHub(size int, minLevel slog.Level) *logHub {
+	return &logHub{
+		minLevel: minLevel,
+		recent:   make([]logEntry, size),
+		subs:     make(map[chan logEntry]struct{}),
+	}
+}
+
+// publish stores the entry and hands it to all subscribers. Subscribers which
+// can't keep up miss entries instead of blocking logging.
+func (h *logHub) publish(e logEntry) {
+	if e.Level < h.minLevel {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.recent) > 0 {
+		h.recent[h.next] = e
+		h.next = (h.next + 1) % len(h.recent)
+		h.full = h.full || h.next == 0
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// snapshot returns the stored entries from oldest to newest
+func (h *logHub) snapshot() []logEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.snapshotLocked()
+}
+
+func (h *logHub) snapshotLocked() []logEntry {
+	if !h.full {
+		return append([]logEntry(nil), h.recent[:h.next]...)
+	}
+	return append(append([]logEntry(nil), h.recent[h.next:]...), h.recent[:h.next]...)
+}
+
+// subscribe returns the current backlog and a channel receiving all entries
+// published afterwards. cancel must be called once done.
+func (h *logHub) subscribe() (backlog []logEntry, ch <-chan logEntry, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan logEntry, 64)
+	h.subs[c] = struct{}{}
+	return h.snapshotLocked(), c, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, c)
+	}
+}
+
+// tailHandler is a slog.Handler publishing records to logHubs (down to their
+// minLevel) and forwarding the ones enabled there to next
+type tailHandler struct {
+	next   slog.Handler
+	hubs   []*logHub
+	attrs  []slog.Attr
+	prefix string
+}
+
+func newTailHandler(next slog.Handler, hubs ...*logHub) *tailHandler {
+	return &tailHandler{next: next, hubs: hubs}
+}
+
+func (h *tailHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, hub := range h.hubs {
+		if level >= hub.minLevel {
+			return true
+		}
+	}
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *tailHandler) Handle(ctx context.Context, r slog.Record) error {
+	e := logEntry{
+		Time:  r.Time,
+		Level: r.Level,
+		Msg:   r.Message,
+		Attrs: make(map[string]any),
+	}
+	for _, a := range h.attrs {
+		addAttr(e.Attrs, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(e.Attrs, h.prefix, a)
+		return true
+	})
+	for _, hub := range h.hubs {
+		hub.publish(e)
+	}
+
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *tailHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.next = h.next.WithAttrs(attrs)
+	n.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		n.attrs = append(n.attrs, a)
+	}
+	return &n
+}
+
+func (h *tailHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.next = h.next.WithGroup(name)
+	n.prefix = h.prefix + name + "."
+	return &n
+}
+
+// addAttr flattens a into m (groups are joined with ".")
+func addAttr(m map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		for _, g := range v.Group() {
+			addAttr(m, prefix+a.Key+".", g)
+		}
+	case slog.KindDuration:
+		m[prefix+a.Key] = v.Duration().String()
+	case slog.KindAny:
+		m[prefix+a.Key] = fmt.Sprint(v.Any())
+	default:
+		m[prefix+a.Key] = v.Any()
+	}
+}
+
+// logFilter selects log entries for the admin API
+type logFilter struct {
+	level     slog.Level
+	requestID string
+	script    string
+}
+
+func (f logFilter) match(e logEntry) bool {
+	if e.Level < f.level {
+		return false
+	}
+	if f.requestID != "" && fmt.Sprint(e.Attrs["request_id"]) != f.requestID {
+		return false
+	}
+	if f.script != "" {
+		s, ok := e.Attrs["script"]
+		if !ok || !strings.Contains(fmt.Sprint(s), f.script) {
+			return false
+		}
+	}
+	return true
+}
@@ -6,10 +6,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
-	"net/http/fcgi"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,26 +22,225 @@ import (
 	"time"
 
 	"github.com/alexflint/go-arg"
-	"golang.org/x/sync/semaphore"
 )
 
 // arguments holds command-line arguments parsed by go-arg
 type arguments struct {
-	Socket     string `arg:"-s,--socket" help:"Socket URL (tcp:host:port or unix:/path). Default: stdin"`
-	Timeout    int    `arg:"-t,--timeout" help:"Idle timeout in seconds; exit if no new request within this period"`
-	Workers    int    `arg:"-w,--workers" help:"Max concurrent CGI handlers (default 1)"`
-	ForwardErr bool   `arg:"-f,--forward-stderr" help:"Forward CGI stderr over FastCGI instead of host stderr"`
-	LogFormat  string `arg:"--log-format" help:"Log format: 'json' (default) or 'test'"`
-	LogLevel   string `arg:"--log-level" help:"Log level: 'info' (default), 'debug', 'warn' or 'error'"`
+	Socket             string            `arg:"-s,--socket,env:FCGIWRAP_SOCKET" help:"Socket URL (tcp:host:port or unix:/path). Default: stdin"`
+	HTTP               string            `arg:"--http,env:FCGIWRAP_HTTP" help:"Serve plain HTTP on host:port, e.g. to test scripts with curl without a web server. Scripts are looked up by the URL path below --http-root. Only FastCGI is served on --socket if it is given as well"`
+	AJP                string            `arg:"--ajp,env:FCGIWRAP_AJP" help:"Serve AJP 1.3 (e.g. for mod_proxy_ajp) on host:port (bind it to localhost unless --ajp-secret is set). Scripts are looked up like with --http. Only FastCGI is served on --socket if it is given as well"`
+	AJPSecret          string            `arg:"--ajp-secret,env:FCGIWRAP_AJP_SECRET" help:"Secret AJP requests have to carry (secret of mod_proxy_ajp, shared secret of mod_jk), others are rejected with 403"`
+	HTTPRoot           string            `arg:"--http-root,env:FCGIWRAP_HTTP_ROOT" help:"Directory scripts are looked up in with --http and --ajp. Default: --document-root or the working directory"`
+	ForceSocket        bool              `arg:"--force-socket,env:FCGIWRAP_FORCE_SOCKET" help:"Replace existing unix sockets even if another process is still listening on them"`
+	LockFile           string            `arg:"--lock-file,env:FCGIWRAP_LOCK_FILE" help:"Hold an exclusive lock on this file while running, a second instance using the same file fails to start"`
+	ConfigFile         string            `arg:"-c,--config,env:FCGIWRAP_CONFIG" help:"YAML or TOML (by .toml extension) configuration file, keys are the long flag names (see 'config schema'). Flags override values from the file"`
+	Vhosts             []vhostConfig     `arg:"--vhost,separate,env:FCGIWRAP_VHOST" help:"Settings for requests to hosts (SERVER_NAME or Host header) matching a glob as HOST=FILE, e.g. '*.example.org=/etc/fcgiwrap/example.yaml'. FILE is a configuration file like --config with the per-request keys like document-root, alias, exec-prefix, limits (repeatable, the first match wins)"`
+	SBOM               bool              `arg:"--sbom" help:"Print a CycloneDX SBOM of the binary (modules from the embedded build information) and exit"`
+	Timeout            int               `arg:"-t,--timeout,env:FCGIWRAP_TIMEOUT" help:"Idle timeout in seconds; exit if no new request within this period"`
+	Workers            int               `arg:"-w,--workers,env:FCGIWRAP_WORKERS" help:"Max concurrent CGI handlers (default 1)"`
+	MaxQueue           int               `arg:"--max-queue,env:FCGIWRAP_MAX_QUEUE" help:"Max requests waiting for a worker, further ones are rejected with 503 (0: unlimited)"`
+	QueueTimeout       time.Duration     `arg:"--queue-timeout,env:FCGIWRAP_QUEUE_TIMEOUT" help:"Max time a request waits for a worker before it is rejected with 503 (0: unlimited)"`
+	Rate               float64           `arg:"--rate,env:FCGIWRAP_RATE" help:"Max requests per second overall, further ones wait up to --rate-wait or are rejected with 503 (0: unlimited)"`
+	RateBurst          int               `arg:"--rate-burst,env:FCGIWRAP_RATE_BURST" help:"Requests allowed at once beyond --rate (default: the rate)"`
+	RateWait           time.Duration     `arg:"--rate-wait,env:FCGIWRAP_RATE_WAIT" help:"Max time a request exceeding --rate waits for its turn (0: rejected right away)"`
+	ClientRate         float64           `arg:"--client-rate,env:FCGIWRAP_CLIENT_RATE" help:"Max requests per second per client IP (REMOTE_ADDR), further ones are rejected with 429 (0: unlimited)"`
+	ClientBurst        int               `arg:"--client-burst,env:FCGIWRAP_CLIENT_BURST" help:"Requests a client may send at once beyond --client-rate (default: the rate)"`
+	MaxPerClient       int               `arg:"--max-per-client,env:FCGIWRAP_MAX_PER_CLIENT" help:"Max concurrent requests per client IP (REMOTE_ADDR), further ones are rejected with 429 (0: unlimited)"`
+	SpoolBody          byteSize          `arg:"--spool-body,env:FCGIWRAP_SPOOL_BODY" help:"Read request bodies completely before occupying a worker and verify them against CONTENT_LENGTH, bodies larger than this are spooled to a temp file, e.g. 1M (0: stream bodies to the children)"`
+	SpoolDir           string            `arg:"--spool-dir,env:FCGIWRAP_SPOOL_DIR" help:"Directory for spooled request bodies and the FastCGI stdin queued beyond 1M per request. Default: $TMPDIR or /tmp"`
+	SpoolMax           byteSize          `arg:"--spool-max,env:FCGIWRAP_SPOOL_MAX" help:"Max size of a spooled request body, larger ones are rejected with 413 (0: unlimited)"`
+	SpoolQuota         byteSize          `arg:"--spool-quota,env:FCGIWRAP_SPOOL_QUOTA" help:"Max disk space used by all spooled request bodies together, requests exceeding it are rejected with 503 (0: unlimited)"`
+	MaxBodySize        byteSize          `arg:"--max-body-size,env:FCGIWRAP_MAX_BODY_SIZE" help:"Max size of request bodies, e.g. 10M. Larger ones are rejected with 413 before the script is started, or the script is killed once it read too much (0: unlimited)"`
+	UploadGrace        time.Duration     `arg:"--upload-grace,env:FCGIWRAP_UPLOAD_GRACE" help:"How long a script may keep running once the upload of its request body was cut off (client disconnect) and its stdin closed, before it gets SIGTERM"`
+	Warmup             []warmupRequest   `arg:"--warmup,separate,env:FCGIWRAP_WARMUP" help:"Request executed at startup before serving, as \"SCRIPT [PARAM=VALUE ...]\", e.g. to prime caches (repeatable)"`
+	ThreadPool         int               `arg:"--thread-pool,env:FCGIWRAP_THREAD_POOL" help:"Start CGI children from N dedicated OS threads and wait for their exit in the netpoller instead of blocking one thread per child (-1: GOMAXPROCS, 0: disabled)"`
+	MaxThreads         int               `arg:"--max-threads,env:FCGIWRAP_MAX_THREADS" help:"Limit of OS threads of the wrapper, exceeding it crashes the wrapper (0: go default of 10000)"`
+	Reap               bool              `arg:"--reap,env:FCGIWRAP_REAP" help:"Become child subreaper and reap orphaned processes of double-forking CGI scripts (always done as PID 1)"`
+	SlowThreshold      time.Duration     `arg:"--slow-threshold,env:FCGIWRAP_SLOW_THRESHOLD" help:"Log a warning with the (redacted) environment for requests taking longer than this, e.g. 2s. Default: disabled"`
+	ExecTimeout        time.Duration     `arg:"--exec-timeout,env:FCGIWRAP_EXEC_TIMEOUT" help:"Kill CGI children running longer than this, e.g. 30s; answered with 504 if no headers were sent yet (per script: FCGI_TIMEOUT param). Default: no limit"`
+	TimeoutSignal      signalName        `arg:"--timeout-signal,env:FCGIWRAP_TIMEOUT_SIGNAL" help:"Signal sent to CGI children shortly before the execution timeout, e.g. SIGALRM, so they can flush output or report an error (per script: FCGI_TIMEOUT_SIGNAL param). Default: none"`
+	TimeoutGrace       time.Duration     `arg:"--timeout-grace,env:FCGIWRAP_TIMEOUT_GRACE" help:"How long before the execution timeout the --timeout-signal is sent"`
+	DocumentRoot       string            `arg:"--document-root,env:FCGIWRAP_DOCUMENT_ROOT" help:"DOCUMENT_ROOT used for all requests, overriding the one passed by the web server, so scripts outside of it are never executed"`
+	StripPrefix        string            `arg:"--strip-prefix,env:FCGIWRAP_STRIP_PREFIX" help:"URL prefix removed from SCRIPT_NAME (or the URL path with --http/--ajp) before it is looked up below the DOCUMENT_ROOT, e.g. /cgi-bin. Only used if the web server doesn't pass SCRIPT_FILENAME"`
+	Alias              []scriptAlias     `arg:"--alias,separate,env:FCGIWRAP_ALIAS" help:"Map a SCRIPT_NAME prefix to a script or directory of scripts outside of the DOCUMENT_ROOT as PREFIX=PATH, e.g. /git=/usr/lib/git-core/git-http-backend (repeatable, the first match wins)"`
+	DirIndex           []string          `arg:"--dir-index,separate,env:FCGIWRAP_DIR_INDEX" help:"Index script executed if the requested script is a directory, the first one existing is used (repeatable, \"\": none). Default: index.cgi and index.pl"`
+	ResolveDocRoot     bool              `arg:"--resolve-docroot,env:FCGIWRAP_RESOLVE_DOCROOT" help:"Resolve symlinks of the DOCUMENT_ROOT and the directories of scripts before checking that scripts are below it (e.g. /var/www/html -> releases/N with nginx passing $realpath_root). Scripts which are symlinks are still rejected"`
+	FollowSymlinks     bool              `arg:"--follow-symlinks,env:FCGIWRAP_FOLLOW_SYMLINKS" help:"Allow scripts which are symlinks. All symlinks of the script path and the DOCUMENT_ROOT (e.g. /var/www/current -> release dir) are resolved, the resolved script must be below the resolved DOCUMENT_ROOT or a --symlink-root"`
+	SymlinkRoots       []string          `arg:"--symlink-root,separate,env:FCGIWRAP_SYMLINK_ROOT" help:"Additional directory resolved scripts may be in with --follow-symlinks (repeatable)"`
+	Allow              []pathPattern     `arg:"--allow,separate,env:FCGIWRAP_ALLOW" help:"Only execute scripts whose (resolved) path matches one of these patterns: a glob with ** across directories, e.g. /srv/www/cgi-bin/**, or a regular expression prefixed with re: (repeatable)"`
+	Deny               []pathPattern     `arg:"--deny,separate,env:FCGIWRAP_DENY" help:"Never execute scripts whose (resolved) path matches this pattern, e.g. **/private/** (repeatable, like --allow)"`
+	Hidden             []string          `arg:"--hidden,separate,env:FCGIWRAP_HIDDEN" help:"Glob of path components below the DOCUMENT_ROOT which are hidden, scripts below or named like them are never executed (repeatable, \"\": none). Default: .* (dotfiles, e.g. .git)"`
+	Suexec             bool              `arg:"--suexec,env:FCGIWRAP_SUEXEC" help:"Refuse scripts which are writable by group or others or setuid/setgid (like Apache suexec)"`
+	SuexecDir          bool              `arg:"--suexec-dir,env:FCGIWRAP_SUEXEC_DIR" help:"With --suexec also check that the directory of the script isn't writable by group or others and is owned by --script-owner"`
+	ScriptOwner        scriptOwner       `arg:"--script-owner,env:FCGIWRAP_SCRIPT_OWNER" help:"With --suexec scripts must be owned by this user[:group] (names or ids), e.g. www-cgi or :1000"`
+	DirConfig          bool              `arg:"--dir-config,env:FCGIWRAP_DIR_CONFIG" help:"Honor .fcgiwrap.toml files in the directory of a script or its nearest ancestor below the DOCUMENT_ROOT, setting interpreter, timeout, env and allow/deny rules for that subtree. Only enable it if everybody able to write below the document root may configure scripts"`
+	FSTimeout          time.Duration     `arg:"--fs-timeout,env:FCGIWRAP_FS_TIMEOUT" help:"Timeout for filesystem checks of the script (e.g. on hung network filesystems), answered with 503. Default: no timeout"`
+	FSBreakerThreshold int               `arg:"--fs-breaker-threshold,env:FCGIWRAP_FS_BREAKER_THRESHOLD" help:"Consecutive filesystem timeouts after which further requests fail immediately with 503"`
+	FSBreakerCooldown  time.Duration     `arg:"--fs-breaker-cooldown,env:FCGIWRAP_FS_BREAKER_COOLDOWN" help:"Time before the filesystem is probed again after the breaker opened"`
+	StatCacheTTL       time.Duration     `arg:"--stat-cache-ttl,env:FCGIWRAP_STAT_CACHE_TTL" help:"How long the results of the filesystem checks of scripts are cached, changes to their directories and new scripts take up to this long to be noticed (0: no caching)"`
+	ForwardErr         bool              `arg:"-f,--forward-stderr,env:FCGIWRAP_FORWARD_STDERR" help:"Forward CGI stderr over FastCGI instead of host stderr"`
+	RawStderr          bool              `arg:"--raw-stderr,env:FCGIWRAP_RAW_STDERR" help:"Pass CGI stderr on to the stderr of the wrapper as is. Default: it is logged line by line, tagged with the script, pid and request ID"`
+	StderrDir          string            `arg:"--stderr-dir,env:FCGIWRAP_STDERR_DIR" help:"Append the stderr of each script to its own file in this directory (e.g. srv_www_cgi-bin_backup.cgi.log) instead of logging it"`
+	StderrMax          byteSize          `arg:"--stderr-max,env:FCGIWRAP_STDERR_MAX" help:"Max amount of stderr logged per request, the rest is dropped (0: unlimited)"`
+	MetaHeaders        bool              `arg:"--meta-headers,env:FCGIWRAP_META_HEADERS" help:"Add X-FCGIWrap-Exec-Time and X-FCGIWrap-Exit-Code response headers (e.g. for $upstream_http_* in nginx). Buffers up to 64KiB of output to learn the exit code"`
+	DebugHeaders       bool              `arg:"--debug-headers,env:FCGIWRAP_DEBUG_HEADERS" help:"Add X-CGI-Exit-Status, X-CGI-Pid and X-CGI-Duration response headers for debugging scripts. Buffers up to 64KiB of output to learn the exit status"`
+	StripContentLength bool              `arg:"--strip-content-length,env:FCGIWRAP_STRIP_CONTENT_LENGTH" help:"Remove the Content-Length header of script responses and let the web server frame them (mismatches are only logged). Default: responses are cut at the declared length or aborted if shorter"`
+	NoBuffering        bool              `arg:"--no-buffering,env:FCGIWRAP_NO_BUFFERING" help:"Flush the output of scripts to the web server as soon as it is read, e.g. for Server-Sent Events. Scripts can request this themselves with the header X-Accel-Buffering: no (also honored by nginx)"`
+	BufferResponse     byteSize          `arg:"--buffer-response,env:FCGIWRAP_BUFFER_RESPONSE" help:"Collect the output of scripts up to this size (e.g. 1M) before sending it, so scripts exiting non-zero or timing out are answered with a clean 500/504 instead of a half-written response. Larger or flushed output is streamed (0: disabled)"`
+	Compress           bool              `arg:"--compress,env:FCGIWRAP_COMPRESS" help:"Compress the output of scripts with gzip or deflate if the client accepts it and the script didn't set a Content-Encoding"`
+	CompressMinSize    byteSize          `arg:"--compress-min-size,env:FCGIWRAP_COMPRESS_MIN_SIZE" help:"Smallest body compressed with --compress"`
+	CompressTypes      []string          `arg:"--compress-types,separate,env:FCGIWRAP_COMPRESS_TYPES" help:"Glob pattern of the media types compressed with --compress (repeatable). Default: text/*, JSON, JavaScript, XML and SVG"`
+	CompressLevels     []compressLevel   `arg:"--compress-level,separate,env:FCGIWRAP_COMPRESS_LEVEL" help:"Compression level of the media types matching a glob as GLOB=LEVEL, from 1 (fastest) to 9 (smallest), 0 (stored) or -2 (Huffman only), e.g. 'application/json=1' (repeatable, the first match wins). Default: 6"`
+	CompressZstd       bool              `arg:"--compress-zstd,env:FCGIWRAP_COMPRESS_ZSTD" help:"Offer zstd with --compress as well, preferred over gzip and deflate"`
+	CompressWindows    []compressWindow  `arg:"--compress-window,separate,env:FCGIWRAP_COMPRESS_WINDOW" help:"zstd window of the media types matching a glob as GLOB=SIZE, a power of two from 1K to 8M, e.g. 'application/json=256K' (repeatable, the first match wins). gzip and deflate always use 32K. Default: depends on the level"`
+	CompressDicts      []compressDict    `arg:"--compress-dict,separate,env:FCGIWRAP_COMPRESS_DICT" help:"zstd dictionary of the media types matching a glob as GLOB=PATH (repeatable, the first match wins). Used with --compress if the client accepts dcz and announces the dictionary via Available-Dictionary (Compression Dictionary Transport)"`
+	Sendfile           bool              `arg:"--sendfile,env:FCGIWRAP_SENDFILE" help:"Serve files referenced by scripts via X-Sendfile (absolute path) or X-Accel-Redirect (path below the document root) instead of their body, with support for range requests. Only files below the document root are served. Default: the headers are passed on to the web server"`
+	ErrorPages         string            `arg:"--error-pages,env:FCGIWRAP_ERROR_PAGES" help:"Format of the responses to errors of the wrapper itself (403, 502, 504, ...): 'text' (default), 'html' or 'json'. They only contain the status and the request ID, details are logged" enum:"text,html,json"`
+	ErrorTemplate      string            `arg:"--error-template,env:FCGIWRAP_ERROR_TEMPLATE" help:"html/template file for --error-pages html, executed with .Status, .StatusText and .RequestID"`
+	HeaderlessType     string            `arg:"--headerless-type,env:FCGIWRAP_HEADERLESS_TYPE" help:"Serve output of scripts which doesn't start with a header block with this Content-Type, e.g. text/plain. Default: answer 502"`
+	DefaultContentType string            `arg:"--default-content-type,env:FCGIWRAP_DEFAULT_CONTENT_TYPE" help:"Content-Type of responses whose header block lacks one, e.g. application/json. Default: sniffed from the body"`
+	MaxHeaders         int               `arg:"--max-headers,env:FCGIWRAP_MAX_HEADERS" help:"Max number of header lines a script may send (interim responses included), exceeding it kills the script and answers 502 (0: unlimited)"`
+	MaxHeaderBytes     byteSize          `arg:"--max-header-bytes,env:FCGIWRAP_MAX_HEADER_BYTES" help:"Max size of the header section a script may send, e.g. 64K (0: unlimited)"`
+	MaxResponseSize    byteSize          `arg:"--max-response-size,env:FCGIWRAP_MAX_RESPONSE_SIZE" help:"Max size of the body a script may send, e.g. 100M. A script sending more is killed and the response aborted (0: unlimited)"`
+	ContentDisposition []dispositionRule `arg:"--content-disposition,separate,env:FCGIWRAP_CONTENT_DISPOSITION" help:"Content-Disposition policy for scripts matching a glob as GLOB=POLICY: keep, sanitize (safe filename, invalid ones dropped), inline or attachment (safe filename from PATH_INFO) (repeatable, per script: FCGI_CONTENT_DISPOSITION param)"`
+	LocalRedirect      string            `arg:"--local-redirect,env:FCGIWRAP_LOCAL_REDIRECT" help:"How local redirects of scripts (only a Location header with a path) are answered: 'internal' (default): the location is served instead, '302': redirect the client" enum:"internal,302"`
+	HeadMode           string            `arg:"--head-mode,env:FCGIWRAP_HEAD_MODE" help:"How HEAD requests are served, the body is never sent: 'run' (default): run the script with REQUEST_METHOD=HEAD, 'get': run it as GET (for scripts not knowing HEAD), 'skip': don't run it, answer 200 without headers" enum:"run,get,skip"`
+	DryRun             bool              `arg:"--dry-run,env:FCGIWRAP_DRY_RUN" help:"Only log the command, working directory and environment CGI children would be executed with and answer 200 without executing anything, e.g. to validate fastcgi_param configs"`
+	LogFormat          string            `arg:"--log-format,env:FCGIWRAP_LOG_FORMAT" help:"Log format: 'json' (default), 'text', or 'syslog'/'journald' to log to the system logger" enum:"json,text,syslog,journald"`
+	LogFile            string            `arg:"--log-file,env:FCGIWRAP_LOG_FILE" help:"Log to this file instead of stderr (reopened on SIGHUP, e.g. for logrotate)"`
+	LogMaxSize         byteSize          `arg:"--log-max-size,env:FCGIWRAP_LOG_MAX_SIZE" help:"Rotate the --log-file once it exceeds this size, e.g. 100M (0: never)"`
+	LogMaxAge          time.Duration     `arg:"--log-max-age,env:FCGIWRAP_LOG_MAX_AGE" help:"Rotate the --log-file once it was written to for this long, e.g. 24h (0: never)"`
+	LogKeep            int               `arg:"--log-keep,env:FCGIWRAP_LOG_KEEP" help:"Number of rotated log files kept (0: all)"`
+	LogBurst           int               `arg:"--log-burst,env:FCGIWRAP_LOG_BURST" help:"Max identical warnings/errors (same message, script and stderr line or error) logged per --log-burst-window, the rest is summarized in one record (0: unlimited)"`
+	LogBurstWindow     time.Duration     `arg:"--log-burst-window,env:FCGIWRAP_LOG_BURST_WINDOW" help:"Window of --log-burst"`
+	LogLevel           string            `arg:"--log-level,env:FCGIWRAP_LOG_LEVEL" help:"Log level: 'info' (default), 'debug', 'warn' or 'error'" enum:"debug,info,warn,error"`
+	LogEnvOnFailure    bool              `arg:"--log-env-on-failure,env:FCGIWRAP_LOG_ENV_ON_FAILURE" help:"Log the CGI environment of failed requests (at debug level, sensitive values redacted), e.g. to debug fastcgi_param configs"`
+	RedactHeader       []string          `arg:"--redact-header,separate,env:FCGIWRAP_REDACT_HEADER" help:"Header whose value is redacted in logs, in addition to Authorization, Cookie and *Key*/*Token*/*Secret*/*Password* (repeatable)"`
+	RedactEnv          []string          `arg:"--redact-env,separate,env:FCGIWRAP_REDACT_ENV" help:"Glob of variables (and log attributes) whose values are redacted in logs, e.g. *_DSN (repeatable)"`
+	RedactValue        []string          `arg:"--redact-value,separate,env:FCGIWRAP_REDACT_VALUE" help:"Regular expression, matching parts of logged values are redacted, e.g. \"sk-[A-Za-z0-9]+\" (repeatable)"`
+	ResolvConf         string            `arg:"--resolv-conf,env:FCGIWRAP_RESOLV_CONF" help:"File bind-mounted over /etc/resolv.conf for CGI children (per script: FCGI_RESOLV_CONF param)"`
+	HostsFile          string            `arg:"--hosts-file,env:FCGIWRAP_HOSTS_FILE" help:"File bind-mounted over /etc/hosts for CGI children (per script: FCGI_HOSTS param)"`
+	LimitCPU           int64             `arg:"--limit-cpu,env:FCGIWRAP_LIMIT_CPU" help:"RLIMIT_CPU for CGI children in seconds (0: unlimited)"`
+	LimitMem           byteSize          `arg:"--limit-mem,env:FCGIWRAP_LIMIT_MEM" help:"RLIMIT_AS for CGI children, e.g. 512M (0: unlimited)"`
+	LimitNofile        int64             `arg:"--limit-nofile,env:FCGIWRAP_LIMIT_NOFILE" help:"RLIMIT_NOFILE for CGI children (0: inherit)"`
+	LimitNproc         int64             `arg:"--limit-nproc,env:FCGIWRAP_LIMIT_NPROC" help:"RLIMIT_NPROC for CGI children; counts all processes of the user (0: unlimited)"`
+	Nice               int               `arg:"--nice,env:FCGIWRAP_NICE" help:"Nice value for CGI children (0: unchanged)"`
+	IONice             ioPriority        `arg:"--ionice,env:FCGIWRAP_IONICE" help:"IO priority for CGI children as class[:level], e.g. idle or best-effort:7"`
+	Locale             string            `arg:"--locale,env:FCGIWRAP_LOCALE" help:"Force LANG and LC_ALL for CGI children, e.g. C.UTF-8 (per script: FCGI_LOCALE param). Default: inherit"`
+	Timezone           string            `arg:"--timezone,env:FCGIWRAP_TIMEZONE" help:"Force TZ for CGI children, e.g. UTC (per script: FCGI_TIMEZONE param). Default: inherit"`
+	Env                envList           `arg:"-e,--env,separate,env:FCGIWRAP_ENV" help:"Additional environment variable KEY=VALUE for CGI children, e.g. PATH or PERL5LIB (repeatable)"`
+	PassEnv            []string          `arg:"--pass-env,separate,env:FCGIWRAP_PASS_ENV" help:"Only inherit these variables of the host environment to CGI children, NAME or PREFIX_* (repeatable). Default: everything which is not blocked"`
+	BlockEnv           []string          `arg:"--block-env,separate,env:FCGIWRAP_BLOCK_ENV" help:"Never inherit these variables of the host environment to CGI children, NAME or PREFIX_*, e.g. AWS_* (repeatable)"`
+	AuthzURL           string            `arg:"--authz-url,env:FCGIWRAP_AUTHZ_URL" help:"Endpoint the request metadata is POSTed to as JSON before executing a script: 2xx allows, 401/403 deny"`
+	AuthzCommand       string            `arg:"--authz-command,env:FCGIWRAP_AUTHZ_COMMAND" help:"Command (run via /bin/sh) getting the request metadata as JSON on stdin before executing a script: exit code 0 allows, 1 denies"`
+	AuthzTimeout       time.Duration     `arg:"--authz-timeout,env:FCGIWRAP_AUTHZ_TIMEOUT" help:"Timeout of the authorization callout"`
+	AuthzCacheTTL      time.Duration     `arg:"--authz-cache-ttl,env:FCGIWRAP_AUTHZ_CACHE_TTL" help:"How long authorization decisions are cached for identical request metadata (0: no caching)"`
+	AuthzFailOpen      bool              `arg:"--authz-fail-open,env:FCGIWRAP_AUTHZ_FAIL_OPEN" help:"Allow requests if the authorization callout fails (default: deny with 503)"`
+	CgroupParent       string            `arg:"--cgroup-parent,env:FCGIWRAP_CGROUP_PARENT" help:"Delegated cgroup v2 directory below which each CGI child gets its own cgroup (must not contain processes itself)"`
+	CgroupMode         string            `arg:"--cgroup-mode,env:FCGIWRAP_CGROUP_MODE" help:"'request' (default): transient cgroup per request, 'script': persistent cgroup per script" enum:"request,script"`
+	CgroupCPUMax       string            `arg:"--cgroup-cpu-max,env:FCGIWRAP_CGROUP_CPU_MAX" help:"Value written to cpu.max of the child cgroup, e.g. '50000 100000'"`
+	CgroupIOMax        []string          `arg:"--cgroup-io-max,separate,env:FCGIWRAP_CGROUP_IO_MAX" help:"Line written to io.max of the child cgroup, e.g. '8:0 rbps=1048576' (repeatable)"`
+	AdminAddr          string            `arg:"--admin-addr,env:FCGIWRAP_ADMIN_ADDR" help:"Socket URL (tcp:host:port or unix:/path) for the admin HTTP API. Unauthenticated, don't expose publicly. Default: disabled"`
+	LogBacklog         int               `arg:"--log-backlog,env:FCGIWRAP_LOG_BACKLOG" help:"Number of recent log records kept for the admin API"`
+	ErrorBacklog       int               `arg:"--error-backlog,env:FCGIWRAP_ERROR_BACKLOG" help:"Number of recent warnings/errors shown on the admin status endpoint"`
+	StatsFile          string            `arg:"--stats-file,env:FCGIWRAP_STATS_FILE" help:"File the request counters are saved to on shutdown and restored from at startup, so the status endpoint reports lifetime counts across (socket activated) restarts. They don't affect --timeout"`
+	StatsdAddr         string            `arg:"--statsd-addr,env:FCGIWRAP_STATSD_ADDR" help:"Send metrics via UDP to this statsd server (host:port, labels as DogStatsD tags) instead of serving them in the Prometheus format on the admin API"`
+	AccessLog          string            `arg:"--access-log,env:FCGIWRAP_ACCESS_LOG" help:"File the requests are logged to (one line each, reopened on SIGHUP). Default: disabled"`
+	AccessLogFormat    string            `arg:"--access-log-format,env:FCGIWRAP_ACCESS_LOG_FORMAT" help:"Format of the access log: 'combined' (default) or 'common'" enum:"common,combined"`
+	OtelEndpoint       string            `arg:"--otel-endpoint,env:FCGIWRAP_OTEL_ENDPOINT" help:"OTLP/HTTP endpoint the spans of the requests are exported to (JSON encoding), e.g. http://localhost:4318/v1/traces. Default: disabled"`
+	OtelServiceName    string            `arg:"--otel-service-name,env:FCGIWRAP_OTEL_SERVICE_NAME" help:"service.name of the exported spans"`
+	PingPath           string            `arg:"--ping-path,env:FCGIWRAP_PING_PATH" help:"URL path (e.g. /fcgi-ping) answered with 200 directly, without executing a script. Default: disabled"`
+	MetricsAddr        string            `arg:"--metrics-addr,env:FCGIWRAP_METRICS_ADDR" help:"Socket URL (tcp:host:port or unix:/path) serving only the Prometheus metrics on /metrics. Default: disabled"`
+	SeccompProfile     string            `arg:"--seccomp-profile,env:FCGIWRAP_SECCOMP_PROFILE" help:"Seccomp profile applied to CGI children before exec: *.json (docker/OCI format without argument filters) or raw BPF. Must allow execve"`
+	Sandbox            bool              `arg:"--sandbox,env:FCGIWRAP_SANDBOX" help:"Run CGI children in new mount/pid/ipc namespaces with a read-only view of the system directories and the document root (requires root)"`
+	SandboxBind        []string          `arg:"--sandbox-bind,separate,env:FCGIWRAP_SANDBOX_BIND" help:"Additional path made available read-only inside the sandbox (repeatable)"`
+	ExecPrefix         string            `arg:"--exec-prefix,env:FCGIWRAP_EXEC_PREFIX" help:"Command every CGI script is launched through, e.g. \"bwrap --ro-bind / / --dev /dev\"; the script and its arguments are appended (shell-like quoting, no expansions)"`
+	Interpreters       []interpreterRule `arg:"--interpreter,separate,env:FCGIWRAP_INTERPRETER" help:"Run scripts matching a glob through an interpreter as GLOB=COMMAND, e.g. '*.py=/usr/bin/python3' (repeatable, the first match wins, per script: FCGI_INTERPRETER param)"`
+	IsindexArgs        bool              `arg:"--isindex-args,env:FCGIWRAP_ISINDEX_ARGS" help:"Pass the words of ISINDEX queries (QUERY_STRING without \"=\") as command line arguments to scripts (RFC 3875 section 4.4). Only enable it for scripts which expect this"`
+	Persistent         []string          `arg:"--persistent,separate,env:FCGIWRAP_PERSISTENT" help:"Glob of scripts which are kept running and reused, they must speak the keep-alive protocol (repeatable, per script: FCGI_PERSISTENT param)"`
+	PersistentIdle     int               `arg:"--persistent-idle,env:FCGIWRAP_PERSISTENT_IDLE" help:"Max idle persistent children kept per script"`
+	PersistentTimeout  time.Duration     `arg:"--persistent-timeout,env:FCGIWRAP_PERSISTENT_TIMEOUT" help:"Idle persistent children are terminated after this"`
+	MaxRequests        int               `arg:"--max-requests,env:FCGIWRAP_MAX_REQUESTS" help:"Persistent children are replaced after serving this many requests, limiting the impact of memory leaks (0: unlimited)"`
+	Scripts            scriptConfigs     `arg:"-" help:"Settings for scripts matching a pattern (like --allow) as mapping of the pattern to timeout, interpreter, env and max-concurrent (only in the configuration file)"`
+
+	ServeCmd   *struct{}  `arg:"subcommand:serve" help:"Serve requests (the default without a subcommand)"`
+	CheckCmd   *struct{}  `arg:"subcommand:check" help:"Validate the configuration (flags, --config, environment and the files it references) and exit"`
+	VersionCmd *struct{}  `arg:"subcommand:version" help:"Print the version and build information and exit"`
+	ConfigCmd  *configCmd `arg:"subcommand:config" help:"Configuration file utilities"`
+
+	// compiled seccomp profile (raw BPF)
+	seccomp []byte
+	// split --exec-prefix with resolved command
+	execPrefix []string
+	// guard for filesystem operations (nil if disabled)
+	fs *fsGuard
+	// clock for timers and timeouts (nil: real clock)
+	clock clock
+	// pool for spawning/waiting for children (nil if disabled)
+	procs *procPool
+	// idle persistent children (nil in tests)
+	persist *persistentPool
+	// authorization callout (nil if disabled)
+	authz *authorizer
+	// metrics backend (nil: discarded)
+	metricsSink Metrics
+	// access log (nil if disabled)
+	accessLog *accessLog
+	// settings of the virtual hosts (--vhost)
+	vhosts []vhost
+}
+
+// defaults for the arguments (before applying the config file and the commandline)
+func defaultArguments() arguments {
+	return arguments{
+		Workers:            1,
+		LogFormat:          "json",
+		LogBurstWindow:     time.Minute,
+		AccessLogFormat:    "combined",
+		OtelServiceName:    "fcgiwrap_go",
+		LogBacklog:         1000,
+		ErrorBacklog:       50,
+		TimeoutGrace:       5 * time.Second,
+		AuthzTimeout:       5 * time.Second,
+		FSBreakerThreshold: 3,
+		FSBreakerCooldown:  30 * time.Second,
+		PersistentIdle:     4,
+		PersistentTimeout:  5 * time.Minute,
+		MaxHeaders:         100,
+		MaxHeaderBytes:     64 << 10,
+		CompressMinSize:    1 << 10,
+		StderrMax:          64 << 10,
+		UploadGrace:        5 * time.Second,
+		StatCacheTTL:       time.Second,
+	}
 }
 
 // parse the arguments with go-arg. Uses MustParese -> might fail/panic
+// Values from the config file (--config) are overridden by FCGIWRAP_*
+// environment variables and those by the commandline.
 func parseArgs() arguments {
-	args := arguments{
-		Workers:   1,
-		LogFormat: "json",
+	args := defaultArguments()
+	p := arg.MustParse(&args)
+
+	var locs configLocations
+	if args.ConfigFile != "" {
+		fileArgs := defaultArguments()
+		var err error
+		locs, err = loadConfigFile(args.ConfigFile, &fileArgs)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		// parse the commandline again on top of the values from the file
+		cli := args
+		args = fileArgs
+		p = arg.MustParse(&args)
+		replaceLists(&args, cli)
+		locs.dropOverridden(args, fileArgs)
+	}
+
+	if err := args.validate(locs); err != nil {
+		p.Fail(err.Error())
 	}
-	arg.MustParse(&args)
 	return args
 }
 
@@ -78,6 +282,11 @@ func allowed_env_inherit(kv string) bool {
 		return false
 	}
 
+	// configuration of the wrapper itself
+	if strings.HasPrefix(k, "FCGIWRAP_") {
+		return false
+	}
+
 	if _, ok := forbidden_env_inherits[k]; ok {
 		return false
 	}
@@ -85,11 +294,29 @@ func allowed_env_inherit(kv string) bool {
 	return true
 }
 
-func setupEnv() []string {
+// env_matches checks whether the name of kv matches any of the patterns (NAME
+// or PREFIX_*)
+func env_matches(kv string, patterns []string) bool {
+	k, _, _ := strings.Cut(kv, "=")
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(k, prefix) || p == k {
+			return true
+		}
+	}
+	return false
+}
+
+// setupEnv returns the part of the host environment inherited by CGI children.
+// pass_env is an allowlist (if not empty), block_env extends
+// forbidden_env_inherits.
+func setupEnv(pass_env []string, block_env []string) []string {
 	env := os.Environ()
 	ret_env := make([]string, 0, len(env))
 	for _, e := range env {
-		if allowed_env_inherit(e) {
+		if !allowed_env_inherit(e) || env_matches(e, block_env) {
+			continue
+		}
+		if len(pass_env) == 0 || env_matches(e, pass_env) {
 			ret_env = append(ret_env, e)
 		}
 	}
@@ -97,59 +324,361 @@ func setupEnv() []string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == childInitArg {
+		childInit(os.Args[2:])
+	}
+
+	var vclock *virtualClock
+	if i := slices.Index(os.Args, virtualClockArg); i > 0 {
+		os.Args = slices.Delete(os.Args, i, i+1)
+		vclock = newVirtualClock(time.Now())
+	}
+
 	args := parseArgs()
-	slog.SetDefault(setupLogger(args.LogFormat, args.LogLevel))
+	if vclock != nil {
+		args.clock = vclock
+	}
+	if args.ConfigCmd != nil {
+		if args.ConfigCmd.Schema != nil {
+			if err := writeConfigSchema(os.Stdout); err != nil {
+				panic(err)
+			}
+		}
+		os.Exit(0)
+	}
+	if args.VersionCmd != nil {
+		if err := writeVersion(os.Stdout); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+	if args.CheckCmd != nil {
+		if err := checkConfig(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+		os.Exit(0)
+	}
+	if args.SBOM {
+		if err := writeSBOM(os.Stdout); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+	started := args.clk().Now()
+	logs := newLogHub(args.LogBacklog, slog.LevelDebug)
+	errs := newLogHub(args.ErrorBacklog, slog.LevelWarn)
+	redact, err := newRedactor(args.RedactHeader, args.RedactEnv, args.RedactValue)
+	if err != nil {
+		panic(err)
+	}
+	if args.ErrorPages != "" && args.ErrorPages != errorPagesText {
+		wrapperErrors, err = newErrorPages(args.ErrorPages, args.ErrorTemplate)
+		if err != nil {
+			panic(err)
+		}
+	}
+	var logOut io.Writer = os.Stderr
+	var logfile *logFile
+	if args.LogFile != "" {
+		if logfile, err = openLogFile(args.LogFile, int64(args.LogMaxSize), args.LogMaxAge, args.LogKeep); err != nil {
+			panic(err)
+		}
+		logOut = logfile
+	}
+	logger, err := setupLogger(logOut, args.LogFormat, args.LogLevel)
+	if err != nil {
+		panic(err)
+	}
+	base := logger.Handler()
+	if args.LogBurst > 0 {
+		sampler := newLogSampler(args.LogBurst, args.LogBurstWindow)
+		go sampler.run()
+		base = sampleHandler{base, sampler}
+	}
+	// the admin API gets records below the log level as well (/logs?level=debug)
+	var hubs []*logHub
+	if args.AdminAddr != "" {
+		hubs = []*logHub{logs, errs}
+	}
+	slog.SetDefault(slog.New(requestIDHandler{redactHandler{newTailHandler(base, hubs...), redact}}))
+	if vclock != nil {
+		slog.Warn("using virtual clock, advance it via the admin API", "admin", args.AdminAddr)
+	}
 	slog.Info("starting fcgiwrap-go", "workers", args.Workers, "timeout", args.Timeout, "socket", args.Socket)
 
-	env := setupEnv()
+	if args.StatsFile != "" {
+		if err := lifetimeStats.load(args.StatsFile); err != nil {
+			slog.Warn("loading stats failed, starting from zero", "path", args.StatsFile, "err", err)
+		}
+	}
 
-	l, sockPath, err := setupListener(args.Socket)
-	if err != nil {
-		slog.Error("Initializing listener failed", "err", err)
+	if args.LockFile != "" {
+		lock, err := acquireLockFile(args.LockFile)
+		if err != nil {
+			slog.Error("Acquiring lock file failed", "err", err)
+			panic(err)
+		}
+		defer lock.Close()
+	}
+
+	if args.SeccompProfile != "" {
+		prog, err := loadSeccompProfile(args.SeccompProfile)
+		if err != nil {
+			slog.Error("Loading seccomp profile failed", "err", err)
+			panic(err)
+		}
+		args.seccomp = encodeBPF(prog)
+		slog.Debug("seccomp profile loaded", "path", args.SeccompProfile, "instructions", len(prog))
+	}
+
+	if args.ExecPrefix != "" {
+		prefix, err := parseExecPrefix(args.ExecPrefix)
+		if err != nil {
+			slog.Error("Parsing exec prefix failed", "err", err)
+			panic(err)
+		}
+		args.execPrefix = prefix
+	}
+
+	args.fs = newFSGuard(args.FSTimeout, args.FSBreakerThreshold, args.FSBreakerCooldown).withStatCache(args.StatCacheTTL, args.clk().Now)
+
+	if args.MaxThreads > 0 {
+		debug.SetMaxThreads(args.MaxThreads)
+	}
+	if args.Reap || os.Getpid() == 1 {
+		if err := startReaper(); err != nil {
+			slog.Error("Starting reaper failed", "err", err)
+			panic(err)
+		}
+	}
+	args.procs = newProcPool(args.ThreadPool)
+	args.authz = newAuthorizer(args)
+	args.persist = newPersistentPool(args.PersistentIdle, args.PersistentTimeout, args.MaxRequests, args.procs)
+
+	var prom *promMetrics
+	var sinks multiMetrics
+	if args.StatsdAddr != "" {
+		statsd, err := newStatsdMetrics(args.StatsdAddr)
+		if err != nil {
+			slog.Error("Initializing statsd failed", "addr", args.StatsdAddr, "err", err)
+			panic(err)
+		}
+		sinks = append(sinks, statsd)
+	}
+	if args.MetricsAddr != "" || args.AdminAddr != "" && args.StatsdAddr == "" {
+		prom = newPromMetrics()
+		sinks = append(sinks, prom)
+	}
+	switch len(sinks) {
+	case 0:
+	case 1:
+		args.metricsSink = sinks[0]
+	default:
+		args.metricsSink = sinks
+	}
+
+	if args.AccessLog != "" {
+		if args.accessLog, err = openAccessLog(args.AccessLog, args.AccessLogFormat); err != nil {
+			slog.Error("Opening access log failed", "path", args.AccessLog, "err", err)
+			panic(err)
+		}
+	}
+
+	// before the virtual hosts inherit it
+	if err := args.setHTTPRoot(); err != nil {
+		panic(err)
+	}
+	if args.vhosts, err = loadVhosts(args); err != nil {
+		slog.Error("Loading virtual host configurations failed", "err", err)
 		panic(err)
 	}
 
-	var timer *time.Timer
+	env := setupEnv(args.PassEnv, args.BlockEnv)
+
+	if args.CgroupParent != "" {
+		if err := enableCgroupControllers(args.CgroupParent); err != nil {
+			slog.Warn("cgroup controllers could not be enabled, limits might not apply", "err", err)
+		}
+	}
+
+	var l, hl, al net.Listener
+	var sockPath string
+	if args.HTTP == "" && args.AJP == "" || args.Socket != "" {
+		l, sockPath, err = setupListener(args.Socket, args.ForceSocket)
+		if err != nil {
+			slog.Error("Initializing listener failed", "err", err)
+			panic(err)
+		}
+	}
+	if args.HTTP != "" {
+		hl, err = net.Listen("tcp", args.HTTP)
+		if err != nil {
+			slog.Error("Initializing HTTP listener failed", "err", err)
+			panic(err)
+		}
+		slog.Warn("serving plain HTTP, meant for local testing", "addr", hl.Addr().String(), "root", args.HTTPRoot)
+	}
+	if args.AJP != "" {
+		al, err = net.Listen("tcp", args.AJP)
+		if err != nil {
+			slog.Error("Initializing AJP listener failed", "err", err)
+			panic(err)
+		}
+		slog.Info("serving AJP", "addr", al.Addr().String(), "root", args.HTTPRoot)
+		if ip, ok := al.Addr().(*net.TCPAddr); ok && !ip.IP.IsLoopback() && args.AJPSecret == "" {
+			slog.Warn("AJP is reachable from other hosts without --ajp-secret, anyone reaching it can pass REMOTE_USER and run scripts", "addr", al.Addr().String())
+		}
+	}
+
+	var activeJobs atomic.Int32
+
+	// also dumps the status on SIGUSR1 without --admin-addr
+	admin := &adminServer{
+		logs:       logs,
+		errors:     errs,
+		activeJobs: &activeJobs,
+		started:    started,
+		clock:      vclock,
+		metrics:    prom,
+		workers:    args.Workers,
+	}
+	admin.setConfig(args)
+
+	var adminSockPath string
+	if args.AdminAddr != "" {
+		var al net.Listener
+		al, adminSockPath, err = setupListener(args.AdminAddr, args.ForceSocket)
+		if err != nil {
+			slog.Error("Initializing admin listener failed", "err", err)
+			panic(err)
+		}
+		go func() {
+			if err := http.Serve(al, admin.handler()); err != nil {
+				slog.Error("admin API stopped", "error", err)
+			}
+		}()
+	}
+
+	var metricsSockPath string
+	if args.MetricsAddr != "" {
+		var ml net.Listener
+		ml, metricsSockPath, err = setupListener(args.MetricsAddr, args.ForceSocket)
+		if err != nil {
+			slog.Error("Initializing metrics listener failed", "err", err)
+			panic(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", prom)
+		go func() {
+			if err := http.Serve(ml, mux); err != nil {
+				slog.Error("metrics listener stopped", "error", err)
+			}
+		}()
+	}
+
+	// the listener is up already, requests queue up until the warm-up is done
+	runWarmups(args, env)
+
+	var timer clockTimer
 	var timerCh <-chan time.Time
 	var timerReset func()
 	if args.Timeout > 0 {
-		timer = time.NewTimer(time.Duration(args.Timeout) * time.Second)
-		timerCh = timer.C
+		// args is replaced on reloads, the timeout needs a restart anyway. It
+		// only depends on the requests of this instance, not on the counters
+		// restored with --stats-file: an instance started by socket activation
+		// has a request waiting anyway.
+		timeout := time.Duration(args.Timeout) * time.Second
+		timer = args.clk().NewTimer(timeout)
+		timerCh = timer.C()
 		timerReset = func() {
-			timer.Reset(time.Duration(args.Timeout) * time.Second)
+			timer.Reset(timeout)
 		}
 	} else {
 		timerCh = make(chan time.Time) // never fires
 		timerReset = func() {}
 	}
 
-	var activeJobs atomic.Int32
+	spool := newSpooler(args.SpoolBody, args.SpoolDir, args.SpoolMax, args.SpoolQuota)
+	if spool != nil {
+		spool.removeOrphans()
+	}
+
 	var wg sync.WaitGroup
-	var sem *semaphore.Weighted
+	var queue *workerQueue
 	if args.Workers > 0 {
-		sem = semaphore.NewWeighted(int64(args.Workers))
+		queue = newWorkerQueue(args.Workers, args.MaxQueue, args.QueueTimeout)
 	}
 
-	h := fcgiHandler(&activeJobs, &wg, sem, timerReset, cgiResponder(args, env))
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- fcgi.Serve(l, h)
-	}()
+	var tr *tracer
+	if args.OtelEndpoint != "" {
+		tr = newTracer(args.OtelEndpoint, args.OtelServiceName)
+	}
+
+	responder := newLiveHandler(cgiResponder(args, env))
+	h := pingHandler(args.PingPath, traceRequests(tr, rateLimitClients(newClientRateLimiter(args.ClientRate, args.ClientBurst), limitClients(newClientLimiter(args.MaxPerClient), limitRate(newRateLimiter(args.Rate, args.RateBurst, args.RateWait), spoolBodies(spool, fcgiHandler(&activeJobs, &wg, queue, timerReset, args.metrics(), responder)))))))
+	errCh := make(chan error, 3)
+	if hl != nil {
+		go func() {
+			errCh <- http.Serve(hl, h)
+		}()
+	}
+	if al != nil {
+		go func() {
+			errCh <- serveAJP(al, h, args.AJPSecret)
+		}()
+	}
+	if l != nil || hl == nil && al == nil {
+		go func() {
+			errCh <- serveFastCGI(l, h, args.Workers, args.SpoolDir)
+		}()
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	usr1Ch := make(chan os.Signal, 1)
+	signal.Notify(usr1Ch, syscall.SIGUSR1)
 
 loop:
 	for {
 		select {
 		case err := <-errCh:
-			if err != nil && !errors.Is(err, fcgi.ErrConnClosed) {
-				slog.Error("fcgi.Serve error", "error", err)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("serving failed", "error", err)
 			}
 			break loop
 		case <-sigCh:
 			slog.Info("shutdown signal received, waiting for active handlers")
 			break loop
+		case <-hupCh:
+			if logfile != nil {
+				if err := logfile.reopen(); err != nil {
+					slog.Error("reopening the log file failed", "path", args.LogFile, "err", err)
+				}
+			}
+			if err := args.accessLog.reopen(); err != nil {
+				slog.Error("reopening the access log failed", "path", args.AccessLog, "err", err)
+			}
+			if args.ConfigFile == "" {
+				// only reopening the logs, e.g. for logrotate
+				continue
+			}
+			next, err := reloadArgs(args, os.Args[1:])
+			if err != nil {
+				slog.Error("reloading the configuration failed, keeping the current one", "err", err)
+				continue
+			}
+			args = next
+			setLogLevel(args.LogLevel)
+			env = setupEnv(args.PassEnv, args.BlockEnv)
+			responder.set(cgiResponder(args, env))
+			admin.setConfig(args)
+			slog.Info("configuration reloaded", "path", args.ConfigFile)
+		case <-usr1Ch:
+			admin.dumpStatus(os.Stderr)
 		case <-timerCh:
 			if activeJobs.Load() == 0 {
 				slog.Info("timeout reached and no active jobs")
@@ -166,20 +695,44 @@ loop:
 		// this should also make the serve function/goroutine terminate
 		l.Close()
 	}
+	if hl != nil {
+		hl.Close()
+	}
+	if al != nil {
+		al.Close()
+	}
 
 	c := make(chan struct{})
 	go func() { wg.Wait(); close(c) }()
 	select {
 	case <-c:
 		slog.Info("all handlers completed")
-	case <-time.After(30 * time.Second):
+	case <-args.clk().NewTimer(30 * time.Second).C():
 		slog.Warn("timeout waiting for handlers to finish")
 	}
 
+	args.persist.closeAll()
+
+	tr.shutdown(5 * time.Second)
+
+	if args.StatsFile != "" {
+		if err := lifetimeStats.save(args.StatsFile); err != nil {
+			slog.Error("saving stats failed", "path", args.StatsFile, "err", err)
+		}
+	}
+
 	if sockPath != "" {
 		_ = os.Remove(sockPath)
 		slog.Debug("removed unix socket", "path", sockPath)
 	}
+	if adminSockPath != "" {
+		_ = os.Remove(adminSockPath)
+		slog.Debug("removed unix socket", "path", adminSockPath)
+	}
+	if metricsSockPath != "" {
+		_ = os.Remove(metricsSockPath)
+		slog.Debug("removed unix socket", "path", metricsSockPath)
+	}
 
 	os.Exit(0) // should terminate/kill all remaining goroutines (particularly the serve goroutine if l=nil)
 }
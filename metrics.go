@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Metrics receives the instrumentation of the wrapper. Implementations must be
+// safe for concurrent use. Labels might be nil.
+type Metrics interface {
+	// Add increments the counter name by delta
+	Add(name string, delta float64, labels map[string]string)
+	// Set sets the gauge name to value
+	Set(name string, value float64, labels map[string]string)
+	// Observe records value in the histogram name
+	Observe(name string, value float64, labels map[string]string)
+}
+
+// metric names
+const (
+	metricRequests   = "fcgiwrap_requests_total"
+	metricDuration   = "fcgiwrap_request_duration_seconds"
+	metricActiveJobs = "fcgiwrap_active_jobs"
+	metricQueueWait  = "fcgiwrap_queue_wait_seconds"
+	metricExits      = "fcgiwrap_child_exits_total"
+	metricRejected   = "fcgiwrap_rejected_requests_total"
+)
+
+// noopMetrics discards everything
+type noopMetrics struct{}
+
+func (noopMetrics) Add(string, float64, map[string]string)     {}
+func (noopMetrics) Set(string, float64, map[string]string)     {}
+func (noopMetrics) Observe(string, float64, map[string]string) {}
+
+// multiMetrics passes the instrumentation on to several backends
+type multiMetrics []Metrics
+
+func (m multiMetrics) Add(name string, delta float64, labels map[string]string) {
+	for _, b := range m {
+		b.Add(name, delta, labels)
+	}
+}
+
+func (m multiMetrics) Set(name string, value float64, labels map[string]string) {
+	for _, b := range m {
+		b.Set(name, value, labels)
+	}
+}
+
+func (m multiMetrics) Observe(name string, value float64, labels map[string]string) {
+	for _, b := range m {
+		b.Observe(name, value, labels)
+	}
+}
+
+// metrics returns the configured metrics (no-op if none)
+func (args arguments) metrics() Metrics {
+	if args.metricsSink == nil {
+		return noopMetrics{}
+	}
+	return args.metricsSink
+}
+
+// labelEscaper escapes label values as the Prometheus text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelKey returns the labels in a canonical (sorted) form
+func labelKey(labels map[string]string) string {
+	var b strings.Builder
+	for i, k := range slices.Sorted(maps.Keys(labels)) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[k]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// histogramBuckets are the upper bounds of the histogram buckets (seconds)
+var histogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// promMetrics keeps the metrics in memory and writes them in the Prometheus
+// text exposition format
+type promMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// series returns the series of name in m, creating it if necessary
+func series[V any](m map[string]map[string]V, name string) map[string]V {
+	s, ok := m[name]
+	if !ok {
+		s = make(map[string]V)
+		m[name] = s
+	}
+	return s
+}
+
+func (p *promMetrics) Add(name string, delta float64, labels map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	series(p.counters, name)[labelKey(labels)] += delta
+}
+
+func (p *promMetrics) Set(name string, value float64, labels map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	series(p.gauges, name)[labelKey(labels)] = value
+}
+
+func (p *promMetrics) Observe(name string, value float64, labels map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := series(p.histograms, name)
+	key := labelKey(labels)
+	h, ok := s[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(histogramBuckets)+1)}
+		s[key] = h
+	}
+	i, _ := slices.BinarySearch(histogramBuckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// promSeries formats a series name with labels (key is from labelKey)
+func promSeries(name string, key string, extra string) string {
+	if extra != "" {
+		if key != "" {
+			key += ","
+		}
+		key += extra
+	}
+	if key == "" {
+		return name
+	}
+	return name + "{" + key + "}"
+}
+
+func promValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (p *promMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// counted for the admin status as well (and kept across restarts)
+	for reason, n := range rejectedRequests.snapshot() {
+		series(p.counters, metricRejected)[labelKey(map[string]string{"reason": reason})] = float64(n)
+	}
+	var b strings.Builder
+	for _, m := range []struct {
+		typ string
+		s   map[string]map[string]float64
+	}{{"counter", p.counters}, {"gauge", p.gauges}} {
+		for _, name := range slices.Sorted(maps.Keys(m.s)) {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", name, m.typ)
+			for _, key := range slices.Sorted(maps.Keys(m.s[name])) {
+				fmt.Fprintf(&b, "%s %s\n", promSeries(name, key, ""), promValue(m.s[name][key]))
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(p.histograms)) {
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		for _, key := range slices.Sorted(maps.Keys(p.histograms[name])) {
+			h := p.histograms[name][key]
+			var cumulative uint64
+			for i, le := range append(histogramBuckets, math.Inf(1)) {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&b, "%s %d\n", promSeries(name+"_bucket", key, `le="`+promValue(le)+`"`), cumulative)
+			}
+			fmt.Fprintf(&b, "%s %s\n", promSeries(name+"_sum", key, ""), promValue(h.sum))
+			fmt.Fprintf(&b, "%s %d\n", promSeries(name+"_count", key, ""), h.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format
+func (p *promMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := p.WriteTo(w); err != nil {
+		slog.Warn("writing metrics failed", "error", err)
+	}
+}
+
+// exitLabel describes how a child exited: its exit code or the signal which
+// killed it
+func exitLabel(st *os.ProcessState) string {
+	if ws, ok := st.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		name, _ := signalName(ws.Signal()).MarshalText()
+		return string(name)
+	}
+	return strconv.Itoa(st.ExitCode())
+}
+
+// statsdMetrics sends the metrics via UDP to a statsd server, labels are sent
+// as (DogStatsD) tags
+type statsdMetrics struct {
+	conn net.Conn
+}
+
+func newStatsdMetrics(addr string) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{conn: conn}, nil
+}
+
+func (s *statsdMetrics) send(name string, value float64, typ string, labels map[string]string) {
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ
+	if len(labels) > 0 {
+		tags := make([]string, 0, len(labels))
+		for _, k := range slices.Sorted(maps.Keys(labels)) {
+			tags = append(tags, k+":"+labels[k])
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		slog.Debug("sending metric to statsd failed", "error", err)
+	}
+}
+
+func (s *statsdMetrics) Add(name string, delta float64, labels map[string]string) {
+	s.send(name, delta, "c", labels)
+}
+
+func (s *statsdMetrics) Set(name string, value float64, labels map[string]string) {
+	s.send(name, value, "g", labels)
+}
+
+func (s *statsdMetrics) Observe(name string, value float64, labels map[string]string) {
+	s.send(name, value, "h", labels)
+}
@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromMetrics(t *testing.T) {
+	p := newPromMetrics()
+	p.Add(metricRequests, 1, map[string]string{"status": "200", "script": "/a.cgi"})
+	p.Add(metricRequests, 2, map[string]string{"script": "/a.cgi", "status": "200"})
+	p.Set(metricActiveJobs, 3, nil)
+	p.Observe(metricQueueWait, 0.02, nil)
+	p.Observe(metricQueueWait, 100, nil)
+
+	var b strings.Builder
+	_, err := p.WriteTo(&b)
+	require.NoError(t, err)
+	out := b.String()
+	assert.Contains(t, out, "# TYPE fcgiwrap_requests_total counter\n"+`fcgiwrap_requests_total{script="/a.cgi",status="200"} 3`+"\n")
+	assert.Contains(t, out, "# TYPE fcgiwrap_active_jobs gauge\nfcgiwrap_active_jobs 3\n")
+	assert.Contains(t, out, "# TYPE fcgiwrap_queue_wait_seconds histogram\n")
+	assert.Contains(t, out, `fcgiwrap_queue_wait_seconds_bucket{le="0.01"} 0`+"\n")
+	assert.Contains(t, out, `fcgiwrap_queue_wait_seconds_bucket{le="0.025"} 1`+"\n")
+	assert.Contains(t, out, `fcgiwrap_queue_wait_seconds_bucket{le="60"} 1`+"\n")
+	assert.Contains(t, out, `fcgiwrap_queue_wait_seconds_bucket{le="+Inf"} 2`+"\n")
+	assert.Contains(t, out, "fcgiwrap_queue_wait_seconds_sum 100.02\nfcgiwrap_queue_wait_seconds_count 2\n")
+
+	rejectedRequests.add("metrics_test")
+	b.Reset()
+	_, err = p.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Contains(t, b.String(), "# TYPE fcgiwrap_rejected_requests_total counter\n")
+	assert.Contains(t, b.String(), `fcgiwrap_rejected_requests_total{reason="metrics_test"} 1`+"\n")
+
+	// only backslash, quote and newline are escaped
+	assert.Equal(t, `script="/a\\b\"c\nü`+"\t"+`"`, labelKey(map[string]string{"script": "/a\\b\"c\nü\t"}))
+}
+
+func TestStatsdMetrics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newStatsdMetrics(pc.LocalAddr().String())
+	require.NoError(t, err)
+	s.Add(metricRequests, 1, map[string]string{"status": "200", "script": "/a.cgi"})
+	s.Set(metricActiveJobs, 2, nil)
+	s.Observe(metricDuration, 0.5, nil)
+
+	buf := make([]byte, 512)
+	for _, want := range []string{
+		"fcgiwrap_requests_total:1|c|#script:/a.cgi,status:200",
+		"fcgiwrap_active_jobs:2|g",
+		"fcgiwrap_request_duration_seconds:0.5|h",
+	} {
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(buf[:n]))
+	}
+}
+
+func TestResponderMetrics(t *testing.T) {
+	tmpDir := t.TempDir()
+	ok := cgiScript(t, tmpDir, "ok.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nok'\n")
+	fail := cgiScript(t, tmpDir, "fail.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nexit 3\n")
+	killed := cgiScript(t, tmpDir, "killed.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nkill -TERM $$\n")
+	prom := newPromMetrics()
+	addr := serveFCGI(t, cgiResponder(arguments{metricsSink: multiMetrics{prom, noopMetrics{}}}, nil))
+	for _, script := range []string{ok, fail, killed} {
+		doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	}
+
+	var b strings.Builder
+	_, err := prom.WriteTo(&b)
+	require.NoError(t, err)
+	out := b.String()
+	assert.Contains(t, out, `fcgiwrap_child_exits_total{code="0",script="`+ok+`"} 1`)
+	assert.Contains(t, out, `fcgiwrap_child_exits_total{code="3",script="`+fail+`"} 1`)
+	assert.Contains(t, out, `fcgiwrap_child_exits_total{code="SIGTERM",script="`+killed+`"} 1`)
+	assert.Contains(t, out, `fcgiwrap_requests_total{script="`+ok+`",status="200"} 1`)
+}
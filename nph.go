@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// nphScript reports whether script is a non-parsed-headers script: its name
+// starts with "nph-" (RFC 3875 section 5) or the FCGI_NPH param says so
+func nphScript(script string, env map[string]string) bool {
+	if v, ok := env["FCGI_NPH"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+		slog.Warn("ignoring invalid FCGI_NPH", "value", v, "error", err)
+	}
+	return strings.HasPrefix(filepath.Base(script), "nph-")
+}
+
+// writeNPHResponse passes the complete HTTP response of a non-parsed-headers
+// script on. Its status line is used as status, the body is flushed as soon as
+// it arrives (and discarded if head is set). Returns false if the response
+// could not be forwarded completely.
+func writeNPHResponse(w http.ResponseWriter, out io.Reader, ctx context.Context, pid int, head bool) bool {
+	var req *http.Request
+	if head {
+		// the response has no body, regardless of its Content-Length
+		req = &http.Request{Method: http.MethodHead}
+		defer io.Copy(io.Discard, out)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(out), req)
+	if err != nil {
+		if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			slog.WarnContext(ctx, "CGI exceeded execution timeout before sending headers", "pid", pid)
+			writeError(w, ctx, http.StatusGatewayTimeout)
+			return false
+		}
+		if errors.Is(context.Cause(ctx), errBodyTooLarge) {
+			writeError(w, ctx, http.StatusRequestEntityTooLarge)
+			return false
+		}
+		slog.WarnContext(ctx, "error reading NPH response", "error", err)
+		writeError(w, ctx, http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+
+	for key, vals := range resp.Header {
+		w.Header()[key] = vals
+	}
+	stripHeaders(ctx, w.Header())
+	w.WriteHeader(resp.StatusCode)
+
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				slog.WarnContext(ctx, "error copying NPH body", "error", err)
+				return false
+			}
+			_ = rc.Flush()
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "error reading NPH body", "error", err)
+			return false
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathPattern matches script paths: a glob ("*" and "?" within a path
+// component, "**" across components, "[...]" classes) or a regular expression
+// prefixed with "re:"
+type pathPattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (p *pathPattern) UnmarshalText(text []byte) error {
+	expr, ok := strings.CutPrefix(string(text), "re:")
+	if !ok {
+		expr = globRegexp(expr)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", text, err)
+	}
+	p.text, p.re = string(text), re
+	return nil
+}
+
+func (p pathPattern) MarshalText() ([]byte, error) {
+	return []byte(p.text), nil
+}
+
+func (p pathPattern) match(path string) bool {
+	return p.re != nil && p.re.MatchString(path)
+}
+
+// globRegexp translates a glob into an anchored regular expression
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// checkPathRules rejects script if it matches one of the deny patterns or if
+// there are allow patterns and none of them matches
+func checkPathRules(script string, allow []pathPattern, deny []pathPattern) error {
+	for _, p := range deny {
+		if p.match(script) {
+			return fmt.Errorf("script %s denied by %q", script, p.text)
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, p := range allow {
+		if p.match(script) {
+			return nil
+		}
+	}
+	return fmt.Errorf("script %s not allowed by any pattern", script)
+}
+
+// defaultHidden are the patterns of hidden path components used if --hidden
+// isn't given
+var defaultHidden = []string{".*"}
+
+// checkHidden rejects scripts with a path component below root (the whole
+// path if root is empty) matching one of the globs (nil: defaultHidden), e.g.
+// scripts in .git/hooks
+func checkHidden(script string, root string, hidden []string) error {
+	if hidden == nil {
+		hidden = defaultHidden
+	}
+	rel := script
+	if root != "" {
+		var err error
+		if rel, err = filepath.Rel(root, script); err != nil {
+			return fmt.Errorf("script path (%s) outside DOCUMENT_ROOT (%s)", script, root)
+		}
+	}
+	for _, component := range strings.Split(filepath.ToSlash(rel), "/") {
+		if component == "" || component == "." || component == ".." {
+			continue
+		}
+		for _, pattern := range hidden {
+			if ok, _ := path.Match(pattern, component); ok && pattern != "" {
+				return fmt.Errorf("script %s is hidden (%q matches %q)", script, component, pattern)
+			}
+		}
+	}
+	return nil
+}
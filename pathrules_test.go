@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func patterns(t *testing.T, texts ...string) []pathPattern {
+	t.Helper()
+	ps := make([]pathPattern, len(texts))
+	for i, text := range texts {
+		require.NoError(t, ps[i].UnmarshalText([]byte(text)))
+	}
+	return ps
+}
+
+func TestPathPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/srv/www/cgi-bin/**", "/srv/www/cgi-bin/a/b.sh", true},
+		{"/srv/www/cgi-bin/**", "/srv/www/other/b.sh", false},
+		{"/srv/www/*.sh", "/srv/www/a.sh", true},
+		{"/srv/www/*.sh", "/srv/www/sub/a.sh", false},
+		{"**/private/**", "/srv/www/private/x.sh", true},
+		{"**/private/**", "/srv/www/privateer/x.sh", false},
+		{"/srv/www/[!.]?.cgi", "/srv/www/ab.cgi", true},
+		{"/srv/www/[!.]?.cgi", "/srv/www/.b.cgi", false},
+		{`re:\.(pl|py)$`, "/srv/www/a.py", true},
+		{`re:\.(pl|py)$`, "/srv/www/a.sh", false},
+	} {
+		assert.Equal(t, tc.match, patterns(t, tc.pattern)[0].match(tc.path), "%s on %s", tc.pattern, tc.path)
+	}
+
+	var p pathPattern
+	assert.Error(t, p.UnmarshalText([]byte("re:(")))
+}
+
+func TestCheckPathRules(t *testing.T) {
+	allow := patterns(t, "/srv/www/**")
+	deny := patterns(t, "**/private/**")
+	assert.NoError(t, checkPathRules("/srv/www/a.sh", nil, nil))
+	assert.NoError(t, checkPathRules("/srv/www/a.sh", allow, deny))
+	assert.ErrorContains(t, checkPathRules("/srv/www/private/a.sh", allow, deny), "denied")
+	assert.ErrorContains(t, checkPathRules("/opt/a.sh", allow, deny), "not allowed")
+}
+
+func TestCheckHidden(t *testing.T) {
+	assert.NoError(t, checkHidden("/srv/www/cgi/a.sh", "/srv/www", nil))
+	assert.ErrorContains(t, checkHidden("/srv/www/.git/hooks/post-update", "/srv/www", nil), "hidden")
+	assert.ErrorContains(t, checkHidden("/srv/www/.a.sh", "/srv/www", nil), "hidden")
+	// only below the document root
+	assert.NoError(t, checkHidden("/home/u/.www/a.sh", "/home/u/.www", nil))
+	assert.ErrorContains(t, checkHidden("/home/u/.www/a.sh", "", nil), "hidden")
+
+	assert.NoError(t, checkHidden("/srv/www/.a.sh", "/srv/www", []string{""}))
+	assert.ErrorContains(t, checkHidden("/srv/www/_priv/a.sh", "/srv/www", []string{"_*"}), "hidden")
+}
@@ -0,0 +1,380 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The keep-alive protocol spoken by persistent children consists of frames
+// ("<length>\n" followed by length bytes). A request is one frame holding the
+// environment (NUL separated KEY=VALUE), followed by the body as frames and an
+// empty frame. The child answers with the usual CGI response (headers + body)
+// split into frames and terminated by an empty frame. The child has to read the
+// complete request before it finishes its response.
+
+// writeFrame writes a single frame
+func writeFrame(w io.Writer, data []byte) error {
+	if _, err := fmt.Fprintf(w, "%d\n", len(data)); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// frameReader reads the payload of frames until the terminating empty frame
+type frameReader struct {
+	r    *bufio.Reader
+	left int
+	eof  bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for f.left == 0 {
+		if f.eof {
+			return 0, io.EOF
+		}
+		line, err := f.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(line, "\n"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid frame length %q", line)
+		}
+		f.left = n
+		f.eof = n == 0
+	}
+
+	if len(p) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// persistentChild is a long running CGI child speaking the keep-alive protocol
+type persistentChild struct {
+	key    string
+	cmd    *exec.Cmd
+	cg     *childCgroup
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	// nil if stderr isn't logged
+	stderr *stderrLog
+	idle   *time.Timer
+	served int
+}
+
+// persistentPool keeps idle persistent children for reuse
+type persistentPool struct {
+	mu          sync.Mutex
+	maxIdle     int
+	timeout     time.Duration
+	maxRequests int
+	procs       *procPool
+	idle        map[string][]*persistentChild
+}
+
+func newPersistentPool(maxIdle int, timeout time.Duration, maxRequests int, procs *procPool) *persistentPool {
+	return &persistentPool{
+		maxIdle:     maxIdle,
+		timeout:     timeout,
+		maxRequests: maxRequests,
+		procs:       procs,
+		idle:        make(map[string][]*persistentChild),
+	}
+}
+
+// persistentScript reports whether script is to be run as persistent child
+func persistentScript(args arguments, script string, env map[string]string) bool {
+	if args.persist == nil {
+		return false
+	}
+	if v, ok := env["FCGI_PERSISTENT"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+		slog.Warn("ignoring invalid FCGI_PERSISTENT", "value", v, "error", err)
+	}
+	for _, pattern := range args.Persistent {
+		if ok, _ := filepath.Match(pattern, script); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns an idle child for key (nil if there is none)
+func (p *persistentPool) get(key string) *persistentChild {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cs := p.idle[key]
+	if len(cs) == 0 {
+		return nil
+	}
+	c := cs[len(cs)-1]
+	p.idle[key] = cs[:len(cs)-1]
+	c.idle.Stop()
+	return c
+}
+
+// put returns c to the pool (or discards it if there are enough idle children
+// or it served enough requests)
+func (p *persistentPool) put(c *persistentChild) {
+	c.served++
+	if p.maxRequests > 0 && c.served >= p.maxRequests {
+		slog.Debug("recycling persistent CGI child", "pid", c.cmd.Process.Pid, "requests", c.served)
+		go c.close(p.procs)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[c.key]) >= p.maxIdle {
+		go c.close(p.procs)
+		return
+	}
+	p.idle[c.key] = append(p.idle[c.key], c)
+	c.idle = time.AfterFunc(p.timeout, func() {
+		if p.remove(c) {
+			slog.Debug("persistent CGI child idle for too long", "pid", c.cmd.Process.Pid)
+			c.close(p.procs)
+		}
+	})
+}
+
+// remove removes c from the idle children, returns false if it isn't idle
+func (p *persistentPool) remove(c *persistentChild) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cs := p.idle[c.key]
+	for i := range cs {
+		if cs[i] == c {
+			p.idle[c.key] = append(cs[:i], cs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll terminates all idle children
+func (p *persistentPool) closeAll() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*persistentChild)
+	p.mu.Unlock()
+	for _, cs := range idle {
+		for _, c := range cs {
+			c.idle.Stop()
+			c.close(p.procs)
+		}
+	}
+}
+
+// startPersistentChild starts cmd (which must not be bound to a request
+// context) as persistent child
+func startPersistentChild(args arguments, key string, cmd *exec.Cmd) (*persistentChild, error) {
+	c := &persistentChild{key: key, cmd: cmd}
+
+	cg, err := newChildCgroup(args, cmd.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if cg != nil {
+		c.cg = cg
+		cg.attach(cmd)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		c.stdin, err = cmd.StdinPipe()
+	}
+	if err != nil {
+		if cg != nil {
+			cg.close()
+		}
+		return nil, err
+	}
+	c.stdout = bufio.NewReader(stdout)
+	// shared by all requests, so never forwarded to the web server and not
+	// capped (the cap applies to single requests)
+	if args.RawStderr {
+		cmd.Stderr = os.Stderr
+	} else {
+		c.stderr = newStderrLog(context.Background(), cmd.Args[0], 0)
+		cmd.Stderr = c.stderr
+		cmd.WaitDelay = stderrWaitDelay
+	}
+
+	if err := args.procs.start(cmd); err != nil {
+		if cg != nil {
+			cg.close()
+		}
+		return nil, err
+	}
+	runningChildren.Add(1)
+	if c.stderr != nil {
+		c.stderr.setPid(cmd.Process.Pid)
+	}
+	slog.Debug("persistent CGI child started", "pid", cmd.Process.Pid, "script", cmd.Args[0])
+	return c, nil
+}
+
+// close terminates the child
+func (c *persistentChild) close(procs *procPool) {
+	_ = c.stdin.Close()
+	_ = signalGroup(c.cmd, syscall.SIGKILL)
+	_ = procs.wait(c.cmd)
+	runningChildren.Add(-1)
+	if c.stderr != nil {
+		_ = c.stderr.Close()
+	}
+	if c.cg != nil {
+		c.cg.close()
+	}
+	slog.Debug("persistent CGI child finished", "pid", c.cmd.Process.Pid)
+}
+
+// writeRequest sends env and body to the child
+func (c *persistentChild) writeRequest(env []string, body io.Reader) error {
+	w := bufio.NewWriter(c.stdin)
+	if err := writeFrame(w, []byte(strings.Join(env, "\x00"))); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err := writeFrame(w, buf[:n]); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeFrame(w, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// servePersistent handles the request prepared as cmd with a (reused)
+// persistent child. The child is discarded on any error. Returns the location
+// of a local redirect, which is up to the caller.
+func servePersistent(w http.ResponseWriter, r *http.Request, ctx context.Context, abort context.CancelCauseFunc, args arguments, cmd *exec.Cmd, env map[string]string, inherited_env []string) string {
+	// children are set up identically if path, arguments, directory and the
+	// environment they are started with (e.g. --env of the virtual host, the
+	// locale, and the child spec) match; the spec (if any) is the last entry of
+	// the environment
+	reqEnv := cmd.Env
+	startEnv := inherit_environment(nil, childEnv(args, env, inherited_env))
+	if n := len(reqEnv); n > 0 && strings.HasPrefix(reqEnv[n-1], childSpecEnv+"=") {
+		startEnv = append(startEnv, reqEnv[n-1])
+		reqEnv = reqEnv[:n-1]
+	}
+	key := strings.Join(slices.Concat([]string{cmd.Path, cmd.Dir, strconv.Itoa(len(cmd.Args))}, cmd.Args, startEnv), "\x00")
+
+	c := args.persist.get(key)
+	if c == nil {
+		var err error
+		c, err = startPersistentChild(args, key, &exec.Cmd{
+			Path:        cmd.Path,
+			Args:        cmd.Args,
+			Dir:         cmd.Dir,
+			Env:         startEnv,
+			SysProcAttr: cmd.SysProcAttr,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to start persistent CGI", "error", err)
+			writeError(w, ctx, http.StatusBadGateway)
+			return ""
+		}
+	}
+
+	ok := false
+	defer func() {
+		if ok {
+			args.persist.put(c)
+		} else {
+			c.close(args.procs)
+		}
+	}()
+
+	// the child is killed on timeout or if the client goes away
+	stop := context.AfterFunc(ctx, func() { _ = signalGroup(c.cmd, syscall.SIGKILL) })
+	defer stop()
+
+	opts := newResponseOptions(args, cmd.Args[0], env)
+	opts.head = r.Method == http.MethodHead
+	if args.Sendfile {
+		opts.sendfile = func(w http.ResponseWriter) bool { return serveSendfile(w, r, ctx, env["DOCUMENT_ROOT"]) }
+	}
+	if args.MetaHeaders {
+		opts.meta = &responseMeta{clock: args.clk(), started: args.clk().Now()}
+	}
+	wrote := make(chan error, 1)
+	go func() {
+		maxBody := int64(args.MaxBodySize)
+		err := c.writeRequest(reqEnv, limitRequestBody(r.Body, maxBody))
+		if errors.Is(err, errBodyTooLarge) {
+			// the final frame is missing, the child never sees a complete body
+			bodyTooLarge(ctx, abort, maxBody)
+		}
+		wrote <- err
+	}()
+
+	location, wroteResponse := writeCGIResponse(w, &frameReader{r: c.stdout}, ctx, c.cmd.Process.Pid, opts)
+	if !wroteResponse {
+		return ""
+	}
+	select {
+	case err := <-wrote:
+		if err != nil {
+			slog.WarnContext(ctx, "writing request to persistent CGI failed", "pid", c.cmd.Process.Pid, "error", err)
+			return ""
+		}
+	case <-time.After(time.Second):
+		slog.WarnContext(ctx, "persistent CGI answered without reading the request", "pid", c.cmd.Process.Pid)
+		return ""
+	}
+	// not reusable if it was killed in the meantime
+	ok = stop()
+
+	return location
+}
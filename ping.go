@@ -0,0 +1,30 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// pingHandler answers requests for path with 200 itself, everything else is
+// passed on to next. Never executes anything, so load balancers can check the
+// liveness cheaply through the normal channel.
+func pingHandler(path string, next http.Handler) http.Handler {
+	if path == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodHead {
+			_, _ = io.WriteString(w, "pong\n")
+		}
+	})
+}
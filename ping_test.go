@@ -0,0 +1,27 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "ok.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nok'\n")
+	addr := serveFCGI(t, pingHandler("/fcgi-ping", cgiResponder(arguments{}, nil)))
+
+	// the script must not be executed, it doesn't even exist
+	res := doFCGI(t, addr, map[string]string{"REQUEST_URI": "/fcgi-ping", "SCRIPT_FILENAME": filepath.Join(tmpDir, "missing.sh")}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "pong\n", res.body)
+
+	res = doFCGI(t, addr, map[string]string{"REQUEST_URI": "/ok.sh", "SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, "ok", res.body)
+}
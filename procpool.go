@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// procPool runs the blocking syscalls of CGI children on a fixed set of OS
+// threads. fork/exec is done by dedicated (locked) worker threads and the exit
+// of children is awaited via a pidfd in the netpoller instead of a thread
+// blocked in wait4 per child. Without it each stalled child pins an OS thread.
+type procPool struct {
+	jobs chan func()
+}
+
+// newProcPool starts n worker threads (n < 0: GOMAXPROCS). Returns nil for
+// n == 0, which runs everything on the default go runtime threads.
+func newProcPool(n int) *procPool {
+	if n == 0 {
+		return nil
+	}
+	if n < 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	p := &procPool{jobs: make(chan func())}
+	for range n {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *procPool) worker() {
+	// never unlocked, so the goroutine keeps this thread for itself
+	runtime.LockOSThread()
+	for job := range p.jobs {
+		job()
+	}
+}
+
+// start starts cmd on one of the worker threads (blocks until one is free)
+func (p *procPool) start(cmd *exec.Cmd) error {
+	spawnLock.RLock()
+	defer spawnLock.RUnlock()
+
+	var err error
+	if p == nil {
+		err = cmd.Start()
+	} else {
+		done := make(chan error, 1)
+		p.jobs <- func() { done <- cmd.Start() }
+		err = <-done
+	}
+	if err == nil {
+		ownChildren.Store(cmd.Process.Pid, struct{}{})
+	}
+	return err
+}
+
+// wait waits for cmd to exit and releases its resources. With a pool the
+// waiting happens in the netpoller so only the final reaping needs a thread.
+func (p *procPool) wait(cmd *exec.Cmd) error {
+	if p != nil {
+		// on failure (e.g. kernel without pidfd) simply fall back to a blocking wait
+		_ = waitExited(cmd.Process.Pid)
+	}
+	defer ownChildren.Delete(cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+// waitExited blocks (without occupying an OS thread) until the child pid has
+// exited. The child is not reaped.
+func waitExited(pid int) error {
+	fd, err := unix.PidfdOpen(pid, unix.PIDFD_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "pidfd")
+	defer f.Close()
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var werr error
+	err = rc.Read(func(fd uintptr) bool {
+		// si_signo is set once the child is waitable
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_PIDFD, int(fd), &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil)
+		if err == unix.EINTR {
+			return false
+		}
+		if err != nil {
+			werr = err
+			return true
+		}
+		return info.Signo != 0
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate requests per second on average and bursts of up to
+// burst requests
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token at now. If there is none it is reserved if it becomes
+// available within maxWait. Reports how long until the token is available.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int, maxWait time.Duration) (bool, time.Duration) {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	if wait > maxWait {
+		return false, wait
+	}
+	b.tokens--
+	return true, wait
+}
+
+// clientRateLimiter limits the request rate per client via a token bucket
+// each
+type clientRateLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// newClientRateLimiter returns nil (no limit) if rate <= 0. burst defaults to
+// the rate (at least 1).
+func newClientRateLimiter(rate float64, burst int) *clientRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &clientRateLimiter{rate: rate, burst: burst, now: time.Now, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow reports whether client may send a request now, otherwise how long it
+// has to wait
+func (l *clientRateLimiter) allow(client string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = b
+	}
+	return b.take(now, l.rate, l.burst, 0)
+}
+
+// sweep forgets the buckets which are full again (at most once a minute), so
+// the map doesn't grow with every client ever seen
+func (l *clientRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimiter limits the overall request rate. Requests exceeding it wait up
+// to maxWait for their turn.
+type rateLimiter struct {
+	rate    float64
+	burst   int
+	maxWait time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+// newRateLimiter returns nil (no limit) if rate <= 0. burst defaults to the
+// rate (at least 1).
+func newRateLimiter(rate float64, burst int, maxWait time.Duration) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	l := &rateLimiter{rate: rate, burst: burst, maxWait: maxWait, now: time.Now}
+	l.bucket = tokenBucket{tokens: float64(burst), last: l.now()}
+	return l
+}
+
+// reserve reserves a request, reporting how long it has to wait for its turn
+// or, if that would exceed maxWait, false and when to retry
+func (l *rateLimiter) reserve() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket.take(l.now(), l.rate, l.burst, l.maxWait)
+}
+
+// cancel returns a reserved token which wasn't used
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket.tokens++
+}
+
+// retryAfterSeconds formats wait for the Retry-After header (at least a
+// second)
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
+
+// rateLimitClients rejects requests with 429 if the client exceeds its rate
+func rateLimitClients(l *clientRateLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r)
+		if ok, wait := l.allow(client); !ok {
+			slog.Warn("client exceeds its request rate", "client", client, "rate", l.rate, "burst", l.burst)
+			rejectedRequests.add("client_rate")
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			writeError(w, r.Context(), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitRate delays requests exceeding the overall rate, or rejects them with
+// 503 if they would wait too long
+func limitRate(l *rateLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.reserve()
+		if !ok {
+			slog.Warn("request rate exceeded", "rate", l.rate, "burst", l.burst)
+			rejectedRequests.add("rate")
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			writeError(w, r.Context(), http.StatusServiceUnavailable)
+			return
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				l.cancel()
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
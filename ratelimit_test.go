@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRateLimiter(t *testing.T) {
+	assert.Nil(t, newClientRateLimiter(0, 10))
+
+	now := time.Unix(1000, 0)
+	l := newClientRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for range 3 {
+		ok, _ := l.allow("a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// other clients have their own bucket
+	ok, _ = l.allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("a")
+	assert.True(t, ok)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+
+	// refilled buckets are forgotten
+	now = now.Add(time.Minute)
+	l.allow("c")
+	assert.NotContains(t, l.buckets, "a")
+	assert.NotContains(t, l.buckets, "b")
+}
+
+func TestRateLimitClients(t *testing.T) {
+	handler := rateLimitClients(newClientRateLimiter(0.5, 1), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	before := rejectedRequests.snapshot()["client_rate"]
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, rejectedRequests.snapshot()["client_rate"])
+}
+
+func TestLimitRate(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0, 1, 0))
+
+	l := newRateLimiter(20, 1, 60*time.Millisecond)
+	handler := limitRate(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	before := rejectedRequests.snapshot()["rate"]
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// waits for the next token (50ms)
+	start := time.Now()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	// two tokens ahead, longer than the allowed wait
+	l.reserve()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, before+1, rejectedRequests.snapshot()["rate"])
+}
@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// held (shared) while spawning children so the reaper never sees a child
+	// which is not registered yet
+	spawnLock sync.RWMutex
+	// pids of the children started by us (awaited via exec.Cmd)
+	ownChildren sync.Map
+)
+
+// startReaper makes the wrapper a child subreaper and reaps all orphaned
+// descendants (e.g. of double-forking CGI scripts) reparented to it. As PID 1
+// this happens anyway, so only the reaping is needed.
+func startReaper() error {
+	if os.Getpid() != 1 {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("becoming child subreaper failed: %w", err)
+		}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGCHLD)
+	go func() {
+		for range ch {
+			reapOrphans()
+		}
+	}()
+	return nil
+}
+
+// reapOrphans reaps all exited children which were not started by us
+func reapOrphans() {
+	spawnLock.Lock()
+	defer spawnLock.Unlock()
+
+	for _, pid := range childPids() {
+		if _, own := ownChildren.Load(pid); own {
+			continue
+		}
+		var ws syscall.WaitStatus
+		if wpid, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err == nil && wpid == pid {
+			slog.Debug("reaped orphaned process", "pid", pid, "status", ws.ExitStatus())
+		}
+	}
+}
+
+// childPids lists the children of all our threads
+func childPids() []int {
+	files, _ := filepath.Glob("/proc/self/task/*/children")
+	var pids []int
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, s := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(s); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids
+}
@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// redactedEnv are glob patterns of variables whose values never are logged
+var redactedEnv = []string{
+	"HTTP_AUTHORIZATION",
+	"HTTP_PROXY_AUTHORIZATION",
+	"HTTP_COOKIE",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*SECRET*",
+	"*TOKEN*",
+	"*KEY*",
+}
+
+// redactor replaces sensitive values before they are logged. A nil redactor
+// only applies the built-in rules.
+type redactor struct {
+	// glob patterns of variable names, header names are included as HTTP_*
+	env []string
+	// values (or parts of them) matching these are replaced
+	values []*regexp.Regexp
+}
+
+// newRedactor extends the built-in rules by the given header names, variable
+// name patterns and value regexes
+func newRedactor(headers []string, env []string, values []string) (*redactor, error) {
+	r := &redactor{env: append(append([]string(nil), redactedEnv...), env...)}
+	for _, p := range r.env {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	for _, h := range headers {
+		r.env = append(r.env, headerEnvName(h))
+	}
+	for _, v := range values {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		r.values = append(r.values, re)
+	}
+	return r, nil
+}
+
+// headerEnvName returns the CGI meta-variable of a header, e.g. HTTP_X_API_KEY
+func headerEnvName(header string) string {
+	return "HTTP_" + strings.ToUpper(strings.ReplaceAll(header, "-", "_"))
+}
+
+// sensitive reports whether the value of the variable name must not be logged
+func (r *redactor) sensitive(name string) bool {
+	patterns := redactedEnv
+	if r != nil {
+		patterns = r.env
+	}
+	name = strings.ToUpper(name)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// value replaces the parts of v matching the value regexes
+func (r *redactor) value(v string) string {
+	if r == nil {
+		return v
+	}
+	for _, re := range r.values {
+		v = re.ReplaceAllString(v, redacted)
+	}
+	return v
+}
+
+// envMap returns a copy of env with the values of sensitive variables replaced
+func (r *redactor) envMap(env map[string]string) map[string]string {
+	ret := make(map[string]string, len(env))
+	for k, v := range env {
+		if r.sensitive(k) {
+			v = redacted
+		} else {
+			v = r.value(v)
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+// header returns a copy of h with the values of sensitive headers replaced
+func (r *redactor) header(h http.Header) http.Header {
+	ret := make(http.Header, len(h))
+	for k, vals := range h {
+		vals = append([]string(nil), vals...)
+		for i := range vals {
+			if r.sensitive(headerEnvName(k)) {
+				vals[i] = redacted
+			} else {
+				vals[i] = r.value(vals[i])
+			}
+		}
+		ret[k] = vals
+	}
+	return ret
+}
+
+// attr redacts a log attribute: by its key, string values and env/header maps
+func (r *redactor) attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch {
+	case v.Kind() == slog.KindGroup:
+		attrs := v.Group()
+		ret := make([]any, len(attrs))
+		for i, a := range attrs {
+			ret[i] = r.attr(a)
+		}
+		return slog.Group(a.Key, ret...)
+	case r.sensitive(a.Key) || r.sensitive(headerEnvName(a.Key)):
+		return slog.String(a.Key, redacted)
+	case v.Kind() == slog.KindString:
+		return slog.String(a.Key, r.value(v.String()))
+	case v.Kind() == slog.KindAny:
+		switch x := v.Any().(type) {
+		case map[string]string:
+			return slog.Any(a.Key, r.envMap(x))
+		case http.Header:
+			return slog.Any(a.Key, r.header(x))
+		case error:
+			return slog.String(a.Key, r.value(x.Error()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactHandler is a slog.Handler redacting all records logged with it
+type redactHandler struct {
+	slog.Handler
+	r *redactor
+}
+
+func (h redactHandler) Handle(ctx context.Context, rec slog.Record) error {
+	ret := slog.NewRecord(rec.Time, rec.Level, h.r.value(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		ret.AddAttrs(h.r.attr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, ret)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		ret[i] = h.r.attr(a)
+	}
+	return redactHandler{h.Handler.WithAttrs(ret), h.r}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{h.Handler.WithGroup(name), h.r}
+}
+
+// logFailedEnv logs the CGI environment of a failed request in one record, to
+// debug the params sent by the web server
+func logFailedEnv(ctx context.Context, env map[string]string) {
+	slog.DebugContext(ctx, "CGI environment of failed request", "env", env)
+}
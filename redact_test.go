@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactEnv(t *testing.T) {
+	env := map[string]string{
+		"QUERY_STRING":       "a=b",
+		"HTTP_AUTHORIZATION": "Basic eDp5",
+		"HTTP_COOKIE":        "session=1",
+		"FCGI_REQUEST_TOKEN": "abc",
+		"DB_PASSWORD":        "hunter2",
+	}
+	var r *redactor
+	assert.Equal(t, map[string]string{
+		"QUERY_STRING":       "a=b",
+		"HTTP_AUTHORIZATION": "[REDACTED]",
+		"HTTP_COOKIE":        "[REDACTED]",
+		"FCGI_REQUEST_TOKEN": "[REDACTED]",
+		"DB_PASSWORD":        "[REDACTED]",
+	}, r.envMap(env))
+	assert.Equal(t, "hunter2", env["DB_PASSWORD"])
+}
+
+func TestRedactor(t *testing.T) {
+	_, err := newRedactor(nil, []string{"["}, nil)
+	assert.Error(t, err)
+	_, err = newRedactor(nil, nil, []string{"("})
+	assert.Error(t, err)
+
+	r, err := newRedactor([]string{"X-Session"}, []string{"*_DSN"}, []string{"sk-[a-z0-9]+"})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"HTTP_X_SESSION": "[REDACTED]",
+		"DB_DSN":         "[REDACTED]",
+		"QUERY_STRING":   "q=[REDACTED]",
+	}, r.envMap(map[string]string{"HTTP_X_SESSION": "1", "DB_DSN": "pg://", "QUERY_STRING": "q=sk-abc1"}))
+	assert.Equal(t, http.Header{"X-Session": {"[REDACTED]"}, "Accept": {"*/*"}},
+		r.header(http.Header{"X-Session": {"1"}, "Accept": {"*/*"}}))
+
+	var buf bytes.Buffer
+	logger := slog.New(redactHandler{slog.NewTextHandler(&buf, nil), r})
+	logger.With("token", "t0").Info("using sk-abc", "error", errors.New("bad key sk-x1"), "env", map[string]string{"DB_DSN": "x"}, "script", "/srv/a.cgi")
+	out := buf.String()
+	assert.Contains(t, out, `msg="using [REDACTED]"`)
+	assert.Contains(t, out, "token=[REDACTED]")
+	assert.Contains(t, out, `error="bad key [REDACTED]"`)
+	assert.Contains(t, out, "map[DB_DSN:[REDACTED]]")
+	assert.Contains(t, out, "script=/srv/a.cgi")
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync/atomic"
+
+	"github.com/alexflint/go-arg"
+)
+
+// reloadKeys are the settings applied when the configuration is reloaded
+// (SIGHUP), changes of the others only take effect after a restart
+var reloadKeys = []string{
+	"log-level", "env", "pass-env", "block-env", "interpreter", "vhost",
+	"limit-cpu", "limit-mem", "limit-nofile", "limit-nproc", "nice", "ionice", "locale", "timezone",
+	"exec-timeout", "timeout-signal", "timeout-grace", "max-body-size", "max-response-size",
+	"document-root", "strip-prefix", "alias", "dir-index", "allow", "deny", "hidden",
+	"resolv-conf", "hosts-file", "scripts", "slow-threshold",
+}
+
+// liveHandler serves requests with the current handler, which is replaced
+// when the configuration is reloaded. Running requests finish with the old one.
+type liveHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func newLiveHandler(h http.Handler) *liveHandler {
+	l := &liveHandler{}
+	l.set(h)
+	return l
+}
+
+func (l *liveHandler) set(h http.Handler) {
+	l.h.Store(&h)
+}
+
+func (l *liveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*l.h.Load()).ServeHTTP(w, r)
+}
+
+// parseCommandline parses cmdline (and the environment) on top of args
+func parseCommandline(args *arguments, cmdline []string) error {
+	p, err := arg.NewParser(arg.Config{}, args)
+	if err != nil {
+		return err
+	}
+	return p.Parse(cmdline)
+}
+
+// reloadArgs reads the configuration file and the commandline (cmdline)
+// again and returns cur with the reloadable settings replaced. Every change is
+// logged.
+func reloadArgs(cur arguments, cmdline []string) (arguments, error) {
+	if cur.ConfigFile == "" {
+		return cur, errors.New("no configuration file (--config) to reload")
+	}
+	cli := defaultArguments()
+	if err := parseCommandline(&cli, cmdline); err != nil {
+		return cur, err
+	}
+	next := defaultArguments()
+	locs, err := loadConfigFile(cur.ConfigFile, &next)
+	if err != nil {
+		return cur, err
+	}
+	if err := parseCommandline(&next, cmdline); err != nil {
+		return cur, err
+	}
+	replaceLists(&next, cli)
+	if err := next.validate(locs); err != nil {
+		return cur, err
+	}
+
+	next.Scripts.keepSemaphores(cur.Scripts)
+
+	// made absolute at startup
+	if abs, err := filepath.Abs(next.HTTPRoot); err == nil && abs == cur.HTTPRoot {
+		next.HTTPRoot = cur.HTTPRoot
+	}
+
+	v, n := reflect.ValueOf(&cur).Elem(), reflect.ValueOf(next)
+	for _, f := range configFields() {
+		old, val := v.Field(f.index), n.Field(f.index)
+		if reflect.DeepEqual(old.Interface(), val.Interface()) {
+			continue
+		}
+		if !slices.Contains(reloadKeys, f.key) {
+			slog.Warn("setting changed, it takes effect after a restart", "setting", f.key)
+			continue
+		}
+		if slices.Contains(secretKeys, f.key) {
+			slog.Info("setting reloaded", "setting", f.key)
+		} else {
+			slog.Info("setting reloaded", "setting", f.key, "old", fmt.Sprint(old), "new", fmt.Sprint(val))
+		}
+		old.Set(val)
+	}
+
+	old := cur.vhosts
+	cur.vhosts = nil
+	if cur.vhosts, err = loadVhosts(cur); err != nil {
+		return cur, err
+	}
+	for _, v := range cur.vhosts {
+		for _, o := range old {
+			if o.pattern == v.pattern {
+				v.args.Scripts.keepSemaphores(o.args.Scripts)
+				break
+			}
+		}
+	}
+	return cur, nil
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadArgs(t *testing.T) {
+	path := writeConfig(t, "workers: 2\nexec-timeout: 10s\nlog-level: info\n")
+	cur := defaultArguments()
+	_, err := loadConfigFile(path, &cur)
+	require.NoError(t, err)
+	cur.ConfigFile = path
+
+	require.NoError(t, os.WriteFile(path, []byte("workers: 4\nexec-timeout: 20s\nlog-level: debug\n"), 0o644))
+	next, err := reloadArgs(cur, []string{"--config", path})
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Second, next.ExecTimeout)
+	assert.Equal(t, "debug", next.LogLevel)
+	assert.Equal(t, 2, next.Workers, "workers need a restart")
+
+	// the commandline still overrides the file, invalid files are rejected
+	next, err = reloadArgs(cur, []string{"--config", path, "--exec-timeout", "5s"})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, next.ExecTimeout)
+	require.NoError(t, os.WriteFile(path, []byte("exec-timeout: soon\n"), 0o644))
+	_, err = reloadArgs(cur, []string{"--config", path})
+	assert.ErrorContains(t, err, `invalid value for "exec-timeout"`)
+
+	_, err = reloadArgs(defaultArguments(), nil)
+	assert.ErrorContains(t, err, "no configuration file")
+}
+
+func TestReloadArgsLists(t *testing.T) {
+	path := writeConfig(t, "pass-env: [PATH, LANG]\n")
+	cur := defaultArguments()
+	cur.ConfigFile = path
+
+	next, err := reloadArgs(cur, []string{"--config", path})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PATH", "LANG"}, next.PassEnv)
+
+	// lists given on the commandline or in the environment replace the ones
+	// of the file instead of being appended
+	next, err = reloadArgs(cur, []string{"--config", path, "--pass-env", "TZ"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TZ"}, next.PassEnv)
+	t.Setenv("FCGIWRAP_PASS_ENV", "HOME")
+	next, err = reloadArgs(cur, []string{"--config", path})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"HOME"}, next.PassEnv)
+}
+
+func TestReloadArgsScriptSemaphores(t *testing.T) {
+	path := writeConfig(t, "scripts:\n  /srv/slow/**:\n    max-concurrent: 1\n  /srv/other/**:\n    max-concurrent: 1\n")
+	cur := defaultArguments()
+	_, err := loadConfigFile(path, &cur)
+	require.NoError(t, err)
+	cur.ConfigFile = path
+	release, ok := cur.Scripts.match("/srv/slow/a.sh").acquire()
+	require.True(t, ok)
+	defer release()
+	_, ok = cur.Scripts.match("/srv/other/a.sh").acquire()
+	require.True(t, ok)
+
+	require.NoError(t, os.WriteFile(path, []byte("scripts:\n  /srv/slow/**:\n    max-concurrent: 1\n    timeout: 5s\n  /srv/other/**:\n    max-concurrent: 2\n"), 0o644))
+	next, err := reloadArgs(cur, []string{"--config", path})
+	require.NoError(t, err)
+	// the running instance still counts
+	_, ok = next.Scripts.match("/srv/slow/a.sh").acquire()
+	assert.False(t, ok)
+	// a changed limit starts over
+	_, ok = next.Scripts.match("/srv/other/a.sh").acquire()
+	assert.True(t, ok)
+}
+
+func TestLiveHandler(t *testing.T) {
+	live := newLiveHandler(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	live.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	live.set(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }))
+	rec = httptest.NewRecorder()
+	live.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// randomHex returns n cryptographically random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newRequestID returns an ID identifying a request in the logs
+func newRequestID() string {
+	return randomHex(8)
+}
+
+// maxRequestID is the maximal length of an incoming request ID
+const maxRequestID = 128
+
+// incomingRequestID returns the request ID sent by the client or the web
+// server (X-Request-ID), if it is safe to log and to pass on
+func incomingRequestID(env map[string]string) string {
+	id := env["HTTP_X_REQUEST_ID"]
+	if len(id) > maxRequestID {
+		return ""
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-_.:+/=@", c)) {
+			return ""
+		}
+	}
+	return id
+}
+
+// newRequestToken returns a secret random token, e.g. for temp file names
+func newRequestToken() string {
+	return randomHex(32)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID stored in ctx ("" if there is none)
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler is a slog.Handler adding the request ID from the context
+// (if any) to all records logged with it
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -6,92 +6,1177 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
-	"net/http/fcgi"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// abortKillDelay is how long a CGI may take to exit after SIGTERM once its
+// request was aborted
+const abortKillDelay = 5 * time.Second
+
+// childWaitDelay is the WaitDelay of CGI children. Once the context is done it
+// also bounds the time until SIGKILL, so it leaves aborted requests their grace
+// period.
+const childWaitDelay = max(stderrWaitDelay, abortKillDelay)
+
 // returns a http handler which handles the cgi request, executes the desired command and passes the response in the http response
 func cgiResponder(args arguments, inherited_env []string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		env := fcgi.ProcessEnv(r)
+		params := fcgiParamsFrom(r)
+		args := args.forHost(requestHost(r, params))
+		if params == nil {
+			// plain HTTP (--http) or AJP (--ajp)
+			root := args.HTTPRoot
+			if root == "" {
+				root = args.DocumentRoot
+			}
+			var err error
+			if params, err = httpParams(r, root, args.StripPrefix); err != nil {
+				slog.ErrorContext(r.Context(), "can't serve request", "error", err)
+				writeError(w, r.Context(), http.StatusInternalServerError)
+				return
+			}
+			w = &cgiStatusWriter{ResponseWriter: w}
+		}
+		if args.DocumentRoot != "" {
+			params = maps.Clone(params)
+			params["DOCUMENT_ROOT"] = args.DocumentRoot
+		}
+		serveCGI(w, r, cgiEnv(r, params), args, inherited_env)
+	})
+}
 
-		cmd, err := prepareCGICommand(env, inherited_env, r.Context())
-		if err != nil {
-			slog.Warn("preparing CGI command failed", "error", err)
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
+// serveCGI executes the CGI script described by env for the request r
+func serveCGI(w http.ResponseWriter, r *http.Request, env map[string]string, args arguments, inherited_env []string) {
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	var script string
+	start := args.clk().Now()
+	defer func() {
+		status := sw.status()
+		lifetimeStats.record(script, status)
+		labels := map[string]string{"script": script, "status": strconv.Itoa(status)}
+		args.metrics().Add(metricRequests, 1, labels)
+		args.metrics().Observe(metricDuration, args.clk().Now().Sub(start).Seconds(), map[string]string{"script": script})
+		// local redirects are part of the original request
+		if r.Context().Value(localRedirectsKey{}) == nil {
+			args.accessLog.log(r, env, script, status, sw.size, start, args.clk().Now().Sub(start))
 		}
+	}()
 
-		// wire stdout
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			slog.Warn("failed to pipe stdout", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	id := incomingRequestID(env)
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx := withRequestID(r.Context(), id)
+	w.Header().Set("X-Request-ID", id)
+	spanFrom(ctx).set("fcgiwrap.request_id", id)
+
+	in := &readCounter{ReadCloser: r.Body}
+	r = r.WithContext(r.Context())
+	r.Body = in
+	var exitCode string
+	defer func() {
+		// local redirects are part of the original request
+		if r.Context().Value(localRedirectsKey{}) != nil {
 			return
 		}
+		took := args.clk().Now().Sub(start)
+		if args.SlowThreshold > 0 && took > args.SlowThreshold {
+			slog.WarnContext(ctx, "slow CGI request", "script", script, "duration", took, "threshold", args.SlowThreshold, "env", env)
+		}
+		attrs := []any{"script", script, "status", sw.status(), "duration", took, "bytes_in", in.n.Load(), "bytes_out", sw.size}
+		if exitCode != "" {
+			attrs = append(attrs, "exit_code", exitCode)
+		}
+		if wait, ok := queueWaitFrom(r.Context()); ok {
+			attrs = append(attrs, "queue_wait", wait)
+		}
+		slog.InfoContext(ctx, "request finished", attrs...)
+	}()
+	// as received, env is adjusted for this script below
+	params := maps.Clone(env)
+	env["FCGI_REQUEST_ID"] = id
+	env["FCGI_REQUEST_TOKEN"] = newRequestToken()
 
-		// wire stderr
-		if args.ForwardErr {
-			cmd.Stderr = w
-		} else {
-			cmd.Stderr = os.Stderr
+	applyAlias(env, args.Alias, args.fs)
+	mapScriptName(env, args.StripPrefix)
+	splitPathInfo(env, args.fs)
+	dirIndexScript(env, args.DirIndex, args.fs)
+
+	// applied before the per-directory configuration, so it takes precedence
+	if sc := args.Scripts.match(filepath.Clean(scriptPath(env))); sc != nil {
+		sc.cfg.apply(env)
+		release, ok := sc.acquire()
+		if !ok {
+			slog.WarnContext(ctx, "too many concurrent instances of the script", "pattern", sc.pattern.text)
+			rejectedRequests.add("script_concurrency")
+			writeError(w, ctx, http.StatusServiceUnavailable)
+			return
 		}
+		defer release()
+	}
 
-		// wire stdin
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			slog.Warn("failed to prepare command", "error", err)
-			http.Error(w, err.Error(), http.StatusForbidden)
+	var dirCfg *dirConfig
+	if args.DirConfig {
+		var err error
+		if dirCfg, err = findDirConfig(env, args); err != nil {
+			slog.ErrorContext(ctx, "loading per-directory configuration failed", "error", err)
+			writeError(w, ctx, http.StatusInternalServerError)
 			return
 		}
+		if dirCfg != nil {
+			dirCfg.apply(env)
+		}
+	}
+
+	timeout := execTimeout(args, env)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(args.clk(), ctx, timeout)
+		defer cancel()
+	}
+
+	failed := false
+	if args.LogEnvOnFailure {
+		defer func() {
+			// errors of the wrapper itself are sent via WriteHeader
+			if failed || sw.code >= 400 {
+				logFailedEnv(ctx, env)
+			}
+		}()
+	}
+
+	maxBody := int64(args.MaxBodySize)
+	if maxBody > 0 && r.ContentLength > maxBody {
+		slog.WarnContext(ctx, "request body too large", "content_length", r.ContentLength, "max", maxBody)
+		rejectedRequests.add("body_size")
+		writeError(w, ctx, http.StatusRequestEntityTooLarge)
+		return
+	}
+	// cancelled (killing the child) if the body turns out to be too large
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
 
-		if err := cmd.Start(); err != nil {
-			slog.Error("failed to start CGI", "error", err)
-			http.Error(w, "failed to start CGI: "+err.Error(), http.StatusBadGateway)
+	head := r.Method == http.MethodHead
+	if head && args.HeadMode == "get" {
+		env["REQUEST_METHOD"] = http.MethodGet
+	}
+
+	cmd, err := prepareCGICommand(args, env, inherited_env, ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "preparing CGI command failed", "error", err)
+		status := http.StatusForbidden
+		if errors.Is(err, errFSUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, ctx, status)
+		return
+	}
+	// Args[0] always is the script, even if it is started via the helper
+	script = cmd.Args[0]
+	spanFrom(ctx).set("fcgiwrap.script", script)
+	if err := dirCfg.check(filepath.Clean(script)); err != nil {
+		slog.WarnContext(ctx, "script denied by per-directory configuration", "error", err)
+		writeError(w, ctx, http.StatusForbidden)
+		return
+	}
+	// a request aborted by the web server gets the chance to clean up before
+	// SIGKILL follows, other cancellations kill right away
+	cmd.Cancel = func() error {
+		if !requestAborted(ctx) {
+			return signalGroup(cmd, syscall.SIGKILL)
+		}
+		slog.WarnContext(ctx, "request aborted by web server, terminating CGI", "pid", cmd.Process.Pid)
+		args.clk().AfterFunc(abortKillDelay, func() { _ = signalGroup(cmd, syscall.SIGKILL) })
+		return signalGroup(cmd, syscall.SIGTERM)
+	}
+
+	if args.DryRun {
+		serveDryRun(w, ctx, cmd)
+		return
+	}
+
+	if status := args.authz.authorize(ctx, r, script); status != 0 {
+		writeError(w, ctx, status)
+		return
+	}
+
+	if head && args.HeadMode == "skip" {
+		slog.DebugContext(ctx, "not running CGI for HEAD request")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if persistentScript(args, script, env) {
+		if location := servePersistent(w, r, ctx, abort, args, cmd, env, inherited_env); location != "" {
+			serveLocalRedirect(w, r, ctx, args, params, inherited_env, location)
+		}
+		return
+	}
+
+	cg, err := newChildCgroup(args, script)
+	if err != nil {
+		slog.ErrorContext(ctx, "preparing cgroup failed", "error", err)
+		writeError(w, ctx, http.StatusInternalServerError)
+		return
+	}
+	if cg != nil {
+		defer cg.close()
+		cg.attach(cmd)
+	}
+
+	// wire stdout
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to pipe stdout", "error", err)
+		writeError(w, ctx, http.StatusInternalServerError)
+		return
+	}
+
+	// wire stderr
+	var stderr *stderrLog
+	switch {
+	case args.ForwardErr && fcgiStderrFrom(r) != nil:
+		// sent as FCGI_STDERR records
+		cmd.Stderr = fcgiStderrFrom(r)
+		cmd.WaitDelay = childWaitDelay
+	case args.RawStderr:
+		cmd.Stderr = os.Stderr
+	default:
+		stderr = newStderrLog(ctx, script, int64(args.StderrMax))
+		if args.StderrDir != "" {
+			f, err := stderrFile(args.StderrDir, script)
+			if err != nil {
+				slog.WarnContext(ctx, "opening stderr file failed, logging it instead", "error", err)
+			} else {
+				defer f.Close()
+				stderr.out = f
+			}
+		}
+		cmd.Stderr = stderr
+		// don't wait forever for descendants still holding stderr open
+		cmd.WaitDelay = childWaitDelay
+		defer stderr.Close()
+	}
+
+	// wire stdin
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to prepare command", "error", err)
+		writeError(w, ctx, http.StatusForbidden)
+		return
+	}
+
+	// wire the FCGI_DATA stream of filter requests
+	var data *filterData
+	if src := fcgiDataFrom(r); src != nil {
+		if data, err = newFilterData(cmd, src); err != nil {
+			slog.ErrorContext(ctx, "failed to pipe FCGI_DATA", "error", err)
+			writeError(w, ctx, http.StatusInternalServerError)
 			return
 		}
-		defer slog.Debug("CGI process finished", "pid", cmd.Process.Pid)
+		defer data.close()
+	}
+
+	started := args.clk().Now()
+	if err := args.procs.start(cmd); err != nil {
+		slog.ErrorContext(ctx, "failed to start CGI", "error", err)
+		writeError(w, ctx, http.StatusBadGateway)
+		return
+	}
+	if stderr != nil {
+		stderr.setPid(cmd.Process.Pid)
+	}
+	_, execSpan := startSpan(ctx, "exec")
+	execSpan.set("process.pid", cmd.Process.Pid)
+	defer func() {
+		// runs after the child was reaped (deferred below)
+		if cmd.ProcessState != nil {
+			exitCode = exitLabel(cmd.ProcessState)
+			args.metrics().Add(metricExits, 1, map[string]string{"script": script, "code": exitCode})
+			execSpan.set("process.exit.code", exitCode)
+			if !cmd.ProcessState.Success() {
+				execSpan.fail("exit " + exitCode)
+			}
+		}
+		execSpan.finish()
+	}()
+	if data != nil {
+		data.start(ctx)
+	}
+	runningChildren.Add(1)
+	defer runningChildren.Add(-1)
+	if warn := timeoutWarning(args, env, timeout, cmd); warn != nil {
+		defer warn.Stop()
+	}
+	defer func() {
+		// make sure the child is gone and reaped, also on early returns
+		if cmd.ProcessState == nil {
+			if requestAborted(ctx) {
+				// SIGKILL follows after the grace period (cmd.Cancel), until
+				// then the script may still be writing
+				go io.Copy(io.Discard, stdout)
+			} else {
+				_ = signalGroup(cmd, syscall.SIGKILL)
+			}
+			_ = args.procs.wait(cmd)
+		}
+	}()
 
-		// Copy request body to CGI stdin
-		go func() {
-			io.Copy(stdin, r.Body)
+	// Copy request body to CGI stdin
+	var cont *continueGate
+	if !nphScript(script, env) {
+		cont = newContinueGate(r)
+	}
+	var truncated atomic.Bool
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		if !cont.wait(ctx, args.clk()) {
+			// rejected by the script, the client doesn't send the body
 			stdin.Close()
+			return
+		}
+		received := &countingReader{r: r.Body}
+		if _, err := io.Copy(stdin, limitRequestBody(received, maxBody)); errors.Is(err, errBodyTooLarge) {
+			bodyTooLarge(ctx, abort, maxBody)
+			// before closing stdin, the script must not see a complete body
+			_ = signalGroup(cmd, syscall.SIGKILL)
+		}
+		stdin.Close()
+
+		if !received.truncated(r.ContentLength) {
+			return
+		}
+		// the client is gone, don't let the script wait for the rest
+		truncated.Store(true)
+		slog.WarnContext(ctx, "request body cut off, closed stdin of CGI", "pid", cmd.Process.Pid, "content_length", r.ContentLength, "received", received.n, "error", received.err)
+		t := args.clk().AfterFunc(args.UploadGrace, func() {
+			slog.WarnContext(ctx, "terminating CGI after its request body was cut off", "pid", cmd.Process.Pid)
+			_ = signalGroup(cmd, syscall.SIGTERM)
+		})
+		<-finished
+		t.Stop()
+	}()
+
+	opts := newResponseOptions(args, script, env)
+	opts.head = head
+	opts.interim = r.ProtoAtLeast(1, 1)
+	opts.cont = cont
+	if args.Sendfile {
+		opts.sendfile = func(w http.ResponseWriter) bool { return serveSendfile(w, r, ctx, env["DOCUMENT_ROOT"]) }
+	}
+	var waitErr error
+	if args.MetaHeaders || args.DebugHeaders {
+		opts.meta = &responseMeta{clock: args.clk(), started: started, wait: func() *os.ProcessState {
+			waitErr = args.procs.wait(cmd)
+			return cmd.ProcessState
+		}, meta: args.MetaHeaders, debug: args.DebugHeaders, pid: cmd.Process.Pid}
+	}
+	var location string
+	var buf *responseBuffer
+	if nphScript(script, env) {
+		// the limit includes the headers here
+		if !writeNPHResponse(w, limitBody(stdout, int64(args.MaxResponseSize)), ctx, cmd.Process.Pid, head) {
+			return
+		}
+	} else {
+		out := w
+		if args.BufferResponse > 0 {
+			buf = newResponseBuffer(w, int64(args.BufferResponse))
+			out = buf
+		}
+		var ok bool
+		location, ok = writeCGIResponse(out, stdout, ctx, cmd.Process.Pid, opts)
+		if !ok {
+			if buf != nil {
+				buf.finish(ctx, true)
+			}
+			return
+		}
+	}
+
+	if cmd.ProcessState == nil {
+		waitErr = args.procs.wait(cmd)
+	}
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() >= 0 {
+		setFCGIAppStatus(r, cmd.ProcessState.ExitCode())
+	}
+	if truncated.Load() {
+		failed = true
+	}
+	if err := waitErr; err != nil {
+		failed = true
+		if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			slog.WarnContext(ctx, "CGI killed after exceeding execution timeout", "pid", cmd.Process.Pid)
+		} else {
+			slog.ErrorContext(ctx, "CGI exited with error", "error", err)
+		}
+	}
+	if buf != nil && location == "" {
+		buf.finish(ctx, failed)
+	}
+	if location != "" {
+		serveLocalRedirect(w, r, ctx, args, params, inherited_env, location)
+	}
+}
+
+// serveDryRun logs what would be executed instead of executing it
+func serveDryRun(w http.ResponseWriter, ctx context.Context, cmd *exec.Cmd) {
+	// as map, so sensitive values are redacted
+	env := make(map[string]string, len(cmd.Env))
+	for _, kv := range cmd.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	slog.InfoContext(ctx, "dry run, not executing CGI", "path", cmd.Path, "args", cmd.Args, "dir", cmd.Dir, "env", env)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "dry run: would execute %q with arguments %q in %q\n", cmd.Path, cmd.Args, cmd.Dir)
+}
+
+// writeCGIResponse parses the CGI headers from out and streams the response to
+// w. Returns false if the response could not be forwarded completely. If the
+// response is a local redirect (RFC 3875 section 6.2.2) nothing is written and
+// its location is returned instead. The body is checked against a declared
+// Content-Length. On false the child may still be writing, the caller has to
+// kill it.
+func writeCGIResponse(w http.ResponseWriter, out io.Reader, ctx context.Context, pid int, opts responseOptions) (string, bool) {
+	_, headerSpan := startSpan(ctx, "read headers")
+	defer headerSpan.finish()
+	// unless accepted, the client doesn't need to send the body
+	defer opts.cont.open(false)
+	// Use bufio to scan headers
+	br := bufio.NewReader(out)
+	if opts.meta != nil {
+		br = bufio.NewReaderSize(out, metaLookahead)
+	}
+	headerless := !startsWithHeader(br)
+	if headerless {
+		if opts.headerlessType == "" {
+			slog.WarnContext(ctx, "CGI output doesn't start with a header block", "pid", pid)
+			writeError(w, ctx, http.StatusBadGateway)
+			return "", false
+		}
+		slog.DebugContext(ctx, "CGI output without header block", "pid", pid)
+		w.Header().Set("Content-Type", opts.headerlessType)
+	}
+	limits := &headerLimits{maxCount: opts.maxHeaders, maxBytes: opts.maxHeaderBytes}
+	for !headerless {
+		header, err := readCGIHeader(br, limits)
+		if errors.Is(err, errHeaderTooLarge) {
+			slog.WarnContext(ctx, "CGI header section exceeds limits, aborting response", "pid", pid, "max_headers", opts.maxHeaders, "max_header_bytes", opts.maxHeaderBytes)
+			writeError(w, ctx, http.StatusBadGateway)
+			return "", false
+		}
+		if err != nil {
+			if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+				slog.WarnContext(ctx, "CGI exceeded execution timeout before sending headers", "pid", pid)
+				writeError(w, ctx, http.StatusGatewayTimeout)
+				return "", false
+			}
+			if errors.Is(context.Cause(ctx), errBodyTooLarge) {
+				writeError(w, ctx, http.StatusRequestEntityTooLarge)
+				return "", false
+			}
+			slog.WarnContext(ctx, "error reading CGI headers", "error", err)
+			writeError(w, ctx, http.StatusBadGateway)
+			return "", false
+		}
+
+		// interim responses (e.g. "Status: 100 Continue") are followed by
+		// another header block. FastCGI and AJP have no way to carry them
+		// (their writers drop them), the web server answers Expect:
+		// 100-continue itself.
+		if code := interimStatus(header); code != 0 {
+			if code == http.StatusContinue && opts.cont != nil {
+				opts.cont.accept(w)
+				continue
+			}
+			if opts.interim {
+				slog.DebugContext(ctx, "forwarding interim response of CGI", "pid", pid, "status", code)
+				writeInterim(w, header, code)
+			}
+			continue
+		}
+		if location := localRedirect(header, br); location != "" {
+			return location, true
+		}
+		if headerStatus(header) < http.StatusMultipleChoices {
+			opts.cont.accept(w)
+		}
+		for key, vals := range header {
+			w.Header()[key] = append(w.Header()[key], vals...)
+		}
+		stripHeaders(ctx, w.Header())
+		if opts.sendfile != nil && wantsSendfile(w.Header()) {
+			// the body of the script doesn't matter
+			_, _ = io.Copy(io.Discard, br)
+			return "", opts.sendfile(w)
+		}
+		if opts.defaultType != "" && w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", opts.defaultType)
+		}
+		break
+	}
+
+	declared := int64(-1)
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			slog.WarnContext(ctx, "invalid Content-Length of CGI", "pid", pid, "content_length", cl)
+			writeError(w, ctx, http.StatusBadGateway)
+			return "", false
+		}
+		declared = n
+		if opts.stripLength {
+			w.Header().Del("Content-Length")
+		}
+	}
+
+	if opts.rewrite != nil {
+		opts.rewrite(w.Header())
+	}
+	if opts.meta != nil {
+		opts.meta.addHeaders(w.Header(), br)
+	}
+
+	headerSpan.finish()
+	_, bodySpan := startSpan(ctx, "stream body")
+	defer bodySpan.finish()
+
+	src := limitBody(br, opts.maxBody)
+	if opts.head {
+		// the script must not block on a full pipe
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			logBodyError(ctx, pid, err)
+			return "", false
+		}
+		return "", true
+	}
+
+	// Stream the remaining body
+	var body io.Writer = w
+	if opts.noBuffering || strings.EqualFold(w.Header().Get("X-Accel-Buffering"), "no") {
+		// send the headers right away, e.g. before the first event of SSE
+		fw := &flushWriter{w: w, rc: http.NewResponseController(w)}
+		fw.flush()
+		body = fw
+	} else if encoding, dict := responseEncoding(opts, w.Header(), br, declared); encoding != "" {
+		contentType := w.Header().Get("Content-Type")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		if compressDictFor(contentType, opts.compressDicts) != nil {
+			w.Header().Add("Vary", "Available-Dictionary")
+		}
+		cw, err := newCompressor(w, encoding, compressLevelFor(contentType, opts.compressLevels), compressWindowFor(contentType, opts.compressWindows), dict)
+		if err != nil {
+			logBodyError(ctx, pid, err)
+			return "", false
+		}
+		defer func() {
+			if err := cw.Close(); err != nil {
+				slog.WarnContext(ctx, "error finishing compressed CGI body", "error", err)
+			}
 		}()
+		body = cw
+	}
+	if declared < 0 || opts.stripLength {
+		n, err := io.Copy(body, src)
+		if err != nil {
+			logBodyError(ctx, pid, err)
+			return "", false
+		}
+		if declared >= 0 && n != declared {
+			slog.WarnContext(ctx, "CGI body doesn't match its Content-Length", "pid", pid, "content_length", declared, "size", n)
+		}
+		return "", true
+	}
 
-		// Use bufio to scan headers
-		br := bufio.NewReader(stdout)
-		for {
-			line, err := br.ReadString('\n')
-			if err != nil {
-				slog.Warn("error reading CGI headers", "error", err)
-				http.Error(w, "Bad Gateway", http.StatusBadGateway)
-				return
+	// never send more or less than declared, the response would be corrupt
+	n, err := io.Copy(body, io.LimitReader(src, declared))
+	if err != nil {
+		logBodyError(ctx, pid, err)
+		return "", false
+	}
+	if n < declared {
+		slog.WarnContext(ctx, "CGI body shorter than its Content-Length, aborting response", "pid", pid, "content_length", declared, "size", n)
+		return "", false
+	}
+	extra, err := io.Copy(io.Discard, src)
+	if extra > 0 {
+		slog.WarnContext(ctx, "CGI body longer than its Content-Length, truncated", "pid", pid, "content_length", declared, "size", n+extra)
+	}
+	if err != nil {
+		logBodyError(ctx, pid, err)
+		return "", false
+	}
+	return "", true
+}
+
+// countingReader counts the bytes read and records the error ending the reads
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// truncated reports whether reading failed or ended before contentLength
+// (0 if unknown) bytes were read. Reads stopped early by the reader are fine.
+func (c *countingReader) truncated(contentLength int64) bool {
+	if c.err == nil {
+		return false
+	}
+	return c.err != io.EOF || contentLength > 0 && c.n < contentLength
+}
+
+// limitRequestBody fails with errBodyTooLarge once more than max bytes (0:
+// unlimited) of body are read, e.g. of chunked uploads without
+// CONTENT_LENGTH
+func limitRequestBody(body io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return body
+	}
+	return &sizeLimitReader{r: body, n: max, err: errBodyTooLarge}
+}
+
+// bodyTooLarge aborts the request with errBodyTooLarge, which kills the child
+// and is answered with 413
+func bodyTooLarge(ctx context.Context, abort context.CancelCauseFunc, max int64) {
+	slog.WarnContext(ctx, "request body too large, killing CGI", "max", max)
+	rejectedRequests.add("body_size")
+	abort(errBodyTooLarge)
+}
+
+// errResponseTooLarge is returned once a script sent more than allowed
+var errResponseTooLarge = errors.New("response exceeds the max size")
+
+// sizeLimitReader fails with err once more than n bytes are read
+type sizeLimitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, l.err
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// limitBody limits r to max bytes (0: unlimited)
+func limitBody(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &sizeLimitReader{r: r, n: max, err: errResponseTooLarge}
+}
+
+// logBodyError logs why the body of a script couldn't be passed on
+func logBodyError(ctx context.Context, pid int, err error) {
+	if errors.Is(err, errResponseTooLarge) {
+		slog.WarnContext(ctx, "CGI response exceeds the max size, aborting response", "pid", pid)
+		return
+	}
+	slog.WarnContext(ctx, "error copying CGI body", "error", err)
+}
+
+// flushWriter flushes every write to the web server right away
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flush()
+	return n, err
+}
+
+func (f *flushWriter) flush() {
+	_ = f.rc.Flush()
+}
+
+// errHeaderTooLarge is returned if the header section of a CGI response
+// exceeds its limits
+var errHeaderTooLarge = errors.New("CGI header section too large")
+
+// headerLimits caps the header section of a response, interim blocks included
+type headerLimits struct {
+	// max number of header lines and bytes (0: unlimited)
+	maxCount int
+	maxBytes int64
+	// read so far
+	count int
+	bytes int64
+}
+
+// readHeaderLine reads a line without buffering more than allowed by limits
+// (nil: unlimited)
+func readHeaderLine(br *bufio.Reader, limits *headerLimits) (string, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if limits != nil && limits.maxBytes > 0 && limits.bytes+int64(len(line)) > limits.maxBytes {
+			return "", errHeaderTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if limits != nil {
+			limits.bytes += int64(len(line))
+		}
+		return string(line), nil
+	}
+}
+
+// readCGIHeader reads a header block (up to the empty line). Folded lines
+// (starting with whitespace) continue the previous header. Each header line
+// and byte read is deducted from limits (nil: unlimited).
+func readCGIHeader(br *bufio.Reader, limits *headerLimits) (http.Header, error) {
+	header := make(http.Header)
+	var last string
+	for {
+		line, err := readHeaderLine(br, limits)
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return header, nil // end of headers
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if vals := header[last]; len(vals) > 0 {
+				vals[len(vals)-1] = strings.TrimSpace(vals[len(vals)-1] + " " + strings.TrimSpace(line))
 			}
+			continue
+		}
 
-			line = strings.TrimRight(line, "\r\n")
-			if line == "" {
-				break // end of headers
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			if limits != nil {
+				limits.count++
+				if limits.maxCount > 0 && limits.count > limits.maxCount {
+					return nil, errHeaderTooLarge
+				}
 			}
+			key := strings.TrimSpace(parts[0])
+			val := strings.TrimSpace(parts[1])
+			header.Add(key, val)
+			last = textproto.CanonicalMIMEHeaderKey(key)
+		}
+	}
+}
+
+// startsWithHeader reports whether the output in br starts with a header line
+// (or the empty line ending an empty header block) without consuming anything.
+// Empty output counts as header, reading it fails later on.
+func startsWithHeader(br *bufio.Reader) bool {
+	for i := 0; ; i++ {
+		b, err := br.Peek(i + 1)
+		if err != nil {
+			return i == 0
+		}
+		switch c := b[i]; {
+		case c == ':':
+			return i > 0
+		case c == '\r' || c == '\n':
+			return i == 0
+		case !isTokenChar(c):
+			return false
+		}
+	}
+}
+
+// isTokenChar reports whether c may be part of a header name (RFC 9110 token)
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
 
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				val := strings.TrimSpace(parts[1])
-				w.Header().Add(key, val)
+// hopByHopHeaders only apply to the connection of the script, the web server
+// decides about them on its own (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// stripHeaders removes hop-by-hop headers (including the ones listed in
+// Connection) and headers with invalid names or values from the headers of a
+// script, passing them on corrupts the FastCGI response for some web servers
+func stripHeaders(ctx context.Context, h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
 			}
 		}
+	}
+	for _, key := range hopByHopHeaders {
+		if _, ok := h[key]; ok {
+			slog.DebugContext(ctx, "dropping hop-by-hop header of CGI", "header", key)
+			delete(h, key)
+		}
+	}
+	for key, vals := range h {
+		if !validHeaderName(key) || slices.ContainsFunc(vals, invalidHeaderValue) {
+			slog.WarnContext(ctx, "dropping invalid header of CGI", "header", key)
+			delete(h, key)
+		}
+	}
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidHeaderValue reports whether v contains control characters (besides
+// tabs)
+func invalidHeaderValue(v string) bool {
+	return strings.ContainsFunc(v, func(r rune) bool {
+		return r < ' ' && r != '\t' || r == 0x7f
+	})
+}
+
+// responseOptions configure how the output of a script is passed on
+type responseOptions struct {
+	// adds the metadata headers (nil if disabled)
+	meta *responseMeta
+	// remove the Content-Length header so the web server frames the response
+	stripLength bool
+	// adjusts the headers of the script before they are sent (nil if none)
+	rewrite func(http.Header)
+	// Content-Type of output without header block ("": answer 502)
+	headerlessType string
+	// Content-Type of responses whose headers lack one ("": sniffed)
+	defaultType string
+	// limits of the header section (0: unlimited)
+	maxHeaders     int
+	maxHeaderBytes int64
+	// answer to a HEAD request: the body is discarded, the headers (including
+	// Content-Length) are kept
+	head bool
+	// flush every chunk of the body as soon as it is read (also enabled by the
+	// script via X-Accel-Buffering: no)
+	noBuffering bool
+	// forward interim (1xx) responses, the client understands them
+	interim bool
+	// the body of the request waits for the script to answer (nil: doesn't)
+	cont *continueGate
+	// encoding the body is compressed with ("": none), if it is at least
+	// compressMin bytes large and its type matches compressTypes, at the level
+	// and window of its type. dcz is used instead if the dictionary of its
+	// type is the one the client has (availableDict, its SHA-256).
+	compress        string
+	compressMin     int64
+	compressTypes   []string
+	compressLevels  []compressLevel
+	compressWindows []compressWindow
+	compressDicts   []compressDict
+	availableDict   string
+	// serves the file referenced via X-Sendfile/X-Accel-Redirect instead of
+	// the body (nil: the headers are passed on)
+	sendfile func(http.ResponseWriter) bool
+	// max size of the body, a script sending more is killed (0: unlimited)
+	maxBody int64
+}
+
+// newResponseOptions returns the options for the output of script (without
+// metadata)
+func newResponseOptions(args arguments, script string, env map[string]string) responseOptions {
+	opts := responseOptions{
+		stripLength:    args.StripContentLength,
+		headerlessType: args.HeaderlessType,
+		defaultType:    args.DefaultContentType,
+		noBuffering:    args.NoBuffering,
+		maxBody:        int64(args.MaxResponseSize),
+		maxHeaders:     args.MaxHeaders,
+		maxHeaderBytes: int64(args.MaxHeaderBytes),
+	}
+	if args.Compress {
+		encodings := []string{"gzip", "deflate"}
+		if args.CompressZstd {
+			encodings = []string{"zstd", "gzip", "deflate"}
+		}
+		opts.compress = negotiateEncoding(env["HTTP_ACCEPT_ENCODING"], encodings)
+		opts.compressMin = int64(args.CompressMinSize)
+		opts.compressTypes = args.CompressTypes
+		opts.compressLevels = args.CompressLevels
+		opts.compressWindows = args.CompressWindows
+		if len(args.CompressDicts) > 0 {
+			opts.compressDicts = args.CompressDicts
+			opts.availableDict = availableDictionary(env["HTTP_ACCEPT_ENCODING"], env["HTTP_AVAILABLE_DICTIONARY"])
+		}
+		if len(opts.compressTypes) == 0 {
+			opts.compressTypes = compressTypes
+		}
+	}
+	if policy := dispositionPolicy(args, script, env); policy != "" {
+		opts.rewrite = func(h http.Header) { applyDisposition(h, policy, script, env) }
+	}
+	return opts
+}
+
+// localRedirect returns the location if the response is a local redirect: only
+// a Location header with a path and no body
+func localRedirect(h http.Header, body *bufio.Reader) string {
+	location := h.Get("Location")
+	if len(h) != 1 || !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") {
+		return ""
+	}
+	if _, err := body.Peek(1); err != io.EOF {
+		return ""
+	}
+	return location
+}
+
+// maxLocalRedirects limits the number of local redirects of a single request
+const maxLocalRedirects = 10
+
+type localRedirectsKey struct{}
+
+// serveLocalRedirect answers a local redirect of a script, either with a 302 to
+// the location or by serving the location as new GET request (below the same
+// DOCUMENT_ROOT)
+func serveLocalRedirect(w http.ResponseWriter, r *http.Request, ctx context.Context, args arguments, params map[string]string, inherited_env []string, location string) {
+	if args.LocalRedirect == "302" {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+
+	n, _ := r.Context().Value(localRedirectsKey{}).(int)
+	if n >= maxLocalRedirects {
+		slog.ErrorContext(ctx, "too many local redirects", "location", location)
+		writeError(w, ctx, http.StatusInternalServerError)
+		return
+	}
+	u, err := url.ParseRequestURI(location)
+	docRoot := params["DOCUMENT_ROOT"]
+	if err != nil || docRoot == "" {
+		slog.ErrorContext(ctx, "can't serve local redirect", "location", location, "document_root", docRoot, "error", err)
+		writeError(w, ctx, http.StatusInternalServerError)
+		return
+	}
+	slog.DebugContext(ctx, "serving local redirect", "location", location)
+
+	// the settings of the target script apply, not the ones of this one
+	redirected := maps.Clone(params)
+	for _, k := range []string{"CONTENT_LENGTH", "CONTENT_TYPE", "PATH_INFO", "PATH_TRANSLATED"} {
+		delete(redirected, k)
+	}
+	// a HEAD request stays one
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	redirected["REQUEST_METHOD"] = method
+	redirected["REQUEST_URI"] = location
+	redirected["QUERY_STRING"] = u.RawQuery
+	redirected["SCRIPT_NAME"] = u.Path
+	redirected["SCRIPT_FILENAME"] = filepath.Join(docRoot, u.Path)
 
-		// Stream the remaining body
-		if _, err := io.Copy(w, br); err != nil {
-			slog.Warn("error copying CGI body", "error", err)
+	r2 := r.Clone(context.WithValue(r.Context(), localRedirectsKey{}, n+1))
+	r2.Method = method
+	r2.URL = u
+	r2.Body = http.NoBody
+	r2.ContentLength = 0
+	serveCGI(w, r2, redirected, args, inherited_env)
+}
+
+// headerStatus returns the status of a CGI header block (200 if it has no
+// valid Status header)
+func headerStatus(h http.Header) int {
+	if fields := strings.Fields(h.Get("Status")); len(fields) > 0 {
+		if code, err := strconv.Atoi(fields[0]); err == nil {
+			return code
 		}
+	}
+	return http.StatusOK
+}
 
-		if err := cmd.Wait(); err != nil {
-			slog.Error("CGI exited with error", "error", err)
+// interimStatus returns the status if the header block is an interim (1xx)
+// response, 0 otherwise
+func interimStatus(h http.Header) int {
+	if _, ok := h["Status"]; !ok {
+		return 0
+	}
+	code := headerStatus(h)
+	if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+		return 0
+	}
+	return code
+}
+
+// writeInterim sends an interim response with the headers of the block h,
+// they don't carry over to the final response
+func writeInterim(w http.ResponseWriter, h http.Header, code int) {
+	for key, vals := range h {
+		if key != "Status" {
+			w.Header()[key] = vals
 		}
+	}
+	w.WriteHeader(code)
+	for key := range h {
+		delete(w.Header(), key)
+	}
+}
+
+// expectContinueDelay is how long the body of a request with Expect:
+// 100-continue is held back for the script to answer. Scripts reading their
+// input first get it after that.
+const expectContinueDelay = time.Second
+
+// continueGate holds back the body of a request with Expect: 100-continue
+// until the script accepted it (Status: 100 or a successful response), so it
+// can reject an upload before the client sends it
+type continueGate struct {
+	once    sync.Once
+	done    chan struct{}
+	proceed bool
+}
+
+// newContinueGate returns nil if r doesn't expect a 100 Continue or the web
+// server answers it (FastCGI, AJP)
+func newContinueGate(r *http.Request) *continueGate {
+	if fcgiRequestFrom(r) != nil || ajpParamsFrom(r) != nil || r.ContentLength == 0 || !r.ProtoAtLeast(1, 1) {
+		return nil
+	}
+	if !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return nil
+	}
+	return &continueGate{done: make(chan struct{})}
+}
+
+// accept sends the 100 Continue via w and lets the body through, unless the
+// gate was opened before
+func (g *continueGate) accept(w http.ResponseWriter) {
+	if g == nil {
+		return
+	}
+	g.once.Do(func() {
+		w.WriteHeader(http.StatusContinue)
+		g.proceed = true
+		close(g.done)
 	})
 }
+
+// open lets the body through (proceed) or not, unless the gate was opened
+// before
+func (g *continueGate) open(proceed bool) {
+	if g == nil {
+		return
+	}
+	g.once.Do(func() {
+		g.proceed = proceed
+		close(g.done)
+	})
+}
+
+// wait reports whether the body is to be passed to the script, at most
+// expectContinueDelay after which the body is read anyway (net/http sends the
+// 100 Continue then)
+func (g *continueGate) wait(ctx context.Context, clk clock) bool {
+	if g == nil {
+		return true
+	}
+	t := clk.NewTimer(expectContinueDelay)
+	defer t.Stop()
+	select {
+	case <-g.done:
+	case <-t.C():
+		g.open(true)
+	case <-ctx.Done():
+		g.open(false)
+	}
+	return g.proceed
+}
+
+// metaLookahead is the amount of output buffered to learn the exit code for
+// the metadata headers
+const metaLookahead = 64 << 10
+
+// responseMeta provides the values of the X-FCGIWrap-* response headers
+type responseMeta struct {
+	clock   clock
+	started time.Time
+	// waits for the child to exit (nil if the exit code is never known)
+	wait func() *os.ProcessState
+	// add the X-FCGIWrap-* (--meta-headers) and X-CGI-* (--debug-headers)
+	// headers
+	meta, debug bool
+	pid         int
+}
+
+// addHeaders adds the metadata headers. If the remaining output fits into the
+// buffer of br, the child is awaited so its exit code can be reported.
+func (m *responseMeta) addHeaders(h http.Header, br *bufio.Reader) {
+	var st *os.ProcessState
+	if m.wait != nil {
+		if _, err := br.Peek(br.Size()); err == io.EOF {
+			st = m.wait()
+		}
+	}
+	took := m.clock.Now().Sub(m.started)
+	if m.meta {
+		if st != nil {
+			h.Set("X-FCGIWrap-Exit-Code", strconv.Itoa(st.ExitCode()))
+		}
+		h.Set("X-FCGIWrap-Exec-Time", strconv.FormatFloat(took.Seconds(), 'f', 3, 64))
+	}
+	if m.debug {
+		if st != nil {
+			h.Set("X-CGI-Exit-Status", exitLabel(st))
+		}
+		h.Set("X-CGI-Pid", strconv.Itoa(m.pid))
+		h.Set("X-CGI-Duration", took.String())
+	}
+}
@@ -0,0 +1,978 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fcgiResponse is the parsed result of a FastCGI request
+type fcgiResponse struct {
+	status int
+	header http.Header
+	body   string
+	stderr string
+}
+
+// serveFCGI serves h via FastCGI on a local tcp listener and returns the address
+func serveFCGI(t *testing.T, h http.Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go serveFastCGI(l, h, 0, "")
+	return l.Addr().String()
+}
+
+// writeFCGIRecord writes a single FastCGI record
+func writeFCGIRecord(w io.Writer, typ uint8, id uint16, content []byte) error {
+	hdr := []byte{1, typ, byte(id >> 8), byte(id), byte(len(content) >> 8), byte(len(content)), 0, 0}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// encodeFCGIParams encodes name-value pairs (short lengths only)
+func encodeFCGIParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	for k, v := range params {
+		for _, l := range []int{len(k), len(v)} {
+			if l < 128 {
+				buf.WriteByte(byte(l))
+			} else {
+				binary.Write(&buf, binary.BigEndian, uint32(l)|1<<31)
+			}
+		}
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+// doFCGI performs a FastCGI responder request against addr
+func doFCGI(t *testing.T, addr string, params map[string]string, body string) fcgiResponse {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	if _, ok := params["REQUEST_METHOD"]; !ok {
+		params["REQUEST_METHOD"] = "GET"
+	}
+	if _, ok := params["SERVER_PROTOCOL"]; !ok {
+		params["SERVER_PROTOCOL"] = "HTTP/1.1"
+	}
+	if body != "" {
+		params["CONTENT_LENGTH"] = strconv.Itoa(len(body))
+	}
+
+	const id = 1
+	require.NoError(t, writeFCGIRecord(conn, 1, id, []byte{0, 1, 0, 0, 0, 0, 0, 0})) // begin, responder
+	require.NoError(t, writeFCGIRecord(conn, 4, id, encodeFCGIParams(params)))
+	require.NoError(t, writeFCGIRecord(conn, 4, id, nil))
+	if body != "" {
+		require.NoError(t, writeFCGIRecord(conn, 5, id, []byte(body)))
+	}
+	require.NoError(t, writeFCGIRecord(conn, 5, id, nil))
+
+	var stdout, stderr bytes.Buffer
+	hdr := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(conn, hdr)
+		require.NoError(t, err)
+		content := make([]byte, int(binary.BigEndian.Uint16(hdr[4:]))+int(hdr[6]))
+		_, err = io.ReadFull(conn, content)
+		require.NoError(t, err)
+		content = content[:binary.BigEndian.Uint16(hdr[4:])]
+
+		switch hdr[1] {
+		case 6:
+			stdout.Write(content)
+		case 7:
+			stderr.Write(content)
+		case 3:
+			return parseFCGIResponse(t, stdout.Bytes(), stderr.String())
+		}
+	}
+}
+
+func parseFCGIResponse(t *testing.T, out []byte, stderr string) fcgiResponse {
+	t.Helper()
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(out)))
+	mh, err := tp.ReadMIMEHeader()
+	require.NoError(t, err)
+	body, err := io.ReadAll(tp.R)
+	require.NoError(t, err)
+
+	res := fcgiResponse{status: http.StatusOK, header: http.Header(mh), body: string(body), stderr: stderr}
+	if st := res.header.Get("Status"); st != "" {
+		res.status, err = strconv.Atoi(strings.Fields(st)[0])
+		require.NoError(t, err)
+		res.header.Del("Status")
+	}
+	return res
+}
+
+// cgiScript creates an executable shell script with the given body
+func cgiScript(t *testing.T, dir string, name string, body string) string {
+	t.Helper()
+	script := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"+body), 0o755))
+	return script
+}
+
+func TestResponderBasic(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "hello.sh", "printf 'Content-Type: text/plain\\r\\nX-Test: 1\\r\\n\\r\\n'\nprintf \"hello $GREETING\"\ncat\n")
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "GREETING": "a=b"}, " world")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "text/plain", res.header.Get("Content-Type"))
+	assert.Equal(t, "1", res.header.Get("X-Test"))
+	assert.Equal(t, "hello a=b world", res.body)
+
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": filepath.Join(tmpDir, "missing.sh")}, "")
+	assert.Equal(t, http.StatusForbidden, res.status)
+}
+
+func TestResponderDocumentRoot(t *testing.T) {
+	root, other := t.TempDir(), t.TempDir()
+	cgiScript(t, root, "root.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s' \"$DOCUMENT_ROOT\"\n")
+	outside := cgiScript(t, other, "other.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nran'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{DocumentRoot: root}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_NAME": "/root.sh", "DOCUMENT_ROOT": other}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, root, res.body)
+
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": outside, "DOCUMENT_ROOT": other}, "")
+	assert.Equal(t, http.StatusForbidden, res.status)
+}
+
+func TestResponderExecTimeout(t *testing.T) {
+	tmpDir := t.TempDir()
+	slow := cgiScript(t, tmpDir, "slow.sh", "exec sleep 5\n")
+	addr := serveFCGI(t, cgiResponder(arguments{ExecTimeout: 100 * time.Millisecond}, nil))
+
+	start := time.Now()
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": slow}, "")
+	assert.Equal(t, http.StatusGatewayTimeout, res.status)
+	assert.Less(t, time.Since(start), 4*time.Second)
+
+	// descendants holding stdout open are killed along with the script
+	forked := cgiScript(t, tmpDir, "forked.sh", "sleep 5 &\nwait\n")
+	start = time.Now()
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": forked}, "")
+	assert.Equal(t, http.StatusGatewayTimeout, res.status)
+	assert.Less(t, time.Since(start), 4*time.Second)
+
+	// the param overrides the global timeout
+	fast := cgiScript(t, tmpDir, "fast.sh", "sleep 0.3\nprintf 'Content-Type: text/plain\\r\\n\\r\\nok'\n")
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": fast, "FCGI_TIMEOUT": "2"}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "ok", res.body)
+
+	assert.Equal(t, 3*time.Second, execTimeout(arguments{}, map[string]string{"FCGI_TIMEOUT": "3s"}))
+	assert.Equal(t, time.Second, execTimeout(arguments{ExecTimeout: time.Second}, map[string]string{"FCGI_TIMEOUT": "x"}))
+}
+
+func TestResponderRequestID(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "id.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s %s' \"$FCGI_REQUEST_ID\" \"$FCGI_REQUEST_TOKEN\"\n")
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+
+	seen := make(map[string]bool)
+	for range 2 {
+		res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+		require.Equal(t, http.StatusOK, res.status)
+		id, token, ok := strings.Cut(res.body, " ")
+		require.True(t, ok)
+		assert.Regexp(t, "^[0-9a-f]{16}$", id)
+		assert.Regexp(t, "^[0-9a-f]{64}$", token)
+		assert.Equal(t, id, res.header.Get("X-Request-ID"))
+		assert.False(t, seen[id] || seen[token])
+		seen[id], seen[token] = true, true
+	}
+
+	// an incoming ID is kept unless it isn't safe to log
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "HTTP_X_REQUEST_ID": "lb-4f2a:17"}, "")
+	assert.True(t, strings.HasPrefix(res.body, "lb-4f2a:17 "))
+	assert.Equal(t, "lb-4f2a:17", res.header.Get("X-Request-ID"))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "HTTP_X_REQUEST_ID": "a\"b"}, "")
+	assert.Regexp(t, "^[0-9a-f]{16} ", res.body)
+}
+
+func TestResponderSummary(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(&buf, nil)}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	script := cgiScript(t, t.TempDir(), "echo.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\ncat\nexit 2\n")
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "hello")
+	require.Equal(t, "hello", res.body)
+
+	var summary map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		if rec["msg"] == "request finished" {
+			require.Nil(t, summary, "only one summary per request")
+			summary = rec
+		}
+	}
+	require.NotNil(t, summary)
+	assert.Equal(t, "INFO", summary["level"])
+	assert.Equal(t, script, summary["script"])
+	assert.Equal(t, float64(200), summary["status"])
+	assert.Equal(t, "2", summary["exit_code"])
+	assert.Equal(t, float64(5), summary["bytes_in"])
+	assert.Equal(t, float64(5), summary["bytes_out"])
+	assert.Equal(t, res.header.Get("X-Request-ID"), summary["request_id"])
+	assert.Contains(t, summary, "duration")
+}
+
+func TestResponderSlowThreshold(t *testing.T) {
+	redact, err := newRedactor(nil, nil, nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{redactHandler{slog.NewJSONHandler(&buf, nil), redact}}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	tmpDir := t.TempDir()
+	fast := cgiScript(t, tmpDir, "fast.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\n")
+	slow := cgiScript(t, tmpDir, "slow.sh", "sleep 0.2\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{SlowThreshold: 100 * time.Millisecond}, nil))
+	doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": fast}, "")
+	doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": slow, "HTTP_AUTHORIZATION": "Basic c2VjcmV0"}, "")
+
+	var warnings []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		if rec["msg"] == "slow CGI request" {
+			warnings = append(warnings, rec)
+		}
+	}
+	require.Len(t, warnings, 1)
+	assert.Equal(t, slow, warnings[0]["script"])
+	env, ok := warnings[0]["env"].(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, slow, env["SCRIPT_FILENAME"])
+	assert.NotContains(t, buf.String(), "c2VjcmV0")
+}
+
+func TestResponderDryRun(t *testing.T) {
+	redact, err := newRedactor(nil, nil, nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(redactHandler{slog.NewJSONHandler(&buf, nil), redact}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	tmpDir := t.TempDir()
+	marker := filepath.Join(tmpDir, "executed")
+	script := cgiScript(t, tmpDir, "touch.sh", "touch "+marker+"\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{DryRun: true}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "HTTP_COOKIE": "session=c2VjcmV0"}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Contains(t, res.body, script)
+	assert.NoFileExists(t, marker)
+	// the environment is logged redacted
+	assert.Contains(t, buf.String(), `"HTTP_COOKIE":"[REDACTED]"`)
+	assert.NotContains(t, buf.String(), "c2VjcmV0")
+
+	// the checks of the script still apply
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": filepath.Join(tmpDir, "missing.sh")}, "")
+	assert.Equal(t, http.StatusForbidden, res.status)
+}
+
+func TestResponderInterim(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "interim.sh", "printf 'Status: 100 Continue\\r\\n\\r\\nStatus: 103 Early Hints\\r\\nLink: </a.css>\\r\\n\\r\\n'\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\ncat\n")
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "upload")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "text/plain", res.header.Get("Content-Type"))
+	assert.Empty(t, res.header.Get("Link"))
+	assert.Equal(t, "upload", res.body)
+
+	assert.Equal(t, 0, interimStatus(http.Header{"Status": {"404 Not Found"}}))
+	assert.Equal(t, 0, interimStatus(http.Header{"Status": {"101"}}))
+	assert.Equal(t, 0, interimStatus(http.Header{}))
+}
+
+func TestResponderIsindex(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "args.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nprintf '%s|' \"$QUERY_STRING\" \"$@\"\n")
+	params := func(query string) map[string]string {
+		return map[string]string{"SCRIPT_FILENAME": script, "REQUEST_URI": "/args.sh?" + query}
+	}
+
+	addr := serveFCGI(t, cgiResponder(arguments{IsindexArgs: true}, nil))
+	res := doFCGI(t, addr, params("foo+bar%21"), "")
+	assert.Equal(t, "foo+bar%21|foo|bar!|", res.body)
+	res = doFCGI(t, addr, params("q=foo+bar"), "")
+	assert.Equal(t, "q=foo+bar|", res.body)
+
+	// disabled by default
+	addr = serveFCGI(t, cgiResponder(arguments{}, nil))
+	res = doFCGI(t, addr, params("foo+bar"), "")
+	assert.Equal(t, "foo+bar|", res.body)
+}
+
+func TestResponderLocalRedirect(t *testing.T) {
+	tmpDir := t.TempDir()
+	redir := cgiScript(t, tmpDir, "redir.sh", "printf 'Location: /target.sh?x=1\\r\\n\\r\\n'\n")
+	cgiScript(t, tmpDir, "target.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nprintf '%s %s%s' \"$REQUEST_METHOD\" \"$QUERY_STRING\" \"${PATH_TRANSLATED:+ $PATH_TRANSLATED}\"\n")
+	loop := cgiScript(t, tmpDir, "loop.sh", "printf 'Location: /loop.sh\\r\\n\\r\\n'\n")
+	external := cgiScript(t, tmpDir, "external.sh", "printf 'Location: /target.sh\\r\\n\\r\\nbody'\n")
+	params := func(script string) map[string]string {
+		return map[string]string{"SCRIPT_FILENAME": script, "DOCUMENT_ROOT": tmpDir, "REQUEST_METHOD": "POST"}
+	}
+
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, params(redir), "data")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "GET x=1", res.body)
+
+	// the path info of the original request isn't passed on
+	p := params(redir)
+	p["PATH_INFO"], p["PATH_TRANSLATED"] = "/x", filepath.Join(tmpDir, "x")
+	res = doFCGI(t, addr, p, "")
+	assert.Equal(t, "GET x=1", res.body)
+
+	res = doFCGI(t, addr, params(loop), "")
+	assert.Equal(t, http.StatusInternalServerError, res.status)
+
+	// responses with a body are passed on as is
+	res = doFCGI(t, addr, params(external), "")
+	assert.Equal(t, "/target.sh", res.header.Get("Location"))
+	assert.Equal(t, "body", res.body)
+
+	addr = serveFCGI(t, cgiResponder(arguments{LocalRedirect: "302"}, nil))
+	res = doFCGI(t, addr, params(redir), "")
+	assert.Equal(t, http.StatusFound, res.status)
+	assert.Equal(t, "/target.sh?x=1", res.header.Get("Location"))
+}
+
+func TestResponderNPH(t *testing.T) {
+	tmpDir := t.TempDir()
+	nph := cgiScript(t, tmpDir, "nph-test.sh", "printf 'HTTP/1.1 201 Created\\r\\nX-Test: 1\\r\\nConnection: close\\r\\n\\r\\nhello'\n")
+	plain := cgiScript(t, tmpDir, "plain.sh", "printf 'HTTP/1.1 202 Accepted\\r\\nTransfer-Encoding: chunked\\r\\n\\r\\n3\\r\\nabc\\r\\n0\\r\\n\\r\\n'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": nph}, "")
+	assert.Equal(t, http.StatusCreated, res.status)
+	assert.Equal(t, "1", res.header.Get("X-Test"))
+	assert.Empty(t, res.header.Get("Connection"))
+	assert.Equal(t, "hello", res.body)
+
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": plain, "FCGI_NPH": "1"}, "")
+	assert.Equal(t, http.StatusAccepted, res.status)
+	assert.Equal(t, "abc", res.body)
+
+	// parsed like any other script, the status line isn't a header
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": nph, "FCGI_NPH": "0"}, "")
+	assert.Equal(t, http.StatusBadGateway, res.status)
+}
+
+func TestResponderContentLength(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := func(name, length, body string) string {
+		return cgiScript(t, tmpDir, name, "printf 'Content-Type: text/plain\\r\\nContent-Length: "+length+"\\r\\n\\r\\n"+body+"'\n")
+	}
+	exact := script("exact.sh", "5", "hello")
+	long := script("long.sh", "2", "hello")
+	short := script("short.sh", "10", "hello")
+	invalid := script("invalid.sh", "x", "hello")
+
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": exact}, "")
+	assert.Equal(t, "hello", res.body)
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": long}, "")
+	assert.Equal(t, "he", res.body)
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": short}, "")
+	assert.Equal(t, "hello", res.body) // aborted, the web server notices the missing bytes
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": invalid}, "")
+	assert.Equal(t, http.StatusBadGateway, res.status)
+
+	addr = serveFCGI(t, cgiResponder(arguments{StripContentLength: true}, nil))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": long}, "")
+	assert.Empty(t, res.header.Get("Content-Length"))
+	assert.Equal(t, "hello", res.body)
+}
+
+func TestResponderContentDisposition(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "dl.sh", "printf 'Content-Type: text/plain\\r\\nContent-Disposition: attachment; filename=\"../x.bat\"\\r\\n\\r\\nhello'\n")
+	args := arguments{ContentDisposition: []dispositionRule{{Pattern: filepath.Join(tmpDir, "*"), Policy: dispositionSanitize}}}
+	addr := serveFCGI(t, cgiResponder(args, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, "attachment; filename=x_bat", res.header.Get("Content-Disposition"))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "FCGI_CONTENT_DISPOSITION": "keep"}, "")
+	assert.Equal(t, `attachment; filename="../x.bat"`, res.header.Get("Content-Disposition"))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "FCGI_CONTENT_DISPOSITION": "inline"}, "")
+	assert.Equal(t, "inline", res.header.Get("Content-Disposition"))
+
+	var rule dispositionRule
+	assert.Error(t, rule.UnmarshalText([]byte("*.cgi")))
+	assert.Error(t, rule.UnmarshalText([]byte("*.cgi=download")))
+	require.NoError(t, rule.UnmarshalText([]byte("/srv/*.cgi=attachment")))
+	assert.Equal(t, dispositionRule{Pattern: "/srv/*.cgi", Policy: dispositionAttachment}, rule)
+
+	h := http.Header{}
+	applyDisposition(h, dispositionAttachment, "/srv/get.cgi", map[string]string{"PATH_INFO": "/files/report 2024.pdf"})
+	assert.Equal(t, "attachment; filename=report_2024.pdf", h.Get("Content-Disposition"))
+	applyDisposition(h, dispositionAttachment, "/srv/get.cgi", map[string]string{"PATH_INFO": "/run.CMD"})
+	assert.Equal(t, "attachment; filename=run_CMD", h.Get("Content-Disposition"))
+	h.Set("Content-Disposition", "form-data")
+	applyDisposition(h, dispositionSanitize, "/srv/get.cgi", nil)
+	assert.Empty(t, h.Get("Content-Disposition"))
+}
+
+func TestResponderHeaderless(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "plain.sh", "printf 'hello world\\n\\nmore'\n")
+	empty := cgiScript(t, tmpDir, "empty.sh", "printf '\\r\\nbody'\n")
+
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, http.StatusBadGateway, res.status)
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": empty}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "body", res.body)
+
+	addr = serveFCGI(t, cgiResponder(arguments{HeaderlessType: "text/plain"}, nil))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "text/plain", res.header.Get("Content-Type"))
+	assert.Equal(t, "hello world\n\nmore", res.body)
+
+	for in, want := range map[string]bool{"Content-Type: x\n": true, "\r\n": true, "": true, "X-A:b": true, "hello": false, "a b: c": false, ":x": false} {
+		assert.Equal(t, want, startsWithHeader(bufio.NewReader(strings.NewReader(in))), in)
+	}
+}
+
+func TestResponderDefaultContentType(t *testing.T) {
+	tmpDir := t.TempDir()
+	untyped := cgiScript(t, tmpDir, "json.sh", "printf 'X-A: b\\r\\n\\r\\n{\"a\": 1}'\n")
+	typed := cgiScript(t, tmpDir, "html.sh", "printf 'Content-Type: text/html\\r\\n\\r\\n{}'\n")
+
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": untyped}, "")
+	assert.Equal(t, "text/plain; charset=utf-8", res.header.Get("Content-Type"))
+
+	addr = serveFCGI(t, cgiResponder(arguments{DefaultContentType: "application/json"}, nil))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": untyped}, "")
+	assert.Equal(t, "application/json", res.header.Get("Content-Type"))
+	assert.Equal(t, `{"a": 1}`, res.body)
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": typed}, "")
+	assert.Equal(t, "text/html", res.header.Get("Content-Type"))
+}
+
+func TestResponderStripHeaders(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "hop.sh", "printf 'Content-Type: text/plain\\r\\nConnection: close, X-Private\\r\\nX-Private: 1\\r\\nTransfer-Encoding: chunked\\r\\nKeep-Alive: timeout=5\\r\\nX-Bad\\001: 1\\r\\nX-Ctl: a\\033b\\r\\nX-Ok: 1\\r\\n\\r\\nhello'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "hello", res.body)
+	assert.Equal(t, "1", res.header.Get("X-Ok"))
+	for _, key := range []string{"Connection", "X-Private", "Transfer-Encoding", "Keep-Alive", "X-Bad\x01", "X-Ctl"} {
+		assert.NotContains(t, res.header, key)
+	}
+}
+
+func TestResponderSendfile(t *testing.T) {
+	docRoot := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(filepath.Join(docRoot, "file.txt"), []byte("abcdef"), 0o644))
+	require.NoError(t, os.WriteFile(outside, []byte("secret"), 0o644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(docRoot, "link.txt")))
+	script := cgiScript(t, docRoot, "send.sh", "printf \"$SEND\\r\\n\\r\\nignored\"\n")
+
+	params := func(send string) map[string]string {
+		return map[string]string{"SCRIPT_FILENAME": script, "DOCUMENT_ROOT": docRoot, "SEND": send}
+	}
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, params("X-Accel-Redirect: /file.txt"), "")
+	assert.Equal(t, "/file.txt", res.header.Get("X-Accel-Redirect"))
+	assert.Equal(t, "ignored", res.body)
+
+	addr = serveFCGI(t, cgiResponder(arguments{Sendfile: true}, nil))
+	for send, want := range map[string]struct {
+		status int
+		body   string
+	}{
+		"X-Sendfile: " + filepath.Join(docRoot, "file.txt"): {http.StatusOK, "abcdef"},
+		"X-Accel-Redirect: /file.txt?x=1":                   {http.StatusOK, "abcdef"},
+		"X-Accel-Redirect: /../../file.txt":                 {http.StatusOK, "abcdef"},
+		"X-Sendfile: " + outside:                            {http.StatusForbidden, ""},
+		"X-Accel-Redirect: /link.txt":                       {http.StatusForbidden, ""},
+		"X-Accel-Redirect: /missing.txt":                    {http.StatusNotFound, ""},
+		"X-Sendfile: file.txt":                              {http.StatusForbidden, ""},
+	} {
+		res = doFCGI(t, addr, params(send), "")
+		assert.Equal(t, want.status, res.status, send)
+		if want.body != "" {
+			assert.Equal(t, want.body, res.body, send)
+			assert.Equal(t, "text/plain; charset=utf-8", res.header.Get("Content-Type"), send)
+		}
+		assert.NotContains(t, res.body, "secret", send)
+		assert.Empty(t, res.header.Get("X-Sendfile"), send)
+	}
+
+	p := params("X-Accel-Redirect: /file.txt")
+	p["HTTP_RANGE"] = "bytes=1-2"
+	res = doFCGI(t, addr, p, "")
+	assert.Equal(t, http.StatusPartialContent, res.status)
+	assert.Equal(t, "bc", res.body)
+}
+
+func TestResponderMaxResponseSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	endless := cgiScript(t, tmpDir, "endless.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nexec yes\n")
+	fits := cgiScript(t, tmpDir, "fits.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n0123456789'\n")
+
+	addr := serveFCGI(t, cgiResponder(arguments{MaxResponseSize: 10}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": endless}, "")
+	assert.Equal(t, "y\ny\ny\ny\ny\n", res.body)
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": fits}, "")
+	assert.Equal(t, "0123456789", res.body)
+
+	r := limitBody(strings.NewReader("0123456789"), 4)
+	b, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, errResponseTooLarge)
+	assert.Equal(t, "0123", string(b))
+}
+
+func TestResponderMaxBodySize(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "read.sh", "cat >/dev/null\nprintf 'Content-Type: text/plain\\r\\n\\r\\nread'\n")
+	args := arguments{MaxBodySize: 10}
+
+	addr := serveFCGI(t, cgiResponder(args, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "0123456789")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "read", res.body)
+	// rejected by CONTENT_LENGTH
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "0123456789a")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.status)
+
+	// without CONTENT_LENGTH the script is killed once it read too much
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 100)))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	serveCGI(w, r, map[string]string{"SCRIPT_FILENAME": script}, args, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestResponderTruncatedUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	reader := cgiScript(t, tmpDir, "read.sh", "cat >/dev/null\nprintf 'Content-Type: text/plain\\r\\n\\r\\nread'\n")
+	sleeper := cgiScript(t, tmpDir, "sleep.sh", "exec sleep 10\n")
+
+	truncated := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("abc"))
+		r.ContentLength = 10
+		return r
+	}
+
+	// the script gets EOF and finishes, but the request counts as failed
+	w := httptest.NewRecorder()
+	serveCGI(w, truncated(), map[string]string{"SCRIPT_FILENAME": reader}, arguments{BufferResponse: 1024, UploadGrace: 5 * time.Second}, nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// the script ignoring its stdin is terminated after the grace period
+	start := time.Now()
+	w = httptest.NewRecorder()
+	serveCGI(w, truncated(), map[string]string{"SCRIPT_FILENAME": sleeper}, arguments{UploadGrace: 50 * time.Millisecond}, nil)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	c := &countingReader{r: strings.NewReader("abc")}
+	_, _ = io.ReadAll(c)
+	assert.False(t, c.truncated(3))
+	assert.False(t, c.truncated(0))
+	assert.True(t, c.truncated(4))
+}
+
+func TestReadCGIHeader(t *testing.T) {
+	in := "Content-Type: text/plain\r\nX-Long: a,\r\n  b,\r\n\tc\r\nX-Empty:\r\n x\r\n\r\nbody"
+	h, err := readCGIHeader(bufio.NewReader(strings.NewReader(in)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"Content-Type": {"text/plain"}, "X-Long": {"a, b, c"}, "X-Empty": {"x"}}, h)
+
+	limits := &headerLimits{maxCount: 3}
+	_, err = readCGIHeader(bufio.NewReader(strings.NewReader(in)), limits)
+	require.NoError(t, err)
+	_, err = readCGIHeader(bufio.NewReader(strings.NewReader(in)), limits)
+	assert.ErrorIs(t, err, errHeaderTooLarge)
+
+	_, err = readCGIHeader(bufio.NewReader(strings.NewReader(in)), &headerLimits{maxBytes: int64(len(in) - len("body"))})
+	require.NoError(t, err)
+	_, err = readCGIHeader(bufio.NewReader(strings.NewReader(in)), &headerLimits{maxBytes: 10})
+	assert.ErrorIs(t, err, errHeaderTooLarge)
+}
+
+func TestResponderHead(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "hello.sh", "printf \"Content-Length: 5\\r\\nX-Method: $REQUEST_METHOD\\r\\n\\r\\nhello\"\n")
+	nph := cgiScript(t, tmpDir, "nph-hello.sh", "printf 'HTTP/1.1 200 OK\\r\\nContent-Length: 5\\r\\n\\r\\nhello'\n")
+	params := func(script string) map[string]string {
+		return map[string]string{"SCRIPT_FILENAME": script, "REQUEST_METHOD": http.MethodHead}
+	}
+
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, params(script), "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "5", res.header.Get("Content-Length"))
+	assert.Equal(t, http.MethodHead, res.header.Get("X-Method"))
+	assert.Empty(t, res.body)
+	res = doFCGI(t, addr, params(nph), "")
+	assert.Equal(t, "5", res.header.Get("Content-Length"))
+	assert.Empty(t, res.body)
+
+	addr = serveFCGI(t, cgiResponder(arguments{HeadMode: "get"}, nil))
+	res = doFCGI(t, addr, params(script), "")
+	assert.Equal(t, http.MethodGet, res.header.Get("X-Method"))
+	assert.Empty(t, res.body)
+
+	addr = serveFCGI(t, cgiResponder(arguments{HeadMode: "skip"}, nil))
+	res = doFCGI(t, addr, params(script), "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Empty(t, res.header.Get("X-Method"))
+	assert.Empty(t, res.body)
+}
+
+func TestResponderBufferResponse(t *testing.T) {
+	tmpDir := t.TempDir()
+	failing := cgiScript(t, tmpDir, "fail.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\npartial'\nexit 1\n")
+	large := cgiScript(t, tmpDir, "large.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n0123456789'\nexit 1\n")
+	ok := cgiScript(t, tmpDir, "ok.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nfine'\n")
+
+	addr := serveFCGI(t, cgiResponder(arguments{}, nil))
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": failing}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "partial", res.body)
+
+	addr = serveFCGI(t, cgiResponder(arguments{BufferResponse: 8}, nil))
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": failing}, "")
+	assert.Equal(t, http.StatusInternalServerError, res.status)
+	assert.NotContains(t, res.body, "partial")
+	// exceeds the buffer, already sent when the script fails
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": large}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "0123456789", res.body)
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": ok}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "text/plain", res.header.Get("Content-Type"))
+	assert.Equal(t, "fine", res.body)
+}
+
+// flushRecorder reports the body written so far on every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushed <- f.Body.String()
+}
+
+func TestWriteCGIResponseNoBuffering(t *testing.T) {
+	for name, tc := range map[string]struct {
+		header string
+		opts   responseOptions
+	}{
+		"flag":   {"Content-Type: text/event-stream\r\n\r\n", responseOptions{noBuffering: true}},
+		"header": {"Content-Type: text/event-stream\r\nX-Accel-Buffering: no\r\n\r\n", responseOptions{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			w := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 1)}
+			done := make(chan bool)
+			go func() {
+				_, ok := writeCGIResponse(w, pr, context.Background(), 0, tc.opts)
+				done <- ok
+			}()
+
+			_, err := io.WriteString(pw, tc.header)
+			require.NoError(t, err)
+			assert.Equal(t, "", <-w.flushed)
+			_, err = io.WriteString(pw, "data: 1\n\n")
+			require.NoError(t, err)
+			assert.Equal(t, "data: 1\n\n", <-w.flushed)
+			_, err = io.WriteString(pw, "data: 2\n\n")
+			require.NoError(t, err)
+			assert.Equal(t, "data: 1\n\ndata: 2\n\n", <-w.flushed)
+			pw.Close()
+			assert.True(t, <-done)
+		})
+	}
+}
+
+func TestResponderHeaderLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	many := cgiScript(t, tmpDir, "many.sh", "yes 'X-A: b'\n")
+	long := cgiScript(t, tmpDir, "long.sh", "printf 'X-A: '\nyes | tr -d '\\n'\n")
+
+	addr := serveFCGI(t, cgiResponder(arguments{MaxHeaders: 100, MaxHeaderBytes: 64 << 10}, nil))
+	for _, script := range []string{many, long} {
+		res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+		assert.Equal(t, http.StatusBadGateway, res.status, script)
+	}
+}
+
+func TestResponderThreadPool(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "hello.sh", "sleep 0.2\nprintf 'Content-Type: text/plain\\r\\n\\r\\nhello'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{procs: newProcPool(1)}, nil))
+
+	// more concurrent requests than pool threads (parallel subtests, doFCGI
+	// must run on a test goroutine)
+	t.Run("concurrent", func(t *testing.T) {
+		for i := range 4 {
+			t.Run(strconv.Itoa(i), func(t *testing.T) {
+				t.Parallel()
+				res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+				assert.Equal(t, http.StatusOK, res.status)
+				assert.Equal(t, "hello", res.body)
+			})
+		}
+	})
+
+	assert.Nil(t, newProcPool(0))
+}
+
+func TestResponderPersistent(t *testing.T) {
+	tmpDir := t.TempDir()
+	// minimal keep-alive child in sh: echoes its pid, a counter and the body
+	script := cgiScript(t, tmpDir, "persist.sh", `n=0
+while read len; do
+	env=$(head -c "$len" | tr '\0' '\n')
+	body=
+	while read len && [ "$len" -ne 0 ]; do body="$body$(head -c "$len")"; done
+	n=$((n+1))
+	out=$(printf 'Content-Type: text/plain\r\n\r\n%s %s %s %s' "$$" "$n" "$(echo "$env" | grep '^GREETING=')" "$body")
+	printf '%d\n%s0\n' "${#out}" "$out"
+done
+`)
+	pool := newPersistentPool(1, time.Minute, 3, nil)
+	t.Cleanup(pool.closeAll)
+	addr := serveFCGI(t, cgiResponder(arguments{Persistent: []string{filepath.Join(tmpDir, "*.sh")}, persist: pool}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "GREETING": "a"}, "x")
+	require.Equal(t, http.StatusOK, res.status)
+	first := strings.Fields(res.body)
+	require.Len(t, first, 4)
+	assert.Equal(t, []string{"1", "GREETING=a", "x"}, first[1:])
+
+	// the same child is reused, and doesn't see the environment of the previous request
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "GREETING": "b"}, "yz")
+	require.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, []string{first[0], "2", "GREETING=b", "yz"}, strings.Fields(res.body))
+
+	// replaced after the third request
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, []string{first[0], "3"}, strings.Fields(res.body)[:2])
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	fields := strings.Fields(res.body)
+	assert.NotEqual(t, first[0], fields[0])
+	assert.Equal(t, "1", fields[1])
+
+	// not shared between requests starting it with a different environment
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "FCGI_LOCALE": "C"}, "")
+	c := strings.Fields(res.body)[0]
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "FCGI_LOCALE": "POSIX"}, "")
+	assert.NotEqual(t, c, strings.Fields(res.body)[0])
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "FCGI_LOCALE": "C"}, "")
+	assert.Equal(t, c, strings.Fields(res.body)[0])
+
+	// killed if its response is too large
+	limited := serveFCGI(t, cgiResponder(arguments{Persistent: []string{filepath.Join(tmpDir, "*.sh")}, persist: pool, MaxResponseSize: 5}, nil))
+	doFCGI(t, limited, map[string]string{"SCRIPT_FILENAME": script}, "")
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	replaced := strings.Fields(res.body)
+	assert.NotEqual(t, fields[0], replaced[0])
+	assert.Equal(t, "1", replaced[1])
+
+	// disabled via param
+	plain := cgiScript(t, tmpDir, "plain.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nplain'\n")
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": plain, "FCGI_PERSISTENT": "0"}, "")
+	assert.Equal(t, "plain", res.body)
+
+	// bodies without CONTENT_LENGTH are limited as well
+	args := arguments{Persistent: []string{filepath.Join(tmpDir, "*.sh")}, persist: pool, MaxBodySize: 10}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 100)))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	serveCGI(w, r, map[string]string{"SCRIPT_FILENAME": script}, args, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small"))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	serveCGI(w, r, map[string]string{"SCRIPT_FILENAME": script}, args, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "small")
+}
+
+func TestFrameReader(t *testing.T) {
+	fr := &frameReader{r: bufio.NewReader(strings.NewReader("3\nabc2\nde0\nrest"))}
+	data, err := io.ReadAll(fr)
+	require.NoError(t, err)
+	assert.Equal(t, "abcde", string(data))
+
+	fr = &frameReader{r: bufio.NewReader(strings.NewReader("3\nab"))}
+	_, err = io.ReadAll(fr)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestResponderTimeoutSignal(t *testing.T) {
+	tmpDir := t.TempDir()
+	// reports the signal instead of dying
+	script := cgiScript(t, tmpDir, "slow.sh", "trap 'printf \"Content-Type: text/plain\\r\\n\\r\\npartial\"; kill $!; exit 0' ALRM\nsleep 5 >/dev/null 2>&1 & wait\n")
+	addr := serveFCGI(t, cgiResponder(arguments{ExecTimeout: time.Second, TimeoutSignal: signalName(syscall.SIGALRM), TimeoutGrace: 800 * time.Millisecond}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "partial", res.body)
+
+	// disabled via param: killed without warning
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "FCGI_TIMEOUT_SIGNAL": "-"}, "")
+	assert.Equal(t, http.StatusGatewayTimeout, res.status)
+
+	var sig signalName
+	require.NoError(t, sig.UnmarshalText([]byte("usr1")))
+	assert.Equal(t, signalName(syscall.SIGUSR1), sig)
+	require.NoError(t, sig.UnmarshalText([]byte("SIGALRM")))
+	assert.Equal(t, signalName(syscall.SIGALRM), sig)
+	require.NoError(t, sig.UnmarshalText([]byte("34")))
+	assert.Equal(t, signalName(34), sig)
+	assert.Error(t, sig.UnmarshalText([]byte("SIGFOO")))
+}
+
+func TestResponderMetaHeaders(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "fail.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nfail'\nexit 3\n")
+	addr := serveFCGI(t, cgiResponder(arguments{MetaHeaders: true}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, "fail", res.body)
+	assert.Equal(t, "3", res.header.Get("X-FCGIWrap-Exit-Code"))
+	assert.Regexp(t, `^\d+\.\d{3}$`, res.header.Get("X-FCGIWrap-Exec-Time"))
+
+	// too much output to wait for the exit
+	big := cgiScript(t, tmpDir, "big.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nhead -c 100000 /dev/zero\n")
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": big}, "")
+	assert.Len(t, res.body, 100000)
+	assert.Empty(t, res.header.Get("X-FCGIWrap-Exit-Code"))
+	assert.NotEmpty(t, res.header.Get("X-FCGIWrap-Exec-Time"))
+	assert.Empty(t, res.header.Get("X-CGI-Pid"), "only with --debug-headers")
+}
+
+func TestResponderDebugHeaders(t *testing.T) {
+	tmpDir := t.TempDir()
+	script := cgiScript(t, tmpDir, "pid.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s' $$\nkill -TERM $$\n")
+	addr := serveFCGI(t, cgiResponder(arguments{DebugHeaders: true}, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+	assert.Equal(t, res.body, res.header.Get("X-CGI-Pid"))
+	assert.Equal(t, "SIGTERM", res.header.Get("X-CGI-Exit-Status"))
+	_, err := time.ParseDuration(res.header.Get("X-CGI-Duration"))
+	assert.NoError(t, err)
+	assert.Empty(t, res.header.Get("X-FCGIWrap-Exec-Time"), "only with --meta-headers")
+}
+
+func TestReaper(t *testing.T) {
+	if os.Getenv("FCGIWRAP_TEST_REAPER") == "" {
+		// becoming a subreaper affects the whole process, so run it separately
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReaper$")
+		cmd.Env = append(os.Environ(), "FCGIWRAP_TEST_REAPER=1")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return
+	}
+
+	require.NoError(t, startReaper())
+	tmpDir := t.TempDir()
+	pidFile := filepath.Join(tmpDir, "pid")
+	script := cgiScript(t, tmpDir, "fork.sh", "sleep 0.2 >/dev/null 2>&1 &\necho $! > "+pidFile+"\nprintf 'Content-Type: text/plain\\r\\n\\r\\nok'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{MetaHeaders: true}, nil))
+
+	for range 3 {
+		res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+		assert.Equal(t, "ok", res.body)
+		assert.Equal(t, "0", res.header.Get("X-FCGIWrap-Exit-Code"))
+	}
+
+	pid, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	// the orphan is reparented to us, an unreaped zombie would still be listed
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat("/proc/" + strings.TrimSpace(string(pid)))
+		return os.IsNotExist(err)
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestWarmup(t *testing.T) {
+	tmpDir := t.TempDir()
+	out := filepath.Join(tmpDir, "out")
+	script := cgiScript(t, tmpDir, "warm.sh", "echo \"$PRIME\" >> "+out+"\nprintf 'Content-Type: text/plain\\r\\n\\r\\nok'\n")
+
+	var args arguments
+	for _, s := range []string{script + " PRIME=a", script + " PRIME=b"} {
+		var wr warmupRequest
+		require.NoError(t, wr.UnmarshalText([]byte(s)))
+		args.Warmup = append(args.Warmup, wr)
+	}
+	runWarmups(args, nil)
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, strings.Fields(string(data)))
+
+	status, _ := runWarmup(args, nil, warmupRequest{Script: filepath.Join(tmpDir, "missing.sh")})
+	assert.Equal(t, http.StatusForbidden, status)
+
+	var wr warmupRequest
+	assert.Error(t, wr.UnmarshalText([]byte(script+" PRIME")))
+	require.NoError(t, wr.UnmarshalText([]byte(script+" B=2 A=1")))
+	text, err := wr.MarshalText()
+	require.NoError(t, err)
+	assert.Equal(t, script+" A=1 B=2", string(text))
+}
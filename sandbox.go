@@ -0,0 +1,508 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// hidden first argument which makes the binary act as setup helper for a CGI
+// child instead of running the server. The helper applies the childSpec and
+// then execs the actual script (so the pid stays the same). With --sandbox it
+// stays around as init of the new pid namespace instead, see sandboxInit.
+const childInitArg = "__fcgiwrap_child_init"
+
+// environment variable used to hand the childSpec to the helper. It is removed
+// again before the script is exec'd
+const childSpecEnv = "FCGIWRAP_CHILD_SPEC"
+
+// bindMount describes a file/directory which is bind-mounted over target inside
+// the private mount namespace of the child
+type bindMount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"ro,omitempty"`
+}
+
+// rlimit is a resource limit applied via setrlimit (soft == hard limit)
+type rlimit struct {
+	Resource int    `json:"resource"`
+	Limit    uint64 `json:"limit"`
+}
+
+// childSpec holds everything which needs to be set up inside the child process
+// right before the script gets exec'd
+type childSpec struct {
+	Mounts  []bindMount `json:"mounts,omitempty"`
+	Rlimits []rlimit    `json:"rlimits,omitempty"`
+	// raw BPF program, see encodeBPF
+	Seccomp []byte       `json:"seccomp,omitempty"`
+	Sandbox *sandboxSpec `json:"sandbox,omitempty"`
+	Nice    int          `json:"nice,omitempty"`
+	IOPrio  ioPriority   `json:"ioprio,omitempty"`
+	// command (resolved path first) the script is launched through
+	ExecPrefix []string `json:"exec_prefix,omitempty"`
+}
+
+// whether the spec requires the helper at all
+func (s childSpec) empty() bool {
+	return len(s.Mounts) == 0 && len(s.Rlimits) == 0 && len(s.Seccomp) == 0 && s.Sandbox == nil &&
+		s.Nice == 0 && s.IOPrio == 0 && len(s.ExecPrefix) == 0
+}
+
+// wrapChildCommand rewrites cmd so that it is started via the wrapper binary
+// itself (as helper) which applies spec and then execs the original command.
+// Does nothing if the spec is empty.
+func wrapChildCommand(cmd *exec.Cmd, spec childSpec) error {
+	if spec.empty() {
+		return nil
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("encoding child spec failed: %w", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("resolving own executable failed: %w", err)
+	}
+
+	cmd.Args = append([]string{cmd.Args[0], childInitArg, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	cmd.Env = append(cmd.Env, childSpecEnv+"="+string(data))
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if len(spec.Mounts) > 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if spec.Sandbox != nil {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC
+	}
+	return nil
+}
+
+// childInit is the entrypoint of the helper. args[0] is the script to execute
+// followed by its arguments. Never returns.
+func childInit(args []string) {
+	// everything in here needs to happen on the thread which finally calls exec
+	runtime.LockOSThread()
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "fcgiwrap-go: child setup failed: %v\n", err)
+		os.Exit(127)
+	}
+
+	if len(args) == 0 {
+		fail(fmt.Errorf("no command given"))
+	}
+
+	var spec childSpec
+	if err := json.Unmarshal([]byte(os.Getenv(childSpecEnv)), &spec); err != nil {
+		fail(fmt.Errorf("decoding child spec failed: %w", err))
+	}
+	os.Unsetenv(childSpecEnv)
+
+	if spec.Sandbox != nil {
+		sandboxInit(args, spec, fail)
+	}
+
+	if err := spec.apply(); err != nil {
+		fail(err)
+	}
+
+	// the prefix gets the script as argument (argv[0] of the prefix is its own
+	// path, some wrappers like firejail depend on it)
+	args = append(spec.ExecPrefix, args...)
+
+	err := syscall.Exec(args[0], args, os.Environ())
+	fail(fmt.Errorf("exec %s failed: %w", args[0], err))
+}
+
+// sandboxInit keeps the helper running as pid 1 of the sandbox pid namespace.
+// The kernel drops signals without a handler sent to that process, so the
+// script runs as its child (in a process group of its own) and the signals are
+// forwarded to it. The seccomp filter is applied by the helper re-executed in
+// between, everything else is inherited from here. Exits with the status of the
+// script (128+signal if it was killed), the kernel kills whatever is left in
+// the namespace then. Never returns.
+func sandboxInit(args []string, spec childSpec, fail func(error)) {
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs)
+
+	filter := spec.Seccomp
+	spec.Seccomp = nil
+	if err := spec.apply(); err != nil {
+		fail(err)
+	}
+	args = append(spec.ExecPrefix, args...)
+
+	path, env := args[0], os.Environ()
+	if len(filter) > 0 {
+		data, err := json.Marshal(childSpec{Seccomp: filter})
+		if err != nil {
+			fail(fmt.Errorf("encoding child spec failed: %w", err))
+		}
+		// the fresh /proc of the sandbox still links to the wrapper binary
+		path = "/proc/self/exe"
+		args = append([]string{args[0], childInitArg}, args...)
+		env = append(env, childSpecEnv+"="+string(data))
+	}
+	// stdio and the FCGI_DATA stream of filters
+	files := []uintptr{0, 1, 2}
+	if fd, err := strconv.Atoi(os.Getenv("FCGI_DATA_FD")); err == nil && fd == len(files) {
+		files = append(files, uintptr(fd))
+	}
+	pid, err := syscall.ForkExec(path, args, &syscall.ProcAttr{
+		Env:   env,
+		Files: files,
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		fail(fmt.Errorf("exec %s failed: %w", args[0], err))
+	}
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGCHLD:
+			for {
+				var ws syscall.WaitStatus
+				wpid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+				if err != nil || wpid <= 0 {
+					break
+				}
+				if wpid != pid {
+					continue
+				}
+				if ws.Signaled() {
+					os.Exit(128 + int(ws.Signal()))
+				}
+				os.Exit(ws.ExitStatus())
+			}
+		case syscall.SIGURG:
+			// used by the go runtime for preemption
+		default:
+			_ = syscall.Kill(-pid, sig.(syscall.Signal))
+		}
+	}
+}
+
+// apply the spec to the current process
+func (s childSpec) apply() error {
+	if len(s.Mounts) > 0 || s.Sandbox != nil {
+		// don't propagate anything back to the host namespace
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("making mounts private failed: %w", err)
+		}
+	}
+
+	// open the sources while the host filesystem is still visible, the sandbox
+	// root hides it
+	srcs := make([]string, len(s.Mounts))
+	for i, m := range s.Mounts {
+		fd, err := openPath(m.Source)
+		if err != nil {
+			return err
+		}
+		srcs[i] = fd
+	}
+
+	if s.Sandbox != nil {
+		// the mounts are applied inside the new root
+		if err := s.Sandbox.enter(s.Mounts, srcs); err != nil {
+			return err
+		}
+	} else if err := bindMounts("/", s.Mounts, srcs); err != nil {
+		return err
+	}
+	for _, l := range s.Rlimits {
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Limit, Max: l.Limit}); err != nil {
+			return fmt.Errorf("setrlimit %d failed: %w", l.Resource, err)
+		}
+	}
+	// both only apply to the calling thread, which is the one calling exec
+	if s.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, s.Nice); err != nil {
+			return fmt.Errorf("setting nice value failed: %w", err)
+		}
+	}
+	if s.IOPrio != 0 {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(s.IOPrio)); errno != 0 {
+			return fmt.Errorf("setting io priority failed: %w", errno)
+		}
+	}
+	// needs to be last, the filter might block syscalls needed above
+	if len(s.Seccomp) > 0 {
+		prog, err := decodeBPF(s.Seccomp)
+		if err != nil {
+			return err
+		}
+		if err := installSeccomp(prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rlimitsFromArgs collects the resource limits configured via the commandline
+func rlimitsFromArgs(args arguments) []rlimit {
+	var limits []rlimit
+	for _, l := range []struct {
+		resource int
+		value    int64
+	}{
+		{syscall.RLIMIT_CPU, args.LimitCPU},
+		{syscall.RLIMIT_AS, int64(args.LimitMem)},
+		{syscall.RLIMIT_NOFILE, args.LimitNofile},
+		{unix.RLIMIT_NPROC, args.LimitNproc},
+	} {
+		if l.value > 0 {
+			limits = append(limits, rlimit{Resource: l.resource, Limit: uint64(l.value)})
+		}
+	}
+	return limits
+}
+
+// bindMounts applies mounts below root, srcs are the opened sources (see openPath)
+func bindMounts(root string, mounts []bindMount, srcs []string) error {
+	for i, m := range mounts {
+		target := filepath.Join(root, m.Target)
+		if err := syscall.Mount(srcs[i], target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind mount %s -> %s failed: %w", m.Source, m.Target, err)
+		}
+		if m.ReadOnly {
+			if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				return fmt.Errorf("remount %s read-only failed: %w", m.Target, err)
+			}
+		}
+	}
+	return nil
+}
+
+// constants from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// ioPriority is an io priority as passed to ioprio_set. It is given as
+// class[:level] on the commandline, e.g. "idle" or "best-effort:7"
+type ioPriority int
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (p *ioPriority) UnmarshalText(text []byte) error {
+	class, level, hasLevel := strings.Cut(string(text), ":")
+	c, ok := ioprioClasses[class]
+	if !ok {
+		return fmt.Errorf("invalid io scheduling class %q (realtime, best-effort or idle)", class)
+	}
+	l := 4
+	if hasLevel {
+		var err error
+		if l, err = strconv.Atoi(level); err != nil || l < 0 || l > 7 {
+			return fmt.Errorf("invalid io priority level %q (0-7)", level)
+		}
+	}
+	if c == ioprioClasses["idle"] {
+		l = 0
+	}
+	*p = ioPriority(c<<ioprioClassShift | l)
+	return nil
+}
+
+// openPath opens path with O_PATH and returns the /proc/self/fd link which
+// can be used as mount source later on. The fd is closed on exec.
+func openPath(path string) (string, error) {
+	fd, err := syscall.Open(path, unix.O_PATH|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return "", fmt.Errorf("opening %s failed: %w", path, err)
+	}
+	return fmt.Sprintf("/proc/self/fd/%d", fd), nil
+}
+
+// system directories made available (read-only) inside the sandbox
+var sandboxSystemDirs = []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/usr", "/etc"}
+
+// device nodes made available inside the sandbox
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom", "/dev/tty"}
+
+// the sandbox root is assembled on a tmpfs mounted here (only in the private
+// mount namespace of the child)
+const sandboxBase = "/tmp"
+
+// sandboxSpec describes the minimal filesystem view of a sandboxed child
+type sandboxSpec struct {
+	// paths bind-mounted read-only at the same location
+	Binds []string `json:"binds"`
+	// top-level symlinks to recreate (e.g. /bin -> usr/bin on merged-usr systems)
+	Symlinks map[string]string `json:"symlinks,omitempty"`
+	// working directory inside the sandbox
+	Dir string `json:"dir"`
+}
+
+// newSandboxSpec assembles the sandbox for a script. docRoot (the directory of
+// the script if unset) and dir are made available in addition to the system
+// and the configured directories.
+func newSandboxSpec(args arguments, docRoot string, dir string) *sandboxSpec {
+	sb := &sandboxSpec{Symlinks: make(map[string]string), Dir: dir}
+	for _, d := range sandboxSystemDirs {
+		info, err := os.Lstat(d)
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(d); err == nil {
+				sb.Symlinks[d] = target
+			}
+			continue
+		}
+		sb.Binds = append(sb.Binds, d)
+	}
+	for _, b := range append(args.SandboxBind, docRoot, dir) {
+		if b != "" && !slices.Contains(sb.Binds, b) {
+			sb.Binds = append(sb.Binds, b)
+		}
+	}
+	if dir == "" {
+		sb.Dir = "/"
+	}
+	return sb
+}
+
+// enter builds the sandbox root, applies mounts (srcs are the opened sources)
+// inside of it and pivots into it. Requires new mount and pid namespaces.
+func (s *sandboxSpec) enter(mounts []bindMount, srcs []string) error {
+	bindSrcs := make([]string, len(s.Binds))
+	for i, b := range s.Binds {
+		fd, err := openPath(b)
+		if err != nil {
+			return err
+		}
+		bindSrcs[i] = fd
+	}
+
+	root := sandboxBase
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting sandbox root failed: %w", err)
+	}
+
+	bind := func(src, target string, flags uintptr) error {
+		dst := filepath.Join(root, target)
+		var st syscall.Stat_t
+		if err := syscall.Stat(src, &st); err != nil {
+			return fmt.Errorf("stat %s failed: %w", target, err)
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return err
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(dst, nil, 0o644); err != nil {
+				return err
+			}
+		}
+		if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount %s failed: %w", target, err)
+		}
+		if err := syscall.Mount("", dst, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, ""); err != nil {
+			return fmt.Errorf("remount %s failed: %w", target, err)
+		}
+		return nil
+	}
+
+	// minimal /dev
+	if err := os.Mkdir(filepath.Join(root, "dev"), 0o755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", filepath.Join(root, "dev"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting /dev failed: %w", err)
+	}
+	for _, d := range sandboxDevices {
+		if _, err := os.Stat(d); err != nil {
+			continue
+		}
+		if err := bind(d, d, syscall.MS_NOSUID|syscall.MS_NOEXEC); err != nil {
+			return err
+		}
+	}
+
+	// fresh /proc for the new pid namespace and a writable /tmp
+	if err := os.Mkdir(filepath.Join(root, "proc"), 0o555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc failed: %w", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 0o1777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting /tmp failed: %w", err)
+	}
+
+	// binds last, the document root might be located below /tmp
+	for i, b := range s.Binds {
+		if err := bind(bindSrcs[i], b, syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV); err != nil {
+			return err
+		}
+	}
+	for link, target := range s.Symlinks {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			return err
+		}
+	}
+
+	if err := bindMounts(root, mounts, srcs); err != nil {
+		return err
+	}
+
+	// switch to the new root and get rid of the old one
+	oldRoot := filepath.Join(root, ".oldroot")
+	if err := os.Mkdir(oldRoot, 0o700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root failed: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root failed: %w", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("remounting root read-only failed: %w", err)
+	}
+
+	if err := syscall.Chdir(s.Dir); err != nil {
+		return fmt.Errorf("chdir %s inside sandbox failed: %w", s.Dir, err)
+	}
+	return nil
+}
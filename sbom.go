@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// buildModule is a go module the binary was built from
+type buildModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+}
+
+// buildInfo is the build information embedded by the go toolchain
+type buildInfo struct {
+	GoVersion string            `json:"go_version"`
+	Main      buildModule       `json:"main"`
+	Deps      []buildModule     `json:"deps"`
+	Settings  map[string]string `json:"settings"`
+}
+
+func toBuildModule(m *debug.Module) buildModule {
+	if m.Replace != nil {
+		if m.Replace.Version == "" {
+			// replaced by a local directory, there is no version
+			return buildModule{Path: m.Path}
+		}
+		m = m.Replace
+	}
+	return buildModule{Path: m.Path, Version: m.Version, Sum: m.Sum}
+}
+
+// readBuildInfo returns the build information of the running binary
+func readBuildInfo() (buildInfo, error) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return buildInfo{}, fmt.Errorf("binary has no build information")
+	}
+	info := buildInfo{
+		GoVersion: bi.GoVersion,
+		Main:      toBuildModule(&bi.Main),
+		Settings:  make(map[string]string),
+	}
+	for _, d := range bi.Deps {
+		info.Deps = append(info.Deps, toBuildModule(d))
+	}
+	for _, s := range bi.Settings {
+		info.Settings[s.Key] = s.Value
+	}
+	return info, nil
+}
+
+// purl returns the package URL of the module. Modules without a proper
+// version (e.g. "(devel)" of a main module built from a checkout) get none.
+func (m buildModule) purl() string {
+	segments := strings.Split(m.Path, "/")
+	for i, s := range segments {
+		segments[i] = purlEscape(s)
+	}
+	purl := "pkg:golang/" + strings.Join(segments, "/")
+	if m.Version != "" && m.Version != "(devel)" {
+		purl += "@" + purlEscape(m.Version)
+	}
+	return purl
+}
+
+// purlEscape percent-encodes everything but the unreserved characters, as
+// required by the purl spec for path segments and versions
+func purlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// cycloneDX component and BOM (only the fields which are filled)
+type cdxComponent struct {
+	Type    string `json:"type"`
+	BOMRef  string `json:"bom-ref"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	PURL    string `json:"purl"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+type cdxBOM struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string       `json:"timestamp"`
+		Component cdxComponent `json:"component"`
+	} `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+// cycloneDX converts the build information to a CycloneDX 1.5 SBOM
+func (info buildInfo) cycloneDX(now time.Time) cdxBOM {
+	var uuid [16]byte
+	_, _ = rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // variant 10
+
+	component := func(typ string, m buildModule) cdxComponent {
+		return cdxComponent{Type: typ, BOMRef: m.purl(), Name: m.Path, Version: m.Version, PURL: m.purl()}
+	}
+
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]),
+		Version:      1,
+		Components:   []cdxComponent{},
+	}
+	bom.Metadata.Timestamp = now.UTC().Format(time.RFC3339)
+	bom.Metadata.Component = component("application", info.Main)
+
+	main := cdxDependency{Ref: info.Main.purl(), DependsOn: []string{}}
+	for _, d := range info.Deps {
+		bom.Components = append(bom.Components, component("library", d))
+		main.DependsOn = append(main.DependsOn, d.purl())
+	}
+	bom.Dependencies = []cdxDependency{main}
+	return bom
+}
+
+// writeSBOM prints the CycloneDX SBOM of the running binary
+func writeSBOM(w io.Writer) error {
+	info, err := readBuildInfo()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info.cycloneDX(time.Now()))
+}
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"gopkg.in/yaml.v3"
+)
+
+// scriptConfigKeys are the settings of a section of the `scripts` key
+var scriptConfigKeys = []string{"timeout", "interpreter", "env", "max-concurrent"}
+
+// scriptConfig are the settings for the scripts matching a pattern, a
+// section of the `scripts` key of the configuration file
+type scriptConfig struct {
+	pattern pathPattern
+	// timeout, interpreter and env, applied like a per-directory configuration
+	cfg dirConfig
+	// limits the concurrently running instances to max (nil: unlimited)
+	sem *semaphore.Weighted
+	max int64
+}
+
+// scriptConfigs are the `scripts` sections of the configuration file, the
+// first one matching a script applies
+type scriptConfigs []*scriptConfig
+
+// UnmarshalYAML implements yaml.Unmarshaler (used for the configuration file)
+func (s *scriptConfigs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping of script patterns")
+	}
+	var configs scriptConfigs
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		sc, err := parseScriptConfig(k.Value, v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k.Value, err)
+		}
+		configs = append(configs, sc)
+	}
+	*s = configs
+	return nil
+}
+
+func parseScriptConfig(pattern string, node *yaml.Node) (*scriptConfig, error) {
+	sc := &scriptConfig{cfg: dirConfig{path: "scripts." + pattern}}
+	if err := sc.pattern.UnmarshalText([]byte(pattern)); err != nil {
+		return nil, err
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a mapping of settings")
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if k := node.Content[i].Value; !slices.Contains(scriptConfigKeys, k) {
+			return nil, fmt.Errorf("%d:%d: unknown key %q", node.Content[i].Line, node.Content[i].Column, k)
+		}
+	}
+	var v struct {
+		Timeout       string            `yaml:"timeout"`
+		Interpreter   string            `yaml:"interpreter"`
+		Env           map[string]string `yaml:"env"`
+		MaxConcurrent int64             `yaml:"max-concurrent"`
+	}
+	if err := node.Decode(&v); err != nil {
+		return nil, err
+	}
+	if v.Timeout != "" {
+		if _, err := strconv.Atoi(v.Timeout); err != nil {
+			if _, err := time.ParseDuration(v.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout %q", v.Timeout)
+			}
+		}
+	}
+	sc.cfg.Timeout, sc.cfg.Interpreter, sc.cfg.Env = v.Timeout, v.Interpreter, v.Env
+	if v.MaxConcurrent > 0 {
+		sc.sem, sc.max = semaphore.NewWeighted(v.MaxConcurrent), v.MaxConcurrent
+	}
+	return sc, nil
+}
+
+// jsonSchemaType implements jsonSchemaTyper
+func (scriptConfigs) jsonSchemaType() any {
+	return "object"
+}
+
+// match returns the first configuration matching script (nil if none does)
+func (s scriptConfigs) match(script string) *scriptConfig {
+	for _, sc := range s {
+		if sc.pattern.match(script) {
+			return sc
+		}
+	}
+	return nil
+}
+
+// keepSemaphores takes over the concurrency limits of old (the configuration
+// before a reload) for unchanged patterns and limits, so the running instances
+// still count
+func (s scriptConfigs) keepSemaphores(old scriptConfigs) {
+	for _, sc := range s {
+		for _, o := range old {
+			if o.pattern.text == sc.pattern.text && o.max == sc.max {
+				sc.sem = o.sem
+				break
+			}
+		}
+	}
+}
+
+// acquire takes a slot of the concurrency limit, false if all are taken. The
+// returned function releases it.
+func (sc *scriptConfig) acquire() (func(), bool) {
+	if sc.sem == nil {
+		return func() {}, true
+	}
+	if !sc.sem.TryAcquire(1) {
+		return nil, false
+	}
+	return func() { sc.sem.Release(1) }, true
+}
@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadScriptConfigs(t *testing.T) {
+	path := writeConfig(t, "scripts:\n  '**/backup.cgi':\n    timeout: 10m\n    max-concurrent: 1\n  '**/*.py':\n    interpreter: /usr/bin/python3\n    env:\n      PYTHONPATH: /srv/lib\n")
+	args := defaultArguments()
+	_, err := loadConfigFile(path, &args)
+	require.NoError(t, err)
+	require.Len(t, args.Scripts, 2)
+	assert.Equal(t, "10m", args.Scripts.match("/srv/www/backup.cgi").cfg.Timeout)
+	assert.Equal(t, map[string]string{"PYTHONPATH": "/srv/lib"}, args.Scripts.match("/srv/www/app.py").cfg.Env)
+	assert.Nil(t, args.Scripts.match("/srv/www/app.sh"))
+
+	// the order of the file is kept for TOML as well
+	path = filepath.Join(t.TempDir(), "fcgiwrap.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[scripts.\"/srv/b/**\"]\ntimeout = \"1s\"\n\n[scripts.\"/srv/**\"]\ntimeout = \"2s\"\n"), 0o644))
+	args = defaultArguments()
+	_, err = loadConfigFile(path, &args)
+	require.NoError(t, err)
+	assert.Equal(t, "1s", args.Scripts.match("/srv/b/x.cgi").cfg.Timeout)
+
+	for content, msg := range map[string]string{
+		"scripts: [a]\n":                         "expected a mapping",
+		"scripts:\n  '**':\n    timeout: soon\n": "invalid timeout",
+		"scripts:\n  '**':\n    memory: 1\n":     `unknown key "memory"`,
+	} {
+		args = defaultArguments()
+		_, err = loadConfigFile(writeConfig(t, content), &args)
+		assert.ErrorContains(t, err, msg)
+	}
+}
+
+func TestResponderScriptConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	slow := cgiScript(t, tmpDir, "backup.cgi", "sleep 0.3\nprintf 'Content-Type: text/plain\\r\\n\\r\\n%s' \"$BACKUP\"\n")
+	path := writeConfig(t, "scripts:\n  '**/backup.cgi':\n    timeout: 5s\n    max-concurrent: 1\n    env:\n      BACKUP: full\n")
+	args := arguments{ExecTimeout: 100 * time.Millisecond}
+	_, err := loadConfigFile(path, &args)
+	require.NoError(t, err)
+	addr := serveFCGI(t, cgiResponder(args, nil))
+
+	second := make(chan fcgiResponse)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		second <- doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": slow}, "")
+	}()
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": slow}, "")
+	assert.Equal(t, http.StatusOK, res.status, "the timeout of the script applies")
+	assert.Equal(t, "full", res.body)
+	assert.Equal(t, http.StatusServiceUnavailable, (<-second).status, "only one instance may run")
+}
+
+func TestResponderScriptConfigLocalRedirect(t *testing.T) {
+	tmpDir := t.TempDir()
+	redir := cgiScript(t, tmpDir, "redir.sh", "printf 'Location: /target.sh\\r\\n\\r\\n'\n")
+	cgiScript(t, tmpDir, "target.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s' \"$NAME\"\n")
+	path := writeConfig(t, "scripts:\n  '**/redir.sh':\n    env:\n      NAME: redir\n  '**/target.sh':\n    env:\n      NAME: target\n")
+	args := defaultArguments()
+	_, err := loadConfigFile(path, &args)
+	require.NoError(t, err)
+	addr := serveFCGI(t, cgiResponder(args, nil))
+
+	// the redirect target gets its own settings, not the ones of the script
+	// redirecting to it
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": redir, "DOCUMENT_ROOT": tmpDir}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, "target", res.body)
+}
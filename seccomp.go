@@ -0,0 +1,208 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompRetKillProcess = unix.SECCOMP_RET_KILL_PROCESS
+	seccompRetKillThread  = unix.SECCOMP_RET_KILL_THREAD
+	seccompRetTrap        = unix.SECCOMP_RET_TRAP
+	seccompRetErrno       = unix.SECCOMP_RET_ERRNO
+	seccompRetLog         = unix.SECCOMP_RET_LOG
+	seccompRetAllow       = unix.SECCOMP_RET_ALLOW
+
+	bpfLdWAbs = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	bpfJeqK   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfJgeK   = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+	bpfRetK   = unix.BPF_RET | unix.BPF_K
+
+	// offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	bpfMaxInsns = unix.BPF_MAXINSNS
+
+	// __X32_SYSCALL_BIT: x32 syscalls pass the x86_64 architecture check with
+	// this bit set, the numbers of other architectures are far below
+	x32SyscallBit = 0x40000000
+)
+
+// sockFilter is a single classic BPF instruction (struct sock_filter)
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// sockFprog is struct sock_fprog
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+// seccompProfile is the supported subset of the OCI/docker seccomp profile
+// format. Argument filters are not supported.
+type seccompProfile struct {
+	DefaultAction   string `json:"defaultAction"`
+	DefaultErrnoRet *uint  `json:"defaultErrnoRet"`
+	Syscalls        []struct {
+		Names    []string          `json:"names"`
+		Action   string            `json:"action"`
+		ErrnoRet *uint             `json:"errnoRet"`
+		Args     []json.RawMessage `json:"args"`
+	} `json:"syscalls"`
+}
+
+// seccompAction maps a profile action to the seccomp return value
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			errno = uint32(*errnoRet)
+		}
+		return seccompRetErrno | (errno & 0xffff), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	default:
+		return 0, fmt.Errorf("unsupported seccomp action %q", action)
+	}
+}
+
+// compileSeccompProfile translates a JSON profile to a BPF program for the
+// native architecture
+func compileSeccompProfile(data []byte) ([]sockFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, fmt.Errorf("JSON seccomp profiles are unsupported on this architecture")
+	}
+
+	var p seccompProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing seccomp profile failed: %w", err)
+	}
+	def, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	prog := []sockFilter{
+		// kill everything which is not the native architecture (syscall numbers differ)
+		{Code: bpfLdWAbs, K: seccompDataArch},
+		{Code: bpfJeqK, Jt: 1, Jf: 0, K: seccompAuditArch},
+		{Code: bpfRetK, K: seccompRetKillProcess},
+		{Code: bpfLdWAbs, K: seccompDataNr},
+		// kill x32 syscalls, they would bypass the rules
+		{Code: bpfJgeK, Jt: 0, Jf: 1, K: x32SyscallBit},
+		{Code: bpfRetK, K: seccompRetKillProcess},
+	}
+	seen := make(map[uint32]bool)
+	for _, rule := range p.Syscalls {
+		if len(rule.Args) > 0 {
+			return nil, fmt.Errorf("seccomp argument filters are unsupported (syscalls %v)", rule.Names)
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown syscall %q in seccomp profile", name)
+			}
+			// first matching rule wins
+			if seen[nr] {
+				continue
+			}
+			seen[nr] = true
+			prog = append(prog,
+				sockFilter{Code: bpfJeqK, Jt: 0, Jf: 1, K: nr},
+				sockFilter{Code: bpfRetK, K: action},
+			)
+		}
+	}
+	prog = append(prog, sockFilter{Code: bpfRetK, K: def})
+
+	if len(prog) > bpfMaxInsns {
+		return nil, fmt.Errorf("seccomp profile too large (%d instructions)", len(prog))
+	}
+	return prog, nil
+}
+
+// loadSeccompProfile reads a seccomp profile. Files ending in .json are
+// compiled, everything else is taken as raw BPF program (array of struct
+// sock_filter in native byte order, as e.g. exported by libseccomp).
+func loadSeccompProfile(path string) ([]sockFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading seccomp profile failed: %w", err)
+	}
+	if strings.HasSuffix(path, ".json") {
+		return compileSeccompProfile(data)
+	}
+	return decodeBPF(data)
+}
+
+// decodeBPF decodes a raw BPF program
+func decodeBPF(data []byte) ([]sockFilter, error) {
+	if len(data) == 0 || len(data)%8 != 0 || len(data)/8 > bpfMaxInsns {
+		return nil, fmt.Errorf("invalid BPF program size %d", len(data))
+	}
+	prog := make([]sockFilter, len(data)/8)
+	for i := range prog {
+		ins := data[i*8:]
+		prog[i] = sockFilter{
+			Code: binary.NativeEndian.Uint16(ins[0:]),
+			Jt:   ins[2],
+			Jf:   ins[3],
+			K:    binary.NativeEndian.Uint32(ins[4:]),
+		}
+	}
+	return prog, nil
+}
+
+// encodeBPF is the inverse of decodeBPF
+func encodeBPF(prog []sockFilter) []byte {
+	data := make([]byte, 8*len(prog))
+	for i, ins := range prog {
+		binary.NativeEndian.PutUint16(data[i*8:], ins.Code)
+		data[i*8+2] = ins.Jt
+		data[i*8+3] = ins.Jf
+		binary.NativeEndian.PutUint32(data[i*8+4:], ins.K)
+	}
+	return data
+}
+
+// installSeccomp sets no_new_privs and installs the filter for the calling
+// thread (inherited across exec)
+func installSeccomp(prog []sockFilter) error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs failed: %w", err)
+	}
+	fprog := sockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+		return fmt.Errorf("installing seccomp filter failed: %w", err)
+	}
+	return nil
+}
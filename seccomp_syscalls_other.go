@@ -0,0 +1,12 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+//go:build !amd64 && !arm64
+
+package main
+
+// JSON seccomp profiles are unsupported on this architecture (raw BPF works)
+const seccompAuditArch = 0
+
+var syscallNumbers = map[string]uint32{}
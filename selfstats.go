@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// number of currently running CGI child processes
+var runningChildren atomic.Int32
+
+// selfStats describes the resource usage of the wrapper process itself
+// (separate from the per-request statistics)
+type selfStats struct {
+	RSSBytes   int64   `json:"rss_bytes"`
+	OpenFDs    int     `json:"open_fds"`
+	Goroutines int     `json:"goroutines"`
+	Children   int32   `json:"children"`
+	GC         gcStats `json:"gc"`
+}
+
+type gcStats struct {
+	NumGC      uint32    `json:"num_gc"`
+	PauseTotal string    `json:"pause_total"`
+	LastGC     time.Time `json:"last_gc"`
+	HeapAlloc  uint64    `json:"heap_alloc_bytes"`
+	HeapSys    uint64    `json:"heap_sys_bytes"`
+}
+
+func collectSelfStats() selfStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	st := selfStats{
+		RSSBytes:   -1,
+		OpenFDs:    -1,
+		Goroutines: runtime.NumGoroutine(),
+		Children:   runningChildren.Load(),
+		GC: gcStats{
+			NumGC:      m.NumGC,
+			PauseTotal: time.Duration(m.PauseTotalNs).String(),
+			HeapAlloc:  m.HeapAlloc,
+			HeapSys:    m.HeapSys,
+		},
+	}
+	if m.LastGC > 0 {
+		st.GC.LastGC = time.Unix(0, int64(m.LastGC))
+	}
+
+	// second field of statm is the resident set size in pages
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				st.RSSBytes = pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		st.OpenFDs = len(fds)
+	}
+
+	return st
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideDocRoot = errors.New("outside of the document root")
+
+// wantsSendfile reports whether the script asked to serve a file instead of its
+// body
+func wantsSendfile(h http.Header) bool {
+	return h.Get("X-Sendfile") != "" || h.Get("X-Accel-Redirect") != ""
+}
+
+// sendfilePath returns the file referenced by X-Sendfile (absolute path) or
+// X-Accel-Redirect (URL path below docRoot). Symlinks are resolved, the file
+// must be below docRoot.
+func sendfilePath(h http.Header, docRoot string) (string, error) {
+	if docRoot == "" {
+		return "", errOutsideDocRoot
+	}
+	var p string
+	if xs := h.Get("X-Sendfile"); xs != "" {
+		if !filepath.IsAbs(xs) {
+			return "", fmt.Errorf("X-Sendfile must be absolute, got %q", xs)
+		}
+		p = filepath.Clean(xs)
+	} else {
+		uri, _, _ := strings.Cut(h.Get("X-Accel-Redirect"), "?")
+		p = filepath.Join(docRoot, filepath.FromSlash(path.Clean("/"+uri)))
+	}
+
+	root, err := filepath.EvalSymlinks(docRoot)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(root, real) {
+		return "", errOutsideDocRoot
+	}
+	return real, nil
+}
+
+// serveSendfile serves the file referenced by the headers of the script itself
+// (with support for range and conditional requests). The headers of the script
+// are kept apart from the ones describing its (empty) body.
+func serveSendfile(w http.ResponseWriter, r *http.Request, ctx context.Context, docRoot string) bool {
+	h := w.Header()
+	p, err := sendfilePath(h, docRoot)
+	for _, key := range []string{"X-Sendfile", "X-Accel-Redirect", "Content-Length", "Status"} {
+		h.Del(key)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "can't serve file referenced by CGI", "error", err)
+		status := http.StatusForbidden
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		writeError(w, ctx, status)
+		return false
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		slog.WarnContext(ctx, "can't open file referenced by CGI", "path", p, "error", err)
+		writeError(w, ctx, http.StatusNotFound)
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		slog.WarnContext(ctx, "file referenced by CGI isn't a regular file", "path", p)
+		writeError(w, ctx, http.StatusForbidden)
+		return false
+	}
+	slog.DebugContext(ctx, "serving file referenced by CGI", "path", p)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalName is a signal which can be given by name (with or without SIG
+// prefix) or number on the commandline, e.g. "SIGALRM" or "14"
+type signalName syscall.Signal
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"PIPE": syscall.SIGPIPE,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+	"XCPU": syscall.SIGXCPU,
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (s *signalName) UnmarshalText(text []byte) error {
+	name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(string(text))), "SIG")
+	if name == "" {
+		*s = 0
+		return nil
+	}
+	if sig, ok := signalNames[name]; ok {
+		*s = signalName(sig)
+		return nil
+	}
+	n, err := strconv.Atoi(name)
+	if err != nil || n <= 0 || n > 64 {
+		return fmt.Errorf("invalid signal %q", string(text))
+	}
+	*s = signalName(n)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (s signalName) MarshalText() ([]byte, error) {
+	for name, sig := range signalNames {
+		if signalName(sig) == s {
+			return []byte("SIG" + name), nil
+		}
+	}
+	if s == 0 {
+		return nil, nil
+	}
+	return []byte(strconv.Itoa(int(s))), nil
+}
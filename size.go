@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a number of bytes which can be given with a binary unit suffix
+// (K, M, G, T) on the commandline, e.g. "512M"
+type byteSize int64
+
+var byteSizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], s[i:]
+	}
+
+	mult, ok := byteSizeUnits[unit]
+	if !ok {
+		return fmt.Errorf("invalid size unit in %q", string(text))
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", string(text), err)
+	}
+	if n > math.MaxInt64/mult {
+		return fmt.Errorf("invalid size %q: value out of range", string(text))
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (b byteSize) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+// jsonSchemaType implements jsonSchemaTyper (plain numbers are allowed as well)
+func (byteSize) jsonSchemaType() any {
+	return []string{"integer", "string"}
+}
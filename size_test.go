@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestByteSizeUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "4K", want: 4 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "512MiB", want: 512 << 20},
+		{in: "2gb", want: 2 << 30},
+		{in: "1T", want: 1 << 40},
+		{in: "12X", wantErr: true},
+		{in: "M", wantErr: true},
+		{in: "8388607T", want: 8388607 << 40},
+		{in: "8388608T", wantErr: true},
+		{in: "99999999999G", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var b byteSize
+			err := b.UnmarshalText([]byte(tt.in))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, b)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// spoolFilePrefix is the prefix of the temp files of spooled bodies
+const spoolFilePrefix = "fcgiwrap-body-"
+
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errSpoolQuota   = errors.New("spool quota exceeded")
+	// the spool file couldn't be written, not the fault of the client
+	errSpoolDisk = errors.New("spooling to disk failed")
+)
+
+// spooler reads request bodies completely before they are handled. Up to
+// threshold bytes are kept in memory, the rest is written to a temp file in
+// dir.
+type spooler struct {
+	threshold int64
+	dir       string
+	// max size of a single body (0: unlimited)
+	max int64
+	// max disk space used by all spooled bodies (0: unlimited)
+	quota int64
+	used  atomic.Int64
+}
+
+// newSpooler returns nil (bodies are streamed) if threshold <= 0
+func newSpooler(threshold byteSize, dir string, max byteSize, quota byteSize) *spooler {
+	if threshold <= 0 {
+		return nil
+	}
+	return &spooler{threshold: int64(threshold), dir: dir, max: int64(max), quota: int64(quota)}
+}
+
+// spooledBody is a request body read completely before the request is handled,
+// the part exceeding the threshold lives in an (already unlinked) temp file
+type spooledBody struct {
+	io.Reader
+	file *os.File
+	// release frees the disk space accounted for the file
+	release func()
+}
+
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.release()
+	return b.file.Close()
+}
+
+// quotaWriter writes to a spool file while accounting the used disk space
+type quotaWriter struct {
+	f       *os.File
+	s       *spooler
+	written int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	if used := w.s.used.Add(n); w.s.quota > 0 && used > w.s.quota {
+		w.s.used.Add(-n)
+		return 0, errSpoolQuota
+	}
+	w.written += n
+	written, err := w.f.Write(p)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", errSpoolDisk, err)
+	}
+	return written, err
+}
+
+// spool reads body completely. Returns the body and its size.
+func (s *spooler) spool(body io.Reader) (*spooledBody, int64, error) {
+	if s.max > 0 {
+		body = io.LimitReader(body, s.max+1)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(body, s.threshold+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.max > 0 && n > s.max {
+		return nil, 0, errBodyTooLarge
+	}
+	if n <= s.threshold {
+		return &spooledBody{Reader: &buf}, n, nil
+	}
+
+	f, err := os.CreateTemp(s.dir, spoolFilePrefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", errSpoolDisk, err)
+	}
+	// nobody else needs to see the file, it is gone once closed
+	_ = os.Remove(f.Name())
+	qw := &quotaWriter{f: f, s: s}
+	release := func() { s.used.Add(-qw.written) }
+	rest, err := io.Copy(qw, body)
+	if err == nil && s.max > 0 && n+rest > s.max {
+		err = errBodyTooLarge
+	}
+	if err == nil {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			err = fmt.Errorf("%w: %w", errSpoolDisk, err)
+		}
+	}
+	if err != nil {
+		release()
+		f.Close()
+		return nil, 0, err
+	}
+	return &spooledBody{Reader: io.MultiReader(&buf, f), file: f, release: release}, n + rest, nil
+}
+
+// removeOrphans removes spool files older than a minute left behind by crashed
+// instances (spool files are unlinked right after their creation)
+func (s *spooler) removeOrphans() {
+	dir := s.dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	files, err := filepath.Glob(filepath.Join(dir, spoolFilePrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		info, err := os.Lstat(f)
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < time.Minute {
+			continue
+		}
+		if err := os.Remove(f); err == nil {
+			slog.Info("removed orphaned spool file", "path", f)
+		}
+	}
+}
+
+// spoolBodies reads the request body completely before passing the request on,
+// so slow uploads don't occupy a worker while the child waits for its stdin.
+// Bodies not matching CONTENT_LENGTH are rejected with 400, too large ones
+// with 413 and if the quota or the disk is exhausted with 503 (other disk errors:
+// 500).
+func spoolBodies(s *spooler, next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body *spooledBody
+		var n int64
+		var err error
+		if s.max > 0 && r.ContentLength > s.max {
+			// no need to read it
+			err = errBodyTooLarge
+		} else {
+			body, n, err = s.spool(r.Body)
+		}
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			slog.Warn("request body too large", "max", s.max)
+			rejectedRequests.add("spool_max")
+			writeError(w, r.Context(), http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(err, errSpoolQuota):
+			slog.Warn("spool quota exhausted", "quota", s.quota)
+			rejectedRequests.add("spool_quota")
+			writeError(w, r.Context(), http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errSpoolDisk):
+			slog.Error("spooling request body failed", "error", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+				status = http.StatusServiceUnavailable
+			}
+			writeError(w, r.Context(), status)
+			return
+		case err != nil:
+			slog.Warn("reading request body failed", "error", err)
+			writeError(w, r.Context(), http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+		if r.ContentLength >= 0 && n != r.ContentLength {
+			slog.Warn("request body doesn't match CONTENT_LENGTH", "content_length", r.ContentLength, "size", n)
+			rejectedRequests.add("content_length")
+			writeError(w, r.Context(), http.StatusBadRequest)
+			return
+		}
+		r.Body = body
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxStatCacheEntries bounds the stat cache, of which at most
+// maxNegativeStatEntries are "not found" results (their paths are chosen by
+// the clients)
+const (
+	maxStatCacheEntries    = 4096
+	maxNegativeStatEntries = 1024
+)
+
+// statCache keeps lstat results of scripts (including "not found") for a
+// short time, so hot scripts don't cost several lstat calls per request. Only
+// the file itself is checked again (fileChanged), the directories leading to
+// it and missing files are noticed to have changed at most one TTL later.
+type statCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]statCacheEntry
+	negative int
+}
+
+type statCacheEntry struct {
+	info    os.FileInfo
+	err     error
+	expires time.Time
+}
+
+func newStatCache(ttl time.Duration, now func() time.Time) *statCache {
+	return &statCache{ttl: ttl, now: now, entries: make(map[string]statCacheEntry)}
+}
+
+// get returns the cached result for name, ok is false if there is none or it
+// expired
+func (c *statCache) get(name string) (os.FileInfo, error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok || c.now().After(e.expires) {
+		return nil, nil, false
+	}
+	return e.info, e.err, true
+}
+
+// put caches the result of an lstat of name. If the cache is full, expired
+// entries are dropped first, then arbitrary ones. "Not found" results beyond
+// their limit are not cached.
+func (c *statCache) put(name string, info os.FileInfo, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if old, ok := c.entries[name]; ok {
+		c.remove(name, old)
+	}
+	if err != nil && c.negative >= maxNegativeStatEntries {
+		c.removeExpired(now)
+		if c.negative >= maxNegativeStatEntries {
+			return
+		}
+	}
+	if len(c.entries) >= maxStatCacheEntries {
+		c.removeExpired(now)
+		for k, e := range c.entries {
+			if len(c.entries) < maxStatCacheEntries {
+				break
+			}
+			c.remove(k, e)
+		}
+	}
+	c.entries[name] = statCacheEntry{info: info, err: err, expires: now.Add(c.ttl)}
+	if err != nil {
+		c.negative++
+	}
+}
+
+func (c *statCache) remove(name string, e statCacheEntry) {
+	delete(c.entries, name)
+	if e.err != nil {
+		c.negative--
+	}
+}
+
+func (c *statCache) removeExpired(now time.Time) {
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			c.remove(k, e)
+		}
+	}
+}
+
+// fileChanged reports whether the file was modified or replaced
+func fileChanged(a, b os.FileInfo) bool {
+	if !a.ModTime().Equal(b.ModTime()) || a.Mode() != b.Mode() || a.Size() != b.Size() {
+		return true
+	}
+	sa, okA := a.Sys().(*syscall.Stat_t)
+	sb, okB := b.Sys().(*syscall.Stat_t)
+	return okA && okB && (sa.Ino != sb.Ino || sa.Dev != sb.Dev)
+}
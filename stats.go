@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scriptStats are the counters of a single script
+type scriptStats struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+// requestStats are aggregate counters of the handled requests. Errors are
+// responses with a 5xx status.
+type requestStats struct {
+	mu sync.Mutex
+	// first start the counters were collected from (persisted)
+	Since    time.Time               `json:"since"`
+	Requests uint64                  `json:"requests"`
+	Errors   uint64                  `json:"errors"`
+	Scripts  map[string]*scriptStats `json:"scripts"`
+	// only filled in the state file, the status endpoint reports them separately
+	Rejected map[string]uint64 `json:"rejected,omitempty"`
+}
+
+// lifetimeStats is reported on the admin status endpoint and persisted with
+// --stats-file
+var lifetimeStats = requestStats{Since: time.Now(), Scripts: make(map[string]*scriptStats)}
+
+// record counts a request. script is empty if the request didn't get as far as
+// determining the script.
+func (s *requestStats) record(script string, status int) {
+	failed := status >= 500
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Requests++
+	if failed {
+		s.Errors++
+	}
+	if script == "" {
+		return
+	}
+	sc, ok := s.Scripts[script]
+	if !ok {
+		sc = &scriptStats{}
+		s.Scripts[script] = sc
+	}
+	sc.Requests++
+	if failed {
+		sc.Errors++
+	}
+}
+
+// snapshot returns a copy of the counters
+func (s *requestStats) snapshot() *requestStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := &requestStats{
+		Since:    s.Since,
+		Requests: s.Requests,
+		Errors:   s.Errors,
+		Scripts:  make(map[string]*scriptStats, len(s.Scripts)),
+	}
+	for k, v := range s.Scripts {
+		c := *v
+		ret.Scripts[k] = &c
+	}
+	return ret
+}
+
+// loadStats adds the counters persisted in path. A missing file is no error.
+func (s *requestStats) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved requestStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !saved.Since.IsZero() && saved.Since.Before(s.Since) {
+		s.Since = saved.Since
+	}
+	s.Requests += saved.Requests
+	s.Errors += saved.Errors
+	for k, v := range saved.Scripts {
+		if v == nil {
+			continue
+		}
+		sc, ok := s.Scripts[k]
+		if !ok {
+			sc = &scriptStats{}
+			s.Scripts[k] = sc
+		}
+		sc.Requests += v.Requests
+		sc.Errors += v.Errors
+	}
+	for reason, n := range saved.Rejected {
+		rejectedRequests.addN(reason, n)
+	}
+	return nil
+}
+
+// save writes the counters and the rejected requests to path (atomically via a
+// temp file)
+func (s *requestStats) save(path string) error {
+	snap := s.snapshot()
+	snap.Rejected = rejectedRequests.snapshot()
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// statusWriter remembers the status and size of the response written through
+// it
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	// interim responses are followed by the actual one
+	if w.code == 0 && code >= http.StatusOK {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = w.status()
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// readCounter counts the bytes read from the request body
+type readCounter struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// status returns the status of the response. The status of CGI scripts is
+// passed on as Status header.
+func (w *statusWriter) status() int {
+	if w.code != 0 {
+		return w.code
+	}
+	return headerStatus(w.Header())
+}
@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s := requestStats{Since: since, Scripts: make(map[string]*scriptStats)}
+	s.record("/srv/a.cgi", http.StatusOK)
+	s.record("/srv/a.cgi", http.StatusBadGateway)
+	s.record("", http.StatusForbidden)
+	require.NoError(t, s.save(path))
+
+	// a missing file is fine
+	restored := requestStats{Since: time.Now(), Scripts: make(map[string]*scriptStats)}
+	require.NoError(t, restored.load(filepath.Join(t.TempDir(), "missing.json")))
+	require.NoError(t, restored.load(path))
+	restored.record("/srv/a.cgi", http.StatusOK)
+
+	snap := restored.snapshot()
+	assert.True(t, since.Equal(snap.Since))
+	assert.Equal(t, uint64(4), snap.Requests)
+	assert.Equal(t, uint64(1), snap.Errors)
+	assert.Equal(t, &scriptStats{Requests: 3, Errors: 1}, snap.Scripts["/srv/a.cgi"])
+}
+
+func TestStatusWriter(t *testing.T) {
+	w := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	assert.Equal(t, http.StatusOK, w.status())
+	w.Header().Set("Status", "404 Not Found")
+	assert.Equal(t, http.StatusNotFound, w.status())
+
+	w = &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	w.WriteHeader(http.StatusGatewayTimeout)
+	_, _ = w.Write([]byte("x"))
+	assert.Equal(t, http.StatusGatewayTimeout, w.status())
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStderrLine is the length at which long stderr lines are split
+const maxStderrLine = 4096
+
+// stderrWaitDelay is how long to wait for stderr to be closed once a child
+// exited, its descendants might still hold it open
+const stderrWaitDelay = time.Second
+
+// stderrLog logs the stderr of a child line by line, tagged with the script,
+// the pid and (via the context) the request ID. At most max bytes are logged
+// (0: unlimited), the rest is dropped.
+type stderrLog struct {
+	ctx    context.Context
+	script string
+	max    int64
+	// the lines are appended to out (prefixed with the time, request ID and
+	// pid) instead of being logged (nil: logged)
+	out io.Writer
+
+	mu      sync.Mutex
+	pid     int
+	logged  int64
+	dropped int64
+	// incomplete line
+	buf []byte
+}
+
+func newStderrLog(ctx context.Context, script string, max int64) *stderrLog {
+	return &stderrLog{ctx: ctx, script: script, max: max}
+}
+
+// setPid tags the following records with the pid (known after the start)
+func (l *stderrLog) setPid(pid int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pid = pid
+}
+
+func (l *stderrLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 && len(l.buf) < maxStderrLine {
+			break
+		}
+		if i < 0 || i > maxStderrLine {
+			i = maxStderrLine
+		}
+		l.log(l.buf[:i])
+		if i < len(l.buf) && l.buf[i] == '\n' {
+			i++
+		}
+		l.buf = l.buf[i:]
+	}
+	return len(p), nil
+}
+
+// log logs a line unless the cap is reached
+func (l *stderrLog) log(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if l.max > 0 && l.logged+int64(len(line)) > l.max {
+		l.dropped += int64(len(line))
+		return
+	}
+	l.logged += int64(len(line))
+	if l.out != nil {
+		prefix := fmt.Sprintf("%s %s[%d] ", time.Now().Format(time.RFC3339), requestIDFrom(l.ctx), l.pid)
+		if _, err := l.out.Write(append(append([]byte(prefix), line...), '\n')); err != nil {
+			slog.WarnContext(l.ctx, "writing CGI stderr to file failed", "script", l.script, "error", err)
+		}
+		return
+	}
+	slog.WarnContext(l.ctx, "CGI stderr", "script", l.script, "pid", l.pid, "line", string(line))
+}
+
+// stderrFileEscaper maps the path of a script to a file name. "_" and "%" are
+// percent-encoded first, so "_" stands for "/" only and names don't collide.
+var stderrFileEscaper = strings.NewReplacer("%", "%25", "_", "%5F", "/", "_")
+
+// stderrFile opens the file in dir the stderr of script is appended to, named
+// after its path (e.g. srv_www_cgi-bin_backup.cgi.log)
+func stderrFile(dir string, script string) (*os.File, error) {
+	name := stderrFileEscaper.Replace(strings.TrimPrefix(filepath.Clean(script), "/")) + ".log"
+	return os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+}
+
+// Close logs an incomplete last line and how much was dropped
+func (l *stderrLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.log(l.buf)
+		l.buf = nil
+	}
+	if l.dropped > 0 {
+		slog.WarnContext(l.ctx, "CGI stderr exceeded its cap, dropped the rest", "script", l.script, "pid", l.pid, "max", l.max, "dropped", l.dropped)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStderrLog(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(&buf, nil)}))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	l := newStderrLog(withRequestID(context.Background(), "abc"), "/srv/a.cgi", 20)
+	l.setPid(42)
+	_, _ = l.Write([]byte("first\r\nsec"))
+	_, _ = l.Write([]byte("ond\n" + strings.Repeat("x", 30) + "\nlast"))
+	require.NoError(t, l.Close())
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		records = append(records, rec)
+	}
+	require.Len(t, records, 4)
+	assert.Equal(t, "first", records[0]["line"])
+	assert.Equal(t, "/srv/a.cgi", records[0]["script"])
+	assert.Equal(t, float64(42), records[0]["pid"])
+	assert.Equal(t, "abc", records[0]["request_id"])
+	assert.Equal(t, "second", records[1]["line"])
+	// the long line exceeds the cap, the short one still fits
+	assert.Equal(t, "last", records[2]["line"])
+	assert.Equal(t, float64(30), records[3]["dropped"])
+
+	// long lines are split
+	buf.Reset()
+	l = newStderrLog(context.Background(), "/srv/a.cgi", 0)
+	_, _ = l.Write([]byte(strings.Repeat("y", maxStderrLine+10)))
+	require.NoError(t, l.Close())
+	assert.Equal(t, 2, strings.Count(buf.String(), "CGI stderr"))
+}
+
+func TestResponderStderrDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	logDir := filepath.Join(tmpDir, "logs")
+	require.NoError(t, os.Mkdir(logDir, 0o755))
+	script := cgiScript(t, tmpDir, "warn.sh", "echo first >&2\necho second >&2\nprintf 'Content-Type: text/plain\\r\\n\\r\\nok'\n")
+	addr := serveFCGI(t, cgiResponder(arguments{StderrDir: logDir}, nil))
+
+	for range 2 {
+		res := doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script}, "")
+		require.Equal(t, "ok", res.body)
+	}
+	name := stderrFileEscaper.Replace(strings.TrimPrefix(script, "/")) + ".log"
+	data, err := os.ReadFile(filepath.Join(logDir, name))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 4, "appended")
+	assert.Regexp(t, `^\d{4}-\d\d-\d\dT\S+ [0-9a-f]{16}\[\d+\] first$`, lines[0])
+	assert.Regexp(t, ` second$`, lines[3])
+
+	// "_" in the path doesn't make the names of different scripts collide
+	for script, want := range map[string]string{
+		"/srv/a_b/c":     "srv_a%5Fb_c.log",
+		"/srv/a/b_c":     "srv_a_b%5Fc.log",
+		"/srv/100%/x.sh": "srv_100%25_x.sh.log",
+	} {
+		f, err := stderrFile(logDir, script)
+		require.NoError(t, err)
+		f.Close()
+		assert.FileExists(t, filepath.Join(logDir, want))
+	}
+}
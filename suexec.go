@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// scriptOwner is the owner scripts must have (--script-owner), given as
+// user[:group] names or numeric ids. -1 means any, the zero value (no text)
+// allows every owner.
+type scriptOwner struct {
+	text string
+	uid  int
+	gid  int
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (o *scriptOwner) UnmarshalText(text []byte) error {
+	*o = scriptOwner{text: string(text), uid: -1, gid: -1}
+	name, group, hasGroup := strings.Cut(string(text), ":")
+	if name != "" {
+		uid, err := strconv.Atoi(name)
+		if err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return fmt.Errorf("invalid script owner %q: %w", name, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		o.uid = uid
+	}
+	if hasGroup && group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return fmt.Errorf("invalid script group %q: %w", group, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		o.gid = gid
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (o scriptOwner) MarshalText() ([]byte, error) {
+	return []byte(o.text), nil
+}
+
+// checkOwnership applies the hardening of Apache's suexec to the script (and
+// its directory if dir is set): it must not be writable by group or others,
+// must not be setuid/setgid (the script only) and must be owned by owner (if
+// given)
+func checkOwnership(script string, dir bool, owner scriptOwner, fs *fsGuard) error {
+	info, err := fs.lstat(script)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return fmt.Errorf("%s is setuid/setgid", script)
+	}
+	if err := checkOwner(script, info, owner); err != nil {
+		return err
+	}
+	if !dir {
+		return nil
+	}
+	parent := filepath.Dir(script)
+	if info, err = fs.stat(parent); err != nil {
+		return err
+	}
+	return checkOwner(parent, info, owner)
+}
+
+// checkOwner checks that the file isn't group/world-writable and its owner
+func checkOwner(name string, info os.FileInfo, owner scriptOwner) error {
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", name)
+	}
+	if owner.text == "" || owner.uid < 0 && owner.gid < 0 {
+		return nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("owner of " + name + " unknown")
+	}
+	if owner.uid >= 0 && int(st.Uid) != owner.uid || owner.gid >= 0 && int(st.Gid) != owner.gid {
+		return fmt.Errorf("%s is owned by %d:%d, not %s", name, st.Uid, st.Gid, owner.text)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOwnership(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(dir, 0o755))
+	script := cgiScript(t, dir, "app.sh", "exit 0\n")
+	require.NoError(t, os.Chmod(script, 0o755))
+
+	var owner scriptOwner
+	require.NoError(t, owner.UnmarshalText([]byte(strconv.Itoa(os.Getuid()))))
+	assert.NoError(t, checkOwnership(script, true, owner, nil))
+	require.NoError(t, owner.UnmarshalText([]byte(":"+strconv.Itoa(os.Getgid()+1))))
+	assert.ErrorContains(t, checkOwnership(script, false, owner, nil), "owned by")
+
+	require.NoError(t, os.Chmod(dir, 0o777))
+	assert.NoError(t, checkOwnership(script, false, scriptOwner{}, nil))
+	assert.ErrorContains(t, checkOwnership(script, true, scriptOwner{}, nil), filepath.Base(dir)+" is writable")
+
+	require.NoError(t, os.Chmod(script, 0o775))
+	assert.ErrorContains(t, checkOwnership(script, false, scriptOwner{}, nil), "writable by group")
+	require.NoError(t, os.Chmod(script, 0o755|os.ModeSetuid))
+	assert.ErrorContains(t, checkOwnership(script, false, scriptOwner{}, nil), "setuid")
+
+	assert.Error(t, owner.UnmarshalText([]byte("no-such-user-fcgiwrap")))
+}
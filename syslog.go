@@ -0,0 +1,189 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// logIdentifier is the name the records are tagged with in the system logger
+const logIdentifier = "fcgiwrap_go"
+
+// journaldSocket is the socket of the native journald protocol
+const journaldSocket = "/run/systemd/journal/socket"
+
+// logField is an attribute of a record, groups flattened into the key
+type logField struct {
+	key   string
+	value string
+}
+
+// fieldHandler is a slog.Handler flattening the attributes of the records
+// (groups as prefix "group.") and passing them on to emit
+type fieldHandler struct {
+	level  slog.Leveler
+	emit   func(r slog.Record, fields []logField) error
+	fields []logField
+	prefix string
+}
+
+func (h *fieldHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *fieldHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := append([]logField(nil), h.fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendLogFields(fields, h.prefix, a)
+		return true
+	})
+	return h.emit(r, fields)
+}
+
+func (h *fieldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fields = append([]logField(nil), h.fields...)
+	for _, a := range attrs {
+		h2.fields = appendLogFields(h2.fields, h.prefix, a)
+	}
+	return &h2
+}
+
+func (h *fieldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// appendLogFields appends the attribute a (all attributes of a group)
+func appendLogFields(fields []logField, prefix string, a slog.Attr) []logField {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return fields
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			fields = appendLogFields(fields, prefix, ga)
+		}
+		return fields
+	}
+	return append(fields, logField{key: prefix + a.Key, value: a.Value.String()})
+}
+
+// newSyslogHandler logs to the syslog daemon at addr via network (both empty:
+// the local one), the attributes as key=value after the message
+func newSyslogHandler(network string, addr string, level slog.Leveler) (slog.Handler, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldHandler{level: level, emit: func(r slog.Record, fields []logField) error {
+		var b strings.Builder
+		b.WriteString(r.Message)
+		for _, f := range fields {
+			b.WriteString(" " + f.key + "=")
+			if strings.ContainsAny(f.value, " \"=\n") || f.value == "" {
+				b.WriteString(strconv.Quote(f.value))
+			} else {
+				b.WriteString(f.value)
+			}
+		}
+		switch {
+		case r.Level >= slog.LevelError:
+			return w.Err(b.String())
+		case r.Level >= slog.LevelWarn:
+			return w.Warning(b.String())
+		case r.Level >= slog.LevelInfo:
+			return w.Info(b.String())
+		default:
+			return w.Debug(b.String())
+		}
+	}}, nil
+}
+
+// syslogPriority maps a slog level to a syslog priority
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// journaldField turns an attribute key into a journald field name (upper
+// case letters, digits and underscores, not starting with an underscore)
+func journaldField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "X_" + name
+	}
+	return name
+}
+
+// appendJournaldField appends a field in the native journald format
+func appendJournaldField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	// values with newlines are length-prefixed
+	b.WriteString(name + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// newJournaldHandler logs to journald via its native protocol at socket, the
+// attributes as fields of the entries
+func newJournaldHandler(socket string, level slog.Leveler) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &fieldHandler{level: level, emit: func(r slog.Record, fields []logField) error {
+		var b bytes.Buffer
+		appendJournaldField(&b, "MESSAGE", r.Message)
+		appendJournaldField(&b, "PRIORITY", strconv.Itoa(syslogPriority(r.Level)))
+		appendJournaldField(&b, "SYSLOG_IDENTIFIER", logIdentifier)
+		for _, f := range fields {
+			appendJournaldField(&b, journaldField(f.key), f.value)
+		}
+		if _, err := conn.Write(b.Bytes()); err != nil {
+			// e.g. too large for a datagram, stderr is the only place left
+			fmt.Fprintf(os.Stderr, "logging to journald failed: %v: %s\n", err, r.Message)
+			return err
+		}
+		return nil
+	}}, nil
+}
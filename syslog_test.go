@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenUnixgram returns a datagram socket in a temp dir
+func listenUnixgram(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	return conn, path
+}
+
+func TestSyslogHandler(t *testing.T) {
+	conn, path := listenUnixgram(t)
+	h, err := newSyslogHandler("unixgram", path, slog.LevelInfo)
+	require.NoError(t, err)
+	logger := slog.New(h).With("request_id", "42")
+	logger.Debug("hidden")
+	logger.WithGroup("g").Warn("CGI failed", "script", "/srv/a b.cgi", "k", "v")
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	// daemon.warning
+	assert.Regexp(t, `^<28>.* fcgiwrap_go\[\d+\]: CGI failed request_id=42 g\.script="/srv/a b\.cgi" g\.k=v\n$`, string(buf[:n]))
+}
+
+func TestJournaldHandler(t *testing.T) {
+	conn, path := listenUnixgram(t)
+	h, err := newJournaldHandler(path, slog.LevelDebug)
+	require.NoError(t, err)
+	slog.New(h).Error("failed", "request_id", "42", "stderr", "a\nb", "9lives", 1)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	var multiline bytes.Buffer
+	multiline.WriteString("STDERR\n")
+	_ = binary.Write(&multiline, binary.LittleEndian, uint64(3))
+	multiline.WriteString("a\nb\n")
+	assert.Equal(t, "MESSAGE=failed\nPRIORITY=3\nSYSLOG_IDENTIFIER=fcgiwrap_go\nREQUEST_ID=42\n"+multiline.String()+"X_9LIVES=1\n", string(buf[:n]))
+}
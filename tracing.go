@@ -0,0 +1,335 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// status codes of OTLP spans
+const spanStatusError = 2
+
+const (
+	// maxSpanBatch is the number of spans exported at once
+	maxSpanBatch = 256
+	// spanExportInterval is how often spans are exported at most
+	spanExportInterval = 2 * time.Second
+	// spanQueue is the number of finished spans waiting for the export,
+	// further ones are dropped
+	spanQueue = 4096
+)
+
+// tracer records spans and exports them via OTLP/HTTP (JSON encoding) to
+// endpoint, e.g. http://localhost:4318/v1/traces
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	spans chan *span
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newTracer(endpoint string, service string) *tracer {
+	t := &tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, spanQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// span is a timed operation of a trace. All methods can be called on nil (the
+// request isn't traced).
+type span struct {
+	tracer  *tracer
+	name    string
+	kind    int
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	start   time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []otlpAttr
+	err      string
+	finished bool
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFrom returns the span stored in ctx (nil if there is none)
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the span in ctx, nil if the request isn't
+// traced
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: parent.tracer, name: name, kind: spanKindInternal, traceID: parent.traceID, parent: parent.id, start: time.Now()}
+	_, _ = rand.Read(s.id[:])
+	return withSpan(ctx, s), s
+}
+
+// parseTraceparent parses a W3C traceparent header
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil {
+		return
+	}
+	if traceID == [16]byte{} || parent == [8]byte{} {
+		return
+	}
+	return traceID, parent, flags[0]&1 == 1, true
+}
+
+// startRequest starts the span of a request continuing the trace of the
+// traceparent header (if valid). Returns nil if the caller didn't sample it.
+func (t *tracer) startRequest(traceparent string) *span {
+	s := &span{tracer: t, name: "CGI request", kind: spanKindServer, start: time.Now()}
+	if traceID, parent, sampled, ok := parseTraceparent(traceparent); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parent = traceID, parent
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+// set sets the attribute key (string or int value)
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v map[string]any
+	switch value := value.(type) {
+	case int:
+		// int64 is a string in the JSON encoding of OTLP
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	default:
+		v = map[string]any{"stringValue": value}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: v})
+}
+
+// fail marks the span as failed
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = msg
+}
+
+// finish ends the span and queues it for the export, further calls are
+// ignored
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished, s.end = true, time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		slog.Debug("span queue full, dropping span", "span", s.name)
+	}
+}
+
+// export sends the finished spans in batches until the tracer is stopped
+func (t *tracer) export() {
+	defer close(t.done)
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= maxSpanBatch {
+				t.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				t.send(batch)
+				batch = nil
+			}
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			if len(batch) > 0 {
+				t.send(batch)
+			}
+			return
+		}
+	}
+}
+
+// shutdown exports the remaining spans, waiting at most timeout
+func (t *tracer) shutdown(timeout time.Duration) {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+		slog.Warn("exporting the remaining spans timed out")
+	}
+}
+
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlp converts the (finished) span to its OTLP representation
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.id[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes: s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		o.Status.Code, o.Status.Message = spanStatusError, s.err
+	}
+	return o
+}
+
+// send exports the spans, failures are logged and the spans dropped
+func (t *tracer) send(batch []*span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	req := map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": []otlpAttr{
+			{Key: "service.name", Value: map[string]any{"stringValue": t.service}},
+		}},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]any{"name": "fcgiwrap_go"},
+			"spans": spans,
+		}},
+	}}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		slog.Warn("encoding spans failed", "error", err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("exporting spans failed", "endpoint", t.endpoint, "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("exporting spans failed", "endpoint", t.endpoint, "spans", len(batch), "status", resp.StatusCode)
+	}
+}
+
+// traceRequests records a span for every request passed on to next (nil
+// tracer: disabled)
+func traceRequests(t *tracer, next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := t.startRequest(r.Header.Get("Traceparent"))
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.set("http.request.method", r.Method)
+		s.set("url.path", r.URL.Path)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(withSpan(r.Context(), s)))
+		status := sw.status()
+		s.set("http.response.status_code", status)
+		if status >= 500 {
+			s.fail(http.StatusText(status))
+		}
+		s.finish()
+	})
+}
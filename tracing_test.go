@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parent, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.Equal(t, byte(0x4b), traceID[0])
+	assert.Equal(t, byte(0xb7), parent[7])
+	assert.True(t, sampled)
+
+	_, _, sampled, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sampled)
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, _, _, ok := parseTraceparent(h)
+		assert.False(t, ok, h)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	script := cgiScript(t, t.TempDir(), "fail.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\nfailed'\nexit 3\n")
+	tr := newTracer(collector.URL, "test")
+	var active atomic.Int32
+	h := traceRequests(tr, fcgiHandler(&active, &sync.WaitGroup{}, newWorkerQueue(1, 0, 0), func() {}, noopMetrics{}, cgiResponder(arguments{}, nil)))
+	addr := serveFCGI(t, h)
+
+	doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "HTTP_TRACEPARENT": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "")
+	// not sampled by the caller
+	doFCGI(t, addr, map[string]string{"SCRIPT_FILENAME": script, "HTTP_TRACEPARENT": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}, "")
+	tr.shutdown(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := make(map[string]otlpSpan)
+	for _, s := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+		byName[s.Name] = s
+	}
+	require.Len(t, byName, len(spans))
+	require.Contains(t, byName, "CGI request")
+	root := byName["CGI request"]
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+	assert.Equal(t, spanKindServer, root.Kind)
+	assert.Contains(t, root.Attributes, otlpAttr{Key: "fcgiwrap.script", Value: map[string]any{"stringValue": script}})
+	for _, name := range []string{"queue wait", "exec", "read headers", "stream body"} {
+		require.Contains(t, byName, name)
+		assert.Equal(t, root.SpanID, byName[name].ParentSpanID, name)
+	}
+	assert.Contains(t, byName["exec"].Attributes, otlpAttr{Key: "process.exit.code", Value: map[string]any{"stringValue": "3"}})
+	assert.Equal(t, spanStatusError, byName["exec"].Status.Code)
+}
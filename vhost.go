@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// vhostKeys are the configuration keys which can be set per virtual host
+// (--vhost), the others only take effect at startup
+var vhostKeys = []string{
+	"document-root", "strip-prefix", "alias", "dir-index", "follow-symlinks", "symlink-root",
+	"allow", "deny", "hidden", "suexec", "suexec-dir", "script-owner", "dir-config",
+	"exec-prefix", "interpreter", "exec-timeout", "timeout-signal", "timeout-grace",
+	"max-body-size", "max-response-size", "limit-cpu", "limit-mem", "limit-nofile", "limit-nproc",
+	"nice", "locale", "timezone", "env", "isindex-args", "scripts", "slow-threshold",
+}
+
+// vhostConfig is a --vhost HOST=FILE: requests for hosts matching the glob
+// HOST use the settings of the YAML configuration FILE
+type vhostConfig struct {
+	pattern string
+	file    string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (v *vhostConfig) UnmarshalText(text []byte) error {
+	pattern, file, ok := strings.Cut(string(text), "=")
+	if !ok || pattern == "" || file == "" {
+		return fmt.Errorf("invalid virtual host %q (expected HOST=FILE)", string(text))
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid virtual host pattern %q: %w", pattern, err)
+	}
+	*v = vhostConfig{pattern: strings.ToLower(pattern), file: file}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (v vhostConfig) MarshalText() ([]byte, error) {
+	return []byte(v.pattern + "=" + v.file), nil
+}
+
+// vhost are the arguments used for requests to hosts matching pattern
+type vhost struct {
+	pattern string
+	args    arguments
+}
+
+// loadVhosts loads the configuration files of the virtual hosts on top of args
+func loadVhosts(args arguments) ([]vhost, error) {
+	var vhosts []vhost
+	var errs []error
+	for _, cfg := range args.Vhosts {
+		va := args
+		va.vhosts = nil
+		locs, err := loadConfigFile(cfg.file, &va)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for key, loc := range locs {
+			if !slices.Contains(vhostKeys, key) {
+				errs = append(errs, fmt.Errorf("%s: %q can't be set per virtual host", loc, key))
+			}
+		}
+		if err := va.validate(locs); err != nil {
+			errs = append(errs, err)
+		}
+		if _, ok := locs["exec-prefix"]; ok {
+			if va.execPrefix, err = parseExecPrefix(va.ExecPrefix); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", locs["exec-prefix"], err))
+			}
+		}
+		vhosts = append(vhosts, vhost{pattern: cfg.pattern, args: va})
+	}
+	return vhosts, errors.Join(errs...)
+}
+
+// forHost returns the arguments of the first virtual host matching host, args
+// itself if there is none
+func (args arguments) forHost(host string) arguments {
+	for _, v := range args.vhosts {
+		if ok, _ := path.Match(v.pattern, host); ok {
+			return v.args
+		}
+	}
+	return args
+}
+
+// requestHost is the host a request was sent to: SERVER_NAME or the Host
+// header (lowercased, without port)
+func requestHost(r *http.Request, params map[string]string) string {
+	host := params["SERVER_NAME"]
+	if host == "" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVhosts(t *testing.T) {
+	dir := t.TempDir()
+	siteA, siteB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, site := range []string{siteA, siteB} {
+		require.NoError(t, os.Mkdir(site, 0o755))
+		cgiScript(t, site, "site.sh", "printf 'Content-Type: text/plain\\r\\n\\r\\n%s %s' \"$DOCUMENT_ROOT\" \"$SITE\"\n")
+	}
+	cfgA := filepath.Join(dir, "a.yaml")
+	require.NoError(t, os.WriteFile(cfgA, []byte("document-root: "+siteA+"\nenv:\n  SITE: a\n"), 0o644))
+
+	var vc vhostConfig
+	require.NoError(t, vc.UnmarshalText([]byte("*.A.example="+cfgA)))
+	args := arguments{DocumentRoot: siteB, Vhosts: []vhostConfig{vc}}
+	var err error
+	args.vhosts, err = loadVhosts(args)
+	require.NoError(t, err)
+	addr := serveFCGI(t, cgiResponder(args, nil))
+
+	res := doFCGI(t, addr, map[string]string{"SCRIPT_NAME": "/site.sh", "SERVER_NAME": "www.a.example"}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, siteA+" a", res.body)
+
+	res = doFCGI(t, addr, map[string]string{"SCRIPT_NAME": "/site.sh", "SERVER_NAME": "b.example"}, "")
+	assert.Equal(t, http.StatusOK, res.status)
+	assert.Equal(t, siteB+" ", res.body)
+
+	// settings only evaluated at startup are rejected
+	bad := filepath.Join(dir, "bad.yaml")
+	require.NoError(t, os.WriteFile(bad, []byte("workers: 3\n"), 0o644))
+	require.NoError(t, vc.UnmarshalText([]byte("bad.example="+bad)))
+	_, err = loadVhosts(arguments{Vhosts: []vhostConfig{vc}})
+	assert.ErrorContains(t, err, `"workers" can't be set per virtual host`)
+}
+
+func TestVhostsHTTP(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	marker := filepath.Join(outside, "ran")
+	script := cgiScript(t, outside, "x.sh", "touch "+marker+"\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\n")
+	cfg := filepath.Join(dir, "evil.yaml")
+	require.NoError(t, os.WriteFile(cfg, []byte("env:\n  SITE: evil\n"), 0o644))
+
+	var vc vhostConfig
+	require.NoError(t, vc.UnmarshalText([]byte("evil.example="+cfg)))
+	args := arguments{HTTP: "localhost:0", HTTPRoot: dir, Vhosts: []vhostConfig{vc}}
+	require.NoError(t, args.setHTTPRoot())
+	var err error
+	args.vhosts, err = loadVhosts(args)
+	require.NoError(t, err)
+	// the virtual host looks up scripts in the same root
+	assert.Equal(t, args.HTTPRoot, args.forHost("evil.example").HTTPRoot)
+
+	for _, host := range []string{"evil.example", "other.example"} {
+		r := httptest.NewRequest("GET", script, nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		cgiResponder(args, nil).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code, host)
+	}
+	assert.NoFileExists(t, marker)
+
+	// no root to look up scripts in at all
+	r := httptest.NewRequest("GET", script, nil)
+	w := httptest.NewRecorder()
+	cgiResponder(arguments{}, nil).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NoFileExists(t, marker)
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2025 2025 Lukas Heindl
+//
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmupRequest is a request executed at startup, given as
+// "SCRIPT [PARAM=VALUE ...]" (params are passed like FastCGI params)
+type warmupRequest struct {
+	Script string
+	Params map[string]string
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler (used by go-arg)
+func (wr *warmupRequest) UnmarshalText(text []byte) error {
+	fields := strings.Fields(string(text))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty warm-up request")
+	}
+	*wr = warmupRequest{Script: fields[0], Params: make(map[string]string)}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid param %q (expected PARAM=VALUE)", f)
+		}
+		wr.Params[k] = v
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler (used by go-arg for defaults)
+func (wr warmupRequest) MarshalText() ([]byte, error) {
+	parts := []string{wr.Script}
+	for k, v := range wr.Params {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts[1:])
+	return []byte(strings.Join(parts, " ")), nil
+}
+
+// warmupWriter discards the response, only the status is kept
+type warmupWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *warmupWriter) Header() http.Header { return w.header }
+
+func (w *warmupWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+}
+
+func (w *warmupWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+// runWarmups executes all warm-up requests (at most workers at a time) and
+// waits for them to finish
+func runWarmups(args arguments, inherited_env []string) {
+	if len(args.Warmup) == 0 {
+		return
+	}
+	start := time.Now()
+	sem := make(chan struct{}, max(args.Workers, 1))
+	var wg sync.WaitGroup
+	for _, wr := range args.Warmup {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status, took := runWarmup(args, inherited_env, wr)
+			if status >= 400 {
+				slog.Warn("warm-up request failed", "script", wr.Script, "status", status, "duration", took)
+			} else {
+				slog.Debug("warm-up request done", "script", wr.Script, "status", status, "duration", took)
+			}
+		}()
+	}
+	wg.Wait()
+	slog.Info("warm-up finished", "requests", len(args.Warmup), "duration", time.Since(start))
+}
+
+func runWarmup(args arguments, inherited_env []string, wr warmupRequest) (int, time.Duration) {
+	env := map[string]string{
+		"SCRIPT_FILENAME": wr.Script,
+		"REQUEST_METHOD":  "GET",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+	}
+	for k, v := range wr.Params {
+		env[k] = v
+	}
+	r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+	if err != nil {
+		return http.StatusInternalServerError, 0
+	}
+
+	// not a request of a client
+	args.accessLog = nil
+	start := time.Now()
+	w := &warmupWriter{header: make(http.Header)}
+	serveCGI(w, r, env, args, inherited_env)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.status, time.Since(start)
+}